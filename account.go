@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DefaultSessionTTL is how long a customer stays signed in
+const DefaultSessionTTL = 30 * 24 * time.Hour
+
+// OrderTokenHeader carries the access token of a guest order, which a
+// guest needs to see, pay or cancel it
+const OrderTokenHeader = "X-Order-Token"
+
+// Limits on passwords. bcrypt only reads the first 72 bytes, so longer
+// passwords are refused rather than silently cut short.
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72
+)
+
+// Errors returned for accounts and sessions
+var (
+	ErrAccountNotFound  = errors.New("account not found")
+	ErrDuplicateAccount = errors.New("an account with this email already exists")
+	ErrSessionNotFound  = errors.New("session not found")
+	// ErrBadCredentials is returned for an unknown email and a wrong
+	// password alike, so sign-ins cannot probe for accounts
+	ErrBadCredentials = errors.New("invalid email or password")
+)
+
+// WithSessionTTL sets how long a customer stays signed in
+func WithSessionTTL(ttl time.Duration) Option {
+	return func(s *Server) { s.sessionTTL = ttl }
+}
+
+// Account is a registered customer. Orders placed while signed in are
+// linked to it.
+type Account struct {
+	ID int `json:"id"`
+	// Email is stored in lower case and is unique
+	Email string `json:"email"`
+	Name  string `json:"name"`
+	// PasswordHash is a bcrypt hash; the password itself is never stored
+	PasswordHash string    `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Session is a signed-in customer. Only a hash of its token is stored, so
+// the tokens cannot be read back out of the store.
+type Session struct {
+	TokenHash string
+	AccountID int
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// RegisterRequest creates an account
+type RegisterRequest struct {
+	Email    string `json:"email"`
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// LoginRequest signs a customer in
+type LoginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// LoginResponse carries the bearer token of a new session
+type LoginResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Account   Account   `json:"account"`
+}
+
+// normalizeEmail returns an email in the form accounts are stored under
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// validateRegistration checks a normalized registration request and
+// returns a *ValidationError listing all problems found
+func validateRegistration(req RegisterRequest) error {
+	verr := &ValidationError{Message: "invalid account"}
+	add := func(field, message string) {
+		verr.Fields = append(verr.Fields, FieldError{Field: field, Message: message})
+	}
+
+	switch {
+	case req.Email == "":
+		add("email", "is required")
+	case len(req.Email) > maxCustomerFieldLength || !validEmail(req.Email):
+		add("email", "must be an email address such as name@example.com")
+	}
+
+	switch name := req.Name; {
+	case name == "":
+		add("name", "is required")
+	case len(name) > maxCustomerFieldLength:
+		add("name", fmt.Sprintf("must be at most %d characters", maxCustomerFieldLength))
+	}
+
+	switch {
+	case len(req.Password) < minPasswordLength:
+		add("password", fmt.Sprintf("must be at least %d characters", minPasswordLength))
+	case len(req.Password) > maxPasswordLength:
+		add("password", fmt.Sprintf("must be at most %d bytes", maxPasswordLength))
+	case strings.EqualFold(req.Password, req.Email):
+		add("password", "must not be the email address")
+	}
+
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// register creates an account with a hashed password
+func (s *Server) register(ctx context.Context, req RegisterRequest) (Account, error) {
+	req.Email = normalizeEmail(req.Email)
+	req.Name = strings.TrimSpace(req.Name)
+	if err := validateRegistration(req); err != nil {
+		return Account{}, err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), s.passwordCost)
+	if err != nil {
+		return Account{}, err
+	}
+	return s.store.CreateAccount(ctx, Account{
+		Email:        req.Email,
+		Name:         req.Name,
+		PasswordHash: string(hash),
+		CreatedAt:    time.Now(),
+	})
+}
+
+// dummyPasswordHash is checked against when no account has the email
+// signing in, so unknown emails take as long to refuse as wrong passwords
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+	return hash
+})
+
+// login checks an email and password and starts a session for the account
+func (s *Server) login(ctx context.Context, req LoginRequest) (LoginResponse, error) {
+	account, err := s.store.GetAccountByEmail(ctx, normalizeEmail(req.Email))
+	if errors.Is(err, ErrAccountNotFound) {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(req.Password))
+		return LoginResponse{}, ErrBadCredentials
+	}
+	if err != nil {
+		return LoginResponse{}, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(req.Password)) != nil {
+		return LoginResponse{}, ErrBadCredentials
+	}
+	return s.startSession(ctx, account)
+}
+
+// startSession signs an account in and returns the new session's token
+func (s *Server) startSession(ctx context.Context, account Account) (LoginResponse, error) {
+	token, err := newToken()
+	if err != nil {
+		return LoginResponse{}, err
+	}
+
+	now := time.Now()
+	session := Session{
+		TokenHash: hashToken(token),
+		AccountID: account.ID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.sessionTTL),
+	}
+	if err := s.store.CreateSession(ctx, session); err != nil {
+		return LoginResponse{}, err
+	}
+	return LoginResponse{Token: token, ExpiresAt: session.ExpiresAt, Account: account}, nil
+}
+
+// newToken returns a random token for a session or a guest order
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken returns the hash a session or order token is stored under
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// errUnauthenticated is returned for a bearer token that is neither the
+// admin token nor a live session
+var errUnauthenticated = errors.New("invalid or expired session")
+
+// errSignInRequired is returned when a guest asks for something only a
+// signed-in customer may have
+var errSignInRequired = errors.New("sign in required")
+
+// caller is who sent a request: the admin, a signed-in customer, or a
+// guest when neither
+type caller struct {
+	admin     bool
+	accountID int
+	// token is the bearer token of the customer's session
+	token string
+	// orderToken is the access token of a guest order, if one was sent
+	orderToken string
+}
+
+// guest reports whether the request was sent by no one in particular
+func (c caller) guest() bool {
+	return !c.admin && c.accountID == 0
+}
+
+// canAccess reports whether the caller may see and act on an order. Orders
+// placed from an account belong to it; guest orders are open to whoever
+// holds their access token. The admin may act on any order.
+func (c caller) canAccess(o Order) bool {
+	switch {
+	case c.admin:
+		return true
+	case o.AccountID != 0:
+		return o.AccountID == c.accountID
+	}
+	return o.AccessTokenHash != "" && c.orderToken != "" &&
+		subtle.ConstantTimeCompare([]byte(hashToken(c.orderToken)), []byte(o.AccessTokenHash)) == 1
+}
+
+// identify tells who sent a request from its bearer token. Requests
+// without one come from a guest; unknown or expired tokens are refused
+// with errUnauthenticated rather than treated as a guest, so the client
+// learns to sign in again.
+func (s *Server) identify(r *http.Request) (caller, error) {
+	orderToken := r.Header.Get(OrderTokenHeader)
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return caller{orderToken: orderToken}, nil
+	}
+	if s.isAdmin(r) {
+		return caller{admin: true}, nil
+	}
+
+	session, err := s.store.GetSession(r.Context(), hashToken(token))
+	if errors.Is(err, ErrSessionNotFound) || (err == nil && !time.Now().Before(session.ExpiresAt)) {
+		return caller{}, errUnauthenticated
+	}
+	if err != nil {
+		return caller{}, err
+	}
+	return caller{accountID: session.AccountID, token: token, orderToken: orderToken}, nil
+}
+
+// ExpireSessions removes the sessions that expired by now and returns how
+// many were removed
+func (s *Server) ExpireSessions(ctx context.Context, now time.Time) (int, error) {
+	return s.store.DeleteSessions(ctx, now)
+}
+
+// expireSessionsEvery runs ExpireSessions on every tick until ctx is done
+func (s *Server) expireSessionsEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if _, err := s.ExpireSessions(ctx, now); err != nil {
+				log.Printf("expire sessions: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newAccountTestServer returns a server with the admin token that hashes
+// passwords at the lowest cost, to keep the tests fast
+func newAccountTestServer(t *testing.T, opts ...Option) *Server {
+	t.Helper()
+	opts = append([]Option{WithAdminToken(testAdminToken)}, opts...)
+	srv := NewServer(NewMemoryStore(testCatalog(t)), opts...)
+	srv.passwordCost = bcrypt.MinCost
+	return srv
+}
+
+// customerRequest sends a request through the router as the customer
+// signed in with token, or as a guest when token is empty
+func customerRequest(srv *Server, method, url string, body any, token string) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	req, _ := http.NewRequest(method, url, &buf)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rr, req)
+	return rr
+}
+
+// registerAccount creates an account and returns its first session
+func registerAccount(t *testing.T, srv *Server, email string) LoginResponse {
+	t.Helper()
+	rr := customerRequest(srv, "POST", "/api/accounts", RegisterRequest{Email: email, Name: "Jane Doe", Password: "correct horse"}, "")
+	var resp LoginResponse
+	if rr.Code != http.StatusCreated || json.Unmarshal(rr.Body.Bytes(), &resp) != nil {
+		t.Fatalf("registering %s failed: %v: %s", email, rr.Code, rr.Body)
+	}
+	return resp
+}
+
+// customerOrders lists the orders visible with token
+func customerOrders(t *testing.T, srv *Server, token string) []Order {
+	t.Helper()
+	rr := customerRequest(srv, "GET", "/api/orders", nil, token)
+	var orders []Order
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &orders) != nil {
+		t.Fatalf("listing orders failed: %v: %s", rr.Code, rr.Body)
+	}
+	return orders
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	t.Parallel()
+	srv := newAccountTestServer(t)
+
+	registered := registerAccount(t, srv, " Jane@Example.com ")
+	if registered.Token == "" || registered.Account.ID == 0 || registered.Account.Email != "jane@example.com" {
+		t.Fatalf("expected a signed-in account under the lower-cased email, got %+v", registered)
+	}
+	stored, err := srv.store.GetAccount(context.Background(), registered.Account.ID)
+	if err != nil || bcrypt.CompareHashAndPassword([]byte(stored.PasswordHash), []byte("correct horse")) != nil {
+		t.Errorf("expected a bcrypt hash of the password stored, got %q, %v", stored.PasswordHash, err)
+	}
+
+	rr := customerRequest(srv, "POST", "/api/accounts", RegisterRequest{Email: "JANE@example.com", Name: "Jane", Password: "another one"}, "")
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a taken email, got %v: %s", rr.Code, rr.Body)
+	}
+
+	for _, req := range []LoginRequest{
+		{Email: "jane@example.com", Password: "wrong horse"},
+		{Email: "john@example.com", Password: "correct horse"},
+	} {
+		rr := customerRequest(srv, "POST", "/api/login", req, "")
+		if rr.Code != http.StatusUnauthorized || !bytes.Contains(rr.Body.Bytes(), []byte(ErrBadCredentials.Error())) {
+			t.Errorf("%s: expected 401 with the same message, got %v: %s", req.Email, rr.Code, rr.Body)
+		}
+	}
+
+	rr = customerRequest(srv, "POST", "/api/login", LoginRequest{Email: "JANE@example.com ", Password: "correct horse"}, "")
+	var login LoginResponse
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &login) != nil {
+		t.Fatalf("login failed: %v: %s", rr.Code, rr.Body)
+	}
+	if login.Token == registered.Token || login.Account.ID != registered.Account.ID {
+		t.Errorf("expected a new session for the account, got %+v", login)
+	}
+
+	rr = customerRequest(srv, "GET", "/api/account", nil, login.Token)
+	var account Account
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &account) != nil || account.Email != "jane@example.com" {
+		t.Errorf("expected the signed-in account, got %v: %s", rr.Code, rr.Body)
+	}
+	if rr := customerRequest(srv, "GET", "/api/account", nil, ""); rr.Code != http.StatusUnauthorized || rr.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("expected guests asked to sign in, got %v", rr.Code)
+	}
+
+	// Signing out ends only that session
+	if rr := customerRequest(srv, "POST", "/api/logout", nil, login.Token); rr.Code != http.StatusNoContent {
+		t.Fatalf("logout failed: %v: %s", rr.Code, rr.Body)
+	}
+	if rr := customerRequest(srv, "GET", "/api/account", nil, login.Token); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected the token refused after logout, got %v", rr.Code)
+	}
+	if rr := customerRequest(srv, "GET", "/api/account", nil, registered.Token); rr.Code != http.StatusOK {
+		t.Errorf("expected the other session kept, got %v", rr.Code)
+	}
+}
+
+func TestRegisterValidatesAccount(t *testing.T) {
+	t.Parallel()
+	srv := newAccountTestServer(t)
+
+	testCases := []struct {
+		name  string
+		req   RegisterRequest
+		field string
+	}{
+		{"no email", RegisterRequest{Name: "Jane", Password: "correct horse"}, "email"},
+		{"bad email", RegisterRequest{Email: "jane@", Name: "Jane", Password: "correct horse"}, "email"},
+		{"no name", RegisterRequest{Email: "jane@example.com", Name: " ", Password: "correct horse"}, "name"},
+		{"short password", RegisterRequest{Email: "jane@example.com", Name: "Jane", Password: "horse"}, "password"},
+		{"long password", RegisterRequest{Email: "jane@example.com", Name: "Jane", Password: string(bytes.Repeat([]byte("a"), 73))}, "password"},
+		{"email as password", RegisterRequest{Email: "jane@example.com", Name: "Jane", Password: "JANE@example.com"}, "password"},
+	}
+	for _, tc := range testCases {
+		rr := customerRequest(srv, "POST", "/api/accounts", tc.req, "")
+		if rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: expected 422, got %v: %s", tc.name, rr.Code, rr.Body)
+			continue
+		}
+		var verr ValidationError
+		json.Unmarshal(rr.Body.Bytes(), &verr)
+		if len(verr.Fields) != 1 || verr.Fields[0].Field != tc.field {
+			t.Errorf("%s: expected an error on %s, got %+v", tc.name, tc.field, verr.Fields)
+		}
+	}
+}
+
+func TestOrdersBelongToAccounts(t *testing.T) {
+	t.Parallel()
+	srv := newAccountTestServer(t)
+	jane := registerAccount(t, srv, "jane@example.com")
+	john := registerAccount(t, srv, "john@example.com")
+
+	// The account comes from the session, never from the request body
+	order := Order{Items: []OrderItem{{ProductID: 1, Quantity: 1}}, OrderContact: OrderContact{AccountID: john.Account.ID}}
+	rr := customerRequest(srv, "POST", "/api/orders", order, jane.Token)
+	var janes Order
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &janes) != nil {
+		t.Fatalf("placing an order failed: %v: %s", rr.Code, rr.Body)
+	}
+	if janes.AccountID != jane.Account.ID {
+		t.Errorf("expected the order linked to account %d, got %d", jane.Account.ID, janes.AccountID)
+	}
+
+	cart := cartRequest(t, srv, "POST", "/api/carts", map[string]any{
+		"items": []CartItem{{ProductID: 2, Quantity: 1}},
+	}, http.StatusCreated)
+	rr = customerRequest(srv, "POST", "/api/carts/"+cart.ID+"/checkout", nil, john.Token)
+	var johns Order
+	if rr.Code != http.StatusCreated || json.Unmarshal(rr.Body.Bytes(), &johns) != nil || johns.AccountID != john.Account.ID {
+		t.Fatalf("expected the checkout linked to account %d, got %v: %s", john.Account.ID, rr.Code, rr.Body)
+	}
+	guest := createTestOrder(t, srv, OrderItem{ProductID: 3, Quantity: 1})
+	if guest.AccountID != 0 {
+		t.Errorf("expected a guest order without an account, got %d", guest.AccountID)
+	}
+
+	if orders := customerOrders(t, srv, jane.Token); len(orders) != 1 || orders[0].ID != janes.ID {
+		t.Errorf("expected only jane's order, got %+v", orders)
+	}
+	if orders := customerOrders(t, srv, john.Token); len(orders) != 1 || orders[0].ID != johns.ID {
+		t.Errorf("expected only john's order, got %+v", orders)
+	}
+	if orders := customerOrders(t, srv, testAdminToken); len(orders) != 3 {
+		t.Errorf("expected the admin to see all 3 orders, got %d", len(orders))
+	}
+	if rr := customerRequest(srv, "GET", "/api/orders", nil, ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected guests asked to sign in, got %v", rr.Code)
+	}
+	if rr := customerRequest(srv, "GET", "/api/orders", nil, "not-a-token"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected an unknown token refused, got %v", rr.Code)
+	}
+
+	// Another account's order is hidden as if it did not exist
+	url := fmt.Sprintf("/api/orders/%d", janes.ID)
+	if rr := customerRequest(srv, "GET", url, nil, john.Token); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for another account's order, got %v", rr.Code)
+	}
+	if rr := customerRequest(srv, "GET", url, nil, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a guest, got %v", rr.Code)
+	}
+	for _, token := range []string{jane.Token, testAdminToken} {
+		if rr := customerRequest(srv, "GET", url, nil, token); rr.Code != http.StatusOK {
+			t.Errorf("expected the order shown to its account and the admin, got %v", rr.Code)
+		}
+	}
+
+	// A guest order is shown to whoever holds its access token, and is
+	// hidden from strangers like an account's order
+	if guest.AccessToken == "" || janes.AccessToken != "" {
+		t.Fatalf("expected an access token for the guest order only, got %q and %q", guest.AccessToken, janes.AccessToken)
+	}
+	url = fmt.Sprintf("/api/orders/%d", guest.ID)
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set(OrderTokenHeader, guest.AccessToken)
+	rr = httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rr, req)
+	var fetched Order
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &fetched) != nil || fetched.AccessToken != "" {
+		t.Errorf("expected the guest order shown without its token again, got %v: %s", rr.Code, rr.Body)
+	}
+	stranger := createTestOrder(t, srv, OrderItem{ProductID: 3, Quantity: 1})
+	for _, tc := range []struct {
+		name, bearer, orderToken string
+	}{
+		{"no token", "", ""},
+		{"another guest order's token", "", stranger.AccessToken},
+		{"a customer", john.Token, ""},
+	} {
+		req, _ := http.NewRequest("GET", url, nil)
+		if tc.bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.bearer)
+		}
+		req.Header.Set(OrderTokenHeader, tc.orderToken)
+		rr := httptest.NewRecorder()
+		srv.Routes().ServeHTTP(rr, req)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404 for another guest's order, got %v", tc.name, rr.Code)
+		}
+	}
+}
+
+func TestOrderActionsBelongToAccounts(t *testing.T) {
+	t.Parallel()
+	srv := newAccountTestServer(t)
+	jane := registerAccount(t, srv, "jane@example.com")
+	john := registerAccount(t, srv, "john@example.com")
+
+	rr := customerRequest(srv, "POST", "/api/orders", Order{Items: []OrderItem{{ProductID: 1, Quantity: 1}}}, jane.Token)
+	var order Order
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &order) != nil {
+		t.Fatalf("placing an order failed: %v: %s", rr.Code, rr.Body)
+	}
+	payment := PaymentRequest{OrderID: order.ID, Amount: order.Total}
+	cancel := fmt.Sprintf("/api/orders/%d/cancel", order.ID)
+	status := fmt.Sprintf("/api/orders/%d/status", order.ID)
+	refunds := fmt.Sprintf("/api/orders/%d/refunds", order.ID)
+
+	// Everyone but jane and the admin is told the order does not exist, or
+	// that the action needs the admin
+	for _, token := range []string{"", john.Token} {
+		testCases := []struct {
+			name   string
+			method string
+			url    string
+			body   any
+			code   int
+		}{
+			{"pay", "POST", "/api/payment", payment, http.StatusNotFound},
+			{"cancel", "POST", cancel, nil, http.StatusNotFound},
+			{"set status", "PUT", status, StatusUpdateRequest{Status: StatusFulfilled}, http.StatusUnauthorized},
+			{"refund", "POST", refunds, RefundRequest{Amount: &Money{Amount: 100, Currency: DefaultCurrency}}, http.StatusUnauthorized},
+		}
+		for _, tc := range testCases {
+			if rr := customerRequest(srv, tc.method, tc.url, tc.body, token); rr.Code != tc.code {
+				t.Errorf("%s with token %q: expected %v, got %v: %s", tc.name, token, tc.code, rr.Code, rr.Body)
+			}
+		}
+	}
+	if fetched, _ := srv.store.GetOrder(context.Background(), order.ID); fetched.Status != StatusPending {
+		t.Fatalf("expected the order left pending, got %s", fetched.Status)
+	}
+
+	if rr := customerRequest(srv, "POST", "/api/payment", payment, jane.Token); rr.Code != http.StatusOK {
+		t.Fatalf("expected jane to pay her order, got %v: %s", rr.Code, rr.Body)
+	}
+	for _, token := range []string{"", john.Token} {
+		if rr := customerRequest(srv, "POST", cancel, nil, token); rr.Code != http.StatusNotFound {
+			t.Errorf("expected 404 cancelling another account's paid order, got %v", rr.Code)
+		}
+	}
+	if rr := customerRequest(srv, "POST", "/api/payment", payment, "not-a-token"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected an unknown token refused, got %v", rr.Code)
+	}
+	rr = customerRequest(srv, "POST", cancel, nil, jane.Token)
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &order) != nil || order.Status != StatusCancelled {
+		t.Errorf("expected jane to cancel her order, got %v: %s", rr.Code, rr.Body)
+	}
+}
+
+func TestSessionsExpire(t *testing.T) {
+	t.Parallel()
+	srv := newAccountTestServer(t, WithSessionTTL(time.Hour))
+	login := registerAccount(t, srv, "jane@example.com")
+	if expires := time.Now().Add(time.Hour); login.ExpiresAt.After(expires) || login.ExpiresAt.Before(expires.Add(-time.Minute)) {
+		t.Errorf("expected the session to expire in an hour, got %v", login.ExpiresAt)
+	}
+
+	removed, err := srv.ExpireSessions(context.Background(), time.Now())
+	if err != nil || removed != 0 {
+		t.Fatalf("expected no sessions expired yet, got %d, %v", removed, err)
+	}
+	removed, err = srv.ExpireSessions(context.Background(), time.Now().Add(2*time.Hour))
+	if err != nil || removed != 1 {
+		t.Fatalf("expected the session expired, got %d, %v", removed, err)
+	}
+	if rr := customerRequest(srv, "GET", "/api/orders", nil, login.Token); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected the expired token refused, got %v", rr.Code)
+	}
+}
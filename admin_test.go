@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testAdminToken = "test-admin-token"
+
+func newAdminTestServer(t *testing.T) *Server {
+	t.Helper()
+	return NewServer(NewMemoryStore(testCatalog(t)), WithAdminToken(testAdminToken))
+}
+
+// adminRequest sends a request with the admin token through the router
+func adminRequest(srv *Server, method, url string, body any) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	req, _ := http.NewRequest(method, url, &buf)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	rr := httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAdminEndpointsRequireToken(t *testing.T) {
+	t.Parallel()
+	lamp := Product{Name: "Desk Lamp", Price: NewMoney(3499, DefaultCurrency), Category: "Home"}
+
+	testCases := []struct {
+		name   string
+		srv    *Server
+		header string
+	}{
+		{"no token", newAdminTestServer(t), ""},
+		{"wrong token", newAdminTestServer(t), "Bearer nope"},
+		{"not a bearer token", newAdminTestServer(t), "Basic " + testAdminToken},
+		{"admin disabled", newTestServer(t), "Bearer "},
+	}
+
+	for _, tc := range testCases {
+		body, _ := json.Marshal(lamp)
+		req, _ := http.NewRequest("POST", "/api/products", bytes.NewBuffer(body))
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+		rr := httptest.NewRecorder()
+		tc.srv.Routes().ServeHTTP(rr, req)
+		if rr.Code != http.StatusUnauthorized || rr.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: expected 401 with a challenge, got %v", tc.name, rr.Code)
+		}
+
+		products, _ := tc.srv.store.ListProducts(context.Background(), ProductFilter{}, Page{})
+		if len(products) != 5 {
+			t.Errorf("%s: catalog changed without authentication", tc.name)
+		}
+	}
+}
+
+func TestProductCRUD(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+
+	rr := adminRequest(srv, "POST", "/api/products", Product{
+		ID:          1,
+		Name:        "Desk Lamp",
+		Description: "LED desk lamp",
+		Price:       NewMoney(3499, DefaultCurrency),
+		Image:       "https://example.com/lamp.jpg",
+		Category:    "Home",
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create failed: got %v: %s", rr.Code, rr.Body)
+	}
+	var lamp Product
+	json.Unmarshal(rr.Body.Bytes(), &lamp)
+	if lamp.ID != 6 {
+		t.Errorf("expected the store to allocate ID 6 ignoring the client's, got %d", lamp.ID)
+	}
+	path := fmt.Sprintf("/api/products/%d", lamp.ID)
+
+	// PATCH changes only the fields sent
+	rr = adminRequest(srv, "PATCH", path, map[string]any{"price": "29.99"})
+	var patched Product
+	json.Unmarshal(rr.Body.Bytes(), &patched)
+	if rr.Code != http.StatusOK || patched.Price != NewMoney(2999, DefaultCurrency) || patched.Description != "LED desk lamp" {
+		t.Errorf("patch: got %v %+v", rr.Code, patched)
+	}
+
+	// PUT replaces every field
+	rr = adminRequest(srv, "PUT", path, Product{Name: "Floor Lamp", Price: NewMoney(8999, DefaultCurrency), Category: "Home"})
+	var replaced Product
+	json.Unmarshal(rr.Body.Bytes(), &replaced)
+	if rr.Code != http.StatusOK || replaced.ID != lamp.ID || replaced.Name != "Floor Lamp" || replaced.Description != "" {
+		t.Errorf("put: got %v %+v", rr.Code, replaced)
+	}
+
+	products, _ := srv.store.ListProducts(context.Background(), ProductFilter{}, Page{})
+	if len(products) != 6 {
+		t.Errorf("expected 6 products, got %d", len(products))
+	}
+
+	if rr := adminRequest(srv, "PUT", "/api/products/999", replaced); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 replacing an unknown product, got %v", rr.Code)
+	}
+}
+
+func TestProductValidation(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+
+	rr := adminRequest(srv, "POST", "/api/products", Product{
+		Name:     "  ",
+		Price:    NewMoney(0, DefaultCurrency),
+		Image:    "javascript:alert(1)",
+		Category: "",
+	})
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %v: %s", rr.Code, rr.Body)
+	}
+	var verr ValidationError
+	json.Unmarshal(rr.Body.Bytes(), &verr)
+	fields := map[string]bool{}
+	for _, f := range verr.Fields {
+		fields[f.Field] = true
+	}
+	for _, field := range []string{"name", "price", "category", "image"} {
+		if !fields[field] {
+			t.Errorf("expected an error for %s, got %+v", field, verr.Fields)
+		}
+	}
+
+	// A PATCH is validated against the resulting product
+	rr = adminRequest(srv, "PATCH", "/api/products/1", map[string]any{"price": -5})
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 patching a negative price, got %v", rr.Code)
+	}
+	product, _ := srv.store.GetProduct(context.Background(), 1)
+	if product.Price != NewMoney(9999, DefaultCurrency) {
+		t.Errorf("rejected patch changed the product: %+v", product)
+	}
+}
+
+func TestDeleteProductKeepsOrderHistory(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+	order := payTestOrder(t, srv, OrderItem{ProductID: 3, Quantity: 2})
+
+	if rr := adminRequest(srv, "DELETE", "/api/products/3", nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("delete failed: got %v: %s", rr.Code, rr.Body)
+	}
+	// Deleting again is harmless
+	if rr := adminRequest(srv, "DELETE", "/api/products/3", nil); rr.Code != http.StatusNoContent {
+		t.Errorf("expected 204 deleting twice, got %v", rr.Code)
+	}
+
+	products, _ := srv.store.ListProducts(context.Background(), ProductFilter{}, Page{})
+	for _, p := range products {
+		if p.ID == 3 {
+			t.Error("deleted product is still listed")
+		}
+	}
+
+	// The product still resolves for the existing order
+	req, _ := http.NewRequest("GET", "/api/products/3", nil)
+	rr := httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rr, req)
+	var product Product
+	json.Unmarshal(rr.Body.Bytes(), &product)
+	if rr.Code != http.StatusOK || product.DeletedAt == nil {
+		t.Errorf("expected the deleted product with deleted_at, got %v: %s", rr.Code, rr.Body)
+	}
+
+	// and can still be refunded, but not ordered again or edited
+	if rr := requestRefund(srv, order.ID, RefundRequest{Items: []OrderItem{{ProductID: 3, Quantity: 1}}}); rr.Code != http.StatusOK {
+		t.Errorf("refund of a deleted product failed: got %v: %s", rr.Code, rr.Body)
+	}
+	jsonData, _ := json.Marshal(Order{Items: []OrderItem{{ProductID: 3, Quantity: 1}}})
+	req, _ = http.NewRequest("POST", "/api/orders", bytes.NewBuffer(jsonData))
+	rr = httptest.NewRecorder()
+	srv.CreateOrder(rr, req)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 ordering a deleted product, got %v", rr.Code)
+	}
+	if rr := adminRequest(srv, "PATCH", "/api/products/3", map[string]any{"name": "Back"}); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 patching a deleted product, got %v", rr.Code)
+	}
+	if rr := adminRequest(srv, "DELETE", "/api/products/999", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 deleting an unknown product, got %v", rr.Code)
+	}
+}
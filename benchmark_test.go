@@ -10,13 +10,15 @@ import (
 
 // BenchmarkGetProducts benchmarks the getProducts endpoint
 func BenchmarkGetProducts(b *testing.B) {
+	srv := newTestServer(b)
+
 	req, err := http.NewRequest("GET", "/api/products", nil)
 	if err != nil {
 		b.Fatal(err)
 	}
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(GetProducts)
+	handler := http.HandlerFunc(srv.GetProducts)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -27,6 +29,8 @@ func BenchmarkGetProducts(b *testing.B) {
 
 // BenchmarkCreateOrder benchmarks the createOrder endpoint
 func BenchmarkCreateOrder(b *testing.B) {
+	srv := newTestServer(b)
+
 	orderData := Order{
 		Items: []OrderItem{
 			{ProductID: 1, Quantity: 2},
@@ -39,12 +43,10 @@ func BenchmarkCreateOrder(b *testing.B) {
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(CreateOrder)
+	handler := http.HandlerFunc(srv.CreateOrder)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		// Reset state for each iteration
-		ResetGlobalState()
 		handler.ServeHTTP(rr, req)
 		rr.Body.Reset()
 	}
@@ -52,6 +54,8 @@ func BenchmarkCreateOrder(b *testing.B) {
 
 // BenchmarkProcessPayment benchmarks the processPayment endpoint
 func BenchmarkProcessPayment(b *testing.B) {
+	srv := newTestServer(b)
+
 	// Setup: create an order first
 	orderData := Order{
 		Items: []OrderItem{
@@ -64,7 +68,7 @@ func BenchmarkProcessPayment(b *testing.B) {
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
-	CreateOrder(rr, req)
+	srv.CreateOrder(rr, req)
 
 	var order Order
 	json.Unmarshal(rr.Body.Bytes(), &order)
@@ -80,13 +84,10 @@ func BenchmarkProcessPayment(b *testing.B) {
 	req.Header.Set("Content-Type", "application/json")
 
 	rr = httptest.NewRecorder()
-	handler := http.HandlerFunc(ProcessPayment)
+	handler := http.HandlerFunc(srv.ProcessPayment)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		// Reset state for each iteration
-		ResetGlobalState()
-
 		// Recreate order for each iteration
 		orderData := Order{
 			Items: []OrderItem{
@@ -98,7 +99,7 @@ func BenchmarkProcessPayment(b *testing.B) {
 		req.Header.Set("Content-Type", "application/json")
 
 		rr := httptest.NewRecorder()
-		CreateOrder(rr, req)
+		srv.CreateOrder(rr, req)
 
 		var order Order
 		json.Unmarshal(rr.Body.Bytes(), &order)
@@ -119,6 +120,8 @@ func BenchmarkProcessPayment(b *testing.B) {
 
 // BenchmarkOrderCalculation benchmarks order total calculation
 func BenchmarkOrderCalculation(b *testing.B) {
+	srv := newTestServer(b)
+
 	orderData := Order{
 		Items: []OrderItem{
 			{ProductID: 1, Quantity: 2},
@@ -132,11 +135,10 @@ func BenchmarkOrderCalculation(b *testing.B) {
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(CreateOrder)
+	handler := http.HandlerFunc(srv.CreateOrder)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		ResetGlobalState()
 		handler.ServeHTTP(rr, req)
 		rr.Body.Reset()
 	}
@@ -144,13 +146,33 @@ func BenchmarkOrderCalculation(b *testing.B) {
 
 // BenchmarkConcurrentRequests benchmarks concurrent API requests
 func BenchmarkConcurrentRequests(b *testing.B) {
+	srv := newTestServer(b)
+
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
 			// Simulate concurrent product requests
 			req, _ := http.NewRequest("GET", "/api/products", nil)
 			rr := httptest.NewRecorder()
-			handler := http.HandlerFunc(GetProducts)
+			handler := http.HandlerFunc(srv.GetProducts)
 			handler.ServeHTTP(rr, req)
 		}
 	})
 }
+
+// BenchmarkConcurrentOrderWrites benchmarks concurrent order creation and status updates
+func BenchmarkConcurrentOrderWrites(b *testing.B) {
+	srv := newTestServer(b)
+	jsonData, _ := json.Marshal(Order{Items: []OrderItem{{ProductID: 1, Quantity: 1}}})
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req, _ := http.NewRequest("POST", "/api/orders", bytes.NewBuffer(jsonData))
+			rr := httptest.NewRecorder()
+			srv.CreateOrder(rr, req)
+
+			var order Order
+			json.Unmarshal(rr.Body.Bytes(), &order)
+			srv.store.UpdateOrder(req.Context(), order.ID, markPaid)
+		}
+	})
+}
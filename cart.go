@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// DefaultCartTTL is how long a cart is kept after its last change
+const DefaultCartTTL = 7 * 24 * time.Hour
+
+// Errors returned for carts
+var (
+	ErrCartNotFound     = errors.New("cart not found")
+	ErrCartItemNotFound = errors.New("cart item not found")
+	ErrCartCheckedOut   = errors.New("cart has already been checked out")
+)
+
+// WithCartTTL sets how long a cart is kept after its last change; 0 keeps
+// carts forever
+func WithCartTTL(ttl time.Duration) Option {
+	return func(s *Server) { s.cartTTL = ttl }
+}
+
+// Cart is a shopping cart kept on the server, so it survives page reloads
+// and can be picked up on another device. Its ID is a random token: anyone
+// holding it can read and change the cart.
+type Cart struct {
+	ID    string     `json:"id"`
+	Items []CartItem `json:"items"`
+	// OrderID is set once the cart is checked out; it cannot change after
+	OrderID   int       `json:"order_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// CartItem is a line of a cart. Its ID is unique within the cart.
+type CartItem struct {
+	ID        int `json:"id"`
+	ProductID int `json:"product_id"`
+	VariantID int `json:"variant_id,omitempty"`
+	Quantity  int `json:"quantity"`
+}
+
+func (item CartItem) orderItem() OrderItem {
+	return OrderItem{ProductID: item.ProductID, VariantID: item.VariantID, Quantity: item.Quantity}
+}
+
+// CartLine is a cart item priced at today's catalog
+type CartLine struct {
+	CartItem
+	Name      string `json:"name"`
+	UnitPrice *Money `json:"unit_price,omitempty"`
+	LineTotal *Money `json:"line_total,omitempty"`
+	// Problem says why the line cannot be ordered as it stands
+	Problem string `json:"problem,omitempty"`
+}
+
+// CartResponse is a cart with its lines priced and totalled, as the cart
+// endpoints return it. Total covers the lines that have a price.
+type CartResponse struct {
+	ID        string     `json:"id"`
+	Items     []CartLine `json:"items"`
+	Total     Money      `json:"total"`
+	OrderID   int        `json:"order_id,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	// ExpiresAt is when the cart is dropped unless it changes before
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// newCartID returns a random cart ID that cannot be guessed
+func newCartID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// addItem adds quantity units of a product or variant to the cart, on the
+// line that already has it if there is one, and returns that line
+func (c *Cart) addItem(item CartItem) CartItem {
+	for i, line := range c.Items {
+		if line.ProductID == item.ProductID && line.VariantID == item.VariantID {
+			c.Items[i].Quantity += item.Quantity
+			return c.Items[i]
+		}
+	}
+	item.ID = 1
+	for _, line := range c.Items {
+		item.ID = max(item.ID, line.ID+1)
+	}
+	c.Items = append(c.Items, item)
+	return item
+}
+
+// copyCart returns a cart that shares no slices with c
+func copyCart(c Cart) Cart {
+	c.Items = append([]CartItem{}, c.Items...)
+	return c
+}
+
+// itemIndex returns the position of a line in c.Items, or -1
+func (c *Cart) itemIndex(id int) int {
+	for i, line := range c.Items {
+		if line.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// cartExpired reports whether a cart has gone unchanged for longer than
+// the cart TTL
+func (s *Server) cartExpired(c Cart, now time.Time) bool {
+	return s.cartTTL > 0 && now.Sub(c.UpdatedAt) >= s.cartTTL
+}
+
+// getCart returns a cart unless it has expired
+func (s *Server) getCart(ctx context.Context, id string) (Cart, error) {
+	cart, err := s.store.GetCart(ctx, id)
+	if err == nil && s.cartExpired(cart, time.Now()) {
+		return Cart{}, ErrCartNotFound
+	}
+	return cart, err
+}
+
+// changeCart applies fn to a cart that has neither expired nor been
+// checked out, and marks it changed
+func (s *Server) changeCart(ctx context.Context, id string, fn func(*Cart) error) (Cart, error) {
+	now := time.Now()
+	return s.store.UpdateCart(ctx, id, func(c *Cart) error {
+		switch {
+		case s.cartExpired(*c, now):
+			return ErrCartNotFound
+		case c.OrderID != 0:
+			return ErrCartCheckedOut
+		}
+		if err := fn(c); err != nil {
+			return err
+		}
+		c.UpdatedAt = now
+		return nil
+	})
+}
+
+// errCartChanged is returned by editCart's store callback when the cart
+// changed after its edit was checked
+var errCartChanged = errors.New("cart changed")
+
+// editCart applies edit to a cart. edit returns the line it leaves, if
+// any, which is checked against the catalog before the edit is saved. The
+// check runs outside the store's lock, so should the cart change in the
+// meantime the edit is tried again on the new cart.
+func (s *Server) editCart(ctx context.Context, id string, edit func(*Cart) (*CartItem, error)) (Cart, error) {
+	for {
+		cart, err := s.getCart(ctx, id)
+		if err != nil {
+			return Cart{}, err
+		}
+		if cart.OrderID != 0 {
+			return Cart{}, ErrCartCheckedOut
+		}
+		draft := copyCart(cart)
+		line, err := edit(&draft)
+		if err != nil {
+			return Cart{}, err
+		}
+		if line != nil {
+			if err := s.checkCartItem(ctx, *line); err != nil {
+				return Cart{}, err
+			}
+		}
+
+		checked := cart.UpdatedAt
+		updated, err := s.changeCart(ctx, id, func(c *Cart) error {
+			if !c.UpdatedAt.Equal(checked) {
+				return errCartChanged
+			}
+			_, err := edit(c)
+			return err
+		})
+		if !errors.Is(err, errCartChanged) {
+			return updated, err
+		}
+	}
+}
+
+// checkCartItem checks that a cart line can be ordered as it would stand
+// after a change, reporting problems as ValidationError fields
+func (s *Server) checkCartItem(ctx context.Context, item CartItem) error {
+	err := s.validateOrderItems(ctx, []OrderItem{item.orderItem()})
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		return err
+	}
+	fields := make([]FieldError, len(verr.Items))
+	for i, e := range verr.Items {
+		fields[i] = FieldError{Field: e.Field, Message: e.Message}
+	}
+	return &ValidationError{Message: "invalid cart item", Fields: fields}
+}
+
+// priceCart prices every line of a cart at today's catalog, noting lines
+// that could not be ordered as they stand
+func (s *Server) priceCart(ctx context.Context, c Cart) (CartResponse, error) {
+	resp := CartResponse{
+		ID:        c.ID,
+		Items:     make([]CartLine, len(c.Items)),
+		Total:     Money{Currency: DefaultCurrency},
+		OrderID:   c.OrderID,
+		CreatedAt: c.CreatedAt,
+		UpdatedAt: c.UpdatedAt,
+	}
+	if s.cartTTL > 0 {
+		expires := c.UpdatedAt.Add(s.cartTTL)
+		resp.ExpiresAt = &expires
+	}
+
+	priced := 0
+	for i, item := range c.Items {
+		line := CartLine{CartItem: item}
+		resp.Items[i] = line
+
+		product, err := s.store.GetProduct(ctx, item.ProductID)
+		if errors.Is(err, ErrProductNotFound) || (err == nil && product.DeletedAt != nil) {
+			resp.Items[i].Problem = fmt.Sprintf("product %d is no longer sold", item.ProductID)
+			continue
+		}
+		if err != nil {
+			return CartResponse{}, err
+		}
+		line.Name = product.Name
+		price, available, err := product.lineFor(item.VariantID)
+		if err != nil {
+			line.Problem = fmt.Sprintf("variant %d of product %d is no longer sold", item.VariantID, item.ProductID)
+			resp.Items[i] = line
+			continue
+		}
+		if j := product.variantIndex(item.VariantID); j >= 0 {
+			line.Name += " (" + optionsLabel(product.Variants[j].Options) + ")"
+		}
+
+		lineTotal := price.Mul(item.Quantity)
+		if priced == 0 {
+			resp.Total.Currency = price.Currency
+		}
+		if total, err := resp.Total.Add(lineTotal); err != nil {
+			line.Problem = fmt.Sprintf("priced in %s, unlike the rest of the cart", price.Currency)
+		} else {
+			resp.Total = total
+			priced++
+		}
+		line.UnitPrice, line.LineTotal = &price, &lineTotal
+		if line.Problem == "" && item.Quantity > available {
+			line.Problem = fmt.Sprintf("only %d of %s in stock", max(available, 0), item.orderItem().stockName())
+		}
+		resp.Items[i] = line
+	}
+	return resp, nil
+}
+
+// checkoutCart places an order for the items of a cart, placed by contact,
+// and marks the cart checked out. Should another checkout of the cart win
+// the race, the order placed here is cancelled again.
+func (s *Server) checkoutCart(ctx context.Context, id string, contact OrderContact) (Order, error) {
+	cart, err := s.getCart(ctx, id)
+	if err != nil {
+		return Order{}, err
+	}
+	if cart.OrderID != 0 {
+		return Order{}, ErrCartCheckedOut
+	}
+
+	items := make([]OrderItem, len(cart.Items))
+	for i, item := range cart.Items {
+		items[i] = item.orderItem()
+	}
+	order, err := s.placeOrder(ctx, items, contact)
+	if err != nil {
+		return Order{}, err
+	}
+
+	_, err = s.changeCart(ctx, id, func(c *Cart) error {
+		c.OrderID = order.ID
+		return nil
+	})
+	if err != nil {
+		_, cancelErr := s.store.UpdateOrder(ctx, order.ID, func(o *Order) error {
+			return o.Transition(StatusCancelled, time.Now())
+		})
+		if cancelErr != nil {
+			log.Printf("cancel order %d of cart %s: %v", order.ID, id, cancelErr)
+		}
+		return Order{}, err
+	}
+	return order, nil
+}
+
+// ExpireCarts removes the carts left unchanged for longer than the cart TTL
+// and returns how many were removed
+func (s *Server) ExpireCarts(ctx context.Context, now time.Time) (int, error) {
+	if s.cartTTL <= 0 {
+		return 0, nil
+	}
+	return s.store.DeleteCarts(ctx, now.Add(-s.cartTTL))
+}
+
+// expireCartsEvery runs ExpireCarts on every tick until ctx is done
+func (s *Server) expireCartsEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if _, err := s.ExpireCarts(ctx, now); err != nil {
+				log.Printf("expire carts: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// cartRequest sends a cart request through the router and decodes the cart
+// it returns, failing unless the status is the expected one
+func cartRequest(t *testing.T, srv *Server, method, url string, body any, status int) CartResponse {
+	t.Helper()
+	rr := customerRequest(srv, method, url, body, "")
+	if rr.Code != status {
+		t.Fatalf("%s %s: expected %v, got %v: %s", method, url, status, rr.Code, rr.Body)
+	}
+	var cart CartResponse
+	if status < 300 {
+		if err := json.Unmarshal(rr.Body.Bytes(), &cart); err != nil {
+			t.Fatalf("%s %s: failed to unmarshal cart: %v", method, url, err)
+		}
+	}
+	return cart
+}
+
+func TestCartLifecycle(t *testing.T) {
+	t.Parallel()
+	srv := newStockedServer(t, 5)
+
+	cart := cartRequest(t, srv, "POST", "/api/carts", nil, http.StatusCreated)
+	if len(cart.ID) != 32 || len(cart.Items) != 0 || cart.ExpiresAt == nil {
+		t.Fatalf("expected an empty cart that expires, got %+v", cart)
+	}
+	url := "/api/carts/" + cart.ID
+
+	cartRequest(t, srv, "POST", url+"/items", CartItem{ProductID: 1, Quantity: 2}, http.StatusOK)
+	cartRequest(t, srv, "POST", url+"/items", CartItem{ProductID: 3, Quantity: 1}, http.StatusOK)
+	cart = cartRequest(t, srv, "POST", url+"/items", CartItem{ProductID: 1, Quantity: 1}, http.StatusOK)
+	if len(cart.Items) != 2 || cart.Items[0].Quantity != 3 {
+		t.Fatalf("expected product 1 added to its line, got %+v", cart.Items)
+	}
+	if expected := NewMoney(9999*3+7999, DefaultCurrency); cart.Total != expected {
+		t.Errorf("expected total %v, got %v", expected, cart.Total)
+	}
+
+	cart = cartRequest(t, srv, "PATCH", fmt.Sprintf("%s/items/%d", url, cart.Items[1].ID), map[string]int{"quantity": 4}, http.StatusOK)
+	if cart.Items[1].Quantity != 4 || *cart.Items[1].LineTotal != NewMoney(7999*4, DefaultCurrency) {
+		t.Errorf("expected 4 of product 3, got %+v", cart.Items[1])
+	}
+	cart = cartRequest(t, srv, "DELETE", fmt.Sprintf("%s/items/%d", url, cart.Items[1].ID), nil, http.StatusOK)
+	if len(cart.Items) != 1 || cart.Items[0].ProductID != 1 {
+		t.Errorf("expected only product 1 left, got %+v", cart.Items)
+	}
+
+	// The cart is still there on the next visit
+	cart = cartRequest(t, srv, "GET", url, nil, http.StatusOK)
+	if len(cart.Items) != 1 || cart.Items[0].Name != "Wireless Headphones" {
+		t.Errorf("expected the cart as left, got %+v", cart)
+	}
+
+	rr := customerRequest(srv, "POST", url+"/checkout", nil, "")
+	var order Order
+	if rr.Code != http.StatusCreated || json.Unmarshal(rr.Body.Bytes(), &order) != nil {
+		t.Fatalf("checkout failed: %v: %s", rr.Code, rr.Body)
+	}
+	if len(order.Items) != 1 || order.Items[0].Quantity != 3 || order.Status != StatusPending {
+		t.Errorf("expected a pending order for 3 of product 1, got %+v", order)
+	}
+	if stock, reserved := productStock(t, srv, 1); stock != 5 || reserved != 3 {
+		t.Errorf("expected 3 units reserved, got stock %d reserved %d", stock, reserved)
+	}
+
+	cart = cartRequest(t, srv, "GET", url, nil, http.StatusOK)
+	if cart.OrderID != order.ID {
+		t.Errorf("expected the cart to point at order %d, got %d", order.ID, cart.OrderID)
+	}
+	cartRequest(t, srv, "POST", url+"/items", CartItem{ProductID: 3, Quantity: 1}, http.StatusConflict)
+	cartRequest(t, srv, "POST", url+"/checkout", nil, http.StatusConflict)
+}
+
+func TestCartRejectsInvalidItems(t *testing.T) {
+	t.Parallel()
+	srv := newStockedServer(t, 2)
+	cart := cartRequest(t, srv, "POST", "/api/carts", map[string]any{
+		"items": []CartItem{{ProductID: 1, Quantity: 1}},
+	}, http.StatusCreated)
+	url := "/api/carts/" + cart.ID
+
+	testCases := []struct {
+		name   string
+		method string
+		path   string
+		body   any
+		code   int
+	}{
+		{"unknown product", "POST", "/items", CartItem{ProductID: 999, Quantity: 1}, http.StatusUnprocessableEntity},
+		{"no quantity", "POST", "/items", CartItem{ProductID: 3}, http.StatusUnprocessableEntity},
+		{"more than in stock", "POST", "/items", CartItem{ProductID: 1, Quantity: 2}, http.StatusUnprocessableEntity},
+		{"zero quantity", "PATCH", "/items/1", map[string]int{"quantity": 0}, http.StatusUnprocessableEntity},
+		{"unknown item", "PATCH", "/items/9", map[string]int{"quantity": 1}, http.StatusNotFound},
+		{"bad item ID", "DELETE", "/items/first", nil, http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		if rr := adminRequest(srv, tc.method, url+tc.path, tc.body); rr.Code != tc.code {
+			t.Errorf("%s: expected %v, got %v: %s", tc.name, tc.code, rr.Code, rr.Body)
+		}
+	}
+	if rr := adminRequest(srv, "GET", "/api/carts/unknown", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown cart, got %v", rr.Code)
+	}
+
+	// Lines that went stale since they were added are flagged, not dropped
+	if rr := adminRequest(srv, "DELETE", "/api/products/1", nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("deleting product 1 failed: %v: %s", rr.Code, rr.Body)
+	}
+	cart = cartRequest(t, srv, "GET", url, nil, http.StatusOK)
+	if cart.Items[0].Problem == "" || cart.Total.Amount != 0 {
+		t.Errorf("expected the deleted product flagged, got %+v", cart)
+	}
+	cartRequest(t, srv, "POST", url+"/checkout", nil, http.StatusUnprocessableEntity)
+}
+
+func TestCartsExpire(t *testing.T) {
+	t.Parallel()
+	srv := NewServer(NewMemoryStore(testCatalog(t)), WithCartTTL(time.Hour))
+	cart := cartRequest(t, srv, "POST", "/api/carts", nil, http.StatusCreated)
+	if expires := cart.UpdatedAt.Add(time.Hour); !cart.ExpiresAt.Equal(expires) {
+		t.Errorf("expected the cart to expire at %v, got %v", expires, cart.ExpiresAt)
+	}
+
+	removed, err := srv.ExpireCarts(context.Background(), time.Now())
+	if err != nil || removed != 0 {
+		t.Fatalf("expected no carts expired yet, got %d, %v", removed, err)
+	}
+	removed, err = srv.ExpireCarts(context.Background(), time.Now().Add(2*time.Hour))
+	if err != nil || removed != 1 {
+		t.Fatalf("expected the cart expired, got %d, %v", removed, err)
+	}
+	cartRequest(t, srv, "GET", "/api/carts/"+cart.ID, nil, http.StatusNotFound)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultCatalogPath is the seed catalog loaded when none is given
+const DefaultCatalogPath = "data/catalog.json"
+
+// CatalogError locates a problem in a catalog file
+type CatalogError struct {
+	Path    string
+	Line    int
+	Message string
+}
+
+func (e *CatalogError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.Path, e.Line, e.Message)
+}
+
+// catalogEntry is one product as written in a catalog file. The price is
+// kept as written, a number or a string, so it is parsed in the entry's own
+// currency. Stock is nil when the entry leaves it out.
+type catalogEntry struct {
+	ID          int    `json:"id,omitempty"`
+	SKU         string `json:"sku,omitempty"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Price       any    `json:"price"`
+	Currency    string `json:"currency"`
+	Image       string `json:"image"`
+	Category    string `json:"category"`
+	Stock       *int   `json:"stock,omitempty"`
+}
+
+// newCatalogEntry returns the entry that reads back as p
+func newCatalogEntry(p Product) catalogEntry {
+	return catalogEntry{
+		ID:          p.ID,
+		SKU:         p.SKU,
+		Name:        p.Name,
+		Description: p.Description,
+		Price:       json.Number(p.Price.String()),
+		Currency:    p.Price.Currency,
+		Image:       p.Image,
+		Category:    p.Category,
+		Stock:       &p.Stock,
+	}
+}
+
+// product converts the entry and lists the problems that make it invalid
+func (e catalogEntry) product() (Product, []string) {
+	var problems []string
+
+	currency := DefaultCurrency
+	if e.Currency != "" {
+		currency = strings.ToUpper(e.Currency)
+	}
+	var price Money
+	var err error
+	switch v := e.Price.(type) {
+	case json.Number:
+		price, err = ParseMoney(v.String(), currency)
+	case string:
+		price, err = ParseMoney(v, currency)
+	case nil:
+		err = errors.New("required")
+	default:
+		err = errors.New("must be a number")
+	}
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("price: %v", err))
+	}
+
+	p := Product{
+		ID:          e.ID,
+		SKU:         e.SKU,
+		Name:        e.Name,
+		Description: e.Description,
+		Price:       price,
+		Image:       e.Image,
+		Category:    e.Category,
+	}
+	if e.Stock != nil {
+		p.Stock = *e.Stock
+	}
+	var verr *ValidationError
+	if errors.As(validateProduct(p), &verr) {
+		for _, f := range verr.Fields {
+			// An unparseable price was reported above
+			if f.Field == "price" && err != nil {
+				continue
+			}
+			problems = append(problems, f.Field+" "+f.Message)
+		}
+	}
+	return p, problems
+}
+
+// catalogColumns lists the CSV columns of a catalog in export order
+var catalogColumns = []struct {
+	name     string
+	required bool
+}{
+	{"id", false},
+	{"sku", false},
+	{"name", true},
+	{"description", false},
+	{"price", true},
+	{"currency", false},
+	{"image", false},
+	{"category", true},
+	{"stock", false},
+}
+
+// LoadCatalog reads the seed catalog from a .json or .csv file. Every
+// product needs a unique positive ID. Every problem found is reported as a
+// *CatalogError with its line number.
+func LoadCatalog(path string) ([]Product, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read catalog: %w", err)
+	}
+
+	r := &catalogReader{path: path}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		r.readJSON(data)
+	case ".csv":
+		r.readCSV(data)
+	default:
+		return nil, fmt.Errorf("catalog %s: unsupported format %q, use .json or .csv", path, ext)
+	}
+
+	var products []Product
+	// seen maps product IDs to the line that defined them
+	seen := map[int]int{}
+	for _, row := range r.rows {
+		if row.entry.ID <= 0 {
+			r.fail(row.line, "id must be a positive integer")
+		} else if first, ok := seen[row.entry.ID]; ok {
+			r.fail(row.line, "duplicate product id %d (first defined on line %d)", row.entry.ID, first)
+		} else {
+			seen[row.entry.ID] = row.line
+		}
+
+		p, problems := row.entry.product()
+		for _, problem := range problems {
+			r.fail(row.line, "%s", problem)
+		}
+		products = append(products, p)
+	}
+
+	if len(r.errs) == 0 && len(products) == 0 {
+		r.fail(1, "catalog has no products")
+	}
+	if len(r.errs) > 0 {
+		return nil, errors.Join(r.errs...)
+	}
+	return products, nil
+}
+
+// catalogRow is an entry read from a catalog and the line it starts on
+type catalogRow struct {
+	line  int
+	entry catalogEntry
+}
+
+// catalogReader collects the entries of a catalog and the problems that
+// kept it from reading others
+type catalogReader struct {
+	path string
+	rows []catalogRow
+	errs []error
+}
+
+func (r *catalogReader) fail(line int, format string, args ...any) {
+	r.errs = append(r.errs, &CatalogError{Path: r.path, Line: line, Message: fmt.Sprintf(format, args...)})
+}
+
+// newEntryDecoder returns a decoder that rejects fields a catalog entry
+// does not have
+func newEntryDecoder(data []byte) *json.Decoder {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	dec.UseNumber()
+	return dec
+}
+
+// readJSON reads a JSON array of catalog entries
+func (r *catalogReader) readJSON(data []byte) {
+	dec := newEntryDecoder(data)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		r.fail(lineAt(data, 0), "catalog must be a JSON array of products")
+		return
+	}
+	for dec.More() {
+		start := skipSpace(data, dec.InputOffset())
+		var e catalogEntry
+		if err := dec.Decode(&e); err != nil {
+			// The decoder cannot resume inside a bad value
+			line, message := decodeError(data, start, err)
+			r.fail(line, "%s", message)
+			return
+		}
+		r.rows = append(r.rows, catalogRow{line: lineAt(data, start), entry: e})
+	}
+	if _, err := dec.Token(); err != nil {
+		r.fail(lineAt(data, dec.InputOffset()), "%v", err)
+	}
+}
+
+// readNDJSON reads one catalog entry per line, skipping blank lines
+func (r *catalogReader) readNDJSON(data []byte) {
+	for i, text := range bytes.Split(data, []byte("\n")) {
+		line := i + 1
+		if len(bytes.TrimSpace(text)) == 0 {
+			continue
+		}
+		dec := newEntryDecoder(text)
+		var e catalogEntry
+		if err := dec.Decode(&e); err != nil {
+			_, message := decodeError(text, skipSpace(text, 0), err)
+			r.fail(line, "%s", message)
+			continue
+		}
+		if dec.More() {
+			r.fail(line, "unexpected data after the product")
+			continue
+		}
+		r.rows = append(r.rows, catalogRow{line: line, entry: e})
+	}
+}
+
+// decodeError returns the line of an error decoding the value at start of
+// data, and a description of it
+func decodeError(data []byte, start int64, err error) (int, string) {
+	// Both offsets point just past the offending byte, but a type error
+	// counts from the start of the value
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return lineAt(data, syntaxErr.Offset-1), err.Error()
+	case errors.As(err, &typeErr):
+		return lineAt(data, start+typeErr.Offset-1), fmt.Sprintf("%s must be a %s, not a %s", typeErr.Field, typeErr.Type, typeErr.Value)
+	default:
+		return lineAt(data, start), err.Error()
+	}
+}
+
+// skipSpace returns the offset of the first token at or after offset
+func skipSpace(data []byte, offset int64) int64 {
+	for offset < int64(len(data)) && strings.ContainsRune(" \t\r\n,", rune(data[offset])) {
+		offset++
+	}
+	return offset
+}
+
+// lineAt returns the line of the first token at or after offset
+func lineAt(data []byte, offset int64) int {
+	if offset < 0 {
+		offset = 0
+	}
+	offset = skipSpace(data, min(offset, int64(len(data))))
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// readCSV reads a CSV file whose header names the catalog columns
+func (r *catalogReader) readCSV(data []byte) {
+	cr := csv.NewReader(bytes.NewReader(data))
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return
+	}
+	if err != nil {
+		r.fail(1, "%v", err)
+		return
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	known := map[string]bool{}
+	for _, col := range catalogColumns {
+		known[col.name] = true
+		if _, ok := columns[col.name]; col.required && !ok {
+			r.fail(1, "missing column %q", col.name)
+		}
+	}
+	for _, name := range header {
+		if name = strings.ToLower(strings.TrimSpace(name)); !known[name] {
+			r.fail(1, "unknown column %q", name)
+		}
+	}
+	if len(r.errs) > 0 {
+		return
+	}
+
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			r.fail(parseErr.Line, "%v", parseErr.Err)
+			continue
+		}
+		if err != nil {
+			r.fail(0, "%v", err)
+			return
+		}
+		line, _ := cr.FieldPos(0)
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		e := catalogEntry{
+			SKU:         field("sku"),
+			Name:        field("name"),
+			Description: field("description"),
+			Price:       field("price"),
+			Currency:    field("currency"),
+			Image:       field("image"),
+			Category:    field("category"),
+		}
+		if id := field("id"); id != "" {
+			if e.ID, err = strconv.Atoi(id); err != nil {
+				r.fail(line, "id %q is not an integer", id)
+				continue
+			}
+		}
+		if stock := field("stock"); stock != "" {
+			n, err := strconv.Atoi(stock)
+			if err != nil {
+				r.fail(line, "stock %q is not an integer", stock)
+				continue
+			}
+			e.Stock = &n
+		}
+		r.rows = append(r.rows, catalogRow{line: line, entry: e})
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// maxImportSize caps the body of an import request
+const maxImportSize = 10 << 20
+
+// Formats of the bulk import and export endpoints. Both carry the columns
+// of a catalog file, with the SKU identifying each product.
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+// What an import does with each row
+const (
+	ImportCreate    = "create"
+	ImportUpdate    = "update"
+	ImportUnchanged = "unchanged"
+	ImportError     = "error"
+)
+
+// FieldChange is the old and new value of a product field, as written in
+// the import file
+type FieldChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// ImportRow reports what an import does with one row of the file
+type ImportRow struct {
+	Line   int    `json:"line"`
+	SKU    string `json:"sku,omitempty"`
+	Action string `json:"action"`
+	// ProductID is the product the row updates, or the one it created
+	ProductID int                    `json:"product_id,omitempty"`
+	Changes   map[string]FieldChange `json:"changes,omitempty"`
+	Errors    []string               `json:"errors,omitempty"`
+
+	product Product
+	// keepStock is set when the row leaves the stock of the product alone
+	keepStock bool
+}
+
+// ImportReport lists every row of an import in file order, with totals
+type ImportReport struct {
+	DryRun    bool        `json:"dry_run"`
+	Created   int         `json:"created"`
+	Updated   int         `json:"updated"`
+	Unchanged int         `json:"unchanged"`
+	Failed    int         `json:"failed"`
+	Rows      []ImportRow `json:"rows"`
+}
+
+// importFormat reads the format of an import from the format parameter,
+// falling back to the Content-Type
+func importFormat(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case FormatCSV, FormatNDJSON:
+		return format, nil
+	case "":
+	default:
+		return "", fmt.Errorf("format must be %s or %s", FormatCSV, FormatNDJSON)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		return FormatCSV, nil
+	case "application/x-ndjson", "application/ndjson":
+		return FormatNDJSON, nil
+	}
+	return "", fmt.Errorf("send text/csv or application/x-ndjson, or set format")
+}
+
+// planImport works out what importing data would do without saving
+// anything. Rows are matched to products by SKU, deleted products
+// included; the id column is ignored so an export can be imported back.
+// Rows without a stock leave the stock of existing products alone, and
+// the variants of existing products are kept: their stock is set through
+// the product API.
+func (s *Server) planImport(ctx context.Context, format string, data []byte) (ImportReport, error) {
+	cr := &catalogReader{}
+	if format == FormatCSV {
+		cr.readCSV(data)
+	} else {
+		cr.readNDJSON(data)
+	}
+
+	report := ImportReport{Rows: []ImportRow{}}
+	for _, err := range cr.errs {
+		var cerr *CatalogError
+		if errors.As(err, &cerr) {
+			report.Rows = append(report.Rows, ImportRow{Line: cerr.Line, Action: ImportError, Errors: []string{cerr.Message}})
+		}
+	}
+
+	// seen maps SKUs to the line that first used them
+	seen := map[string]int{}
+	for _, row := range cr.rows {
+		p, problems := row.entry.product()
+		p.ID = 0
+		ir := ImportRow{Line: row.line, SKU: p.SKU, product: p}
+
+		if p.SKU == "" {
+			problems = append(problems, "sku is required")
+		} else if first, ok := seen[p.SKU]; ok {
+			problems = append(problems, fmt.Sprintf("duplicate sku %q (first used on line %d)", p.SKU, first))
+		} else {
+			seen[p.SKU] = row.line
+		}
+		if len(problems) > 0 {
+			ir.Action, ir.Errors = ImportError, problems
+			report.Rows = append(report.Rows, ir)
+			continue
+		}
+
+		existing, err := s.store.GetProductBySKU(ctx, p.SKU)
+		switch {
+		case errors.Is(err, ErrProductNotFound):
+			ir.Action = ImportCreate
+		case err != nil:
+			return ImportReport{}, err
+		default:
+			ir.ProductID = existing.ID
+			ir.keepStock = row.entry.Stock == nil
+			if err := ir.merge(existing, &p); err != nil {
+				ir.fail(err)
+				report.Rows = append(report.Rows, ir)
+				continue
+			}
+			ir.product = p
+		}
+		report.Rows = append(report.Rows, ir)
+	}
+
+	sort.SliceStable(report.Rows, func(i, j int) bool { return report.Rows[i].Line < report.Rows[j].Line })
+	report.count()
+	return report, nil
+}
+
+// merge turns p, the product a row describes, into the replacement of
+// existing: stock the row leaves out and the variants come from existing,
+// whose reservations must still fit. It records what the row changes.
+func (row *ImportRow) merge(existing Product, p *Product) error {
+	if row.keepStock {
+		p.Stock = existing.Stock
+	}
+	p.Variants = copyVariants(existing.Variants)
+	if err := keepReservations(existing, p); err != nil {
+		return err
+	}
+	row.Changes = productChanges(existing, *p)
+	row.Action = ImportUpdate
+	if len(row.Changes) == 0 {
+		row.Action = ImportUnchanged
+	}
+	return nil
+}
+
+// fail marks a row as failed because of err
+func (row *ImportRow) fail(err error) {
+	row.Action, row.Changes = ImportError, nil
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		for _, f := range verr.Fields {
+			row.Errors = append(row.Errors, f.Field+" "+f.Message)
+		}
+		return
+	}
+	row.Errors = append(row.Errors, err.Error())
+}
+
+// count totals the rows of the report by action
+func (r *ImportReport) count() {
+	r.Created, r.Updated, r.Unchanged, r.Failed = 0, 0, 0, 0
+	for _, row := range r.Rows {
+		switch row.Action {
+		case ImportCreate:
+			r.Created++
+		case ImportUpdate:
+			r.Updated++
+		case ImportUnchanged:
+			r.Unchanged++
+		case ImportError:
+			r.Failed++
+		}
+	}
+}
+
+// productChanges lists the fields an import changes on a product. Importing
+// a deleted product puts it back on sale.
+func productChanges(old, p Product) map[string]FieldChange {
+	changes := map[string]FieldChange{}
+	for _, f := range []struct{ name, from, to string }{
+		{"name", old.Name, p.Name},
+		{"description", old.Description, p.Description},
+		{"price", old.Price.String(), p.Price.String()},
+		{"currency", old.Price.Currency, p.Price.Currency},
+		{"image", old.Image, p.Image},
+		{"category", old.Category, p.Category},
+		{"stock", strconv.Itoa(old.Stock), strconv.Itoa(p.Stock)},
+	} {
+		if f.from != f.to {
+			changes[f.name] = FieldChange{From: f.from, To: f.to}
+		}
+	}
+	if old.DeletedAt != nil {
+		changes["deleted_at"] = FieldChange{From: old.DeletedAt.Format(time.RFC3339)}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return changes
+}
+
+// applyImport saves the rows of a planned import in one store
+// transaction: every row or none. Products may have changed since the
+// plan, so each update is merged again with the product as it is now, and
+// SKUs are checked again as the rows are saved. A row that fails then is
+// marked failed in the report and nothing is saved.
+func (s *Server) applyImport(ctx context.Context, report *ImportReport) error {
+	var rows []*ImportRow
+	var products []Product
+	// updates maps the products being updated to their rows
+	updates := map[int]*ImportRow{}
+	for i := range report.Rows {
+		row := &report.Rows[i]
+		switch row.Action {
+		case ImportCreate, ImportUpdate:
+			p := row.product
+			p.ID = row.ProductID
+			rows = append(rows, row)
+			products = append(products, p)
+			if p.ID != 0 {
+				updates[p.ID] = row
+			}
+		}
+	}
+	if len(products) == 0 {
+		return nil
+	}
+
+	saved, err := s.store.SaveProducts(ctx, products, func(old Product, p *Product) error {
+		return updates[p.ID].merge(old, p)
+	})
+	var berr *BatchError
+	if errors.As(err, &berr) && (errors.As(berr.Err, new(*ValidationError)) || errors.Is(berr.Err, ErrDuplicateSKU)) {
+		rows[berr.Index].fail(berr.Err)
+		report.count()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for i, p := range saved {
+		rows[i].ProductID = p.ID
+		s.indexProduct(p)
+	}
+	report.count()
+	return nil
+}
+
+// catalogRecord returns the CSV record of a product, in the order of
+// catalogColumns
+func catalogRecord(p Product) []string {
+	return []string{
+		strconv.Itoa(p.ID),
+		p.SKU,
+		p.Name,
+		p.Description,
+		p.Price.String(),
+		p.Price.Currency,
+		p.Image,
+		p.Category,
+		strconv.Itoa(p.Stock),
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// importProducts posts a file to the import endpoint as the admin
+func importProducts(srv *Server, query, contentType, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/api/admin/products/import"+query, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	req.Header.Set("Content-Type", contentType)
+	rr := httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rr, req)
+	return rr
+}
+
+func decodeReport(t *testing.T, rr *httptest.ResponseRecorder) ImportReport {
+	t.Helper()
+	var report ImportReport
+	if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+		t.Fatalf("decode report: %v: %s", err, rr.Body)
+	}
+	return report
+}
+
+const importCSV = `sku,name,description,price,image,category
+WH-1000,Wireless Headphones,High-quality wireless headphones with noise cancellation,89.99,https://images.unsplash.com/photo-1505740420928-5e560c06d30e?w=300&h=200&fit=crop,Electronics
+SW-2000,Smart Watch,Fitness tracking smartwatch with heart rate monitor,199.99,https://images.unsplash.com/photo-1523275335684-37898b6baf30?w=300&h=200&fit=crop,Electronics
+DL-6000,Desk Lamp,,34.99,,Home
+`
+
+func TestImportDryRunReportsDiffs(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+
+	rr := importProducts(srv, "?dry_run=true", "text/csv", importCSV)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("dry run failed: got %v: %s", rr.Code, rr.Body)
+	}
+	report := decodeReport(t, rr)
+	if !report.DryRun || report.Created != 1 || report.Updated != 1 || report.Unchanged != 1 || report.Failed != 0 {
+		t.Errorf("unexpected totals %+v", report)
+	}
+	if len(report.Rows) != 3 {
+		t.Fatalf("expected 3 rows, got %+v", report.Rows)
+	}
+
+	headphones := report.Rows[0]
+	if headphones.Line != 2 || headphones.Action != ImportUpdate || headphones.ProductID != 1 {
+		t.Errorf("expected line 2 to update product 1, got %+v", headphones)
+	}
+	if change := headphones.Changes["price"]; len(headphones.Changes) != 1 || change.From != "99.99" || change.To != "89.99" {
+		t.Errorf("expected only the price to change, got %+v", headphones.Changes)
+	}
+	if report.Rows[1].Action != ImportUnchanged || report.Rows[2].Action != ImportCreate {
+		t.Errorf("expected unchanged then create, got %+v", report.Rows[1:])
+	}
+
+	// Nothing was saved
+	if p, _ := srv.store.GetProduct(context.Background(), 1); p.Price != NewMoney(9999, DefaultCurrency) {
+		t.Errorf("dry run changed the price to %s", p.Price)
+	}
+	if _, err := srv.store.GetProductBySKU(context.Background(), "DL-6000"); err == nil {
+		t.Error("dry run created a product")
+	}
+}
+
+func TestImportUpsertsBySKU(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+	ctx := context.Background()
+
+	// A deleted product comes back on sale when imported
+	if rr := adminRequest(srv, "DELETE", "/api/products/2", nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("delete failed: got %v", rr.Code)
+	}
+
+	rr := importProducts(srv, "", "text/csv; charset=utf-8", importCSV)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("import failed: got %v: %s", rr.Code, rr.Body)
+	}
+	report := decodeReport(t, rr)
+	if report.DryRun || report.Created != 1 || report.Updated != 2 {
+		t.Errorf("unexpected totals %+v", report)
+	}
+	if _, ok := report.Rows[1].Changes["deleted_at"]; !ok {
+		t.Errorf("expected restoring the watch to show as a change, got %+v", report.Rows[1])
+	}
+
+	if p, _ := srv.store.GetProduct(ctx, 1); p.Price != NewMoney(8999, DefaultCurrency) || p.SKU != "WH-1000" {
+		t.Errorf("expected product 1 repriced to 89.99, got %+v", p)
+	}
+	if p, _ := srv.store.GetProduct(ctx, 2); p.DeletedAt != nil {
+		t.Errorf("expected product 2 back on sale, got %+v", p)
+	}
+	lamp, err := srv.store.GetProductBySKU(ctx, "DL-6000")
+	if err != nil || lamp.ID != report.Rows[2].ProductID || lamp.Category != "Home" {
+		t.Errorf("expected the lamp created as product %d, got %+v, %v", report.Rows[2].ProductID, lamp, err)
+	}
+
+	// Importing the same file again changes nothing
+	report = decodeReport(t, importProducts(srv, "", "text/csv", importCSV))
+	if report.Unchanged != 3 {
+		t.Errorf("expected every row unchanged on a second import, got %+v", report)
+	}
+}
+
+func TestImportNDJSON(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+
+	body := `{"sku": "CM-3000", "name": "Coffee Maker", "price": "74.99", "category": "Kitchen"}
+
+{"sku": "TP-7000", "name": "Teapot", "price": 1500, "currency": "JPY", "category": "Kitchen"}
+`
+	rr := importProducts(srv, "", "application/x-ndjson", body)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("import failed: got %v: %s", rr.Code, rr.Body)
+	}
+	report := decodeReport(t, rr)
+	if len(report.Rows) != 2 || report.Rows[0].Line != 1 || report.Rows[1].Line != 3 {
+		t.Fatalf("expected rows on lines 1 and 3, got %+v", report.Rows)
+	}
+
+	teapot, err := srv.store.GetProductBySKU(context.Background(), "TP-7000")
+	if err != nil || teapot.Price != NewMoney(1500, "JPY") {
+		t.Errorf("expected a teapot at 1500 JPY, got %+v, %v", teapot, err)
+	}
+	// Fields missing from the row are cleared, as with PUT
+	if coffee, _ := srv.store.GetProduct(context.Background(), 3); coffee.Description != "" || coffee.Image != "" {
+		t.Errorf("expected the coffee maker replaced by the row, got %+v", coffee)
+	}
+}
+
+func TestImportRejectsInvalidFiles(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+
+	body := `{"sku": "DL-6000", "name": "Desk Lamp", "price": 34.99, "category": "Home"}
+{"name": "No SKU", "price": 5, "category": "Home"}
+{"sku": "DL-6000", "name": "Lamp Again", "price": 5, "category": "Home"}
+{"sku": "BAD SKU", "name": "", "price": -1, "category": "Home"}
+{"sku": "XX-1", "name": "Broken",
+{"sku": "XX-2", "name": "Extra", "price": 5, "category": "Home", "colour": "red"}
+`
+	rr := importProducts(srv, "", "application/x-ndjson", body)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %v: %s", rr.Code, rr.Body)
+	}
+	report := decodeReport(t, rr)
+	if report.Created != 1 || report.Failed != 5 {
+		t.Errorf("unexpected totals %+v", report)
+	}
+	for _, want := range []struct {
+		line     int
+		fragment string
+	}{
+		{2, "sku is required"},
+		{3, "duplicate sku"},
+		{4, "sku may only contain"},
+		{4, "name is required"},
+		{4, "price must be greater than zero"},
+		{5, "unexpected EOF"},
+		{6, `unknown field "colour"`},
+	} {
+		row := report.Rows[want.line-1]
+		if row.Line != want.line || row.Action != ImportError || !strings.Contains(strings.Join(row.Errors, "; "), want.fragment) {
+			t.Errorf("expected line %d to fail with %q, got %+v", want.line, want.fragment, row)
+		}
+	}
+
+	// One bad row keeps the whole file out
+	if _, err := srv.store.GetProductBySKU(context.Background(), "DL-6000"); err == nil {
+		t.Error("expected no product saved from a file with errors")
+	}
+
+	// A CSV header problem is reported on line 1
+	report = decodeReport(t, importProducts(srv, "?format=csv", "text/plain", "sku,name,price\nA-1,Thing,5\n"))
+	if len(report.Rows) != 1 || report.Rows[0].Line != 1 || !strings.Contains(report.Rows[0].Errors[0], "category") {
+		t.Errorf("expected a missing column error on line 1, got %+v", report.Rows)
+	}
+}
+
+func TestImportRequestErrors(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+
+	testCases := []struct {
+		name        string
+		query       string
+		contentType string
+		code        int
+	}{
+		{"unknown content type", "", "application/json", http.StatusUnsupportedMediaType},
+		{"unknown format", "?format=xml", "text/csv", http.StatusUnsupportedMediaType},
+		{"bad dry_run", "?dry_run=maybe", "text/csv", http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		if rr := importProducts(srv, tc.query, tc.contentType, importCSV); rr.Code != tc.code {
+			t.Errorf("%s: expected %v, got %v: %s", tc.name, tc.code, rr.Code, rr.Body)
+		}
+	}
+
+	req, _ := http.NewRequest("POST", "/api/admin/products/import", strings.NewReader(importCSV))
+	req.Header.Set("Content-Type", "text/csv")
+	rr := httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without the admin token, got %v", rr.Code)
+	}
+}
+
+func TestExportProducts(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+	if rr := adminRequest(srv, "DELETE", "/api/products/5", nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("delete failed: got %v", rr.Code)
+	}
+
+	rr := adminRequest(srv, "GET", "/api/admin/products/export", nil)
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/csv") {
+		t.Fatalf("expected a CSV export, got %v %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 5 || strings.Join(records[0], ",") != "id,sku,name,description,price,currency,image,category,stock" {
+		t.Fatalf("expected a header and the 4 products on sale, got %v", records)
+	}
+	if got := strings.Join(records[1][:6], ","); got != "1,WH-1000,Wireless Headphones,High-quality wireless headphones with noise cancellation,99.99,USD" {
+		t.Errorf("unexpected first row %q", got)
+	}
+
+	rr = adminRequest(srv, "GET", "/api/admin/products/export?format=ndjson", nil)
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	if rr.Code != http.StatusOK || len(lines) != 4 {
+		t.Fatalf("expected 4 NDJSON lines, got %v: %s", rr.Code, rr.Body)
+	}
+
+	// An export imports back without changes
+	for _, export := range []struct{ format, contentType string }{
+		{FormatCSV, "text/csv"},
+		{FormatNDJSON, "application/x-ndjson"},
+	} {
+		body := adminRequest(srv, "GET", "/api/admin/products/export?format="+export.format, nil).Body.String()
+		report := decodeReport(t, importProducts(srv, "?dry_run=true", export.contentType, body))
+		if report.Unchanged != 4 || report.Failed != 0 {
+			t.Errorf("%s: expected the export to import back unchanged, got %+v", export.format, report)
+		}
+	}
+
+	if rr := adminRequest(srv, "GET", "/api/admin/products/export?format=xml", nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown format, got %v", rr.Code)
+	}
+}
+
+func TestExportSpansPages(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+	ctx := context.Background()
+	for i := 0; i < MaxPageLimit; i++ {
+		p := Product{Name: "Widget", Price: NewMoney(100, DefaultCurrency), Category: "Widgets"}
+		if _, err := srv.store.CreateProduct(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rr := adminRequest(srv, "GET", "/api/admin/products/export?format=ndjson", nil)
+	if n := bytes.Count(rr.Body.Bytes(), []byte("\n")); n != MaxPageLimit+5 {
+		t.Errorf("expected %d products exported, got %d", MaxPageLimit+5, n)
+	}
+}
+
+func TestImportSavesAllRowsOrNone(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+	ctx := context.Background()
+	if _, err := srv.store.CreateProduct(ctx, Product{
+		SKU: "TS-100", Name: "T-Shirt", Price: NewMoney(1999, DefaultCurrency), Category: "Clothing",
+		Variants: []Variant{{SKU: "TS-100-RED", Options: map[string]string{"color": "red"}, Stock: 5}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second row takes a variant's SKU, which only saving finds out;
+	// the first row is not saved either
+	rr := importProducts(srv, "", "text/csv", "sku,name,price,category\nWH-1000,Wireless Headphones,89.99,Electronics\nTS-100-RED,Red Shirt,19.99,Clothing\n")
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %v: %s", rr.Code, rr.Body)
+	}
+	report := decodeReport(t, rr)
+	if report.Failed != 1 || report.Rows[1].Action != ImportError || len(report.Rows[1].Errors) == 0 {
+		t.Errorf("expected the shirt row to fail, got %+v", report)
+	}
+	if p, _ := srv.store.GetProduct(ctx, 1); p.Price != NewMoney(9999, DefaultCurrency) {
+		t.Errorf("expected product 1 unchanged, got %+v", p.Price)
+	}
+	if _, err := srv.store.GetProductBySKU(ctx, "TS-100-RED"); err == nil {
+		t.Error("expected no product created")
+	}
+}
+
+func TestImportChecksReservationsWhenSaving(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+	ctx := context.Background()
+
+	report, err := srv.planImport(ctx, FormatCSV, []byte("sku,name,price,category,stock\nWH-1000,Wireless Headphones,89.99,Electronics,1\nDL-6000,Desk Lamp,34.99,Home,3\n"))
+	if err != nil || report.Failed != 0 {
+		t.Fatalf("expected a clean plan, got %+v, %v", report, err)
+	}
+
+	// An order reserves more headphones than the file leaves in stock
+	// after the plan was made
+	createTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 2})
+
+	if err := srv.applyImport(ctx, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Failed != 1 || report.Rows[0].Action != ImportError {
+		t.Fatalf("expected the headphones row to fail, got %+v", report)
+	}
+	if p, _ := srv.store.GetProduct(ctx, 1); p.Stock == 1 || p.Price != NewMoney(9999, DefaultCurrency) {
+		t.Errorf("expected product 1 unchanged, got %+v", p)
+	}
+	if _, err := srv.store.GetProductBySKU(ctx, "DL-6000"); err == nil {
+		t.Error("expected the lamp not to be created")
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeCatalog writes a catalog file named name into a temporary directory
+func writeCatalog(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadCatalogFormatsAgree(t *testing.T) {
+	t.Parallel()
+	fromJSON := testCatalog(t)
+	fromCSV, err := LoadCatalog("testdata/catalog.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromJSON, fromCSV) {
+		t.Errorf("JSON and CSV catalogs differ:\n%+v\n%+v", fromJSON, fromCSV)
+	}
+	if len(fromJSON) != 5 || fromJSON[0].Price != NewMoney(9999, DefaultCurrency) {
+		t.Errorf("unexpected catalog %+v", fromJSON)
+	}
+}
+
+func TestLoadCatalogShippedFile(t *testing.T) {
+	t.Parallel()
+	products, err := LoadCatalog(DefaultCatalogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(products) == 0 {
+		t.Error("expected the shipped catalog to have products")
+	}
+}
+
+func TestLoadCatalogCurrency(t *testing.T) {
+	t.Parallel()
+	path := writeCatalog(t, "yen.csv", "id,name,price,currency,category\n1,Teapot,1500,jpy,Kitchen\n")
+	products, err := LoadCatalog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if products[0].Price != NewMoney(1500, "JPY") {
+		t.Errorf("expected 1500 JPY, got %s", products[0].Price)
+	}
+}
+
+func TestLoadCatalogErrors(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name    string
+		file    string
+		content string
+		// want holds the expected line of each error and a fragment of it
+		want map[int]string
+	}{
+		{
+			name: "json invalid fields",
+			file: "catalog.json",
+			content: `[
+  {"id": 1, "name": "Mug", "price": 5, "category": "Kitchen"},
+  {"id": 1, "name": "", "price": -1, "category": "Kitchen"},
+  {"id": 2, "name": "Pan", "price": "abc", "category": "Kitchen",
+   "image": "ftp://example.com/pan.png"}
+]`,
+			want: map[int]string{3: "duplicate product id 1", 4: "image"},
+		},
+		{
+			name: "json unknown field",
+			file: "catalog.json",
+			content: `[
+  {"id": 1, "name": "Mug", "price": 5, "category": "Kitchen"},
+  {"id": 2, "name": "Pan", "price": 5, "colour": "red", "category": "Kitchen"}
+]`,
+			want: map[int]string{3: `unknown field "colour"`},
+		},
+		{
+			name: "json wrong type",
+			file: "catalog.json",
+			content: `[
+  {"id": 1, "name": "Mug",
+   "price": 5, "category": ["Kitchen"]}
+]`,
+			want: map[int]string{3: "category must be a string"},
+		},
+		{
+			name:    "json syntax",
+			file:    "catalog.json",
+			content: "[\n  {\"id\": 1,\n  \"name\": }\n]",
+			want:    map[int]string{3: "invalid character"},
+		},
+		{
+			name:    "json not an array",
+			file:    "catalog.json",
+			content: `{"id": 1}`,
+			want:    map[int]string{1: "JSON array"},
+		},
+		{
+			name:    "empty",
+			file:    "catalog.json",
+			content: "[]",
+			want:    map[int]string{1: "no products"},
+		},
+		{
+			name:    "csv missing column",
+			file:    "catalog.csv",
+			content: "id,name,price,colour\n1,Mug,5,red\n",
+			want:    map[int]string{1: `missing column "category"`},
+		},
+		{
+			name:    "csv bad rows",
+			file:    "catalog.csv",
+			content: "id,name,price,category\n1,Mug,5,Kitchen\nx,Pan,5,Kitchen\n3,Pot,,Kitchen\n4,Lid,5\n",
+			want:    map[int]string{3: "id", 4: "price", 5: "wrong number of fields"},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			path := writeCatalog(t, tc.file, tc.content)
+			_, err := LoadCatalog(path)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for line, fragment := range tc.want {
+				if !hasCatalogError(err, line, fragment) {
+					t.Errorf("expected an error on line %d mentioning %q, got:\n%v", line, fragment, err)
+				}
+			}
+			if !strings.HasPrefix(err.Error(), path+":") {
+				t.Errorf("expected errors prefixed with the path, got %v", err)
+			}
+		})
+	}
+}
+
+// hasCatalogError reports whether err joins a CatalogError on line whose
+// message contains fragment
+func hasCatalogError(err error, line int, fragment string) bool {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return false
+	}
+	for _, err := range joined.Unwrap() {
+		var cerr *CatalogError
+		if errors.As(err, &cerr) && cerr.Line == line && strings.Contains(cerr.Message, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLoadCatalogUnsupportedFormat(t *testing.T) {
+	t.Parallel()
+	if _, err := LoadCatalog(writeCatalog(t, "catalog.yaml", "- id: 1\n")); err == nil {
+		t.Error("expected an error for a YAML catalog")
+	}
+	if _, err := LoadCatalog(filepath.Join(t.TempDir(), "missing.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected a not-exist error, got %v", err)
+	}
+}
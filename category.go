@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Errors returned by the category methods of Store implementations
+var (
+	ErrCategoryNotFound  = errors.New("category not found")
+	ErrDuplicateCategory = errors.New("another category already has this name or slug")
+	ErrCategoryInUse     = errors.New("category still has subcategories or products on sale")
+	ErrParentNotFound    = errors.New("parent category not found")
+	ErrCategoryCycle     = errors.New("a category cannot be moved under itself or its subcategories")
+)
+
+// Category groups products for browsing. Categories form a tree: each has
+// at most one parent, and products name the category they are in.
+type Category struct {
+	ID   int    `json:"id"`
+	Slug string `json:"slug"`
+	// Name is what products put in their category field
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// ParentID is 0 for top-level categories
+	ParentID int `json:"parent_id,omitempty"`
+}
+
+// CategoryNode is a category with its subcategories, as served by
+// GET /api/categories
+type CategoryNode struct {
+	Category
+	Children []CategoryNode `json:"children"`
+}
+
+// slugify turns a category name into a slug: lower case letters and
+// digits, with a dash for each run of anything else
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		default:
+			dash = true
+		}
+	}
+	if b.Len() == 0 {
+		return "category"
+	}
+	return b.String()
+}
+
+// uniqueSlug returns the slug of name, numbered if taken reports another
+// category already has it
+func uniqueSlug(name string, taken func(slug string) bool) string {
+	base := slugify(name)
+	slug := base
+	for n := 2; taken(slug); n++ {
+		slug = fmt.Sprintf("%s-%d", base, n)
+	}
+	return slug
+}
+
+// categoryTaken reports whether a category other than c has its name or
+// slug
+func categoryTaken(categories []Category, c Category) bool {
+	for _, other := range categories {
+		if other.ID != c.ID && (other.Name == c.Name || other.Slug == c.Slug) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCategory checks that c would still leave categories a tree: its
+// parent exists and is not c or one of c's subcategories
+func checkCategory(categories []Category, c Category) error {
+	parents := map[int]int{}
+	for _, other := range categories {
+		parents[other.ID] = other.ParentID
+	}
+	if c.ParentID == 0 {
+		return nil
+	}
+	if _, ok := parents[c.ParentID]; !ok {
+		return fmt.Errorf("%w: %d", ErrParentNotFound, c.ParentID)
+	}
+	for id := c.ParentID; id != 0; id = parents[id] {
+		if id == c.ID {
+			return ErrCategoryCycle
+		}
+	}
+	return nil
+}
+
+// categoryTree arranges the categories under parentID, 0 for the top
+// level, into trees, each level in name order
+func categoryTree(categories []Category, parentID int) []CategoryNode {
+	children := map[int][]Category{}
+	for _, c := range categories {
+		children[c.ParentID] = append(children[c.ParentID], c)
+	}
+	var build func(parentID int) []CategoryNode
+	build = func(parentID int) []CategoryNode {
+		level := children[parentID]
+		sort.Slice(level, func(i, j int) bool { return level[i].Name < level[j].Name })
+		nodes := make([]CategoryNode, len(level))
+		for i, c := range level {
+			nodes[i] = CategoryNode{Category: c, Children: build(c.ID)}
+		}
+		return nodes
+	}
+	return build(parentID)
+}
+
+// findCategory returns the category with the given slug
+func findCategory(categories []Category, slug string) (Category, error) {
+	for _, c := range categories {
+		if c.Slug == slug {
+			return c, nil
+		}
+	}
+	return Category{}, ErrCategoryNotFound
+}
+
+// findCategoryByID returns the category with the given ID
+func findCategoryByID(categories []Category, id int) (Category, error) {
+	for _, c := range categories {
+		if c.ID == id {
+			return c, nil
+		}
+	}
+	return Category{}, ErrCategoryNotFound
+}
+
+// withDescendants returns the names of the categories named or slugged by
+// values and of all their subcategories. Values that match no category are
+// kept as they are, so they still match products by name.
+func withDescendants(categories []Category, values []string) []string {
+	children := map[int][]Category{}
+	for _, c := range categories {
+		children[c.ParentID] = append(children[c.ParentID], c)
+	}
+
+	var names []string
+	seen := map[string]bool{}
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	var walk func(c Category)
+	walk = func(c Category) {
+		add(c.Name)
+		for _, child := range children[c.ID] {
+			walk(child)
+		}
+	}
+
+	for _, v := range values {
+		found := false
+		for _, c := range categories {
+			if c.Name == v || c.Slug == v {
+				walk(c)
+				found = true
+				break
+			}
+		}
+		if !found {
+			add(v)
+		}
+	}
+	return names
+}
+
+// expandCategories widens a product filter's categories to their
+// subcategories, so browsing a category lists everything under it
+func (s *Server) expandCategories(ctx context.Context, filter ProductFilter) (ProductFilter, error) {
+	if len(filter.Categories) == 0 {
+		return filter, nil
+	}
+	categories, err := s.store.ListCategories(ctx)
+	if err != nil {
+		return ProductFilter{}, err
+	}
+	filter.Categories = withDescendants(categories, filter.Categories)
+	return filter, nil
+}
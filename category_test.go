@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// getCategory fetches a category by slug, with its subcategories
+func getCategory(t *testing.T, srv *Server, slug string) CategoryNode {
+	t.Helper()
+	req, _ := http.NewRequest("GET", "/api/categories/"+slug, nil)
+	rr := httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rr, req)
+	var node CategoryNode
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &node) != nil {
+		t.Fatalf("GET category %s: got %v: %s", slug, rr.Code, rr.Body)
+	}
+	return node
+}
+
+// createCategory adds a category through the admin API
+func createCategory(t *testing.T, srv *Server, c Category) Category {
+	t.Helper()
+	rr := adminRequest(srv, "POST", "/api/categories", c)
+	var created Category
+	if rr.Code != http.StatusCreated || json.Unmarshal(rr.Body.Bytes(), &created) != nil {
+		t.Fatalf("create category %s: got %v: %s", c.Name, rr.Code, rr.Body)
+	}
+	return created
+}
+
+func TestGetCategoriesTree(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+	electronics := getCategory(t, srv, "electronics")
+	audio := createCategory(t, srv, Category{Name: "Audio", Description: "Sound at home and on the go", ParentID: electronics.ID})
+	createCategory(t, srv, Category{Name: "Wearables", ParentID: electronics.ID})
+	createCategory(t, srv, Category{Name: "Earbuds", Slug: "in-ear", ParentID: audio.ID})
+	if audio.Slug != "audio" {
+		t.Errorf("expected the slug made from the name, got %q", audio.Slug)
+	}
+
+	req, _ := http.NewRequest("GET", "/api/categories", nil)
+	rr := httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rr, req)
+	var tree []CategoryNode
+	if err := json.Unmarshal(rr.Body.Bytes(), &tree); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("expected the tree, got %v: %s", rr.Code, rr.Body)
+	}
+
+	var names []string
+	var walk func(nodes []CategoryNode, depth int)
+	walk = func(nodes []CategoryNode, depth int) {
+		for _, n := range nodes {
+			names = append(names, fmt.Sprintf("%d:%s", depth, n.Name))
+			walk(n.Children, depth+1)
+		}
+	}
+	walk(tree, 0)
+	expected := "[0:Accessories 0:Electronics 1:Audio 2:Earbuds 1:Wearables 0:Kitchen 0:Sports]"
+	if fmt.Sprint(names) != expected {
+		t.Errorf("expected %s, got %v", expected, names)
+	}
+
+	node := getCategory(t, srv, "audio")
+	if node.Description != "Sound at home and on the go" || len(node.Children) != 1 || node.Children[0].Slug != "in-ear" {
+		t.Errorf("expected audio with its subcategory, got %+v", node)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/categories/garden", nil)
+	rr = httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown slug, got %v", rr.Code)
+	}
+}
+
+func TestGetProductsIncludesSubcategories(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+	electronics := getCategory(t, srv, "electronics")
+	audio := createCategory(t, srv, Category{Name: "Audio", ParentID: electronics.ID})
+	createCategory(t, srv, Category{Name: "Earbuds", ParentID: audio.ID})
+	if rr := adminRequest(srv, "PATCH", "/api/products/1", map[string]string{"category": "Earbuds"}); rr.Code != http.StatusOK {
+		t.Fatalf("moving product 1 failed: %v: %s", rr.Code, rr.Body)
+	}
+
+	testCases := []struct {
+		query    string
+		expected []int
+	}{
+		{"?category=Electronics", []int{1, 2}},
+		{"?category=audio", []int{1}},
+		{"?category=Earbuds", []int{1}},
+		{"?category=Kitchen&category=audio", []int{1, 3}},
+	}
+	for _, tc := range testCases {
+		req, _ := http.NewRequest("GET", "/api/products"+tc.query, nil)
+		rr := httptest.NewRecorder()
+		srv.GetProducts(rr, req)
+		var products []Product
+		json.Unmarshal(rr.Body.Bytes(), &products)
+		var got []int
+		for _, p := range products {
+			got = append(got, p.ID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.expected) {
+			t.Errorf("%q: expected products %v, got %v", tc.query, tc.expected, got)
+		}
+	}
+}
+
+func TestAdminCategories(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+	electronics := getCategory(t, srv, "electronics")
+	audio := createCategory(t, srv, Category{Name: "Audio", ParentID: electronics.ID})
+
+	testCases := []struct {
+		name   string
+		method string
+		path   string
+		body   any
+		code   int
+	}{
+		{"no name", "POST", "/api/categories", Category{}, http.StatusUnprocessableEntity},
+		{"bad slug", "POST", "/api/categories", Category{Name: "Toys", Slug: "Toys!"}, http.StatusUnprocessableEntity},
+		{"unknown parent", "POST", "/api/categories", Category{Name: "Toys", ParentID: 999}, http.StatusUnprocessableEntity},
+		{"duplicate name", "POST", "/api/categories", Category{Name: "Kitchen", Slug: "cooking"}, http.StatusConflict},
+		{"moved under itself", "PUT", "/api/categories/electronics", Category{Name: "Electronics", ParentID: audio.ID}, http.StatusUnprocessableEntity},
+		{"unknown category", "PUT", "/api/categories/garden", Category{Name: "Garden"}, http.StatusNotFound},
+		{"delete with subcategories", "DELETE", "/api/categories/electronics", nil, http.StatusConflict},
+		{"delete with products", "DELETE", "/api/categories/kitchen", nil, http.StatusConflict},
+		{"delete", "DELETE", "/api/categories/audio", nil, http.StatusNoContent},
+	}
+	for _, tc := range testCases {
+		if rr := adminRequest(srv, tc.method, tc.path, tc.body); rr.Code != tc.code {
+			t.Errorf("%s: expected %v, got %v: %s", tc.name, tc.code, rr.Code, rr.Body)
+		}
+	}
+
+	// Renaming a category renames it on its products, and search follows
+	if rr := searchProducts(srv, "q=kitchen"); rr.Code != http.StatusOK {
+		t.Fatalf("search failed: %v", rr.Code)
+	}
+	rr := adminRequest(srv, "PUT", "/api/categories/kitchen", Category{Name: "Home & Kitchen", Description: "Appliances"})
+	var renamed Category
+	json.Unmarshal(rr.Body.Bytes(), &renamed)
+	if rr.Code != http.StatusOK || renamed.Slug != "home-kitchen" {
+		t.Fatalf("expected the category renamed, got %v: %s", rr.Code, rr.Body)
+	}
+	if p, _ := srv.store.GetProduct(context.Background(), 3); p.Category != "Home & Kitchen" {
+		t.Errorf("expected product 3 in the renamed category, got %q", p.Category)
+	}
+	if ids := searchIDs(t, srv, "home"); fmt.Sprint(ids) != "[3]" {
+		t.Errorf("expected search to find product 3 by its new category, got %v", ids)
+	}
+}
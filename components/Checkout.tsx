@@ -49,7 +49,18 @@ export default function Checkout({
           'Content-Type': 'application/json',
         },
         body: JSON.stringify({
-          items: cart
+          items: cart,
+          customer: {
+            name: customerInfo.name,
+            email: customerInfo.email
+          },
+          shipping_address: {
+            name: customerInfo.name,
+            line1: customerInfo.address,
+            city: customerInfo.city,
+            postal_code: customerInfo.zipCode,
+            country: 'US'
+          }
         })
       })
 
@@ -64,10 +75,12 @@ export default function Checkout({
         method: 'POST',
         headers: {
           'Content-Type': 'application/json',
+          'X-Order-Token': order.access_token,
         },
         body: JSON.stringify({
           order_id: order.id,
-          amount: total
+          amount: order.total,
+          card_number: customerInfo.cardNumber.replace(/\s+/g, '')
         })
       })
 
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// DefaultCountry is the country of addresses that do not name one
+const DefaultCountry = "US"
+
+// Limits on customer fields
+const (
+	maxCustomerFieldLength = 200
+	maxPostalCodeLength    = 10
+)
+
+// Customer is who placed an order and how to reach them
+type Customer struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	Phone string `json:"phone,omitempty"`
+}
+
+// Address is a postal address. Country is an ISO 3166-1 alpha-2 code.
+type Address struct {
+	Name       string `json:"name"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city"`
+	Region     string `json:"region,omitempty"`
+	PostalCode string `json:"postal_code"`
+	Country    string `json:"country"`
+}
+
+// OrderContact is who placed an order and where it goes. Orders placed
+// without any of it, as API clients did before, have none.
+type OrderContact struct {
+	// AccountID is the account signed in when the order was placed, 0 for
+	// guests. It is never read from requests.
+	AccountID int `json:"account_id,omitempty"`
+	// AccessTokenHash is the hash of the token that opens a guest order;
+	// see OrderTokenHeader. Orders of an account have none.
+	AccessTokenHash string    `json:"-"`
+	Customer        *Customer `json:"customer,omitempty"`
+	ShippingAddress *Address  `json:"shipping_address,omitempty"`
+	// BillingAddress is the shipping address unless given
+	BillingAddress *Address `json:"billing_address,omitempty"`
+}
+
+// empty reports whether no contact details were given
+func (c OrderContact) empty() bool {
+	return c.Customer == nil && c.ShippingAddress == nil && c.BillingAddress == nil
+}
+
+// clone returns contact details that share nothing with c
+func (c OrderContact) clone() OrderContact {
+	if c.Customer != nil {
+		customer := *c.Customer
+		c.Customer = &customer
+	}
+	if c.ShippingAddress != nil {
+		shipping := *c.ShippingAddress
+		c.ShippingAddress = &shipping
+	}
+	if c.BillingAddress != nil {
+		billing := *c.BillingAddress
+		c.BillingAddress = &billing
+	}
+	return c
+}
+
+// postalCodePatterns are the postal code formats of the countries the shop
+// ships to most, matched after normalizeContact upper-cases the code.
+// Other countries only need a code of reasonable length.
+var postalCodePatterns = map[string]*regexp.Regexp{
+	"US": regexp.MustCompile(`^\d{5}(-\d{4})?$`),
+	"CA": regexp.MustCompile(`^[A-Z]\d[A-Z] ?\d[A-Z]\d$`),
+	"GB": regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`),
+	"DE": regexp.MustCompile(`^\d{5}$`),
+	"FR": regexp.MustCompile(`^\d{5}$`),
+	"ES": regexp.MustCompile(`^\d{5}$`),
+	"IT": regexp.MustCompile(`^\d{5}$`),
+	"NL": regexp.MustCompile(`^\d{4} ?[A-Z]{2}$`),
+	"AU": regexp.MustCompile(`^\d{4}$`),
+	"JP": regexp.MustCompile(`^\d{3}-?\d{4}$`),
+	"IN": regexp.MustCompile(`^\d{6}$`),
+	"BR": regexp.MustCompile(`^\d{5}-?\d{3}$`),
+}
+
+// countryPattern matches ISO 3166-1 alpha-2 codes
+var countryPattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// normalizeContact trims the contact details, upper-cases country and
+// postal codes, fills in DefaultCountry and bills to the shipping address
+// when no billing address is given
+func normalizeContact(c OrderContact) OrderContact {
+	c = c.clone()
+	if c.Customer != nil {
+		c.Customer.Name = strings.TrimSpace(c.Customer.Name)
+		c.Customer.Email = strings.TrimSpace(c.Customer.Email)
+		c.Customer.Phone = strings.TrimSpace(c.Customer.Phone)
+	}
+	for _, a := range []*Address{c.ShippingAddress, c.BillingAddress} {
+		if a == nil {
+			continue
+		}
+		for _, field := range []*string{&a.Name, &a.Line1, &a.Line2, &a.City, &a.Region, &a.PostalCode, &a.Country} {
+			*field = strings.TrimSpace(*field)
+		}
+		a.PostalCode = strings.ToUpper(a.PostalCode)
+		a.Country = strings.ToUpper(a.Country)
+		if a.Country == "" {
+			a.Country = DefaultCountry
+		}
+	}
+	if c.BillingAddress == nil && c.ShippingAddress != nil {
+		billing := *c.ShippingAddress
+		c.BillingAddress = &billing
+	}
+	return c
+}
+
+// validateContact checks normalized contact details and returns a
+// *ValidationError listing all problems found. Orders may come without
+// any, but once given they need a customer and a shipping address.
+func validateContact(c OrderContact) error {
+	if c.empty() {
+		return nil
+	}
+	verr := &ValidationError{Message: "invalid customer details"}
+	add := func(field, message string) {
+		verr.Fields = append(verr.Fields, FieldError{Field: field, Message: message})
+	}
+	tooLong := func(field, value string) bool {
+		if len(value) > maxCustomerFieldLength {
+			add(field, fmt.Sprintf("must be at most %d characters", maxCustomerFieldLength))
+			return true
+		}
+		return false
+	}
+	required := func(field, value string) bool {
+		if value == "" {
+			add(field, "is required")
+			return false
+		}
+		return !tooLong(field, value)
+	}
+	address := func(prefix string, a Address) {
+		required(prefix+".name", a.Name)
+		required(prefix+".line1", a.Line1)
+		tooLong(prefix+".line2", a.Line2)
+		required(prefix+".city", a.City)
+		tooLong(prefix+".region", a.Region)
+
+		if !countryPattern.MatchString(a.Country) {
+			add(prefix+".country", "must be a two-letter ISO 3166 country code")
+			return
+		}
+		switch pattern := postalCodePatterns[a.Country]; {
+		case a.PostalCode == "":
+			add(prefix+".postal_code", "is required")
+		case pattern != nil && !pattern.MatchString(a.PostalCode):
+			add(prefix+".postal_code", fmt.Sprintf("is not a valid postal code for %s", a.Country))
+		case len(a.PostalCode) > maxPostalCodeLength:
+			add(prefix+".postal_code", fmt.Sprintf("must be at most %d characters", maxPostalCodeLength))
+		}
+	}
+
+	if c.Customer == nil {
+		add("customer", "is required")
+	} else {
+		required("customer.name", c.Customer.Name)
+		if required("customer.email", c.Customer.Email) && !validEmail(c.Customer.Email) {
+			add("customer.email", "must be an email address such as name@example.com")
+		}
+		tooLong("customer.phone", c.Customer.Phone)
+	}
+
+	if c.ShippingAddress == nil {
+		add("shipping_address", "is required")
+	} else {
+		address("shipping_address", *c.ShippingAddress)
+	}
+	// A billing address copied from the shipping address was checked as that
+	if c.BillingAddress != nil && (c.ShippingAddress == nil || *c.BillingAddress != *c.ShippingAddress) {
+		address("billing_address", *c.BillingAddress)
+	}
+
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// validEmail reports whether s is a bare email address with a dotted
+// domain, as mail can be delivered to
+func validEmail(s string) bool {
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Address != s {
+		return false
+	}
+	at := strings.LastIndexByte(s, '@')
+	domain := s[at+1:]
+	return strings.Contains(domain, ".") && !strings.HasPrefix(domain, ".") && !strings.HasSuffix(domain, ".")
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testContact returns complete contact details for an order shipped to
+// the US
+func testContact() OrderContact {
+	return OrderContact{
+		Customer:        &Customer{Name: "Jane Doe", Email: "jane@example.com"},
+		ShippingAddress: &Address{Name: "Jane Doe", Line1: "1 Main St", City: "Springfield", PostalCode: "62701"},
+	}
+}
+
+func TestCreateOrderWithCustomer(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+
+	contact := testContact()
+	contact.Customer.Email = " jane@example.com "
+	contact.ShippingAddress.PostalCode = "62701-1234"
+	order := createTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 1})
+	jsonData, _ := json.Marshal(Order{Items: []OrderItem{{ProductID: 2, Quantity: 1}}, OrderContact: contact})
+	req, _ := http.NewRequest("POST", "/api/orders", bytes.NewBuffer(jsonData))
+	rr := httptest.NewRecorder()
+	srv.CreateOrder(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected the order placed, got %v: %s", rr.Code, rr.Body)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/orders", nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	rr = httptest.NewRecorder()
+	srv.GetOrders(rr, req)
+	var orders []Order
+	if err := json.Unmarshal(rr.Body.Bytes(), &orders); err != nil || len(orders) != 2 {
+		t.Fatalf("expected both orders, got %v: %s", rr.Code, rr.Body)
+	}
+	if orders[0].ID != order.ID || !orders[0].empty() {
+		t.Errorf("expected the first order without contact details, got %+v", orders[0].OrderContact)
+	}
+
+	got := orders[1]
+	if got.Customer == nil || got.Customer.Email != "jane@example.com" || got.Customer.Name != "Jane Doe" {
+		t.Errorf("expected the trimmed customer, got %+v", got.Customer)
+	}
+	shipping := Address{Name: "Jane Doe", Line1: "1 Main St", City: "Springfield", PostalCode: "62701-1234", Country: DefaultCountry}
+	if got.ShippingAddress == nil || *got.ShippingAddress != shipping {
+		t.Errorf("expected shipping to %+v, got %+v", shipping, got.ShippingAddress)
+	}
+	if got.BillingAddress == nil || *got.BillingAddress != shipping {
+		t.Errorf("expected billing to the shipping address, got %+v", got.BillingAddress)
+	}
+}
+
+func TestCreateOrderValidatesCustomer(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	testCases := []struct {
+		name   string
+		change func(c *OrderContact)
+		field  string
+	}{
+		{"no customer", func(c *OrderContact) { c.Customer = nil }, "customer"},
+		{"no name", func(c *OrderContact) { c.Customer.Name = " " }, "customer.name"},
+		{"no email", func(c *OrderContact) { c.Customer.Email = "" }, "customer.email"},
+		{"email without domain", func(c *OrderContact) { c.Customer.Email = "jane@" }, "customer.email"},
+		{"email with a display name", func(c *OrderContact) { c.Customer.Email = "Jane <jane@example.com>" }, "customer.email"},
+		{"email without a dotted domain", func(c *OrderContact) { c.Customer.Email = "jane@localhost" }, "customer.email"},
+		{"no shipping address", func(c *OrderContact) { c.ShippingAddress = nil }, "shipping_address"},
+		{"no street", func(c *OrderContact) { c.ShippingAddress.Line1 = "" }, "shipping_address.line1"},
+		{"no city", func(c *OrderContact) { c.ShippingAddress.City = "" }, "shipping_address.city"},
+		{"bad ZIP code", func(c *OrderContact) { c.ShippingAddress.PostalCode = "6270" }, "shipping_address.postal_code"},
+		{"US ZIP code in Canada", func(c *OrderContact) { c.ShippingAddress.Country = "ca" }, "shipping_address.postal_code"},
+		{"bad country", func(c *OrderContact) { c.ShippingAddress.Country = "USA" }, "shipping_address.country"},
+		{"bad billing postcode", func(c *OrderContact) {
+			c.BillingAddress = &Address{Name: "Jane Doe", Line1: "10 Downing St", City: "London", PostalCode: "SW1A", Country: "GB"}
+		}, "billing_address.postal_code"},
+	}
+
+	for _, tc := range testCases {
+		contact := testContact()
+		tc.change(&contact)
+		jsonData, _ := json.Marshal(Order{Items: []OrderItem{{ProductID: 1, Quantity: 1}}, OrderContact: contact})
+		req, _ := http.NewRequest("POST", "/api/orders", bytes.NewBuffer(jsonData))
+		rr := httptest.NewRecorder()
+		srv.CreateOrder(rr, req)
+		if rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: expected 422, got %v: %s", tc.name, rr.Code, rr.Body)
+			continue
+		}
+		var verr ValidationError
+		json.Unmarshal(rr.Body.Bytes(), &verr)
+		if len(verr.Fields) != 1 || verr.Fields[0].Field != tc.field {
+			t.Errorf("%s: expected an error on %s, got %+v", tc.name, tc.field, verr.Fields)
+		}
+	}
+
+	// Postal codes are checked in the format of their country
+	for _, a := range []Address{
+		{PostalCode: "k1a 0b1", Country: "CA"},
+		{PostalCode: "SW1A 2AA", Country: "GB"},
+		{PostalCode: "1012 JS", Country: "NL"},
+		{PostalCode: "00-950", Country: "PL"},
+	} {
+		contact := testContact()
+		contact.ShippingAddress.PostalCode, contact.ShippingAddress.Country = a.PostalCode, a.Country
+		if err := validateContact(normalizeContact(contact)); err != nil {
+			t.Errorf("expected %s in %s accepted, got %v", a.PostalCode, a.Country, err)
+		}
+	}
+}
+
+func TestCheckoutCartWithCustomer(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+	cart := cartRequest(t, srv, "POST", "/api/carts", map[string]any{
+		"items": []CartItem{{ProductID: 1, Quantity: 1}},
+	}, http.StatusCreated)
+
+	invalid := testContact()
+	invalid.Customer.Email = "not an email"
+	cartRequest(t, srv, "POST", "/api/carts/"+cart.ID+"/checkout", invalid, http.StatusUnprocessableEntity)
+
+	rr := customerRequest(srv, "POST", "/api/carts/"+cart.ID+"/checkout", testContact(), "")
+	var order Order
+	if rr.Code != http.StatusCreated || json.Unmarshal(rr.Body.Bytes(), &order) != nil {
+		t.Fatalf("checkout failed: %v: %s", rr.Code, rr.Body)
+	}
+	if order.Customer == nil || order.Customer.Email != "jane@example.com" || order.BillingAddress == nil {
+		t.Errorf("expected the order placed with the contact details, got %+v", order.OrderContact)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Card numbers that make FakeGateway fail; any other number is approved
+const (
+	FakeCardDeclined          = "4000000000000002"
+	FakeCardInsufficientFunds = "4000000000009995"
+	FakeCardTimeout           = "4000000000000119"
+)
+
+// fakeAuthorization tracks the lifecycle of one FakeGateway authorization
+type fakeAuthorization struct {
+	orderID  int
+	amount   Money
+	captured bool
+	voided   bool
+	refunded Money
+}
+
+// FakeGateway is a deterministic in-process PaymentGateway for tests and
+// local development. It never contacts a provider; the card number decides
+// the outcome of Authorize.
+type FakeGateway struct {
+	mu             sync.Mutex
+	authorizations map[string]*fakeAuthorization
+	// refunds maps authorization IDs and idempotency keys to the refunds
+	// made with them
+	refunds map[string]string
+	nextID  int
+}
+
+// NewFakeGateway creates an empty fake gateway
+func NewFakeGateway() *FakeGateway {
+	return &FakeGateway{
+		authorizations: map[string]*fakeAuthorization{},
+		refunds:        map[string]string{},
+		nextID:         1,
+	}
+}
+
+func (g *FakeGateway) Authorize(ctx context.Context, req ChargeRequest) (Authorization, error) {
+	switch req.CardNumber {
+	case FakeCardDeclined:
+		return Authorization{}, ErrCardDeclined
+	case FakeCardInsufficientFunds:
+		return Authorization{}, ErrInsufficientFunds
+	case FakeCardTimeout:
+		return Authorization{}, ErrGatewayTimeout
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	id := fmt.Sprintf("fake_auth_%d", g.nextID)
+	g.nextID++
+	g.authorizations[id] = &fakeAuthorization{
+		orderID:  req.OrderID,
+		amount:   req.Amount,
+		refunded: Money{Currency: req.Amount.Currency},
+	}
+	return Authorization{ID: id, Amount: req.Amount}, nil
+}
+
+// Resume returns an authorization that is still open. FakeGateway never
+// asks for customer action, so there is nothing to wait for.
+func (g *FakeGateway) Resume(ctx context.Context, authorizationID string, req ChargeRequest) (Authorization, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	auth, ok := g.authorizations[authorizationID]
+	switch {
+	case !ok || auth.orderID != req.OrderID || auth.amount != req.Amount:
+		return Authorization{}, fmt.Errorf("%w: %s", ErrForeignAuthorization, authorizationID)
+	case auth.voided || auth.captured:
+		return Authorization{}, fmt.Errorf("%w: authorization %s is closed", ErrGatewayFailure, authorizationID)
+	}
+	return Authorization{ID: authorizationID, Amount: auth.amount}, nil
+}
+
+func (g *FakeGateway) Capture(ctx context.Context, authorizationID string, amount Money) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	auth, ok := g.authorizations[authorizationID]
+	switch {
+	case !ok:
+		return fmt.Errorf("%w: unknown authorization %s", ErrGatewayFailure, authorizationID)
+	case auth.voided:
+		return fmt.Errorf("%w: authorization %s was voided", ErrGatewayFailure, authorizationID)
+	case auth.captured:
+		return fmt.Errorf("%w: authorization %s already captured", ErrGatewayFailure, authorizationID)
+	case amount.Currency != auth.amount.Currency || amount.Amount > auth.amount.Amount:
+		return fmt.Errorf("%w: capture of %s exceeds authorization", ErrGatewayFailure, amount)
+	}
+	auth.captured = true
+	auth.amount = amount
+	return nil
+}
+
+func (g *FakeGateway) Void(ctx context.Context, authorizationID string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	auth, ok := g.authorizations[authorizationID]
+	switch {
+	case !ok:
+		return fmt.Errorf("%w: unknown authorization %s", ErrGatewayFailure, authorizationID)
+	case auth.captured:
+		return fmt.Errorf("%w: authorization %s already captured", ErrGatewayFailure, authorizationID)
+	}
+	auth.voided = true
+	return nil
+}
+
+func (g *FakeGateway) Refund(ctx context.Context, authorizationID string, amount Money, idempotencyKey string) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := authorizationID + ":" + idempotencyKey
+	if id, ok := g.refunds[key]; ok && idempotencyKey != "" {
+		return id, nil
+	}
+	auth, ok := g.authorizations[authorizationID]
+	switch {
+	case !ok:
+		return "", fmt.Errorf("%w: unknown authorization %s", ErrGatewayFailure, authorizationID)
+	case !auth.captured:
+		return "", fmt.Errorf("%w: authorization %s not captured", ErrGatewayFailure, authorizationID)
+	case amount.Currency != auth.amount.Currency || auth.refunded.Amount+amount.Amount > auth.amount.Amount:
+		return "", fmt.Errorf("%w: refund of %s exceeds captured amount", ErrGatewayFailure, amount)
+	}
+	auth.refunded.Amount += amount.Amount
+	id := fmt.Sprintf("fake_refund_%d", g.nextID)
+	g.nextID++
+	if idempotencyKey != "" {
+		g.refunds[key] = id
+	}
+	return id, nil
+}
+
+// authorization returns the recorded state of an authorization, for tests
+func (g *FakeGateway) authorization(id string) (fakeAuthorization, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	auth, ok := g.authorizations[id]
+	if !ok {
+		return fakeAuthorization{}, false
+	}
+	return *auth, true
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestFakeGatewayMagicCards(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	gateway := NewFakeGateway()
+	amount := NewMoney(9999, DefaultCurrency)
+
+	testCases := []struct {
+		card     string
+		expected error
+	}{
+		{"4242424242424242", nil},
+		{"", nil},
+		{FakeCardDeclined, ErrCardDeclined},
+		{FakeCardInsufficientFunds, ErrInsufficientFunds},
+		{FakeCardTimeout, ErrGatewayTimeout},
+	}
+
+	for _, tc := range testCases {
+		auth, err := gateway.Authorize(ctx, ChargeRequest{OrderID: 1, Amount: amount, CardNumber: tc.card})
+		if !errors.Is(err, tc.expected) {
+			t.Errorf("card %q: expected %v, got %v", tc.card, tc.expected, err)
+		}
+		if tc.expected == nil && auth.ID == "" {
+			t.Errorf("card %q: expected an authorization ID", tc.card)
+		}
+	}
+}
+
+func TestFakeGatewayLifecycle(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	gateway := NewFakeGateway()
+	amount := NewMoney(5000, DefaultCurrency)
+
+	auth, err := gateway.Authorize(ctx, ChargeRequest{OrderID: 1, Amount: amount})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An open authorization resumes only for the payment it was made for
+	if resumed, err := gateway.Resume(ctx, auth.ID, ChargeRequest{OrderID: 1, Amount: amount}); err != nil || resumed.ID != auth.ID {
+		t.Errorf("expected to resume %s, got %+v, %v", auth.ID, resumed, err)
+	}
+	if _, err := gateway.Resume(ctx, auth.ID, ChargeRequest{OrderID: 2, Amount: amount}); !errors.Is(err, ErrForeignAuthorization) {
+		t.Errorf("expected resuming for another order to fail, got %v", err)
+	}
+
+	// Refunds need a capture first
+	if _, err := gateway.Refund(ctx, auth.ID, amount, ""); !errors.Is(err, ErrGatewayFailure) {
+		t.Errorf("expected refund before capture to fail, got %v", err)
+	}
+
+	if err := gateway.Capture(ctx, auth.ID, amount); err != nil {
+		t.Fatal(err)
+	}
+	if err := gateway.Capture(ctx, auth.ID, amount); !errors.Is(err, ErrGatewayFailure) {
+		t.Errorf("expected second capture to fail, got %v", err)
+	}
+	if err := gateway.Void(ctx, auth.ID); !errors.Is(err, ErrGatewayFailure) {
+		t.Errorf("expected void after capture to fail, got %v", err)
+	}
+
+	// Partial refunds add up to at most the captured amount; one sent again
+	// with its idempotency key is not refunded twice
+	first, err := gateway.Refund(ctx, auth.ID, NewMoney(3000, DefaultCurrency), "refund-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := gateway.Refund(ctx, auth.ID, NewMoney(3000, DefaultCurrency), "refund-1"); err != nil || again != first {
+		t.Errorf("expected the retried refund to return %s, got %s, %v", first, again, err)
+	}
+	if _, err := gateway.Refund(ctx, auth.ID, NewMoney(2001, DefaultCurrency), ""); !errors.Is(err, ErrGatewayFailure) {
+		t.Errorf("expected over-refund to fail, got %v", err)
+	}
+	if _, err := gateway.Refund(ctx, auth.ID, NewMoney(2000, DefaultCurrency), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys belong to their authorization: another one refunds afresh
+	other, _ := gateway.Authorize(ctx, ChargeRequest{OrderID: 3, Amount: amount})
+	if err := gateway.Capture(ctx, other.ID, amount); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := gateway.Refund(ctx, other.ID, NewMoney(3000, DefaultCurrency), "refund-1"); err != nil || id == first {
+		t.Errorf("expected a new refund for %s, got %s, %v", other.ID, id, err)
+	}
+
+	// A voided authorization cannot be captured
+	voided, _ := gateway.Authorize(ctx, ChargeRequest{OrderID: 2, Amount: amount})
+	if err := gateway.Void(ctx, voided.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := gateway.Capture(ctx, voided.ID, amount); !errors.Is(err, ErrGatewayFailure) {
+		t.Errorf("expected capture after void to fail, got %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// Errors a PaymentGateway may return; they are mapped to PaymentResponse codes
+var (
+	ErrCardDeclined      = errors.New("card declined")
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrGatewayTimeout    = errors.New("payment gateway timed out")
+	ErrGatewayFailure    = errors.New("payment gateway error")
+	// ErrForeignAuthorization is returned when resuming an authorization
+	// that does not exist or was made for another payment
+	ErrForeignAuthorization = errors.New("authorization is not for this payment")
+)
+
+// ChargeRequest describes a payment to authorize
+type ChargeRequest struct {
+	OrderID int
+	Amount  Money
+	// CardNumber is used by FakeGateway; providers such as Stripe take a
+	// tokenised PaymentMethod instead
+	CardNumber    string
+	PaymentMethod string
+}
+
+// Authorization is a hold on funds that can later be captured or voided
+type Authorization struct {
+	ID     string
+	Amount Money
+}
+
+// PaymentGateway moves money through a payment provider. Funds are first
+// authorized, then captured once the order is confirmed; an authorization
+// that is not needed is voided. Captured payments can be refunded, in part
+// or in full.
+type PaymentGateway interface {
+	Authorize(ctx context.Context, req ChargeRequest) (Authorization, error)
+	// Resume picks up an authorization that Authorize left waiting on the
+	// customer (ErrRequiresAction) once they have acted. It fails unless
+	// the authorization was made for req's order and amount.
+	Resume(ctx context.Context, authorizationID string, req ChargeRequest) (Authorization, error)
+	Capture(ctx context.Context, authorizationID string, amount Money) error
+	Void(ctx context.Context, authorizationID string) error
+	// Refund returns the provider's identifier for the refund. A refund
+	// sent again with the same idempotencyKey returns the first one rather
+	// than refunding twice. Keys are scoped to the authorization, so the
+	// same key against another authorization is a different refund.
+	Refund(ctx context.Context, authorizationID string, amount Money, idempotencyKey string) (string, error)
+}
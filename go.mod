@@ -4,5 +4,9 @@ go 1.21
 
 require (
 	github.com/gorilla/mux v1.8.1
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/rs/cors v1.10.1
 )
+
+require golang.org/x/crypto v0.33.0
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 
 	"github.com/gorilla/mux"
@@ -12,8 +13,8 @@ import (
 )
 
 func TestFullOrderFlow(t *testing.T) {
-	// Reset state
-	ResetGlobalState()
+	t.Parallel()
+	srv := newAdminTestServer(t)
 
 	// Step 1: Get products
 	req, err := http.NewRequest("GET", "/api/products", nil)
@@ -22,7 +23,7 @@ func TestFullOrderFlow(t *testing.T) {
 	}
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(GetProducts)
+	handler := http.HandlerFunc(srv.GetProducts)
 	handler.ServeHTTP(rr, req)
 
 	if status := rr.Code; status != http.StatusOK {
@@ -48,7 +49,7 @@ func TestFullOrderFlow(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 
 	rr = httptest.NewRecorder()
-	CreateOrder(rr, req)
+	srv.CreateOrder(rr, req)
 
 	if status := rr.Code; status != http.StatusOK {
 		t.Errorf("createOrder failed: got %v want %v", status, http.StatusOK)
@@ -58,10 +59,9 @@ func TestFullOrderFlow(t *testing.T) {
 	json.Unmarshal(rr.Body.Bytes(), &order)
 
 	// Verify order details
-	expectedTotal := (99.99 * 2) + (79.99 * 1) // Headphones + Coffee Maker
-	// Use approximate comparison for floating point precision
-	if order.Total < expectedTotal-0.01 || order.Total > expectedTotal+0.01 {
-		t.Errorf("expected total ~%v, got %v", expectedTotal, order.Total)
+	expectedTotal := NewMoney(9999*2+7999*1, DefaultCurrency) // Headphones + Coffee Maker
+	if order.Total != expectedTotal {
+		t.Errorf("expected total %v, got %v", expectedTotal, order.Total)
 	}
 
 	if order.Status != "pending" {
@@ -77,9 +77,10 @@ func TestFullOrderFlow(t *testing.T) {
 	jsonData, _ = json.Marshal(paymentData)
 	req, _ = http.NewRequest("POST", "/api/payment", bytes.NewBuffer(jsonData))
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(OrderTokenHeader, order.AccessToken)
 
 	rr = httptest.NewRecorder()
-	ProcessPayment(rr, req)
+	srv.ProcessPayment(rr, req)
 
 	if status := rr.Code; status != http.StatusOK {
 		t.Errorf("processPayment failed: got %v want %v", status, http.StatusOK)
@@ -94,8 +95,9 @@ func TestFullOrderFlow(t *testing.T) {
 
 	// Step 4: Verify order status was updated
 	req, _ = http.NewRequest("GET", "/api/orders", nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
 	rr = httptest.NewRecorder()
-	GetOrders(rr, req)
+	srv.GetOrders(rr, req)
 
 	var orders []Order
 	json.Unmarshal(rr.Body.Bytes(), &orders)
@@ -110,6 +112,9 @@ func TestFullOrderFlow(t *testing.T) {
 }
 
 func TestCORSHeaders(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
 	// Test that CORS headers are properly set
 	req, err := http.NewRequest("GET", "/api/products", nil)
 	if err != nil {
@@ -120,7 +125,7 @@ func TestCORSHeaders(t *testing.T) {
 
 	// Create router with CORS
 	r := mux.NewRouter()
-	r.HandleFunc("/api/products", GetProducts).Methods("GET")
+	r.HandleFunc("/api/products", srv.GetProducts).Methods("GET")
 
 	c := cors.New(cors.Options{
 		AllowedOrigins: []string{"http://localhost:3000"},
@@ -148,8 +153,8 @@ func TestCORSHeaders(t *testing.T) {
 }
 
 func TestMultipleOrders(t *testing.T) {
-	// Reset state
-	ResetGlobalState()
+	t.Parallel()
+	srv := newAdminTestServer(t)
 
 	// Create first order
 	order1 := Order{
@@ -163,7 +168,7 @@ func TestMultipleOrders(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
-	CreateOrder(rr, req)
+	srv.CreateOrder(rr, req)
 
 	var createdOrder1 Order
 	json.Unmarshal(rr.Body.Bytes(), &createdOrder1)
@@ -180,7 +185,7 @@ func TestMultipleOrders(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 
 	rr = httptest.NewRecorder()
-	CreateOrder(rr, req)
+	srv.CreateOrder(rr, req)
 
 	var createdOrder2 Order
 	json.Unmarshal(rr.Body.Bytes(), &createdOrder2)
@@ -192,8 +197,9 @@ func TestMultipleOrders(t *testing.T) {
 
 	// Get all orders
 	req, _ = http.NewRequest("GET", "/api/orders", nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
 	rr = httptest.NewRecorder()
-	GetOrders(rr, req)
+	srv.GetOrders(rr, req)
 
 	var orders []Order
 	json.Unmarshal(rr.Body.Bytes(), &orders)
@@ -204,25 +210,27 @@ func TestMultipleOrders(t *testing.T) {
 }
 
 func TestOrderCalculation(t *testing.T) {
+	t.Parallel()
+
 	// Test that order totals are calculated correctly
 	testCases := []struct {
 		name     string
 		items    []OrderItem
-		expected float64
+		expected string
 	}{
 		{
 			name: "Single item",
 			items: []OrderItem{
 				{ProductID: 1, Quantity: 1}, // Headphones $99.99
 			},
-			expected: 99.99,
+			expected: "99.99",
 		},
 		{
 			name: "Multiple quantities",
 			items: []OrderItem{
 				{ProductID: 1, Quantity: 2}, // Headphones $99.99 x 2
 			},
-			expected: 199.98,
+			expected: "199.98",
 		},
 		{
 			name: "Multiple items",
@@ -230,7 +238,7 @@ func TestOrderCalculation(t *testing.T) {
 				{ProductID: 1, Quantity: 1}, // Headphones $99.99
 				{ProductID: 2, Quantity: 1}, // Smart Watch $199.99
 			},
-			expected: 299.98,
+			expected: "299.98",
 		},
 		{
 			name: "Complex order",
@@ -239,14 +247,15 @@ func TestOrderCalculation(t *testing.T) {
 				{ProductID: 3, Quantity: 1}, // Coffee Maker $79.99
 				{ProductID: 5, Quantity: 3}, // Backpack $49.99 x 3 = $149.97
 			},
-			expected: 429.94,
+			expected: "429.94",
 		},
 	}
 
 	for _, tc := range testCases {
+		tc := tc
 		t.Run(tc.name, func(t *testing.T) {
-			// Reset state for each test
-			ResetGlobalState()
+			t.Parallel()
+			srv := newTestServer(t)
 
 			orderData := Order{
 				Items: tc.items,
@@ -257,7 +266,7 @@ func TestOrderCalculation(t *testing.T) {
 			req.Header.Set("Content-Type", "application/json")
 
 			rr := httptest.NewRecorder()
-			CreateOrder(rr, req)
+			srv.CreateOrder(rr, req)
 
 			if status := rr.Code; status != http.StatusOK {
 				t.Errorf("createOrder failed: got %v want %v", status, http.StatusOK)
@@ -266,17 +275,16 @@ func TestOrderCalculation(t *testing.T) {
 			var order Order
 			json.Unmarshal(rr.Body.Bytes(), &order)
 
-			// Use approximate comparison for floating point precision
-			if order.Total < tc.expected-0.01 || order.Total > tc.expected+0.01 {
-				t.Errorf("expected total ~%v, got %v", tc.expected, order.Total)
+			if order.Total.String() != tc.expected {
+				t.Errorf("expected total %v, got %v", tc.expected, order.Total)
 			}
 		})
 	}
 }
 
 func TestInvalidProductID(t *testing.T) {
-	// Reset state before test
-	ResetGlobalState()
+	t.Parallel()
+	srv := newAdminTestServer(t)
 
 	// Test order with non-existent product
 	orderData := Order{
@@ -290,17 +298,101 @@ func TestInvalidProductID(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
-	CreateOrder(rr, req)
+	srv.CreateOrder(rr, req)
 
-	if status := rr.Code; status != http.StatusOK {
-		t.Errorf("createOrder should handle invalid product IDs gracefully")
+	if status := rr.Code; status != http.StatusUnprocessableEntity {
+		t.Errorf("createOrder should reject invalid product IDs: got %v want %v", status, http.StatusUnprocessableEntity)
 	}
 
-	var order Order
-	json.Unmarshal(rr.Body.Bytes(), &order)
+	var verr ValidationError
+	json.Unmarshal(rr.Body.Bytes(), &verr)
+
+	if len(verr.Items) != 1 || verr.Items[0].ProductID != 999 || verr.Items[0].Field != "product_id" {
+		t.Errorf("expected one product_id error for product 999, got %+v", verr.Items)
+	}
+
+	// No order should have been created
+	req, _ = http.NewRequest("GET", "/api/orders", nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	rr = httptest.NewRecorder()
+	srv.GetOrders(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("listing orders failed: got %v: %s", rr.Code, rr.Body)
+	}
+
+	var orders []Order
+	json.Unmarshal(rr.Body.Bytes(), &orders)
+
+	if len(orders) != 0 {
+		t.Errorf("expected no orders, got %d", len(orders))
+	}
+}
 
-	// Order should be created but with 0 total for invalid products
-	if order.Total != 0 {
-		t.Errorf("expected total 0 for invalid product, got %v", order.Total)
+func TestConcurrentOrdersAndPayments(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+	handler := srv.Routes()
+
+	// Place and pay for orders from many clients at once; run with -race
+	const clients = 20
+	var wg sync.WaitGroup
+	created := make(chan Order, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			jsonData, _ := json.Marshal(Order{Items: []OrderItem{{ProductID: 2, Quantity: 1}}})
+			req, _ := http.NewRequest("POST", "/api/orders", bytes.NewBuffer(jsonData))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Errorf("createOrder failed: got %v want %v", rr.Code, http.StatusOK)
+				return
+			}
+
+			var order Order
+			json.Unmarshal(rr.Body.Bytes(), &order)
+			created <- order
+
+			jsonData, _ = json.Marshal(PaymentRequest{OrderID: order.ID, Amount: order.Total})
+			req, _ = http.NewRequest("POST", "/api/payment", bytes.NewBuffer(jsonData))
+			req.Header.Set(OrderTokenHeader, order.AccessToken)
+			rr = httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Errorf("processPayment failed: got %v want %v", rr.Code, http.StatusOK)
+			}
+		}()
+	}
+	wg.Wait()
+	close(created)
+
+	seen := map[int]bool{}
+	for order := range created {
+		if seen[order.ID] {
+			t.Errorf("order ID %d returned twice", order.ID)
+		}
+		seen[order.ID] = true
+	}
+
+	req, _ := http.NewRequest("GET", "/api/orders", nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	var orders []Order
+	json.Unmarshal(rr.Body.Bytes(), &orders)
+
+	if len(orders) != clients {
+		t.Fatalf("expected %d orders, got %d", clients, len(orders))
+	}
+	for i, order := range orders {
+		if order.Status != "paid" {
+			t.Errorf("order %d: expected status 'paid', got %s", order.ID, order.Status)
+		}
+		if i > 0 && order.ID <= orders[i-1].ID {
+			t.Errorf("order IDs not increasing: %d after %d", order.ID, orders[i-1].ID)
+		}
 	}
 }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// DefaultReservationTTL is how long an unpaid order holds its stock
+const DefaultReservationTTL = 15 * time.Minute
+
+// Errors returned when stock cannot cover an order
+var (
+	ErrOutOfStock         = errors.New("out of stock")
+	ErrReservationExpired = errors.New("order reservation expired")
+)
+
+// WithReservationTTL sets how long an unpaid order holds its stock before
+// it is cancelled; 0 keeps reservations until the order is paid or
+// cancelled.
+func WithReservationTTL(ttl time.Duration) Option {
+	return func(s *Server) { s.reservationTTL = ttl }
+}
+
+// holdsReservation reports whether an order in status s keeps its items
+// reserved: it has been placed but not paid yet
+func (s OrderStatus) holdsReservation() bool {
+	return s == StatusPending || s == StatusFailed
+}
+
+// stockEffect returns how much each unit of an order changes a product's
+// stock and reservations when the order moves from one status to another
+func stockEffect(from, to OrderStatus) (stock, reserved int) {
+	switch {
+	case from.holdsReservation() && to == StatusPaid:
+		// Sold: the reserved unit leaves the shelf
+		return -1, -1
+	case from.holdsReservation() && to == StatusCancelled:
+		return 0, -1
+	case from == StatusPaid && to == StatusCancelled:
+		// Cancelled before fulfilment, so the unit never left
+		return 1, 0
+	}
+	return 0, 0
+}
+
+// mergeItems sums the quantity of each product or variant across order
+// lines, in product and variant ID order so stores lock rows in a
+// consistent order
+func mergeItems(items []OrderItem) []OrderItem {
+	quantities := map[lineKey]int{}
+	for _, item := range items {
+		quantities[item.key()] += item.Quantity
+	}
+	merged := make([]OrderItem, 0, len(quantities))
+	for key, quantity := range quantities {
+		merged = append(merged, OrderItem{ProductID: key.productID, VariantID: key.variantID, Quantity: quantity})
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		if merged[i].ProductID != merged[j].ProductID {
+			return merged[i].ProductID < merged[j].ProductID
+		}
+		return merged[i].VariantID < merged[j].VariantID
+	})
+	return merged
+}
+
+// keepReservations carries the reservations of old over to p, its
+// replacement, and rejects changes that would strand them: stock below
+// what unpaid orders reserved, removing a variant they reserved, or
+// adding or removing variants while the product itself is reserved.
+// Variant IDs in p must belong to old.
+func keepReservations(old Product, p *Product) error {
+	verr := &ValidationError{Message: "invalid product"}
+	add := func(field, message string) {
+		verr.Fields = append(verr.Fields, FieldError{Field: field, Message: message})
+	}
+
+	carryReservations(old, p)
+	kept := map[int]bool{}
+	for i, v := range p.Variants {
+		if v.ID == 0 {
+			continue
+		}
+		if old.variantIndex(v.ID) < 0 {
+			add(fmt.Sprintf("variants[%d].id", i), fmt.Sprintf("variant %d is not a variant of this product", v.ID))
+			continue
+		}
+		kept[v.ID] = true
+		if v.Stock < v.Reserved {
+			add(fmt.Sprintf("variants[%d].stock", i), fmt.Sprintf("must be at least the %d units reserved by unpaid orders", v.Reserved))
+		}
+	}
+	for _, v := range old.Variants {
+		if !kept[v.ID] && v.Reserved > 0 {
+			add("variants", fmt.Sprintf("variant %d cannot be removed while unpaid orders reserve %d units of it", v.ID, v.Reserved))
+		}
+	}
+
+	switch {
+	case (len(old.Variants) == 0) != (len(p.Variants) == 0) && old.Reserved > 0:
+		add("variants", fmt.Sprintf("cannot be added or removed while unpaid orders reserve %d units of the product", old.Reserved))
+	case len(p.Variants) == 0 && p.Stock < p.Reserved:
+		add("stock", fmt.Sprintf("must be at least the %d units reserved by unpaid orders", p.Reserved))
+	}
+
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// reservationExpired reports whether an unpaid order has held its stock
+// for longer than the reservation TTL
+func (s *Server) reservationExpired(order Order, now time.Time) bool {
+	return s.reservationTTL > 0 && order.Status.holdsReservation() && now.Sub(order.CreatedAt) >= s.reservationTTL
+}
+
+// expireOrder cancels an unpaid order whose reservation has run out,
+// releasing its stock, and reports whether it did
+func (s *Server) expireOrder(ctx context.Context, orderID int, now time.Time) (bool, error) {
+	expired := false
+	_, err := s.store.UpdateOrder(ctx, orderID, func(o *Order) error {
+		if !s.reservationExpired(*o, now) {
+			return nil
+		}
+		expired = true
+		return o.Transition(StatusCancelled, now)
+	})
+	return expired && err == nil, err
+}
+
+// ExpireReservations cancels every unpaid order whose reservation has run
+// out and returns how many were cancelled
+func (s *Server) ExpireReservations(ctx context.Context, now time.Time) (int, error) {
+	if s.reservationTTL <= 0 {
+		return 0, nil
+	}
+	expired := 0
+	for _, status := range []OrderStatus{StatusPending, StatusFailed} {
+		orders, err := s.store.ListOrders(ctx, OrderFilter{Status: status, CreatedBefore: now.Add(-s.reservationTTL)}, Page{})
+		if err != nil {
+			return expired, err
+		}
+		for _, order := range orders {
+			ok, err := s.expireOrder(ctx, order.ID, now)
+			if err != nil {
+				return expired, fmt.Errorf("expire order %d: %w", order.ID, err)
+			}
+			if ok {
+				expired++
+			}
+		}
+	}
+	return expired, nil
+}
+
+// expireReservationsEvery runs ExpireReservations on every tick until ctx
+// is done
+func (s *Server) expireReservationsEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if _, err := s.ExpireReservations(ctx, now); err != nil {
+				log.Printf("expire reservations: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newStockedServer returns an admin test server whose product 1 has only
+// stock units
+func newStockedServer(t *testing.T, stock int, opts ...Option) *Server {
+	t.Helper()
+	products := testCatalog(t)
+	products[0].Stock = stock
+	return NewServer(NewMemoryStore(products), append([]Option{WithAdminToken(testAdminToken)}, opts...)...)
+}
+
+// placeOrder posts an order and returns the recorder
+func placeOrder(srv *Server, items ...OrderItem) *httptest.ResponseRecorder {
+	jsonData, _ := json.Marshal(Order{Items: items})
+	req, _ := http.NewRequest("POST", "/api/orders", bytes.NewBuffer(jsonData))
+	rr := httptest.NewRecorder()
+	srv.CreateOrder(rr, req)
+	return rr
+}
+
+// productStock returns the stock and reservations of a product
+func productStock(t *testing.T, srv *Server, id int) (int, int) {
+	t.Helper()
+	p, err := srv.store.GetProduct(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.Stock, p.Reserved
+}
+
+func TestOrderRejectsOutOfStockItems(t *testing.T) {
+	t.Parallel()
+	srv := newStockedServer(t, 3)
+	createTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 2})
+
+	rr := placeOrder(srv, OrderItem{ProductID: 2, Quantity: 1}, OrderItem{ProductID: 1, Quantity: 2})
+	var verr ValidationError
+	json.Unmarshal(rr.Body.Bytes(), &verr)
+	if rr.Code != http.StatusUnprocessableEntity || len(verr.Items) != 1 || verr.Items[0].Index != 1 || verr.Items[0].Field != "quantity" {
+		t.Fatalf("expected 422 for line 1, got %v: %s", rr.Code, rr.Body)
+	}
+	if verr.Items[0].Message != "only 1 of product 1 in stock" {
+		t.Errorf("unexpected message %q", verr.Items[0].Message)
+	}
+
+	// The last unit can still be ordered
+	createTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 1})
+	if stock, reserved := productStock(t, srv, 1); stock != 3 || reserved != 3 {
+		t.Errorf("expected all 3 units reserved, got %d of %d", reserved, stock)
+	}
+}
+
+func TestPaymentAndCancellationMoveStock(t *testing.T) {
+	t.Parallel()
+	srv := newStockedServer(t, 10)
+
+	paid := payTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 4})
+	pending := createTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 3})
+	if stock, reserved := productStock(t, srv, 1); stock != 6 || reserved != 3 {
+		t.Errorf("expected 6 in stock with 3 reserved, got %d and %d", stock, reserved)
+	}
+
+	if rr := cancelOrder(srv, pending); rr.Code != http.StatusOK {
+		t.Fatalf("cancel failed: got %v: %s", rr.Code, rr.Body)
+	}
+	if stock, reserved := productStock(t, srv, 1); stock != 6 || reserved != 0 {
+		t.Errorf("expected the pending order released, got %d in stock and %d reserved", stock, reserved)
+	}
+
+	if rr := cancelOrder(srv, paid); rr.Code != http.StatusOK {
+		t.Fatalf("cancel failed: got %v: %s", rr.Code, rr.Body)
+	}
+	if stock, _ := productStock(t, srv, 1); stock != 10 {
+		t.Errorf("expected the paid order restocked to 10, got %d", stock)
+	}
+}
+
+func TestExpireReservations(t *testing.T) {
+	t.Parallel()
+	srv := newStockedServer(t, 5, WithReservationTTL(time.Minute))
+	order := createTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 5})
+	paid := payTestOrder(t, srv, OrderItem{ProductID: 2, Quantity: 1})
+
+	ctx := context.Background()
+	if n, err := srv.ExpireReservations(ctx, time.Now()); err != nil || n != 0 {
+		t.Fatalf("expected nothing to expire yet, got %d, %v", n, err)
+	}
+	n, err := srv.ExpireReservations(ctx, time.Now().Add(2*time.Minute))
+	if err != nil || n != 1 {
+		t.Fatalf("expected one order to expire, got %d, %v", n, err)
+	}
+
+	expired, _ := srv.store.GetOrder(ctx, order.ID)
+	if expired.Status != StatusCancelled {
+		t.Errorf("expected the expired order cancelled, got %s", expired.Status)
+	}
+	if _, reserved := productStock(t, srv, 1); reserved != 0 {
+		t.Errorf("expected the reservation released, got %d reserved", reserved)
+	}
+	if kept, _ := srv.store.GetOrder(ctx, paid.ID); kept.Status != StatusPaid {
+		t.Errorf("expected the paid order untouched, got %s", kept.Status)
+	}
+}
+
+func TestPaymentRejectsExpiredReservation(t *testing.T) {
+	t.Parallel()
+	srv := newStockedServer(t, 5, WithReservationTTL(time.Nanosecond))
+	order := createTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 2})
+
+	rr := pay(srv, order.AccessToken, PaymentRequest{OrderID: order.ID, Amount: order.Total})
+	var resp PaymentResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if rr.Code != http.StatusConflict || resp.Code != PaymentCodeReservationExpired {
+		t.Fatalf("expected 409 %s, got %v: %s", PaymentCodeReservationExpired, rr.Code, rr.Body)
+	}
+
+	fetched, _ := srv.store.GetOrder(context.Background(), order.ID)
+	if fetched.Status != StatusCancelled {
+		t.Errorf("expected the order cancelled, got %s", fetched.Status)
+	}
+	if stock, reserved := productStock(t, srv, 1); stock != 5 || reserved != 0 {
+		t.Errorf("expected the stock untouched, got %d in stock and %d reserved", stock, reserved)
+	}
+}
+
+func TestAdminStockLevels(t *testing.T) {
+	t.Parallel()
+	srv := newStockedServer(t, 5)
+	createTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 3})
+
+	testCases := []struct {
+		name  string
+		stock int
+		code  int
+	}{
+		{"negative", -1, http.StatusUnprocessableEntity},
+		{"below reserved", 2, http.StatusUnprocessableEntity},
+		{"covers reserved", 3, http.StatusOK},
+		{"restock", 50, http.StatusOK},
+	}
+	for _, tc := range testCases {
+		rr := adminRequest(srv, "PATCH", "/api/products/1", map[string]int{"stock": tc.stock, "reserved": 0})
+		if rr.Code != tc.code {
+			t.Errorf("%s: expected %v, got %v: %s", tc.name, tc.code, rr.Code, rr.Body)
+		}
+	}
+
+	// The reservation survives the admin's changes
+	if stock, reserved := productStock(t, srv, 1); stock != 50 || reserved != 3 {
+		t.Errorf("expected 50 in stock with 3 reserved, got %d and %d", stock, reserved)
+	}
+}
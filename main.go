@@ -1,198 +1,1334 @@
 package main
 
 import (
+	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Product represents a product in our store
 type Product struct {
-	ID          int     `json:"id"`
-	Name        string  `json:"name"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price"`
-	Image       string  `json:"image"`
-	Category    string  `json:"category"`
+	ID int `json:"id"`
+	// SKU is the merchant's own identifier; bulk imports match products
+	// by it. It is optional but unique when set.
+	SKU         string `json:"sku,omitempty"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Price       Money  `json:"price"`
+	Image       string `json:"image"`
+	Category    string `json:"category"`
+	// Stock is the number of units on hand. Reserved of them are held by
+	// unpaid orders; only the store changes it. For a product with
+	// variants both are the totals of its variants.
+	Stock    int       `json:"stock"`
+	Reserved int       `json:"reserved"`
+	Variants []Variant `json:"variants,omitempty"`
+	// DeletedAt is set once the product is withdrawn from sale; it stays
+	// resolvable for the orders that contain it
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 // OrderItem represents an item in an order
 type OrderItem struct {
 	ProductID int `json:"product_id"`
+	// VariantID is required for products with variants and 0 otherwise
+	VariantID int `json:"variant_id,omitempty"`
 	Quantity  int `json:"quantity"`
+	// UnitPrice is the product price when the order was placed; it is set
+	// by the store and ignored in requests
+	UnitPrice Money `json:"unit_price"`
 }
 
 // Order represents a customer order
 type Order struct {
 	ID        int         `json:"id"`
 	Items     []OrderItem `json:"items"`
-	Total     float64     `json:"total"`
-	Status    string      `json:"status"`
+	Total     Money       `json:"total"`
+	Status    OrderStatus `json:"status"`
 	CreatedAt time.Time   `json:"created_at"`
+	// History lists every status the order has been in, oldest first
+	History []StatusChange `json:"history"`
+	Refunds []Refund       `json:"refunds"`
+	// AccessToken opens a guest order. It is sent once, in the response
+	// placing the order, and only its hash is stored.
+	AccessToken string `json:"access_token,omitempty"`
+	OrderContact
+}
+
+// Payment represents a payment recorded against an order
+type Payment struct {
+	ID        int       `json:"id"`
+	OrderID   int       `json:"order_id"`
+	Amount    Money     `json:"amount"`
+	Reference string    `json:"reference"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 // PaymentRequest represents a payment request
 type PaymentRequest struct {
-	OrderID int     `json:"order_id"`
-	Amount  float64 `json:"amount"`
+	OrderID       int    `json:"order_id"`
+	Amount        Money  `json:"amount"`
+	CardNumber    string `json:"card_number,omitempty"`
+	PaymentMethod string `json:"payment_method,omitempty"`
+	// AuthorizationID resumes a payment that answered requires_action,
+	// once the customer has completed 3D Secure
+	AuthorizationID string `json:"authorization_id,omitempty"`
+}
+
+// PaymentResponse represents a payment response
+type PaymentResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+	OrderID int    `json:"order_id"`
+	Code    string `json:"code,omitempty"`
+	// NextActionURL is where the customer completes 3D Secure when Code
+	// is requires_action
+	NextActionURL string `json:"next_action_url,omitempty"`
+	// AuthorizationID is sent back with the payment to resume it once the
+	// customer has acted
+	AuthorizationID string `json:"authorization_id,omitempty"`
+}
+
+// Server holds the dependencies shared by the HTTP handlers
+type Server struct {
+	store              Store
+	gateway            PaymentGateway
+	maxQuantityPerLine int
+	adminToken         string
+	reservationTTL     time.Duration
+	cartTTL            time.Duration
+	sessionTTL         time.Duration
+	// passwordCost is the bcrypt cost new passwords are hashed at
+	passwordCost int
+
+	// search is built on the first search; searchMu guards it
+	searchMu sync.Mutex
+	search   *SearchIndex
+}
+
+// Option configures optional Server behaviour
+type Option func(*Server)
+
+// WithMaxQuantityPerLine limits how many units a single order line may request
+func WithMaxQuantityPerLine(n int) Option {
+	return func(s *Server) { s.maxQuantityPerLine = n }
+}
+
+// WithPaymentGateway sets the provider used to charge orders
+func WithPaymentGateway(g PaymentGateway) Option {
+	return func(s *Server) { s.gateway = g }
+}
+
+// NewServer creates a server backed by the given store. Payments go through
+// a FakeGateway unless another gateway is configured.
+func NewServer(store Store, opts ...Option) *Server {
+	s := &Server{
+		store:              store,
+		gateway:            NewFakeGateway(),
+		maxQuantityPerLine: DefaultMaxQuantityPerLine,
+		reservationTTL:     DefaultReservationTTL,
+		cartTTL:            DefaultCartTTL,
+		sessionTTL:         DefaultSessionTTL,
+		passwordCost:       bcrypt.DefaultCost,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Routes returns the router with all API routes registered
+func (s *Server) Routes() *mux.Router {
+	r := mux.NewRouter()
+
+	r.HandleFunc("/api/products", s.GetProducts).Methods("GET")
+	r.HandleFunc("/api/products/search", s.SearchProducts).Methods("GET")
+	r.HandleFunc("/api/products/{id}", s.GetProduct).Methods("GET")
+	r.HandleFunc("/api/products", s.requireAdmin(s.CreateProduct)).Methods("POST")
+	r.HandleFunc("/api/products/{id}", s.requireAdmin(s.ReplaceProduct)).Methods("PUT")
+	r.HandleFunc("/api/products/{id}", s.requireAdmin(s.PatchProduct)).Methods("PATCH")
+	r.HandleFunc("/api/products/{id}", s.requireAdmin(s.DeleteProduct)).Methods("DELETE")
+	r.HandleFunc("/api/admin/products/import", s.requireAdmin(s.ImportProducts)).Methods("POST")
+	r.HandleFunc("/api/admin/products/export", s.requireAdmin(s.ExportProducts)).Methods("GET")
+	r.HandleFunc("/api/categories", s.GetCategories).Methods("GET")
+	r.HandleFunc("/api/categories/{slug}", s.GetCategory).Methods("GET")
+	r.HandleFunc("/api/categories", s.requireAdmin(s.CreateCategory)).Methods("POST")
+	r.HandleFunc("/api/categories/{slug}", s.requireAdmin(s.ReplaceCategory)).Methods("PUT")
+	r.HandleFunc("/api/categories/{slug}", s.requireAdmin(s.DeleteCategory)).Methods("DELETE")
+	r.HandleFunc("/api/carts", s.CreateCart).Methods("POST")
+	r.HandleFunc("/api/carts/{id}", s.GetCart).Methods("GET")
+	r.HandleFunc("/api/carts/{id}/items", s.AddCartItem).Methods("POST")
+	r.HandleFunc("/api/carts/{id}/items/{item}", s.UpdateCartItem).Methods("PATCH")
+	r.HandleFunc("/api/carts/{id}/items/{item}", s.RemoveCartItem).Methods("DELETE")
+	r.HandleFunc("/api/carts/{id}/checkout", s.CheckoutCart).Methods("POST")
+	r.HandleFunc("/api/accounts", s.Register).Methods("POST")
+	r.HandleFunc("/api/account", s.GetAccount).Methods("GET")
+	r.HandleFunc("/api/login", s.Login).Methods("POST")
+	r.HandleFunc("/api/logout", s.Logout).Methods("POST")
+	r.HandleFunc("/api/orders", s.CreateOrder).Methods("POST")
+	r.HandleFunc("/api/orders", s.GetOrders).Methods("GET")
+	r.HandleFunc("/api/orders/{id}", s.GetOrder).Methods("GET")
+	r.HandleFunc("/api/orders/{id}/status", s.requireAdmin(s.UpdateOrderStatus)).Methods("PUT")
+	r.HandleFunc("/api/orders/{id}/cancel", s.CancelOrder).Methods("POST")
+	r.HandleFunc("/api/orders/{id}/refunds", s.requireAdmin(s.CreateRefund)).Methods("POST")
+	r.HandleFunc("/api/payment", s.ProcessPayment).Methods("POST")
+
+	return r
+}
+
+// Get all products, or a page of them when limit or cursor is given. The
+// listing can be narrowed by category, subcategories included, and price,
+// sorted, and counted by category and price range with facets=true.
+func (s *Server) GetProducts(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseProductFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, paged, err := parsePage(r.URL.Query())
+	if err == nil {
+		_, err = filter.cursorProduct(page)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	withFacets := false
+	if v := r.URL.Query().Get("facets"); v != "" {
+		if withFacets, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "facets must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+	if filter, err = s.expandCategories(r.Context(), filter); err != nil {
+		internalError(w, err)
+		return
+	}
+
+	products, err := s.store.ListProducts(r.Context(), filter, page.lookahead())
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	resp := ProductListResponse{ListResponse: ListResponse{Data: products}}
+	if paged {
+		resp.ListResponse = paginate(products, page.Limit, func(p Product) (int, string) { return p.ID, filter.sortKey(p) })
+	}
+	if withFacets {
+		facets, err := s.productFacets(r.Context(), filter)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		resp.Facets = &facets
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !paged && !withFacets {
+		json.NewEncoder(w).Encode(products)
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Get a single product by ID
+func (s *Server) GetProduct(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	product, err := s.store.GetProduct(r.Context(), id)
+	if errors.Is(err, ErrProductNotFound) {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(product)
+}
+
+// Search the products on sale by name, category and description, best
+// matches first
+func (s *Server) SearchProducts(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	limit := DefaultSearchLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > MaxPageLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", MaxPageLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	results, err := s.searchProducts(r.Context(), query, limit)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+// ProductPatch holds the product fields a PATCH request changes
+type ProductPatch struct {
+	SKU         *string    `json:"sku"`
+	Name        *string    `json:"name"`
+	Description *string    `json:"description"`
+	Price       *Money     `json:"price"`
+	Image       *string    `json:"image"`
+	Category    *string    `json:"category"`
+	Stock       *int       `json:"stock"`
+	Variants    *[]Variant `json:"variants"`
+}
+
+// apply copies the fields present in the patch onto p
+func (patch ProductPatch) apply(p *Product) {
+	if patch.SKU != nil {
+		p.SKU = *patch.SKU
+	}
+	if patch.Name != nil {
+		p.Name = *patch.Name
+	}
+	if patch.Description != nil {
+		p.Description = *patch.Description
+	}
+	if patch.Price != nil {
+		p.Price = *patch.Price
+	}
+	if patch.Image != nil {
+		p.Image = *patch.Image
+	}
+	if patch.Category != nil {
+		p.Category = *patch.Category
+	}
+	if patch.Stock != nil {
+		p.Stock = *patch.Stock
+	}
+	if patch.Variants != nil {
+		p.Variants = *patch.Variants
+	}
+}
+
+// Add a product to the catalog
+func (s *Server) CreateProduct(w http.ResponseWriter, r *http.Request) {
+	var req Product
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.ID, req.Reserved, req.DeletedAt = 0, 0, nil
+
+	if err := validateProduct(req); err != nil {
+		writeProductError(w, err)
+		return
+	}
+
+	product, err := s.store.CreateProduct(r.Context(), req)
+	if err != nil {
+		writeProductError(w, err)
+		return
+	}
+	s.indexProduct(product)
+	writeJSON(w, http.StatusCreated, product)
+}
+
+// Replace every field of a product
+func (s *Server) ReplaceProduct(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	var req Product
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateProduct(req); err != nil {
+		writeProductError(w, err)
+		return
+	}
+
+	product, err := s.store.UpdateProduct(r.Context(), id, func(p *Product) error {
+		if p.DeletedAt != nil {
+			return ErrProductNotFound
+		}
+		req.ID, req.DeletedAt = p.ID, nil
+		err := keepReservations(*p, &req)
+		*p = req
+		return err
+	})
+	if err != nil {
+		writeProductError(w, err)
+		return
+	}
+	s.indexProduct(product)
+	writeJSON(w, http.StatusOK, product)
+}
+
+// Change some fields of a product
+func (s *Server) PatchProduct(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	var patch ProductPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	product, err := s.store.UpdateProduct(r.Context(), id, func(p *Product) error {
+		if p.DeletedAt != nil {
+			return ErrProductNotFound
+		}
+		old := *p
+		patch.apply(p)
+		if err := validateProduct(*p); err != nil {
+			return err
+		}
+		return keepReservations(old, p)
+	})
+	if err != nil {
+		writeProductError(w, err)
+		return
+	}
+	s.indexProduct(product)
+	writeJSON(w, http.StatusOK, product)
+}
+
+// Withdraw a product from sale. It is kept so existing orders still
+// resolve it, but no longer listed or orderable.
+func (s *Server) DeleteProduct(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	product, err := s.store.UpdateProduct(r.Context(), id, func(p *Product) error {
+		if p.DeletedAt == nil {
+			now := time.Now()
+			p.DeletedAt = &now
+		}
+		return nil
+	})
+	if err != nil {
+		writeProductError(w, err)
+		return
+	}
+	s.indexProduct(product)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Create or update products in bulk from a CSV or NDJSON file, matching
+// them by SKU. Nothing is saved if any row is invalid, or with dry_run=true;
+// either way the response lists what each row does.
+func (s *Server) ImportProducts(w http.ResponseWriter, r *http.Request) {
+	format, err := importFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	var dryRun bool
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "dry_run must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("Import is larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	report, err := s.planImport(r.Context(), format, data)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	report.DryRun = dryRun
+	if report.Failed == 0 && !dryRun {
+		if err := s.applyImport(r.Context(), &report); err != nil {
+			writeProductError(w, err)
+			return
+		}
+	}
+	if report.Failed > 0 {
+		writeJSON(w, http.StatusUnprocessableEntity, report)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// Stream the products on sale as CSV (the default) or NDJSON, in the
+// format ImportProducts reads
+func (s *Server) ExportProducts(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "":
+		format = FormatCSV
+	case FormatCSV, FormatNDJSON:
+	default:
+		http.Error(w, fmt.Sprintf("format must be %s or %s", FormatCSV, FormatNDJSON), http.StatusBadRequest)
+		return
+	}
+
+	page := Page{Limit: MaxPageLimit}
+	products, err := s.store.ListProducts(r.Context(), ProductFilter{}, page)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	// Products are written a page at a time; once the first page is out an
+	// error can only cut the export short
+	var write func(Product) error
+	var flush func() error
+	if format == FormatCSV {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="products.csv"`)
+		cw := csv.NewWriter(w)
+		header := make([]string, len(catalogColumns))
+		for i, col := range catalogColumns {
+			header[i] = col.name
+		}
+		cw.Write(header)
+		write = func(p Product) error { return cw.Write(catalogRecord(p)) }
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="products.ndjson"`)
+		enc := json.NewEncoder(w)
+		write = func(p Product) error { return enc.Encode(newCatalogEntry(p)) }
+		flush = func() error { return nil }
+	}
+
+	for {
+		for _, p := range products {
+			if err = write(p); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = flush()
+		}
+		if err != nil || len(products) < page.Limit {
+			break
+		}
+		page.AfterID = products[len(products)-1].ID
+		products, err = s.store.ListProducts(r.Context(), ProductFilter{}, page)
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		log.Printf("export products: %v", err)
+	}
+}
+
+// writeProductError responds to a failed product change
+func writeProductError(w http.ResponseWriter, err error) {
+	var verr *ValidationError
+	switch {
+	case errors.As(err, &verr):
+		writeJSON(w, http.StatusUnprocessableEntity, verr)
+	case errors.Is(err, ErrProductNotFound):
+		http.Error(w, "Product not found", http.StatusNotFound)
+	case errors.Is(err, ErrDuplicateSKU):
+		writeJSON(w, http.StatusConflict, ErrorResponse{Message: err.Error()})
+	default:
+		internalError(w, err)
+	}
+}
+
+// Get the category tree
+func (s *Server) GetCategories(w http.ResponseWriter, r *http.Request) {
+	categories, err := s.store.ListCategories(r.Context())
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, categoryTree(categories, 0))
+}
+
+// Get a single category by slug, with its subcategories
+func (s *Server) GetCategory(w http.ResponseWriter, r *http.Request) {
+	categories, err := s.store.ListCategories(r.Context())
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	category, err := findCategory(categories, mux.Vars(r)["slug"])
+	if err != nil {
+		writeCategoryError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, CategoryNode{Category: category, Children: categoryTree(categories, category.ID)})
+}
+
+// Add a category. The slug defaults to one made from the name.
+func (s *Server) CreateCategory(w http.ResponseWriter, r *http.Request) {
+	var req Category
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.ID = 0
+	if req.Slug == "" {
+		req.Slug = slugify(req.Name)
+	}
+	if err := validateCategory(req); err != nil {
+		writeCategoryError(w, err)
+		return
+	}
+
+	category, err := s.store.CreateCategory(r.Context(), req)
+	if err != nil {
+		writeCategoryError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, category)
+}
+
+// Replace every field of a category. Renaming it moves its products along;
+// changing its parent moves its whole subtree.
+func (s *Server) ReplaceCategory(w http.ResponseWriter, r *http.Request) {
+	var req Category
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Slug == "" {
+		req.Slug = slugify(req.Name)
+	}
+	if err := validateCategory(req); err != nil {
+		writeCategoryError(w, err)
+		return
+	}
+
+	id, err := s.categoryID(r)
+	if err != nil {
+		writeCategoryError(w, err)
+		return
+	}
+	renamed := false
+	category, err := s.store.UpdateCategory(r.Context(), id, func(c *Category) error {
+		req.ID = c.ID
+		renamed = req.Name != c.Name
+		*c = req
+		return nil
+	})
+	if err != nil {
+		writeCategoryError(w, err)
+		return
+	}
+	if renamed {
+		s.dropSearchIndex()
+	}
+	writeJSON(w, http.StatusOK, category)
+}
+
+// Remove a category that no longer has subcategories or products on sale
+func (s *Server) DeleteCategory(w http.ResponseWriter, r *http.Request) {
+	id, err := s.categoryID(r)
+	if err == nil {
+		err = s.store.DeleteCategory(r.Context(), id)
+	}
+	if err != nil {
+		writeCategoryError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// categoryID looks up the ID of the category a request's slug names
+func (s *Server) categoryID(r *http.Request) (int, error) {
+	categories, err := s.store.ListCategories(r.Context())
+	if err != nil {
+		return 0, err
+	}
+	category, err := findCategory(categories, mux.Vars(r)["slug"])
+	return category.ID, err
+}
+
+// writeCategoryError responds to a failed category lookup or change
+func writeCategoryError(w http.ResponseWriter, err error) {
+	var verr *ValidationError
+	switch {
+	case errors.As(err, &verr):
+		writeJSON(w, http.StatusUnprocessableEntity, verr)
+	case errors.Is(err, ErrParentNotFound), errors.Is(err, ErrCategoryCycle):
+		writeJSON(w, http.StatusUnprocessableEntity, &ValidationError{
+			Message: "invalid category",
+			Fields:  []FieldError{{Field: "parent_id", Message: err.Error()}},
+		})
+	case errors.Is(err, ErrCategoryNotFound):
+		http.Error(w, "Category not found", http.StatusNotFound)
+	case errors.Is(err, ErrDuplicateCategory), errors.Is(err, ErrCategoryInUse):
+		writeJSON(w, http.StatusConflict, ErrorResponse{Message: err.Error()})
+	default:
+		internalError(w, err)
+	}
+}
+
+// Create a new order, linked to the customer's account when signed in
+func (s *Server) CreateOrder(w http.ResponseWriter, r *http.Request) {
+	var req Order
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	who, err := s.identify(r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	req.AccountID = who.accountID
+
+	order, err := s.placeOrder(r.Context(), req.Items, req.OrderContact)
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		writeJSON(w, http.StatusUnprocessableEntity, verr)
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
+
+// placeOrder validates items and contact details and places an order for
+// them, reserving their stock. Items that cannot be ordered and invalid
+// details are reported as a *ValidationError. A guest order comes back
+// with its access token.
+func (s *Server) placeOrder(ctx context.Context, items []OrderItem, contact OrderContact) (Order, error) {
+	if err := s.validateOrderItems(ctx, items); err != nil {
+		return Order{}, err
+	}
+	contact = normalizeContact(contact)
+	if err := validateContact(contact); err != nil {
+		return Order{}, err
+	}
+	var token string
+	contact.AccessTokenHash = ""
+	if contact.AccountID == 0 {
+		var err error
+		if token, err = newToken(); err != nil {
+			return Order{}, err
+		}
+		contact.AccessTokenHash = hashToken(token)
+	}
+
+	order, err := s.store.CreateOrder(ctx, items, contact)
+	if errors.Is(err, ErrProductNotFound) || errors.Is(err, ErrVariantNotFound) ||
+		errors.Is(err, ErrOutOfStock) || errors.Is(err, ErrCurrencyMismatch) {
+		// The catalog or stock changed after validation
+		return Order{}, &ValidationError{Message: err.Error()}
+	}
+	if err != nil {
+		return Order{}, err
+	}
+	order.AccessToken = token
+	return order, nil
+}
+
+// Create a cart, optionally with items in it
+func (s *Server) CreateCart(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Items []CartItem `json:"items"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	id, err := newCartID()
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	now := time.Now()
+	cart := Cart{ID: id, Items: []CartItem{}, CreatedAt: now, UpdatedAt: now}
+	for _, item := range req.Items {
+		item.ID = 0
+		if err := s.checkCartItem(r.Context(), cart.addItem(item)); err != nil {
+			writeCartError(w, err)
+			return
+		}
+	}
+
+	cart, err = s.store.CreateCart(r.Context(), cart)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	s.writeCart(w, r, http.StatusCreated, cart)
+}
+
+// Get a cart with its lines priced at today's catalog
+func (s *Server) GetCart(w http.ResponseWriter, r *http.Request) {
+	cart, err := s.getCart(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeCartError(w, err)
+		return
+	}
+	s.writeCart(w, r, http.StatusOK, cart)
+}
+
+// Add units of a product or variant to a cart, on the line already holding
+// it if there is one
+func (s *Server) AddCartItem(w http.ResponseWriter, r *http.Request) {
+	var req CartItem
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.ID = 0
+
+	cart, err := s.editCart(r.Context(), mux.Vars(r)["id"], func(c *Cart) (*CartItem, error) {
+		line := c.addItem(req)
+		return &line, nil
+	})
+	if err != nil {
+		writeCartError(w, err)
+		return
+	}
+	s.writeCart(w, r, http.StatusOK, cart)
+}
+
+// Change the quantity of a cart line
+func (s *Server) UpdateCartItem(w http.ResponseWriter, r *http.Request) {
+	itemID, err := strconv.Atoi(mux.Vars(r)["item"])
+	if err != nil {
+		http.Error(w, "Invalid cart item ID", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Quantity int `json:"quantity"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	cart, err := s.editCart(r.Context(), mux.Vars(r)["id"], func(c *Cart) (*CartItem, error) {
+		i := c.itemIndex(itemID)
+		if i < 0 {
+			return nil, ErrCartItemNotFound
+		}
+		c.Items[i].Quantity = req.Quantity
+		return &c.Items[i], nil
+	})
+	if err != nil {
+		writeCartError(w, err)
+		return
+	}
+	s.writeCart(w, r, http.StatusOK, cart)
 }
 
-// PaymentResponse represents a payment response
-type PaymentResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
-	OrderID int    `json:"order_id"`
+// Remove a line from a cart
+func (s *Server) RemoveCartItem(w http.ResponseWriter, r *http.Request) {
+	itemID, err := strconv.Atoi(mux.Vars(r)["item"])
+	if err != nil {
+		http.Error(w, "Invalid cart item ID", http.StatusBadRequest)
+		return
+	}
+
+	cart, err := s.editCart(r.Context(), mux.Vars(r)["id"], func(c *Cart) (*CartItem, error) {
+		i := c.itemIndex(itemID)
+		if i < 0 {
+			return nil, ErrCartItemNotFound
+		}
+		c.Items = append(c.Items[:i], c.Items[i+1:]...)
+		return nil, nil
+	})
+	if err != nil {
+		writeCartError(w, err)
+		return
+	}
+	s.writeCart(w, r, http.StatusOK, cart)
 }
 
-// In-memory storage (in production, use a database)
-var products []Product
-var orders []Order
-var nextOrderID = 1
-
-func init() {
-	// Initialize with 5 sample products
-	products = []Product{
-		{
-			ID:          1,
-			Name:        "Wireless Headphones",
-			Description: "High-quality wireless headphones with noise cancellation",
-			Price:       99.99,
-			Image:       "https://images.unsplash.com/photo-1505740420928-5e560c06d30e?w=300&h=200&fit=crop",
-			Category:    "Electronics",
-		},
-		{
-			ID:          2,
-			Name:        "Smart Watch",
-			Description: "Fitness tracking smartwatch with heart rate monitor",
-			Price:       199.99,
-			Image:       "https://images.unsplash.com/photo-1523275335684-37898b6baf30?w=300&h=200&fit=crop",
-			Category:    "Electronics",
-		},
-		{
-			ID:          3,
-			Name:        "Coffee Maker",
-			Description: "Automatic drip coffee maker with programmable timer",
-			Price:       79.99,
-			Image:       "https://images.unsplash.com/photo-1495474472287-4d71bcdd2085?w=300&h=200&fit=crop",
-			Category:    "Kitchen",
-		},
-		{
-			ID:          4,
-			Name:        "Running Shoes",
-			Description: "Comfortable running shoes with breathable mesh",
-			Price:       129.99,
-			Image:       "https://images.unsplash.com/photo-1542291026-7eec264c27ff?w=300&h=200&fit=crop",
-			Category:    "Sports",
-		},
-		{
-			ID:          5,
-			Name:        "Laptop Backpack",
-			Description: "Durable laptop backpack with multiple compartments",
-			Price:       49.99,
-			Image:       "https://images.unsplash.com/photo-1553062407-98eeb64c6a62?w=300&h=200&fit=crop",
-			Category:    "Accessories",
-		},
-	}
-}
-
-// Get all products
-func GetProducts(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(products)
+// Place an order for everything in a cart, linked to the customer's account
+// when signed in
+func (s *Server) CheckoutCart(w http.ResponseWriter, r *http.Request) {
+	var contact OrderContact
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&contact); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	who, err := s.identify(r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	contact.AccountID = who.accountID
+
+	order, err := s.checkoutCart(r.Context(), mux.Vars(r)["id"], contact)
+	if err != nil {
+		writeCartError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, order)
 }
 
-// Get a single product by ID
-func GetProduct(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id, err := strconv.Atoi(vars["id"])
+// writeCart responds with a cart priced at today's catalog
+func (s *Server) writeCart(w http.ResponseWriter, r *http.Request, status int, cart Cart) {
+	resp, err := s.priceCart(r.Context(), cart)
 	if err != nil {
-		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		internalError(w, err)
 		return
 	}
+	writeJSON(w, status, resp)
+}
 
-	for _, product := range products {
-		if product.ID == id {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(product)
-			return
-		}
+// writeCartError responds to a failed cart lookup, change or checkout
+func writeCartError(w http.ResponseWriter, err error) {
+	var verr *ValidationError
+	switch {
+	case errors.As(err, &verr):
+		writeJSON(w, http.StatusUnprocessableEntity, verr)
+	case errors.Is(err, ErrCartNotFound):
+		http.Error(w, "Cart not found", http.StatusNotFound)
+	case errors.Is(err, ErrCartItemNotFound):
+		http.Error(w, "Cart item not found", http.StatusNotFound)
+	case errors.Is(err, ErrCartCheckedOut):
+		writeJSON(w, http.StatusConflict, ErrorResponse{Message: err.Error()})
+	default:
+		internalError(w, err)
+	}
+}
+
+// Register a customer account and sign it in
+func (s *Server) Register(w http.ResponseWriter, r *http.Request) {
+	var req RegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	account, err := s.register(r.Context(), req)
+	var verr *ValidationError
+	switch {
+	case errors.As(err, &verr):
+		writeJSON(w, http.StatusUnprocessableEntity, verr)
+		return
+	case errors.Is(err, ErrDuplicateAccount):
+		writeJSON(w, http.StatusConflict, ErrorResponse{Message: err.Error()})
+		return
+	case err != nil:
+		internalError(w, err)
+		return
 	}
 
-	http.Error(w, "Product not found", http.StatusNotFound)
+	resp, err := s.startSession(r.Context(), account)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, resp)
 }
 
-// Create a new order
-func CreateOrder(w http.ResponseWriter, r *http.Request) {
-	var order Order
-	if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
+// Sign a customer in with their email and password
+func (s *Server) Login(w http.ResponseWriter, r *http.Request) {
+	var req LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	// Calculate total
-	total := 0.0
-	for _, item := range order.Items {
-		for _, product := range products {
-			if product.ID == item.ProductID {
-				total += product.Price * float64(item.Quantity)
-				break
-			}
-		}
+	resp, err := s.login(r.Context(), req)
+	if errors.Is(err, ErrBadCredentials) {
+		writeJSON(w, http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Sign the customer out, ending the session of the token sent
+func (s *Server) Logout(w http.ResponseWriter, r *http.Request) {
+	who, err := s.identify(r)
+	if err == nil && who.token == "" {
+		err = errSignInRequired
+	}
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	if err := s.store.DeleteSession(r.Context(), hashToken(who.token)); err != nil {
+		internalError(w, err)
+		return
 	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Get the account of the signed-in customer
+func (s *Server) GetAccount(w http.ResponseWriter, r *http.Request) {
+	who, err := s.identify(r)
+	if err == nil && who.accountID == 0 {
+		err = errSignInRequired
+	}
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	account, err := s.store.GetAccount(r.Context(), who.accountID)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, account)
+}
+
+// writeAuthError responds to a request whose sender could not be told or
+// needs to sign in
+func writeAuthError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errUnauthenticated) || errors.Is(err, errSignInRequired) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="customer"`)
+		writeJSON(w, http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+	internalError(w, err)
+}
 
-	// Create order
-	order.ID = nextOrderID
-	nextOrderID++
-	order.Total = total
-	order.Status = "pending"
-	order.CreatedAt = time.Now()
+// Get all orders matching the query filters, or a page of them when limit
+// or cursor is given
+func (s *Server) GetOrders(w http.ResponseWriter, r *http.Request) {
+	who, err := s.identify(r)
+	if err == nil && who.guest() {
+		err = errSignInRequired
+	}
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	filter, err := parseOrderFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Customers only see their own orders; the admin sees every order
+	filter.AccountID = who.accountID
+	page, paged, err := parsePage(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	orders = append(orders, order)
+	orders, err := s.store.ListOrders(r.Context(), filter, page.lookahead())
+	if err != nil {
+		internalError(w, err)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(order)
+	if paged {
+		json.NewEncoder(w).Encode(paginate(orders, page.Limit, func(o Order) (int, string) { return o.ID, "" }))
+		return
+	}
+	json.NewEncoder(w).Encode(orders)
 }
 
-// Get all orders
-func GetOrders(w http.ResponseWriter, r *http.Request) {
+// Get a single order by ID
+func (s *Server) GetOrder(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	who, err := s.identify(r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	order, err := s.store.GetOrder(r.Context(), id)
+	// Orders placed from an account are hidden from everyone else, as if
+	// they did not exist
+	if err == nil && !who.canAccess(order) {
+		err = ErrOrderNotFound
+	}
+	if err != nil {
+		writeOrderError(w, err)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(orders)
+	json.NewEncoder(w).Encode(order)
+}
+
+// StatusUpdateRequest moves an order along its fulfillment steps
+type StatusUpdateRequest struct {
+	Status OrderStatus `json:"status"`
+}
+
+// Update the fulfillment status of an order
+func (s *Server) UpdateOrderStatus(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	var req StatusUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !req.Status.Valid() {
+		writeJSON(w, http.StatusUnprocessableEntity, ErrorResponse{Message: fmt.Sprintf("unknown order status %q", req.Status)})
+		return
+	}
+	if !fulfillmentStatuses[req.Status] {
+		writeJSON(w, http.StatusUnprocessableEntity, ErrorResponse{Message: fmt.Sprintf("order status %s cannot be set directly", req.Status)})
+		return
+	}
+
+	order, err := s.store.UpdateOrder(r.Context(), id, func(o *Order) error {
+		return o.Transition(req.Status, time.Now())
+	})
+	if err != nil {
+		writeOrderError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, order)
+}
+
+// Cancel an order, refunding it in full if it was already paid
+func (s *Server) CancelOrder(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	who, err := s.identify(r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	order, err := s.store.GetOrder(r.Context(), id)
+	if err == nil && !who.canAccess(order) {
+		err = ErrOrderNotFound
+	}
+	if err == nil && !order.Status.CanTransition(StatusCancelled) {
+		err = fmt.Errorf("%w: cannot cancel a %s order", ErrInvalidTransition, order.Status)
+	}
+	// Refund a paid order before taking the store's lock, so no lock is
+	// held across a call to the gateway
+	var refund Refund
+	if err == nil && order.Status == StatusPaid {
+		var payment Payment
+		payment, err = s.capturedPayment(r.Context(), id)
+		if err == nil {
+			// An order is paid and cancelled once, and the gateway
+			// scopes keys to the payment, so the key is unique
+			refund, err = s.refund(r.Context(), payment, order.Total, order.Items, "order cancelled", "cancel")
+		}
+	}
+	if err != nil {
+		writeOrderError(w, err)
+		return
+	}
+
+	// Record the refund and the cancellation in one write. Once money went
+	// back it is recorded even if the client has gone.
+	ctx := r.Context()
+	if refund.Reference != "" {
+		ctx = context.WithoutCancel(ctx)
+	}
+	order, err = s.store.UpdateOrder(ctx, id, func(o *Order) error {
+		if refund.Reference == "" {
+			if o.Status == StatusPaid {
+				// Paid since we looked; the client can retry the cancellation
+				return fmt.Errorf("%w: order was paid while cancelling", ErrInvalidTransition)
+			}
+			if !o.Status.CanTransition(StatusCancelled) {
+				return fmt.Errorf("%w: cannot cancel a %s order", ErrInvalidTransition, o.Status)
+			}
+			return o.Transition(StatusCancelled, time.Now())
+		}
+		added, err := recordRefund(o, refund)
+		if err != nil {
+			return err
+		}
+		if !added && o.Status == StatusCancelled {
+			// A concurrent retry cancelled it with this same refund
+			return nil
+		}
+		if o.Status.CanTransition(StatusCancelled) {
+			return o.Transition(StatusCancelled, time.Now())
+		}
+		// Moved along meanwhile; the money is back all the same
+		return settleRefunds(o)
+	})
+	if errors.Is(err, ErrOverRefund) {
+		log.Printf("refund %s of order %d went through but was not recorded: %v", refund.Reference, id, err)
+	}
+	if err != nil {
+		writeOrderError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, order)
 }
 
 // Process payment
-func ProcessPayment(w http.ResponseWriter, r *http.Request) {
+func (s *Server) ProcessPayment(w http.ResponseWriter, r *http.Request) {
+	who, err := s.identify(r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
 	var paymentReq PaymentRequest
 	if err := json.NewDecoder(r.Body).Decode(&paymentReq); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeJSON(w, http.StatusBadRequest, PaymentResponse{
+			Message: "Invalid request body",
+			Code:    PaymentCodeInvalidRequest,
+		})
 		return
 	}
 
-	// Find the order
-	var order *Order
-	for i := range orders {
-		if orders[i].ID == paymentReq.OrderID {
-			order = &orders[i]
-			break
+	// Find the order and reject it early if it cannot be paid. Another
+	// account's order is not found, as in GetOrder.
+	order, err := s.store.GetOrder(r.Context(), paymentReq.OrderID)
+	if err == nil && !who.canAccess(order) {
+		err = ErrOrderNotFound
+	}
+	if err == nil && s.reservationExpired(order, time.Now()) {
+		if _, eerr := s.expireOrder(r.Context(), order.ID, time.Now()); eerr != nil {
+			log.Printf("expire order %d: %v", order.ID, eerr)
 		}
+		err = ErrReservationExpired
+	}
+	if err == nil {
+		err = checkPayable(order, paymentReq.Amount)
+	}
+	if err != nil {
+		writePaymentError(w, paymentReq.OrderID, err)
+		return
 	}
 
-	if order == nil {
-		http.Error(w, "Order not found", http.StatusNotFound)
+	charge := ChargeRequest{
+		OrderID:       order.ID,
+		Amount:        paymentReq.Amount,
+		CardNumber:    paymentReq.CardNumber,
+		PaymentMethod: paymentReq.PaymentMethod,
+	}
+	var auth Authorization
+	if paymentReq.AuthorizationID != "" {
+		auth, err = s.gateway.Resume(r.Context(), paymentReq.AuthorizationID, charge)
+	} else {
+		auth, err = s.gateway.Authorize(r.Context(), charge)
+	}
+	if errors.Is(err, ErrCardDeclined) || errors.Is(err, ErrInsufficientFunds) {
+		s.markPaymentFailed(r.Context(), order.ID)
+	}
+	if err != nil {
+		writePaymentError(w, order.ID, err)
 		return
 	}
 
-	// Simulate payment processing
-	// In a real application, integrate with a payment processor like Stripe
-	time.Sleep(1 * time.Second) // Simulate processing time
+	// Capture before taking the store's lock, so no lock is held across a
+	// call to the gateway. An order paid while authorizing is caught here
+	// and only costs a void.
+	order, err = s.store.GetOrder(r.Context(), order.ID)
+	if err == nil {
+		err = checkPayable(order, paymentReq.Amount)
+	}
+	if err == nil {
+		err = s.gateway.Capture(r.Context(), auth.ID, paymentReq.Amount)
+	}
+	if err != nil {
+		if verr := s.gateway.Void(r.Context(), auth.ID); verr != nil {
+			log.Printf("void authorization %s: %v", auth.ID, verr)
+		}
+		writePaymentError(w, paymentReq.OrderID, err)
+		return
+	}
 
-	// Update order status
-	order.Status = "paid"
+	// Check again under the store's lock, then mark the order paid and
+	// record the payment in one write. A concurrent payment for the same
+	// order may have won meanwhile; the money just captured is then given
+	// back.
+	payment := Payment{OrderID: order.ID, Amount: paymentReq.Amount, Reference: auth.ID}
+	order, _, err = s.store.PayOrder(r.Context(), payment, func(o *Order) error {
+		if s.reservationExpired(*o, time.Now()) {
+			return ErrReservationExpired
+		}
+		if err := checkPayable(*o, paymentReq.Amount); err != nil {
+			return err
+		}
+		return o.Transition(StatusPaid, time.Now())
+	})
+	if err != nil {
+		// The client may be gone; the refund must go through regardless
+		ctx := context.WithoutCancel(r.Context())
+		if _, rerr := s.gateway.Refund(ctx, auth.ID, paymentReq.Amount, "reverse"); rerr != nil {
+			log.Printf("refund unrecorded payment %s of order %d: %v", auth.ID, payment.OrderID, rerr)
+		}
+		if errors.Is(err, ErrReservationExpired) {
+			if _, eerr := s.expireOrder(ctx, payment.OrderID, time.Now()); eerr != nil {
+				log.Printf("expire order %d: %v", payment.OrderID, eerr)
+			}
+		}
+		writePaymentError(w, payment.OrderID, err)
+		return
+	}
 
 	response := PaymentResponse{
 		Success: true,
@@ -204,73 +1340,217 @@ func ProcessPayment(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// markPaymentFailed records a declined payment on a pending order. The
+// order can still be paid with another card.
+func (s *Server) markPaymentFailed(ctx context.Context, orderID int) {
+	_, err := s.store.UpdateOrder(ctx, orderID, func(o *Order) error {
+		if o.Status != StatusPending {
+			return nil
+		}
+		return o.Transition(StatusFailed, time.Now())
+	})
+	if err != nil {
+		log.Printf("mark order %d failed: %v", orderID, err)
+	}
+}
+
+// Refund returned items or an amount of a paid order
+func (s *Server) CreateRefund(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	var req RefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	order, err := s.store.GetOrder(r.Context(), id)
+	if err == nil && !order.Status.CanTransition(StatusRefunded) {
+		err = fmt.Errorf("%w: cannot refund a %s order", ErrInvalidTransition, order.Status)
+	}
+	var payment Payment
+	if err == nil {
+		payment, err = s.capturedPayment(r.Context(), id)
+	}
+	var amount Money
+	var items []OrderItem
+	if err == nil {
+		amount, items, err = planRefund(order, req)
+	}
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		writeJSON(w, http.StatusUnprocessableEntity, verr)
+		return
+	}
+	if err != nil {
+		writeOrderError(w, err)
+		return
+	}
+
+	// Refund before taking the store's lock, so no lock is held across a
+	// call to the gateway. The client's Idempotency-Key, or else the
+	// request itself at this point in the ledger, keys the refund: a retry
+	// after it could not be recorded gets the same refund back.
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		key = refundKey(order, amount, items, req.Reason)
+	}
+	refund, err := s.refund(r.Context(), payment, amount, items, req.Reason, "refund-"+key)
+	if err != nil {
+		writeOrderError(w, err)
+		return
+	}
+
+	// Record the refund and the new status in one write, even if the
+	// client has gone
+	order, err = s.store.UpdateOrder(context.WithoutCancel(r.Context()), id, func(o *Order) error {
+		added, err := recordRefund(o, refund)
+		if err != nil || !added {
+			// Either a concurrent retry recorded this same refund, or
+			// the refund cannot be recorded
+			return err
+		}
+		return settleRefunds(o)
+	})
+	if errors.Is(err, ErrOverRefund) {
+		log.Printf("refund %s of order %d went through but was not recorded: %v", refund.Reference, id, err)
+	}
+	if err != nil {
+		writeOrderError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, order)
+}
+
+// writeOrderError responds to a failed order update
+func writeOrderError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrOrderNotFound):
+		http.Error(w, "Order not found", http.StatusNotFound)
+	case errors.Is(err, ErrInvalidTransition), errors.Is(err, ErrNoPayment),
+		errors.Is(err, ErrRefundMismatch), errors.Is(err, ErrOverRefund):
+		writeJSON(w, http.StatusConflict, ErrorResponse{Message: err.Error()})
+	default:
+		status, code, ok := paymentFailure(err)
+		if !ok {
+			internalError(w, err)
+			return
+		}
+		writeJSON(w, status, ErrorResponse{Message: err.Error(), Code: code})
+	}
+}
+
+// internalError logs a storage failure and hides the details from the client
+func internalError(w http.ResponseWriter, err error) {
+	log.Printf("internal error: %v", err)
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
+}
+
+// storeConfig selects and configures the storage backend
+type storeConfig struct {
+	Backend     string
+	SQLitePath  string
+	PostgresDSN string
+	// CatalogPath is the JSON or CSV file the store is seeded from
+	CatalogPath string
+}
+
+// gatewayConfig selects and configures the payment provider
+type gatewayConfig struct {
+	Provider      string
+	StripeBaseURL string
+	StripeAPIKey  string
+	// StripeReturnURL is where customers land after 3D Secure
+	StripeReturnURL string
+}
+
+// openGateway creates the payment gateway selected on the command line
+func openGateway(cfg gatewayConfig) (PaymentGateway, error) {
+	switch cfg.Provider {
+	case "fake":
+		return NewFakeGateway(), nil
+	case "stripe":
+		if cfg.StripeAPIKey == "" {
+			return nil, fmt.Errorf("stripe gateway needs an API key")
+		}
+		if cfg.StripeReturnURL == "" {
+			return nil, fmt.Errorf("stripe gateway needs a return URL for 3D Secure")
+		}
+		return NewStripeGateway(cfg.StripeBaseURL, cfg.StripeAPIKey, cfg.StripeReturnURL), nil
+	default:
+		return nil, fmt.Errorf("unknown payment gateway %q", cfg.Provider)
+	}
+}
+
+// openStore creates the storage backend selected on the command line
+func openStore(cfg storeConfig) (Store, error) {
+	products, err := LoadCatalog(cfg.CatalogPath)
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.Backend {
+	case "memory":
+		return NewMemoryStore(products), nil
+	case "sqlite":
+		return OpenSQLiteStore(cfg.SQLitePath, products)
+	case "postgres":
+		return OpenPostgresStore(cfg.PostgresDSN, products)
+	default:
+		return nil, fmt.Errorf("unknown store %q", cfg.Backend)
+	}
+}
+
 func main() {
-	r := mux.NewRouter()
+	var cfg storeConfig
+	maxQuantity := flag.Int("max-quantity", DefaultMaxQuantityPerLine, "maximum quantity allowed on a single order line")
+	flag.StringVar(&cfg.Backend, "store", "memory", "storage backend: memory, sqlite or postgres")
+	flag.StringVar(&cfg.SQLitePath, "sqlite-path", "ecommerce.db", "database file used by the sqlite store")
+	flag.StringVar(&cfg.PostgresDSN, "postgres-dsn", os.Getenv("DATABASE_URL"), "connection string used by the postgres store")
+	flag.StringVar(&cfg.CatalogPath, "catalog", DefaultCatalogPath, "JSON or CSV file the catalog is seeded from")
+	var gwCfg gatewayConfig
+	flag.StringVar(&gwCfg.Provider, "payment-gateway", "fake", "payment provider: fake or stripe")
+	flag.StringVar(&gwCfg.StripeBaseURL, "stripe-base-url", DefaultStripeBaseURL, "Stripe API base URL")
+	flag.StringVar(&gwCfg.StripeAPIKey, "stripe-api-key", os.Getenv("STRIPE_API_KEY"), "Stripe secret key")
+	flag.StringVar(&gwCfg.StripeReturnURL, "stripe-return-url", os.Getenv("STRIPE_RETURN_URL"), "page customers return to after 3D Secure")
+	adminToken := flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "bearer token for the admin endpoints; they are disabled when empty")
+	reservationTTL := flag.Duration("reservation-ttl", DefaultReservationTTL, "how long an unpaid order holds its stock; 0 holds it until the order is paid or cancelled")
+	cartTTL := flag.Duration("cart-ttl", DefaultCartTTL, "how long a cart is kept after its last change; 0 keeps carts forever")
+	sessionTTL := flag.Duration("session-ttl", DefaultSessionTTL, "how long a customer stays signed in")
+	flag.Parse()
 
-	// API routes
-	r.HandleFunc("/api/products", GetProducts).Methods("GET")
-	r.HandleFunc("/api/products/{id}", GetProduct).Methods("GET")
-	r.HandleFunc("/api/orders", CreateOrder).Methods("POST")
-	r.HandleFunc("/api/orders", GetOrders).Methods("GET")
-	r.HandleFunc("/api/payment", ProcessPayment).Methods("POST")
+	store, err := openStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	gateway, err := openGateway(gwCfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := NewServer(store,
+		WithMaxQuantityPerLine(*maxQuantity),
+		WithPaymentGateway(gateway),
+		WithAdminToken(*adminToken),
+		WithReservationTTL(*reservationTTL),
+		WithCartTTL(*cartTTL),
+		WithSessionTTL(*sessionTTL),
+	)
+	go server.expireReservationsEvery(context.Background(), time.Minute)
+	go server.expireCartsEvery(context.Background(), time.Hour)
+	go server.expireSessionsEvery(context.Background(), time.Hour)
 
 	// CORS configuration
 	c := cors.New(cors.Options{
 		AllowedOrigins: []string{"http://localhost:3000"},
-		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders: []string{"*"},
 	})
 
-	handler := c.Handler(r)
+	handler := c.Handler(server.Routes())
 
 	fmt.Println("Server starting on port 8080...")
 	log.Fatal(http.ListenAndServe(":8080", handler))
 }
-
-// ResetGlobalState resets the global state for testing
-func ResetGlobalState() {
-	products = []Product{
-		{
-			ID:          1,
-			Name:        "Wireless Headphones",
-			Description: "High-quality wireless headphones with noise cancellation",
-			Price:       99.99,
-			Image:       "https://images.unsplash.com/photo-1505740420928-5e560c06d30e?w=300&h=200&fit=crop",
-			Category:    "Electronics",
-		},
-		{
-			ID:          2,
-			Name:        "Smart Watch",
-			Description: "Fitness tracking smartwatch with heart rate monitor",
-			Price:       199.99,
-			Image:       "https://images.unsplash.com/photo-1523275335684-37898b6baf30?w=300&h=200&fit=crop",
-			Category:    "Electronics",
-		},
-		{
-			ID:          3,
-			Name:        "Coffee Maker",
-			Description: "Automatic drip coffee maker with programmable timer",
-			Price:       79.99,
-			Image:       "https://images.unsplash.com/photo-1495474472287-4d71bcdd2085?w=300&h=200&fit=crop",
-			Category:    "Kitchen",
-		},
-		{
-			ID:          4,
-			Name:        "Running Shoes",
-			Description: "Comfortable running shoes with breathable mesh",
-			Price:       129.99,
-			Image:       "https://images.unsplash.com/photo-1542291026-7eec264c27ff?w=300&h=200&fit=crop",
-			Category:    "Sports",
-		},
-		{
-			ID:          5,
-			Name:        "Laptop Backpack",
-			Description: "Durable laptop backpack with multiple compartments",
-			Price:       49.99,
-			Image:       "https://images.unsplash.com/photo-1553062407-98eeb64c6a62?w=300&h=200&fit=crop",
-			Category:    "Accessories",
-		},
-	}
-	orders = []Order{}
-	nextOrderID = 1
-}
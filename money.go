@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is the currency of amounts that are a bare decimal number
+// on the wire, and of catalog entries that name none
+const DefaultCurrency = "USD"
+
+// ErrCurrencyMismatch is returned when combining amounts in different currencies
+var ErrCurrencyMismatch = errors.New("currency mismatch")
+
+// currencyExponents maps ISO 4217 codes to the number of minor-unit digits.
+// Currencies not listed use two.
+var currencyExponents = map[string]int{
+	"JPY": 0,
+	"KRW": 0,
+	"BHD": 3,
+	"KWD": 3,
+}
+
+// Money is an exact amount held in the minor units (e.g. cents) of an ISO
+// 4217 currency.
+//
+// On the wire Money in DefaultCurrency is a bare decimal number such as
+// 99.99, so existing clients keep working; a quoted decimal string is
+// accepted as well. Amounts in other currencies carry their code, as in
+// {"amount": "1000", "currency": "JPY"}, and clients may send either form.
+// Decimal input with more digits than the currency allows is rounded half
+// away from zero to the nearest minor unit. Arithmetic on Money is exact.
+type Money struct {
+	Amount   int64
+	Currency string
+}
+
+// NewMoney returns an amount of minor units in the given currency
+func NewMoney(minor int64, currency string) Money {
+	return Money{Amount: minor, Currency: currency}
+}
+
+// ParseMoney parses a decimal string such as "19.99" in the given currency
+func ParseMoney(s, currency string) (Money, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok {
+		return Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exponent(currency))), nil)
+	r.Mul(r, new(big.Rat).SetInt(scale))
+
+	// Round half away from zero
+	num, den := r.Num(), r.Denom()
+	q, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if new(big.Int).Mul(new(big.Int).Abs(rem), big.NewInt(2)).Cmp(den) >= 0 {
+		if num.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	if !q.IsInt64() {
+		return Money{}, fmt.Errorf("amount %q out of range", s)
+	}
+	return Money{Amount: q.Int64(), Currency: currency}, nil
+}
+
+// exponent returns the number of minor-unit digits of a currency
+func exponent(currency string) int {
+	if e, ok := currencyExponents[currency]; ok {
+		return e
+	}
+	return 2
+}
+
+// String formats the amount as a plain decimal, e.g. "99.99"
+func (m Money) String() string {
+	exp := exponent(m.Currency)
+	sign := ""
+	minor := m.Amount
+	if minor < 0 {
+		sign = "-"
+	}
+	digits := strconv.FormatUint(absInt64(minor), 10)
+	if exp == 0 {
+		return sign + digits
+	}
+	if len(digits) <= exp {
+		digits = strings.Repeat("0", exp-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-exp] + "." + digits[len(digits)-exp:]
+}
+
+func absInt64(n int64) uint64 {
+	if n < 0 {
+		return uint64(-(n + 1)) + 1
+	}
+	return uint64(n)
+}
+
+// Add returns m + o; both amounts must be in the same currency
+func (m Money) Add(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, o.Currency)
+	}
+	return Money{Amount: m.Amount + o.Amount, Currency: m.Currency}, nil
+}
+
+// Mul returns the amount multiplied by an integer quantity
+func (m Money) Mul(n int) Money {
+	return Money{Amount: m.Amount * int64(n), Currency: m.Currency}
+}
+
+// IsZero reports whether the amount is zero
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+// moneyObject is Money on the wire when it is not in DefaultCurrency
+type moneyObject struct {
+	Amount   json.RawMessage `json:"amount"`
+	Currency string          `json:"currency"`
+}
+
+// currencyPattern matches ISO 4217 currency codes
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// MarshalJSON writes an amount in DefaultCurrency as a bare decimal number
+// and any other as an object with its currency
+func (m Money) MarshalJSON() ([]byte, error) {
+	if m.Currency == DefaultCurrency || m.Currency == "" {
+		return []byte(m.String()), nil
+	}
+	amount, _ := json.Marshal(m.String())
+	return json.Marshal(moneyObject{Amount: amount, Currency: m.Currency})
+}
+
+// UnmarshalJSON reads a decimal number or a quoted decimal string in the
+// default currency, or an object naming its currency
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	currency := DefaultCurrency
+	if len(data) > 0 && data[0] == '{' {
+		var obj moneyObject
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return err
+		}
+		currency = strings.ToUpper(strings.TrimSpace(obj.Currency))
+		if !currencyPattern.MatchString(currency) {
+			return fmt.Errorf("invalid currency %q", obj.Currency)
+		}
+		data = bytes.TrimSpace(obj.Amount)
+	}
+	s := string(data)
+	if len(data) > 0 && data[0] == '"' {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+	}
+	parsed, err := ParseMoney(s, currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
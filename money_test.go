@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseMoneyRounding(t *testing.T) {
+	// Input with more digits than the currency allows is rounded half away
+	// from zero to the nearest minor unit
+	testCases := []struct {
+		input    string
+		currency string
+		expected int64
+	}{
+		{"99.99", "USD", 9999},
+		{"100", "USD", 10000},
+		{"0.1", "USD", 10},
+		{"0.004", "USD", 0},
+		{"0.005", "USD", 1},
+		{"0.015", "USD", 2},
+		{"0.025", "USD", 3},
+		{"-0.005", "USD", -1},
+		{"-0.004", "USD", 0},
+		{"1e2", "USD", 10000},
+		{"1234.5", "JPY", 1235},
+		{"1.2345", "KWD", 1235},
+	}
+
+	for _, tc := range testCases {
+		got, err := ParseMoney(tc.input, tc.currency)
+		if err != nil {
+			t.Errorf("ParseMoney(%q): %v", tc.input, err)
+			continue
+		}
+		if got.Amount != tc.expected || got.Currency != tc.currency {
+			t.Errorf("ParseMoney(%q, %s): expected %d, got %+v", tc.input, tc.currency, tc.expected, got)
+		}
+	}
+
+	if _, err := ParseMoney("ten dollars", "USD"); err == nil {
+		t.Error("expected an error for a non-numeric amount")
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	testCases := []struct {
+		money    Money
+		expected string
+	}{
+		{NewMoney(9999, "USD"), "99.99"},
+		{NewMoney(5, "USD"), "0.05"},
+		{NewMoney(0, "USD"), "0.00"},
+		{NewMoney(-150, "USD"), "-1.50"},
+		{NewMoney(1500, "JPY"), "1500"},
+		{NewMoney(1500, "KWD"), "1.500"},
+	}
+
+	for _, tc := range testCases {
+		if got := tc.money.String(); got != tc.expected {
+			t.Errorf("expected %s, got %s", tc.expected, got)
+		}
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	// Amounts are written as bare decimal numbers, as the float API did
+	data, err := json.Marshal(Product{ID: 1, Price: NewMoney(19999, DefaultCurrency)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw map[string]any
+	json.Unmarshal(data, &raw)
+	if price, ok := raw["price"].(float64); !ok || price != 199.99 {
+		t.Errorf("expected price to be the number 199.99, got %v", raw["price"])
+	}
+
+	// Both numbers and decimal strings are accepted on input
+	for _, input := range []string{`{"amount": 129.99}`, `{"amount": "129.99"}`} {
+		var req PaymentRequest
+		if err := json.Unmarshal([]byte(input), &req); err != nil {
+			t.Fatalf("unmarshal %s: %v", input, err)
+		}
+		if req.Amount != NewMoney(12999, DefaultCurrency) {
+			t.Errorf("unmarshal %s: got %+v", input, req.Amount)
+		}
+	}
+
+	// Other currencies carry their code and survive a round trip
+	yen := NewMoney(1000, "JPY")
+	data, err = json.Marshal(yen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"amount":"1000","currency":"JPY"}` {
+		t.Errorf("expected the amount with its currency, got %s", data)
+	}
+	var back Money
+	if err := json.Unmarshal(data, &back); err != nil || back != yen {
+		t.Errorf("expected %+v back, got %+v (%v)", yen, back, err)
+	}
+	for _, input := range []string{`{"amount": 12.345, "currency": "bhd"}`, `{"amount": "12.345", "currency": "BHD"}`} {
+		var m Money
+		if err := json.Unmarshal([]byte(input), &m); err != nil || m != NewMoney(12345, "BHD") {
+			t.Errorf("unmarshal %s: got %+v (%v)", input, m, err)
+		}
+	}
+
+	for _, input := range []string{`{"amount": "abc"}`, `{"amount": {"amount": "1", "currency": "YEN!"}}`} {
+		var req PaymentRequest
+		if err := json.Unmarshal([]byte(input), &req); err == nil {
+			t.Errorf("unmarshal %s: expected an error", input)
+		}
+	}
+}
+
+func TestMoneyArithmeticIsExact(t *testing.T) {
+	// Summing 0.10 * 3 a thousand times drifts in float64; minor units do not
+	total := NewMoney(0, DefaultCurrency)
+	for i := 0; i < 1000; i++ {
+		var err error
+		total, err = total.Add(NewMoney(10, DefaultCurrency).Mul(3))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if total.String() != "300.00" {
+		t.Errorf("expected 300.00, got %s", total)
+	}
+
+	_, err := NewMoney(100, "USD").Add(NewMoney(100, "EUR"))
+	if !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("expected ErrCurrencyMismatch, got %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OrderFilter narrows ListOrders; zero fields match every order
+type OrderFilter struct {
+	Status OrderStatus
+	// CreatedAfter and CreatedBefore bound created_at; the lower bound is
+	// inclusive and the upper bound exclusive
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// MinTotal and MaxTotal bound the order total, inclusive
+	MinTotal *Money
+	MaxTotal *Money
+	// ProductID matches orders with a line for that product
+	ProductID int
+	// AccountID matches the orders placed by that account
+	AccountID int
+}
+
+// Matches reports whether order passes the filter
+func (f OrderFilter) Matches(order Order) bool {
+	switch {
+	case f.Status != "" && order.Status != f.Status:
+		return false
+	case !f.CreatedAfter.IsZero() && order.CreatedAt.Before(f.CreatedAfter):
+		return false
+	case !f.CreatedBefore.IsZero() && !order.CreatedAt.Before(f.CreatedBefore):
+		return false
+	case f.MinTotal != nil && (order.Total.Currency != f.MinTotal.Currency || order.Total.Amount < f.MinTotal.Amount):
+		return false
+	case f.MaxTotal != nil && (order.Total.Currency != f.MaxTotal.Currency || order.Total.Amount > f.MaxTotal.Amount):
+		return false
+	case f.AccountID != 0 && order.AccountID != f.AccountID:
+		return false
+	}
+	if f.ProductID == 0 {
+		return true
+	}
+	for _, item := range order.Items {
+		if item.ProductID == f.ProductID {
+			return true
+		}
+	}
+	return false
+}
+
+// where renders the filter as a SQL condition on the orders table, written
+// with ? placeholders, and its arguments
+func (f OrderFilter) where() (string, []any) {
+	var conds []string
+	var args []any
+	if f.Status != "" {
+		conds = append(conds, "status = ?")
+		args = append(args, f.Status)
+	}
+	if !f.CreatedAfter.IsZero() {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, f.CreatedAfter.UTC())
+	}
+	if !f.CreatedBefore.IsZero() {
+		conds = append(conds, "created_at < ?")
+		args = append(args, f.CreatedBefore.UTC())
+	}
+	if f.MinTotal != nil {
+		conds = append(conds, "currency = ? AND total_minor >= ?")
+		args = append(args, f.MinTotal.Currency, f.MinTotal.Amount)
+	}
+	if f.MaxTotal != nil {
+		conds = append(conds, "currency = ? AND total_minor <= ?")
+		args = append(args, f.MaxTotal.Currency, f.MaxTotal.Amount)
+	}
+	if f.AccountID != 0 {
+		conds = append(conds, "account_id = ?")
+		args = append(args, f.AccountID)
+	}
+	if f.ProductID != 0 {
+		conds = append(conds, "EXISTS (SELECT 1 FROM order_items WHERE order_items.order_id = orders.id AND order_items.product_id = ?)")
+		args = append(args, f.ProductID)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// parseOrderFilter reads a filter from the query string of GET /api/orders
+func parseOrderFilter(query url.Values) (OrderFilter, error) {
+	var f OrderFilter
+	if v := query.Get("status"); v != "" {
+		f.Status = OrderStatus(v)
+		if !f.Status.Valid() {
+			return OrderFilter{}, fmt.Errorf("unknown order status %q", v)
+		}
+	}
+	for _, bound := range []struct {
+		param string
+		dst   *time.Time
+	}{
+		{"created_after", &f.CreatedAfter},
+		{"created_before", &f.CreatedBefore},
+	} {
+		if v := query.Get(bound.param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return OrderFilter{}, fmt.Errorf("%s must be an RFC 3339 timestamp", bound.param)
+			}
+			*bound.dst = t
+		}
+	}
+	for _, bound := range []struct {
+		param string
+		dst   **Money
+	}{
+		{"min_total", &f.MinTotal},
+		{"max_total", &f.MaxTotal},
+	} {
+		if v := query.Get(bound.param); v != "" {
+			m, err := ParseMoney(v, DefaultCurrency)
+			if err != nil {
+				return OrderFilter{}, fmt.Errorf("%s: %v", bound.param, err)
+			}
+			*bound.dst = &m
+		}
+	}
+	if v := query.Get("product_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id <= 0 {
+			return OrderFilter{}, fmt.Errorf("product_id must be a positive integer")
+		}
+		f.ProductID = id
+	}
+	return f, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// OrderStatus is a step in the order lifecycle
+type OrderStatus string
+
+// Order lifecycle:
+//
+//	pending ──► paid ──► fulfilled ──► shipped ──► delivered
+//	   │  ▲       │          │            │            │
+//	   ▼  │       ▼          ▼            ▼            ▼
+//	  failed   cancelled   partially_refunded ──► refunded
+//
+// pending and failed orders can be paid or cancelled; paid orders can be
+// cancelled or refunded; fulfilled, shipped and delivered orders can only be
+// refunded, in part or in full. cancelled and refunded are final.
+const (
+	StatusPending           OrderStatus = "pending"
+	StatusPaid              OrderStatus = "paid"
+	StatusFulfilled         OrderStatus = "fulfilled"
+	StatusShipped           OrderStatus = "shipped"
+	StatusDelivered         OrderStatus = "delivered"
+	StatusCancelled         OrderStatus = "cancelled"
+	StatusPartiallyRefunded OrderStatus = "partially_refunded"
+	StatusRefunded          OrderStatus = "refunded"
+	StatusFailed            OrderStatus = "failed"
+)
+
+// ErrInvalidTransition is returned when an order cannot move to a status
+var ErrInvalidTransition = errors.New("invalid order status transition")
+
+// orderTransitions lists the statuses each status may move to
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	StatusPending:           {StatusPaid, StatusFailed, StatusCancelled},
+	StatusFailed:            {StatusPaid, StatusCancelled},
+	StatusPaid:              {StatusFulfilled, StatusCancelled, StatusPartiallyRefunded, StatusRefunded},
+	StatusFulfilled:         {StatusShipped, StatusPartiallyRefunded, StatusRefunded},
+	StatusShipped:           {StatusDelivered, StatusPartiallyRefunded, StatusRefunded},
+	StatusDelivered:         {StatusPartiallyRefunded, StatusRefunded},
+	StatusPartiallyRefunded: {StatusRefunded},
+	StatusCancelled:         {},
+	StatusRefunded:          {},
+}
+
+// fulfillmentStatuses can be set directly through the API; the others are
+// reached by paying, cancelling or refunding an order
+var fulfillmentStatuses = map[OrderStatus]bool{
+	StatusFulfilled: true,
+	StatusShipped:   true,
+	StatusDelivered: true,
+}
+
+// StatusChange records one transition in an order's history
+type StatusChange struct {
+	From OrderStatus `json:"from,omitempty"`
+	To   OrderStatus `json:"to"`
+	At   time.Time   `json:"at"`
+}
+
+// Valid reports whether s is a known order status
+func (s OrderStatus) Valid() bool {
+	_, ok := orderTransitions[s]
+	return ok
+}
+
+// CanTransition reports whether an order may move from s to next
+func (s OrderStatus) CanTransition(next OrderStatus) bool {
+	for _, allowed := range orderTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition moves the order to next and records the change, or returns
+// ErrInvalidTransition if the lifecycle does not allow it
+func (o *Order) Transition(next OrderStatus, at time.Time) error {
+	if !o.Status.CanTransition(next) {
+		return fmt.Errorf("%w: %s to %s", ErrInvalidTransition, o.Status, next)
+	}
+	o.History = append(o.History, StatusChange{From: o.Status, To: next, At: at})
+	o.Status = next
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOrderTransitions(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		from, to OrderStatus
+		allowed  bool
+	}{
+		{StatusPending, StatusPaid, true},
+		{StatusPending, StatusFailed, true},
+		{StatusPending, StatusCancelled, true},
+		{StatusPending, StatusShipped, false},
+		{StatusFailed, StatusPaid, true},
+		{StatusPaid, StatusFulfilled, true},
+		{StatusPaid, StatusPaid, false},
+		{StatusPaid, StatusPending, false},
+		{StatusFulfilled, StatusShipped, true},
+		{StatusFulfilled, StatusCancelled, false},
+		{StatusShipped, StatusDelivered, true},
+		{StatusDelivered, StatusRefunded, true},
+		{StatusDelivered, StatusPartiallyRefunded, true},
+		{StatusPartiallyRefunded, StatusRefunded, true},
+		{StatusPartiallyRefunded, StatusShipped, false},
+		{StatusCancelled, StatusPaid, false},
+		{StatusRefunded, StatusPending, false},
+		{StatusPending, "lost", false},
+	}
+
+	for _, tc := range testCases {
+		order := Order{Status: tc.from}
+		err := order.Transition(tc.to, time.Now())
+		if tc.allowed != (err == nil) {
+			t.Errorf("%s -> %s: expected allowed=%v, got %v", tc.from, tc.to, tc.allowed, err)
+			continue
+		}
+		if !tc.allowed {
+			if !errors.Is(err, ErrInvalidTransition) {
+				t.Errorf("%s -> %s: expected ErrInvalidTransition, got %v", tc.from, tc.to, err)
+			}
+			if order.Status != tc.from || len(order.History) != 0 {
+				t.Errorf("%s -> %s: rejected transition changed the order: %+v", tc.from, tc.to, order)
+			}
+			continue
+		}
+		if order.Status != tc.to || len(order.History) != 1 || order.History[0].From != tc.from {
+			t.Errorf("%s -> %s: expected one recorded change, got %+v", tc.from, tc.to, order)
+		}
+	}
+}
+
+// setStatus moves an order along its fulfillment steps as the admin
+func setStatus(srv *Server, orderID int, status OrderStatus) *httptest.ResponseRecorder {
+	return adminRequest(srv, "PUT", fmt.Sprintf("/api/orders/%d/status", orderID), StatusUpdateRequest{Status: status})
+}
+
+func TestUpdateOrderStatus(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+	order := createTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 1})
+
+	// Unpaid orders cannot be fulfilled
+	if rr := setStatus(srv, order.ID, StatusFulfilled); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 fulfilling an unpaid order, got %v: %s", rr.Code, rr.Body)
+	}
+
+	if rr := pay(srv, order.AccessToken, PaymentRequest{OrderID: order.ID, Amount: order.Total}); rr.Code != http.StatusOK {
+		t.Fatalf("payment failed: %v: %s", rr.Code, rr.Body)
+	}
+
+	for _, status := range []OrderStatus{StatusFulfilled, StatusShipped, StatusDelivered} {
+		rr := setStatus(srv, order.ID, status)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("setting %s: got %v: %s", status, rr.Code, rr.Body)
+		}
+		var updated Order
+		json.Unmarshal(rr.Body.Bytes(), &updated)
+		if updated.Status != status {
+			t.Errorf("expected status %s, got %s", status, updated.Status)
+		}
+	}
+
+	// Delivered orders cannot go back
+	rr := setStatus(srv, order.ID, StatusShipped)
+	var errResp ErrorResponse
+	json.Unmarshal(rr.Body.Bytes(), &errResp)
+	if rr.Code != http.StatusConflict || errResp.Message == "" {
+		t.Errorf("expected 409 with an error message, got %v: %s", rr.Code, rr.Body)
+	}
+
+	fetched, _ := srv.store.GetOrder(context.Background(), order.ID)
+	var steps []OrderStatus
+	for _, change := range fetched.History {
+		steps = append(steps, change.To)
+	}
+	expected := []OrderStatus{StatusPending, StatusPaid, StatusFulfilled, StatusShipped, StatusDelivered}
+	if fmt.Sprint(steps) != fmt.Sprint(expected) {
+		t.Errorf("expected history %v, got %v", expected, steps)
+	}
+}
+
+func TestUpdateOrderStatusRejectsBadRequests(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+	order := createTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 1})
+
+	testCases := []struct {
+		name    string
+		orderID int
+		status  OrderStatus
+		code    int
+	}{
+		{"unknown status", order.ID, "lost", http.StatusUnprocessableEntity},
+		{"paid is set by payments", order.ID, StatusPaid, http.StatusUnprocessableEntity},
+		{"cancelled is set by cancellation", order.ID, StatusCancelled, http.StatusUnprocessableEntity},
+		{"unknown order", 999, StatusShipped, http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		if rr := setStatus(srv, tc.orderID, tc.status); rr.Code != tc.code {
+			t.Errorf("%s: expected %v, got %v: %s", tc.name, tc.code, rr.Code, rr.Body)
+		}
+	}
+}
+
+func TestUpdateOrderStatusRequiresAdmin(t *testing.T) {
+	t.Parallel()
+	srv := newAccountTestServer(t)
+	customer := registerAccount(t, srv, "jane@example.com")
+	rr := customerRequest(srv, "POST", "/api/orders", Order{Items: []OrderItem{{ProductID: 1, Quantity: 1}}}, customer.Token)
+	var order Order
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &order) != nil {
+		t.Fatalf("placing an order failed: %v: %s", rr.Code, rr.Body)
+	}
+	if rr := customerRequest(srv, "POST", "/api/payment", PaymentRequest{OrderID: order.ID, Amount: order.Total}, customer.Token); rr.Code != http.StatusOK {
+		t.Fatalf("payment failed: %v: %s", rr.Code, rr.Body)
+	}
+
+	// Not even the customer who placed the order may move it along
+	url := fmt.Sprintf("/api/orders/%d/status", order.ID)
+	for _, token := range []string{"", customer.Token} {
+		if rr := customerRequest(srv, "PUT", url, StatusUpdateRequest{Status: StatusFulfilled}, token); rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401 without the admin token, got %v: %s", rr.Code, rr.Body)
+		}
+	}
+	if fetched, _ := srv.store.GetOrder(context.Background(), order.ID); fetched.Status != StatusPaid {
+		t.Errorf("expected the order left paid, got %s", fetched.Status)
+	}
+	if rr := setStatus(srv, order.ID, StatusFulfilled); rr.Code != http.StatusOK {
+		t.Errorf("expected the admin to fulfil the order, got %v: %s", rr.Code, rr.Body)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// Page sizes accepted by the listing endpoints
+const (
+	DefaultPageLimit = 50
+	MaxPageLimit     = 200
+)
+
+// Page selects a window of a listing ordered by ID. Because IDs only grow,
+// a page that starts after a given ID is unaffected by rows appended later.
+type Page struct {
+	// AfterID skips rows up to and including this ID
+	AfterID int
+	// AfterKey is the sort value of row AfterID in listings ordered by
+	// something else first, such as products by price; rows are then
+	// skipped up to and including that row
+	AfterKey string
+	// Limit caps the number of rows returned; 0 means no limit
+	Limit int
+}
+
+// lookahead returns the page with room for one more row, which tells
+// whether another page follows
+func (p Page) lookahead() Page {
+	if p.Limit > 0 {
+		p.Limit++
+	}
+	return p
+}
+
+// sql appends the page to a SQL condition on a table with an id column and
+// returns the clause to follow FROM, with its arguments
+func (p Page) sql(where string, args []any) (string, []any) {
+	if p.AfterID > 0 {
+		if where == "" {
+			where = " WHERE id > ?"
+		} else {
+			where += " AND id > ?"
+		}
+		args = append(args, p.AfterID)
+	}
+	clause := where + " ORDER BY id"
+	if p.Limit > 0 {
+		clause += " LIMIT ?"
+		args = append(args, p.Limit)
+	}
+	return clause, args
+}
+
+// ListResponse is the envelope of a paginated listing. NextCursor is set
+// while more results follow; pass it back as the cursor parameter.
+type ListResponse struct {
+	Data       any    `json:"data"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// cursor is the decoded form of an opaque pagination cursor
+type cursor struct {
+	AfterID  int    `json:"after"`
+	AfterKey string `json:"key,omitempty"`
+}
+
+func encodeCursor(afterID int, afterKey string) string {
+	data, _ := json.Marshal(cursor{AfterID: afterID, AfterKey: afterKey})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (int, string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	var c cursor
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil || c.AfterID <= 0 {
+		return 0, "", fmt.Errorf("invalid cursor")
+	}
+	return c.AfterID, c.AfterKey, nil
+}
+
+// parsePage reads the limit and cursor parameters. Requests without either
+// get the whole listing as a bare array, as before pagination existed;
+// paged reports whether the client asked for the envelope.
+func parsePage(query url.Values) (page Page, paged bool, err error) {
+	limit, after := query.Get("limit"), query.Get("cursor")
+	if limit == "" && after == "" {
+		return Page{}, false, nil
+	}
+
+	page.Limit = DefaultPageLimit
+	if limit != "" {
+		page.Limit, err = strconv.Atoi(limit)
+		if err != nil || page.Limit < 1 || page.Limit > MaxPageLimit {
+			return Page{}, false, fmt.Errorf("limit must be between 1 and %d", MaxPageLimit)
+		}
+	}
+	if after != "" {
+		if page.AfterID, page.AfterKey, err = decodeCursor(after); err != nil {
+			return Page{}, false, err
+		}
+	}
+	return page, true, nil
+}
+
+// paginate wraps up to limit items in a ListResponse; items are fetched
+// with Page.lookahead so a next page shows as one item too many. key
+// returns what the cursor needs of the last item: its ID and, for listings
+// not ordered by ID, its sort value.
+func paginate[T any](items []T, limit int, key func(T) (int, string)) ListResponse {
+	if len(items) <= limit {
+		return ListResponse{Data: items}
+	}
+	items = items[:limit]
+	return ListResponse{Data: items, NextCursor: encodeCursor(key(items[limit-1]))}
+}
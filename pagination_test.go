@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// listPage fetches a paginated listing and decodes the envelope
+func listPage[T any](t *testing.T, srv *Server, url string) ([]T, string) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	rr := httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET %s: got %v: %s", url, rr.Code, rr.Body)
+	}
+
+	var page struct {
+		Data       []T    `json:"data"`
+		NextCursor string `json:"next_cursor"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil {
+		t.Fatalf("GET %s: expected a page envelope: %v: %s", url, err, rr.Body)
+	}
+	return page.Data, page.NextCursor
+}
+
+func TestPaginateProducts(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	var ids []int
+	url := "/api/products?limit=2"
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("pagination did not terminate")
+		}
+		products, next := listPage[Product](t, srv, url)
+		for _, p := range products {
+			ids = append(ids, p.ID)
+		}
+		if next == "" {
+			break
+		}
+		url = "/api/products?limit=2&cursor=" + next
+	}
+
+	if len(ids) != 5 || ids[0] != 1 || ids[4] != 5 {
+		t.Errorf("expected products 1 to 5 once each, got %v", ids)
+	}
+}
+
+func TestPaginateOrdersWhileAppending(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+	first := createTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 1})
+	second := createTestOrder(t, srv, OrderItem{ProductID: 2, Quantity: 1})
+
+	orders, next := listPage[Order](t, srv, "/api/orders?limit=1")
+	if len(orders) != 1 || orders[0].ID != first.ID || next == "" {
+		t.Fatalf("expected the first order and a cursor, got %+v %q", orders, next)
+	}
+
+	// Orders placed meanwhile neither shift nor repeat what was already seen
+	third := createTestOrder(t, srv, OrderItem{ProductID: 3, Quantity: 1})
+
+	orders, next = listPage[Order](t, srv, "/api/orders?limit=1&cursor="+next)
+	if len(orders) != 1 || orders[0].ID != second.ID {
+		t.Fatalf("expected the second order, got %+v", orders)
+	}
+	orders, next = listPage[Order](t, srv, "/api/orders?limit=1&cursor="+next)
+	if len(orders) != 1 || orders[0].ID != third.ID || next != "" {
+		t.Errorf("expected the third order and no cursor, got %+v %q", orders, next)
+	}
+
+	// A cursor alone uses the default limit
+	orders, next = listPage[Order](t, srv, "/api/orders?cursor="+encodeCursor(first.ID, ""))
+	if len(orders) != 2 || next != "" {
+		t.Errorf("expected the last two orders, got %+v %q", orders, next)
+	}
+}
+
+func TestPaginationCompatibilityAndErrors(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+	createTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 1})
+
+	testCases := []struct {
+		url    string
+		status int
+	}{
+		{"/api/products?limit=0", http.StatusBadRequest},
+		{"/api/products?limit=201", http.StatusBadRequest},
+		{"/api/products?limit=ten", http.StatusBadRequest},
+		{"/api/orders?cursor=not-a-cursor", http.StatusBadRequest},
+		{"/api/orders?status=pending&limit=-1", http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		req, _ := http.NewRequest("GET", tc.url, nil)
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		rr := httptest.NewRecorder()
+		srv.Routes().ServeHTTP(rr, req)
+		if rr.Code != tc.status {
+			t.Errorf("%s: expected %v, got %v", tc.url, tc.status, rr.Code)
+		}
+	}
+
+	// Without limit or cursor the listings stay bare arrays
+	for _, url := range []string{"/api/products", "/api/orders", "/api/orders?status=pending"} {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		rr := httptest.NewRecorder()
+		srv.Routes().ServeHTTP(rr, req)
+		var items []json.RawMessage
+		if err := json.Unmarshal(rr.Body.Bytes(), &items); err != nil || len(items) == 0 {
+			t.Errorf("%s: expected a non-empty bare array, got %s", url, rr.Body)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Error codes reported in PaymentResponse.Code
+const (
+	PaymentCodeInvalidRequest     = "invalid_request"
+	PaymentCodeOrderNotFound      = "order_not_found"
+	PaymentCodeAmountMismatch     = "amount_mismatch"
+	PaymentCodeOrderNotPayable    = "order_not_payable"
+	PaymentCodeReservationExpired = "reservation_expired"
+
+	PaymentCodeCardDeclined      = "card_declined"
+	PaymentCodeInsufficientFunds = "insufficient_funds"
+	PaymentCodeGatewayTimeout    = "gateway_timeout"
+	PaymentCodeGatewayError      = "gateway_error"
+	PaymentCodeRequiresAction    = "requires_action"
+)
+
+// Errors returned when an order cannot take a payment
+var (
+	ErrAmountMismatch  = errors.New("payment amount does not match order total")
+	ErrOrderNotPayable = errors.New("order is not awaiting payment")
+)
+
+// checkPayable reports whether order can be paid with amount
+func checkPayable(order Order, amount Money) error {
+	if !order.Status.CanTransition(StatusPaid) {
+		return fmt.Errorf("%w: order is %s", ErrOrderNotPayable, order.Status)
+	}
+	if amount != order.Total {
+		return fmt.Errorf("%w: expected %s %s, got %s %s", ErrAmountMismatch,
+			order.Total, order.Total.Currency, amount, amount.Currency)
+	}
+	return nil
+}
+
+// paymentFailure maps a payment error to its HTTP status and response code
+func paymentFailure(err error) (int, string, bool) {
+	switch {
+	case errors.Is(err, ErrOrderNotFound):
+		return http.StatusNotFound, PaymentCodeOrderNotFound, true
+	case errors.Is(err, ErrAmountMismatch):
+		return http.StatusUnprocessableEntity, PaymentCodeAmountMismatch, true
+	case errors.Is(err, ErrOrderNotPayable):
+		return http.StatusConflict, PaymentCodeOrderNotPayable, true
+	case errors.Is(err, ErrReservationExpired):
+		return http.StatusConflict, PaymentCodeReservationExpired, true
+	case errors.Is(err, ErrForeignAuthorization):
+		return http.StatusBadRequest, PaymentCodeInvalidRequest, true
+	case errors.Is(err, ErrCardDeclined):
+		return http.StatusPaymentRequired, PaymentCodeCardDeclined, true
+	case errors.Is(err, ErrInsufficientFunds):
+		return http.StatusPaymentRequired, PaymentCodeInsufficientFunds, true
+	case errors.Is(err, ErrRequiresAction):
+		return http.StatusPaymentRequired, PaymentCodeRequiresAction, true
+	case errors.Is(err, ErrGatewayTimeout):
+		return http.StatusGatewayTimeout, PaymentCodeGatewayTimeout, true
+	case errors.Is(err, ErrGatewayFailure):
+		return http.StatusBadGateway, PaymentCodeGatewayError, true
+	}
+	return 0, "", false
+}
+
+// writePaymentError responds with a failed PaymentResponse for err
+func writePaymentError(w http.ResponseWriter, orderID int, err error) {
+	status, code, ok := paymentFailure(err)
+	if !ok {
+		internalError(w, err)
+		return
+	}
+	response := PaymentResponse{
+		Success: false,
+		Message: err.Error(),
+		OrderID: orderID,
+		Code:    code,
+	}
+	var aerr *ActionRequiredError
+	if errors.As(err, &aerr) {
+		response.NextActionURL = aerr.RedirectURL
+		response.AuthorizationID = aerr.AuthorizationID
+	}
+	writeJSON(w, status, response)
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// createTestOrder places an order through the handler and returns it
+func createTestOrder(t testing.TB, srv *Server, items ...OrderItem) Order {
+	t.Helper()
+	jsonData, _ := json.Marshal(Order{Items: items})
+	req, _ := http.NewRequest("POST", "/api/orders", bytes.NewBuffer(jsonData))
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	srv.CreateOrder(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("createOrder failed: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+
+	var order Order
+	json.Unmarshal(rr.Body.Bytes(), &order)
+	return order
+}
+
+// pay submits a payment request with a guest order's access token and
+// returns the recorder
+func pay(srv *Server, orderToken string, paymentReq PaymentRequest) *httptest.ResponseRecorder {
+	jsonData, _ := json.Marshal(paymentReq)
+	req, _ := http.NewRequest("POST", "/api/payment", bytes.NewBuffer(jsonData))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(OrderTokenHeader, orderToken)
+
+	rr := httptest.NewRecorder()
+	srv.ProcessPayment(rr, req)
+	return rr
+}
+
+func TestProcessPaymentAmountMismatch(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+	order := createTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 1})
+
+	rr := pay(srv, order.AccessToken, PaymentRequest{OrderID: order.ID, Amount: NewMoney(1, DefaultCurrency)})
+
+	if status := rr.Code; status != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnprocessableEntity)
+	}
+
+	var payment PaymentResponse
+	json.Unmarshal(rr.Body.Bytes(), &payment)
+
+	if payment.Success {
+		t.Error("payment should not be successful")
+	}
+	if payment.Code != PaymentCodeAmountMismatch {
+		t.Errorf("expected code %s, got %s", PaymentCodeAmountMismatch, payment.Code)
+	}
+
+	// The order must still be awaiting payment
+	fetched, _ := srv.store.GetOrder(context.Background(), order.ID)
+	if fetched.Status != "pending" {
+		t.Errorf("expected status 'pending', got %s", fetched.Status)
+	}
+}
+
+func TestProcessPaymentTwice(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+	order := createTestOrder(t, srv, OrderItem{ProductID: 2, Quantity: 1})
+	paymentReq := PaymentRequest{OrderID: order.ID, Amount: order.Total}
+
+	if rr := pay(srv, order.AccessToken, paymentReq); rr.Code != http.StatusOK {
+		t.Fatalf("first payment failed: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	rr := pay(srv, order.AccessToken, paymentReq)
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusConflict)
+	}
+
+	var payment PaymentResponse
+	json.Unmarshal(rr.Body.Bytes(), &payment)
+
+	if payment.Code != PaymentCodeOrderNotPayable {
+		t.Errorf("expected code %s, got %s", PaymentCodeOrderNotPayable, payment.Code)
+	}
+
+	payments, _ := srv.store.ListPayments(context.Background(), order.ID)
+	if len(payments) != 1 {
+		t.Errorf("expected 1 recorded payment, got %d", len(payments))
+	}
+}
+
+func TestProcessPaymentConcurrentDoublePayment(t *testing.T) {
+	t.Parallel()
+	gateway := NewFakeGateway()
+	srv := NewServer(NewMemoryStore(testCatalog(t)), WithPaymentGateway(gateway))
+	order := createTestOrder(t, srv, OrderItem{ProductID: 3, Quantity: 1})
+	paymentReq := PaymentRequest{OrderID: order.ID, Amount: order.Total}
+
+	// Both requests pass the early check; only one may win the update
+	const attempts = 5
+	codes := make(chan int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- pay(srv, order.AccessToken, paymentReq).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	succeeded := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			succeeded++
+		case http.StatusConflict:
+		default:
+			t.Errorf("unexpected status code %v", code)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("expected exactly one successful payment, got %d", succeeded)
+	}
+
+	// Losers that got as far as capturing were refunded in full
+	kept := 0
+	gateway.mu.Lock()
+	for id, auth := range gateway.authorizations {
+		switch {
+		case auth.captured && auth.refunded.Amount == 0:
+			kept++
+		case auth.captured && auth.refunded != auth.amount:
+			t.Errorf("expected %s refunded in full, got %+v", id, auth)
+		}
+	}
+	gateway.mu.Unlock()
+	if kept != 1 {
+		t.Errorf("expected the customer charged once, got %d charges kept", kept)
+	}
+}
+
+func TestProcessPaymentErrorCodes(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	rr := pay(srv, "", PaymentRequest{OrderID: 999, Amount: NewMoney(100, DefaultCurrency)})
+	var payment PaymentResponse
+	json.Unmarshal(rr.Body.Bytes(), &payment)
+	if rr.Code != http.StatusNotFound || payment.Code != PaymentCodeOrderNotFound {
+		t.Errorf("expected 404 %s, got %v %s", PaymentCodeOrderNotFound, rr.Code, payment.Code)
+	}
+
+	req, _ := http.NewRequest("POST", "/api/payment", bytes.NewBufferString("invalid json"))
+	rr = httptest.NewRecorder()
+	srv.ProcessPayment(rr, req)
+	payment = PaymentResponse{}
+	json.Unmarshal(rr.Body.Bytes(), &payment)
+	if rr.Code != http.StatusBadRequest || payment.Code != PaymentCodeInvalidRequest {
+		t.Errorf("expected 400 %s, got %v %s", PaymentCodeInvalidRequest, rr.Code, payment.Code)
+	}
+}
+
+func TestProcessPaymentGatewayFailures(t *testing.T) {
+	testCases := []struct {
+		card        string
+		status      int
+		code        string
+		orderStatus OrderStatus
+	}{
+		{FakeCardDeclined, http.StatusPaymentRequired, PaymentCodeCardDeclined, StatusFailed},
+		{FakeCardInsufficientFunds, http.StatusPaymentRequired, PaymentCodeInsufficientFunds, StatusFailed},
+		// A timeout says nothing about the card, so the order stays pending
+		{FakeCardTimeout, http.StatusGatewayTimeout, PaymentCodeGatewayTimeout, StatusPending},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.code, func(t *testing.T) {
+			t.Parallel()
+			srv := newTestServer(t)
+			order := createTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 1})
+
+			rr := pay(srv, order.AccessToken, PaymentRequest{OrderID: order.ID, Amount: order.Total, CardNumber: tc.card})
+
+			if status := rr.Code; status != tc.status {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, tc.status)
+			}
+
+			var payment PaymentResponse
+			json.Unmarshal(rr.Body.Bytes(), &payment)
+			if payment.Success || payment.Code != tc.code {
+				t.Errorf("expected failed payment with code %s, got %+v", tc.code, payment)
+			}
+
+			fetched, _ := srv.store.GetOrder(context.Background(), order.ID)
+			if fetched.Status != tc.orderStatus {
+				t.Errorf("expected status %s, got %s", tc.orderStatus, fetched.Status)
+			}
+			payments, _ := srv.store.ListPayments(context.Background(), order.ID)
+			if len(payments) != 0 {
+				t.Errorf("expected no recorded payments, got %d", len(payments))
+			}
+
+			// The order can still be paid with another card
+			rr = pay(srv, order.AccessToken, PaymentRequest{OrderID: order.ID, Amount: order.Total, CardNumber: "4242424242424242"})
+			if rr.Code != http.StatusOK {
+				t.Errorf("retry with a good card failed: got %v: %s", rr.Code, rr.Body)
+			}
+		})
+	}
+}
+
+func TestProcessPaymentRecordsReference(t *testing.T) {
+	t.Parallel()
+	gateway := NewFakeGateway()
+	srv := NewServer(NewMemoryStore(testCatalog(t)), WithPaymentGateway(gateway))
+	order := createTestOrder(t, srv, OrderItem{ProductID: 4, Quantity: 1})
+
+	if rr := pay(srv, order.AccessToken, PaymentRequest{OrderID: order.ID, Amount: order.Total}); rr.Code != http.StatusOK {
+		t.Fatalf("payment failed: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	payments, _ := srv.store.ListPayments(context.Background(), order.ID)
+	if len(payments) != 1 {
+		t.Fatalf("expected 1 payment, got %d", len(payments))
+	}
+	auth, ok := gateway.authorization(payments[0].Reference)
+	if !ok || !auth.captured {
+		t.Errorf("expected payment reference %q to be a captured authorization", payments[0].Reference)
+	}
+}
+
+// racingGateway pays the order from under the handler right after authorizing
+type racingGateway struct {
+	*FakeGateway
+	store  Store
+	lastID string
+}
+
+func (g *racingGateway) Authorize(ctx context.Context, req ChargeRequest) (Authorization, error) {
+	auth, err := g.FakeGateway.Authorize(ctx, req)
+	g.lastID = auth.ID
+	g.store.UpdateOrder(ctx, req.OrderID, func(o *Order) error {
+		o.Status = "paid"
+		return nil
+	})
+	return auth, err
+}
+
+func TestProcessPaymentVoidsLosingAuthorization(t *testing.T) {
+	t.Parallel()
+	store := NewMemoryStore(testCatalog(t))
+	gateway := &racingGateway{FakeGateway: NewFakeGateway(), store: store}
+	srv := NewServer(store, WithPaymentGateway(gateway))
+	order := createTestOrder(t, srv, OrderItem{ProductID: 5, Quantity: 1})
+
+	rr := pay(srv, order.AccessToken, PaymentRequest{OrderID: order.ID, Amount: order.Total})
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusConflict)
+	}
+
+	auth, _ := gateway.authorization(gateway.lastID)
+	if !auth.voided || auth.captured {
+		t.Errorf("expected the authorization to be voided, got %+v", auth)
+	}
+}
+
+// failingPayStore cannot save payments
+type failingPayStore struct {
+	Store
+}
+
+func (failingPayStore) PayOrder(ctx context.Context, payment Payment, fn func(*Order) error) (Order, Payment, error) {
+	return Order{}, Payment{}, errors.New("disk full")
+}
+
+func TestProcessPaymentRefundsUnrecordedPayment(t *testing.T) {
+	t.Parallel()
+	store := NewMemoryStore(testCatalog(t))
+	gateway := NewFakeGateway()
+	srv := NewServer(failingPayStore{store}, WithPaymentGateway(gateway))
+	order := createTestOrder(t, srv, OrderItem{ProductID: 5, Quantity: 1})
+
+	if rr := pay(srv, order.AccessToken, PaymentRequest{OrderID: order.ID, Amount: order.Total}); rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500 when the payment cannot be saved, got %v: %s", rr.Code, rr.Body)
+	}
+
+	// The customer gets the money back and the order can be paid again
+	auth, _ := gateway.authorization("fake_auth_1")
+	if !auth.captured || auth.refunded != order.Total {
+		t.Errorf("expected the captured payment refunded, got %+v", auth)
+	}
+	fetched, _ := store.GetOrder(context.Background(), order.ID)
+	payments, _ := store.ListPayments(context.Background(), order.ID)
+	if fetched.Status != StatusPending || len(payments) != 0 {
+		t.Errorf("expected a pending order without payments, got %s with %d", fetched.Status, len(payments))
+	}
+}
+
+func TestProcessPaymentInOtherCurrency(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+	rr := adminRequest(srv, "POST", "/api/products", Product{
+		Name: "Tea Set", Price: NewMoney(4500, "JPY"), Category: "Home", Stock: 3,
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create failed: got %v: %s", rr.Code, rr.Body)
+	}
+	var teaSet Product
+	json.Unmarshal(rr.Body.Bytes(), &teaSet)
+	if teaSet.Price != NewMoney(4500, "JPY") {
+		t.Fatalf("expected the price to keep its currency, got %+v", teaSet.Price)
+	}
+
+	order := createTestOrder(t, srv, OrderItem{ProductID: teaSet.ID, Quantity: 2})
+	if order.Total != NewMoney(9000, "JPY") {
+		t.Fatalf("expected a total of 9000 JPY, got %+v", order.Total)
+	}
+	if rr := pay(srv, order.AccessToken, PaymentRequest{OrderID: order.ID, Amount: order.Total}); rr.Code != http.StatusOK {
+		t.Fatalf("payment failed: got %v: %s", rr.Code, rr.Body)
+	}
+
+	// An order cannot mix currencies
+	jsonData, _ := json.Marshal(Order{Items: []OrderItem{
+		{ProductID: 1, Quantity: 1},
+		{ProductID: teaSet.ID, Quantity: 1},
+	}})
+	req, _ := http.NewRequest("POST", "/api/orders", bytes.NewBuffer(jsonData))
+	rr = httptest.NewRecorder()
+	srv.CreateOrder(rr, req)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for a mixed-currency order, got %v: %s", rr.Code, rr.Body)
+	}
+}
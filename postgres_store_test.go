@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var postgresSchemaSeq atomic.Int64
+
+// newPostgresStore opens a Postgres store in a schema of its own, so tests
+// can share one database. It skips unless POSTGRES_TEST_DSN is set
+// (see `make test-postgres`).
+func newPostgresStore(t *testing.T) *SQLStore {
+	t.Helper()
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_TEST_DSN not set")
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	schema := fmt.Sprintf("test_%d_%d", time.Now().UnixNano(), postgresSchemaSeq.Add(1))
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cleanup, err := sql.Open("postgres", dsn)
+		if err != nil {
+			return
+		}
+		defer cleanup.Close()
+		cleanup.Exec(`DROP SCHEMA ` + schema + ` CASCADE`)
+	})
+
+	store, err := OpenPostgresStore(withSearchPath(dsn, schema), testCatalog(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// withSearchPath adds a search_path setting to either DSN style lib/pq accepts
+func withSearchPath(dsn, schema string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return dsn
+		}
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	return dsn + " search_path=" + schema
+}
+
+func TestPostgresStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		return newPostgresStore(t)
+	})
+}
+
+func TestPostgresStoreCreateOrderIsAtomic(t *testing.T) {
+	store := newPostgresStore(t)
+	ctx := context.Background()
+
+	// A failing item insert must roll back the order row as well
+	_, err := store.db.Exec(`ALTER TABLE order_items ADD CONSTRAINT quantity_positive CHECK (quantity > 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.CreateOrder(ctx, []OrderItem{
+		{ProductID: 1, Quantity: 1},
+		{ProductID: 2, Quantity: -1},
+	}, OrderContact{})
+	if err == nil {
+		t.Fatal("expected the order insert to fail")
+	}
+
+	orders, err := store.ListOrders(ctx, OrderFilter{}, Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 0 {
+		t.Errorf("expected no orders after rollback, got %d", len(orders))
+	}
+}
+
+func TestRebind(t *testing.T) {
+	t.Parallel()
+
+	pg := &SQLStore{dialect: postgresDialect}
+	if got := pg.rebind(`UPDATE orders SET status = ? WHERE id = ?`); got != `UPDATE orders SET status = $1 WHERE id = $2` {
+		t.Errorf("unexpected postgres query: %s", got)
+	}
+
+	lite := &SQLStore{dialect: sqliteDialect}
+	if got := lite.rebind(`SELECT * FROM orders WHERE id = ?`); got != `SELECT * FROM orders WHERE id = ?` {
+		t.Errorf("unexpected sqlite query: %s", got)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ProductSort orders a product listing; the zero value orders by ID
+type ProductSort string
+
+// Product listing orders. Products with the same price or name follow in
+// ID order.
+const (
+	SortByID        ProductSort = ""
+	SortByPriceAsc  ProductSort = "price_asc"
+	SortByPriceDesc ProductSort = "price_desc"
+	SortByName      ProductSort = "name"
+)
+
+// Valid reports whether s is a known order
+func (s ProductSort) Valid() bool {
+	switch s {
+	case SortByID, SortByPriceAsc, SortByPriceDesc, SortByName:
+		return true
+	}
+	return false
+}
+
+// priceBucketBounds splits prices into the buckets of the price facet, in
+// minor units of DefaultCurrency: under 25, 25 to 50, 50 to 100, 100 to
+// 200, 200 to 500 and 500 or more
+var priceBucketBounds = []int64{2500, 5000, 10000, 20000, 50000}
+
+// ProductFilter narrows and orders ListProducts; zero fields match every
+// product on sale. Prices are those of the products, not their variants.
+type ProductFilter struct {
+	// Categories matches products in any of them
+	Categories []string
+	// MinPrice and MaxPrice bound the price, inclusive
+	MinPrice *Money
+	MaxPrice *Money
+	Sort     ProductSort
+}
+
+// Matches reports whether product passes the filter
+func (f ProductFilter) Matches(p Product) bool {
+	switch {
+	case p.DeletedAt != nil:
+		return false
+	case len(f.Categories) > 0 && !containsString(f.Categories, p.Category):
+		return false
+	case f.MinPrice != nil && (p.Price.Currency != f.MinPrice.Currency || p.Price.Amount < f.MinPrice.Amount):
+		return false
+	case f.MaxPrice != nil && (p.Price.Currency != f.MaxPrice.Currency || p.Price.Amount > f.MaxPrice.Amount):
+		return false
+	}
+	return true
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sortKey returns the value a product is ordered by besides its ID, as
+// carried in cursors
+func (f ProductFilter) sortKey(p Product) string {
+	switch f.Sort {
+	case SortByPriceAsc, SortByPriceDesc:
+		return strconv.FormatInt(p.Price.Amount, 10)
+	case SortByName:
+		return p.Name
+	}
+	return ""
+}
+
+// less reports whether a comes before b in the filter's order
+func (f ProductFilter) less(a, b Product) bool {
+	switch {
+	case f.Sort == SortByPriceAsc && a.Price.Amount != b.Price.Amount:
+		return a.Price.Amount < b.Price.Amount
+	case f.Sort == SortByPriceDesc && a.Price.Amount != b.Price.Amount:
+		return a.Price.Amount > b.Price.Amount
+	case f.Sort == SortByName && a.Name != b.Name:
+		return a.Name < b.Name
+	}
+	return a.ID < b.ID
+}
+
+// sortProducts puts products in the filter's order
+func (f ProductFilter) sortProducts(products []Product) {
+	sort.SliceStable(products, func(i, j int) bool { return f.less(products[i], products[j]) })
+}
+
+// cursorProduct returns a stand-in for the last product of the previous
+// page, carrying the ID and sort value the page's cursor holds
+func (f ProductFilter) cursorProduct(page Page) (Product, error) {
+	last := Product{ID: page.AfterID, Name: page.AfterKey}
+	if f.Sort == SortByPriceAsc || f.Sort == SortByPriceDesc {
+		amount, err := strconv.ParseInt(page.AfterKey, 10, 64)
+		if err != nil && page.AfterID > 0 {
+			return Product{}, fmt.Errorf("invalid cursor")
+		}
+		last.Price.Amount = amount
+	}
+	return last, nil
+}
+
+// where renders the filter as a SQL condition on the products table,
+// written with ? placeholders, and its arguments. Deleted products never
+// match.
+func (f ProductFilter) where() (string, []any) {
+	conds := []string{"deleted_at IS NULL"}
+	var args []any
+	if len(f.Categories) > 0 {
+		conds = append(conds, "category IN (?"+strings.Repeat(", ?", len(f.Categories)-1)+")")
+		for _, c := range f.Categories {
+			args = append(args, c)
+		}
+	}
+	if f.MinPrice != nil {
+		conds = append(conds, "currency = ? AND price_minor >= ?")
+		args = append(args, f.MinPrice.Currency, f.MinPrice.Amount)
+	}
+	if f.MaxPrice != nil {
+		conds = append(conds, "currency = ? AND price_minor <= ?")
+		args = append(args, f.MaxPrice.Currency, f.MaxPrice.Amount)
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// sql renders the filter and a page of it as the clause to follow FROM
+// products, with its arguments. Pages after the first start past the sort
+// value and ID of the previous page's last product.
+func (f ProductFilter) sql(page Page) (string, []any, error) {
+	where, args := f.where()
+	column, order := "", "id"
+	switch f.Sort {
+	case SortByPriceAsc:
+		column, order = "price_minor", "price_minor, id"
+	case SortByPriceDesc:
+		column, order = "price_minor", "price_minor DESC, id"
+	case SortByName:
+		column, order = "name", "name, id"
+	}
+
+	if page.AfterID > 0 {
+		last, err := f.cursorProduct(page)
+		if err != nil {
+			return "", nil, err
+		}
+		switch f.Sort {
+		case SortByID:
+			where += " AND id > ?"
+			args = append(args, page.AfterID)
+		default:
+			var key any = last.Name
+			if column == "price_minor" {
+				key = last.Price.Amount
+			}
+			op := ">"
+			if f.Sort == SortByPriceDesc {
+				op = "<"
+			}
+			where += fmt.Sprintf(" AND (%s %s ? OR (%s = ? AND id > ?))", column, op, column)
+			args = append(args, key, key, page.AfterID)
+		}
+	}
+
+	clause := where + " ORDER BY " + order
+	if page.Limit > 0 {
+		clause += " LIMIT ?"
+		args = append(args, page.Limit)
+	}
+	return clause, args, nil
+}
+
+// parseProductFilter reads a filter from the query string of
+// GET /api/products. category may be repeated to match any of several.
+func parseProductFilter(query url.Values) (ProductFilter, error) {
+	var f ProductFilter
+	for _, c := range query["category"] {
+		if c = strings.TrimSpace(c); c != "" {
+			f.Categories = append(f.Categories, c)
+		}
+	}
+	for _, bound := range []struct {
+		param string
+		dst   **Money
+	}{
+		{"min_price", &f.MinPrice},
+		{"max_price", &f.MaxPrice},
+	} {
+		if v := query.Get(bound.param); v != "" {
+			m, err := ParseMoney(v, DefaultCurrency)
+			if err != nil {
+				return ProductFilter{}, fmt.Errorf("%s: %v", bound.param, err)
+			}
+			*bound.dst = &m
+		}
+	}
+	f.Sort = ProductSort(query.Get("sort"))
+	if !f.Sort.Valid() {
+		return ProductFilter{}, fmt.Errorf("sort must be %s, %s or %s", SortByPriceAsc, SortByPriceDesc, SortByName)
+	}
+	return f, nil
+}
+
+// CategoryCount is the number of matching products in a category
+type CategoryCount struct {
+	Category string `json:"category"`
+	Count    int    `json:"count"`
+}
+
+// PriceBucket is the number of matching products priced from Min up to,
+// but not including, Max; the last bucket has no Max
+type PriceBucket struct {
+	Min   Money  `json:"min"`
+	Max   *Money `json:"max,omitempty"`
+	Count int    `json:"count"`
+}
+
+// ProductFacets counts the products a filter matches by category and by
+// price. Each count ignores the filter's own dimension, so it tells how
+// many products choosing that category or price range would add.
+type ProductFacets struct {
+	Categories []CategoryCount `json:"categories"`
+	Prices     []PriceBucket   `json:"prices"`
+}
+
+// ProductListResponse is a page of products, as ListResponse, with the
+// facets of the listing when they were asked for
+type ProductListResponse struct {
+	ListResponse
+	Facets *ProductFacets `json:"facets,omitempty"`
+}
+
+// priceBucket returns the index of the price facet bucket amount falls in
+func priceBucket(amount int64) int {
+	return sort.Search(len(priceBucketBounds), func(i int) bool { return amount < priceBucketBounds[i] })
+}
+
+// newPriceBuckets returns the buckets of the price facet with the given
+// counts, which are indexed like priceBucket
+func newPriceBuckets(counts map[int]int) []PriceBucket {
+	buckets := make([]PriceBucket, len(priceBucketBounds)+1)
+	for i := range buckets {
+		if i > 0 {
+			buckets[i].Min = NewMoney(priceBucketBounds[i-1], DefaultCurrency)
+		} else {
+			buckets[i].Min = NewMoney(0, DefaultCurrency)
+		}
+		if i < len(priceBucketBounds) {
+			max := NewMoney(priceBucketBounds[i], DefaultCurrency)
+			buckets[i].Max = &max
+		}
+		buckets[i].Count = counts[i]
+	}
+	return buckets
+}
+
+// productFacets counts the products matching filter by category, ignoring
+// the categories chosen, and by price, ignoring the price range chosen
+func (s *Server) productFacets(ctx context.Context, filter ProductFilter) (ProductFacets, error) {
+	byCategory := filter
+	byCategory.Categories = nil
+	categories, err := s.store.CountProductsByCategory(ctx, byCategory)
+	if err != nil {
+		return ProductFacets{}, err
+	}
+
+	byPrice := filter
+	byPrice.MinPrice, byPrice.MaxPrice = nil, nil
+	prices, err := s.store.CountProductsByPrice(ctx, byPrice)
+	if err != nil {
+		return ProductFacets{}, err
+	}
+	return ProductFacets{Categories: categories, Prices: prices}, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetProductsFilters(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	testCases := []struct {
+		query    string
+		status   int
+		expected []int
+	}{
+		{"", http.StatusOK, []int{1, 2, 3, 4, 5}},
+		{"?category=Electronics", http.StatusOK, []int{1, 2}},
+		{"?category=Kitchen&category=Sports", http.StatusOK, []int{3, 4}},
+		{"?min_price=50&max_price=129.99", http.StatusOK, []int{1, 3, 4}},
+		{"?category=Electronics&sort=price_desc", http.StatusOK, []int{2, 1}},
+		{"?sort=price_asc", http.StatusOK, []int{5, 3, 1, 4, 2}},
+		{"?sort=name", http.StatusOK, []int{3, 5, 4, 2, 1}},
+		{"?category=Garden", http.StatusOK, nil},
+		{"?sort=popular", http.StatusBadRequest, nil},
+		{"?min_price=cheap", http.StatusBadRequest, nil},
+		{"?facets=maybe", http.StatusBadRequest, nil},
+	}
+
+	for _, tc := range testCases {
+		req, _ := http.NewRequest("GET", "/api/products"+tc.query, nil)
+		rr := httptest.NewRecorder()
+		srv.GetProducts(rr, req)
+		if rr.Code != tc.status {
+			t.Errorf("%q: handler returned wrong status code: got %v want %v", tc.query, rr.Code, tc.status)
+			continue
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+
+		var products []Product
+		if err := json.Unmarshal(rr.Body.Bytes(), &products); err != nil {
+			t.Fatalf("%q: failed to unmarshal response: %v", tc.query, err)
+		}
+		var got []int
+		for _, p := range products {
+			got = append(got, p.ID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.expected) {
+			t.Errorf("%q: expected products %v, got %v", tc.query, tc.expected, got)
+		}
+	}
+}
+
+func TestPaginateSortedProducts(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	var ids []int
+	url := "/api/products?sort=price_desc&limit=2"
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("pagination did not terminate")
+		}
+		products, next := listPage[Product](t, srv, url)
+		for _, p := range products {
+			ids = append(ids, p.ID)
+		}
+		if next == "" {
+			break
+		}
+		url = "/api/products?sort=price_desc&limit=2&cursor=" + next
+	}
+	if fmt.Sprint(ids) != "[2 4 1 3 5]" {
+		t.Errorf("expected products [2 4 1 3 5], got %v", ids)
+	}
+
+	// A cursor from another order is rejected rather than misread
+	req, _ := http.NewRequest("GET", "/api/products?sort=price_asc&cursor="+encodeCursor(2, "Smart Watch"), nil)
+	rr := httptest.NewRecorder()
+	srv.GetProducts(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a name cursor sorting by price, got %v: %s", rr.Code, rr.Body)
+	}
+}
+
+func TestGetProductsFacets(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	req, _ := http.NewRequest("GET", "/api/products?category=Electronics&max_price=150&facets=true", nil)
+	rr := httptest.NewRecorder()
+	srv.GetProducts(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v: %s", rr.Code, rr.Body)
+	}
+
+	var resp struct {
+		Data   []Product     `json:"data"`
+		Facets ProductFacets `json:"facets"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("expected an envelope with facets: %v: %s", err, rr.Body)
+	}
+	if len(resp.Data) != 1 || resp.Data[0].ID != 1 {
+		t.Errorf("expected product 1, got %+v", resp.Data)
+	}
+
+	// Categories are counted within the price range, prices within the
+	// category, so each facet shows what choosing another value would give
+	if fmt.Sprint(resp.Facets.Categories) != "[{Accessories 1} {Electronics 1} {Kitchen 1} {Sports 1}]" {
+		t.Errorf("unexpected category facet %v", resp.Facets.Categories)
+	}
+	prices := resp.Facets.Prices
+	if len(prices) != 6 || prices[2].Count != 1 || prices[3].Count != 1 {
+		t.Fatalf("expected one product each from 50 and 100, got %+v", prices)
+	}
+	if prices[3].Min != NewMoney(10000, DefaultCurrency) || *prices[3].Max != NewMoney(20000, DefaultCurrency) || prices[5].Max != nil {
+		t.Errorf("unexpected bucket bounds %+v", prices)
+	}
+}
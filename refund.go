@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Errors returned when a refund cannot be refunded or recorded
+var (
+	// ErrNoPayment is returned when a paid order has no recorded payment
+	// to refund against
+	ErrNoPayment = errors.New("order has no recorded payment")
+	// ErrRefundMismatch is returned when the gateway hands back a refund
+	// already recorded for a different request, as when an idempotency
+	// key is reused
+	ErrRefundMismatch = errors.New("refund was recorded for a different request")
+	// ErrOverRefund is returned when recording a refund would take the
+	// order's refunds past its total
+	ErrOverRefund = errors.New("refunds would exceed the order total")
+)
+
+// Refund is money returned to the customer for an order
+type Refund struct {
+	Amount Money `json:"amount"`
+	// Items lists the returned lines when the refund was made by item
+	Items []OrderItem `json:"items,omitempty"`
+	// Reference is the gateway's identifier for the refund
+	Reference string    `json:"reference"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RefundRequest asks to refund part of an order, either for returned line
+// items or as a plain amount
+type RefundRequest struct {
+	Items  []OrderItem `json:"items,omitempty"`
+	Amount *Money      `json:"amount,omitempty"`
+	Reason string      `json:"reason,omitempty"`
+}
+
+// capturedPayment returns the payment an order was paid with
+func (s *Server) capturedPayment(ctx context.Context, orderID int) (Payment, error) {
+	payments, err := s.store.ListPayments(ctx, orderID)
+	if err != nil {
+		return Payment{}, err
+	}
+	if len(payments) == 0 {
+		return Payment{}, fmt.Errorf("%w: order %d", ErrNoPayment, orderID)
+	}
+	return payments[len(payments)-1], nil
+}
+
+// refund returns amount of payment to the customer through the gateway.
+// It is called without holding the store's lock; the caller records the
+// refund on the order afterwards. Retries with the same key, such as after
+// the refund could not be recorded, get the first refund back instead of
+// a second one.
+func (s *Server) refund(ctx context.Context, payment Payment, amount Money, items []OrderItem, reason, key string) (Refund, error) {
+	reference, err := s.gateway.Refund(ctx, payment.Reference, amount, key)
+	if err != nil {
+		return Refund{}, err
+	}
+	return Refund{
+		Amount:    amount,
+		Items:     items,
+		Reference: reference,
+		Reason:    reason,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// refundKey returns the idempotency key of a refund request made when the
+// order had the given refunds. Retries of the request share it; any other
+// request, even for the same amount, gets its own.
+func refundKey(o Order, amount Money, items []OrderItem, reason string) string {
+	data, _ := json.Marshal(struct {
+		Position int         `json:"position"`
+		Amount   Money       `json:"amount"`
+		Items    []OrderItem `json:"items"`
+		Reason   string      `json:"reason"`
+	}{len(o.Refunds), amount, items, reason})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:16])
+}
+
+// recordRefund adds a refund made through the gateway to the order's
+// ledger and reports whether it was new. One an earlier attempt recorded
+// is not added again, but must be for the same request. The ledger is
+// checked again here, under the store's lock, rather than trusting the
+// gateway to refuse refunds beyond what was captured.
+func recordRefund(o *Order, refund Refund) (bool, error) {
+	for _, recorded := range o.Refunds {
+		if recorded.Reference != refund.Reference {
+			continue
+		}
+		if recorded.Amount != refund.Amount || recorded.Reason != refund.Reason || !slices.Equal(recorded.Items, refund.Items) {
+			return false, fmt.Errorf("%w: refund %s", ErrRefundMismatch, refund.Reference)
+		}
+		return false, nil
+	}
+	if refundedAmount(*o)+refund.Amount.Amount > o.Total.Amount {
+		return false, fmt.Errorf("%w: refund %s of %s on top of %s refunded, total %s", ErrOverRefund,
+			refund.Reference, refund.Amount, NewMoney(refundedAmount(*o), o.Total.Currency), o.Total)
+	}
+	o.Refunds = append(o.Refunds, refund)
+	return true, nil
+}
+
+// settleRefunds moves an order to refunded once nothing is left to refund,
+// and to partially_refunded before that
+func settleRefunds(o *Order) error {
+	switch {
+	case refundedAmount(*o) == o.Total.Amount:
+		return o.Transition(StatusRefunded, time.Now())
+	case o.Status != StatusPartiallyRefunded:
+		return o.Transition(StatusPartiallyRefunded, time.Now())
+	}
+	return nil
+}
+
+// refundedAmount returns the minor units already refunded on an order
+func refundedAmount(o Order) int64 {
+	var total int64
+	for _, refund := range o.Refunds {
+		total += refund.Amount.Amount
+	}
+	return total
+}
+
+// planRefund checks a refund request against the order's refund ledger and
+// returns the amount to refund with the priced lines, if any. Problems are
+// reported as a *ValidationError.
+func planRefund(o Order, req RefundRequest) (Money, []OrderItem, error) {
+	var amount Money
+	var items []OrderItem
+	switch {
+	case len(req.Items) > 0 && req.Amount != nil:
+		return Money{}, nil, &ValidationError{Message: "refund either items or an amount, not both"}
+	case req.Amount != nil:
+		amount = *req.Amount
+		if amount.Currency != o.Total.Currency {
+			return Money{}, nil, &ValidationError{Message: fmt.Sprintf("refund currency %s does not match order currency %s", amount.Currency, o.Total.Currency)}
+		}
+		if amount.Amount <= 0 {
+			return Money{}, nil, &ValidationError{Message: "refund amount must be positive"}
+		}
+	case len(req.Items) > 0:
+		var err error
+		if items, amount, err = refundItems(o, req.Items); err != nil {
+			return Money{}, nil, err
+		}
+	default:
+		return Money{}, nil, &ValidationError{Message: "refund must list items or an amount"}
+	}
+
+	remaining := NewMoney(o.Total.Amount-refundedAmount(o), o.Total.Currency)
+	if amount.Amount > remaining.Amount {
+		return Money{}, nil, &ValidationError{Message: fmt.Sprintf("refund of %s exceeds the %s left to refund", amount, remaining)}
+	}
+	return amount, items, nil
+}
+
+// refundItems prices returned lines at what was paid for them, rejecting
+// products or variants not on the order and quantities beyond what is left
+// to return
+func refundItems(o Order, lines []OrderItem) ([]OrderItem, Money, error) {
+	ordered := map[lineKey]int{}
+	prices := map[lineKey]Money{}
+	for _, item := range o.Items {
+		ordered[item.key()] += item.Quantity
+		prices[item.key()] = item.UnitPrice
+	}
+	returned := map[lineKey]int{}
+	for _, refund := range o.Refunds {
+		for _, item := range refund.Items {
+			returned[item.key()] += item.Quantity
+		}
+	}
+
+	verr := &ValidationError{Message: "invalid refund items"}
+	priced := make([]OrderItem, 0, len(lines))
+	total := Money{Currency: o.Total.Currency}
+	for i, line := range lines {
+		key := line.key()
+		left := ordered[key] - returned[key]
+		switch {
+		case ordered[key] == 0:
+			field := "product_id"
+			if line.VariantID != 0 {
+				field = "variant_id"
+			}
+			verr.Items = append(verr.Items, ItemError{
+				Index:     i,
+				ProductID: line.ProductID,
+				VariantID: line.VariantID,
+				Field:     field,
+				Message:   fmt.Sprintf("%s is not on this order", line.stockName()),
+			})
+			continue
+		case line.Quantity <= 0:
+			verr.Items = append(verr.Items, ItemError{
+				Index:     i,
+				ProductID: line.ProductID,
+				VariantID: line.VariantID,
+				Field:     "quantity",
+				Message:   "quantity must be at least 1",
+			})
+			continue
+		case line.Quantity > left:
+			verr.Items = append(verr.Items, ItemError{
+				Index:     i,
+				ProductID: line.ProductID,
+				VariantID: line.VariantID,
+				Field:     "quantity",
+				Message:   fmt.Sprintf("only %d left to refund", left),
+			})
+			continue
+		}
+
+		returned[key] += line.Quantity
+		line.UnitPrice = prices[key]
+		priced = append(priced, line)
+		var err error
+		if total, err = total.Add(line.UnitPrice.Mul(line.Quantity)); err != nil {
+			return nil, Money{}, err
+		}
+	}
+
+	if len(verr.Items) > 0 {
+		return nil, Money{}, verr
+	}
+	return priced, total, nil
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func cancelOrder(srv *Server, order Order) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/api/orders/%d/cancel", order.ID), nil)
+	req.Header.Set(OrderTokenHeader, order.AccessToken)
+	rr := httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rr, req)
+	return rr
+}
+
+// payTestOrder creates an order and pays it in full
+func payTestOrder(t *testing.T, srv *Server, items ...OrderItem) Order {
+	t.Helper()
+	order := createTestOrder(t, srv, items...)
+	if rr := pay(srv, order.AccessToken, PaymentRequest{OrderID: order.ID, Amount: order.Total}); rr.Code != http.StatusOK {
+		t.Fatalf("payment failed: got %v: %s", rr.Code, rr.Body)
+	}
+	return order
+}
+
+func TestCancelPendingOrder(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+	order := createTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 1})
+
+	rr := cancelOrder(srv, order)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("cancel failed: got %v: %s", rr.Code, rr.Body)
+	}
+
+	var cancelled Order
+	json.Unmarshal(rr.Body.Bytes(), &cancelled)
+	if cancelled.Status != StatusCancelled || len(cancelled.Refunds) != 0 {
+		t.Errorf("expected a cancelled order without refunds, got %+v", cancelled)
+	}
+
+	// Cancelled orders can neither be cancelled again nor paid
+	if rr := cancelOrder(srv, order); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 cancelling twice, got %v", rr.Code)
+	}
+	if rr := pay(srv, order.AccessToken, PaymentRequest{OrderID: order.ID, Amount: order.Total}); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 paying a cancelled order, got %v", rr.Code)
+	}
+}
+
+func TestCancelPaidOrderRefunds(t *testing.T) {
+	t.Parallel()
+	gateway := NewFakeGateway()
+	srv := NewServer(NewMemoryStore(testCatalog(t)), WithPaymentGateway(gateway))
+	order := payTestOrder(t, srv, OrderItem{ProductID: 2, Quantity: 2})
+
+	rr := cancelOrder(srv, order)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("cancel failed: got %v: %s", rr.Code, rr.Body)
+	}
+
+	fetched, _ := srv.store.GetOrder(context.Background(), order.ID)
+	if fetched.Status != StatusCancelled {
+		t.Errorf("expected status cancelled, got %s", fetched.Status)
+	}
+	if len(fetched.Refunds) != 1 || fetched.Refunds[0].Amount != order.Total || fetched.Refunds[0].Reference == "" {
+		t.Fatalf("expected one refund of %s, got %+v", order.Total, fetched.Refunds)
+	}
+
+	payments, _ := srv.store.ListPayments(context.Background(), order.ID)
+	auth, _ := gateway.authorization(payments[0].Reference)
+	if auth.refunded != order.Total {
+		t.Errorf("expected the gateway to refund %s, got %s", order.Total, auth.refunded)
+	}
+}
+
+func TestCancelPaidOrderRequiresItsOwner(t *testing.T) {
+	t.Parallel()
+	gateway := NewFakeGateway()
+	srv := newAccountTestServer(t, WithPaymentGateway(gateway))
+	order := payTestOrder(t, srv, OrderItem{ProductID: 2, Quantity: 1})
+	other := createTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 1})
+	customer := registerAccount(t, srv, "jane@example.com")
+
+	// Neither a stranger nor the holder of another order's token can
+	// cancel the order, and so refund it
+	for _, tc := range []struct {
+		name, bearer, orderToken string
+	}{
+		{"no token", "", ""},
+		{"another order's token", "", other.AccessToken},
+		{"a customer", customer.Token, ""},
+	} {
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/api/orders/%d/cancel", order.ID), nil)
+		if tc.bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.bearer)
+		}
+		req.Header.Set(OrderTokenHeader, tc.orderToken)
+		rr := httptest.NewRecorder()
+		srv.Routes().ServeHTTP(rr, req)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %v: %s", tc.name, rr.Code, rr.Body)
+		}
+	}
+
+	fetched, _ := srv.store.GetOrder(context.Background(), order.ID)
+	payments, _ := srv.store.ListPayments(context.Background(), order.ID)
+	auth, _ := gateway.authorization(payments[0].Reference)
+	if fetched.Status != StatusPaid || len(fetched.Refunds) != 0 || auth.refunded.Amount != 0 {
+		t.Fatalf("expected the order still paid and unrefunded, got %s with %+v, %s refunded", fetched.Status, fetched.Refunds, auth.refunded)
+	}
+
+	if rr := cancelOrder(srv, order); rr.Code != http.StatusOK {
+		t.Errorf("expected the owner to cancel, got %v: %s", rr.Code, rr.Body)
+	}
+}
+
+func TestCancelShippedOrderConflicts(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+	order := payTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 1})
+	for _, status := range []OrderStatus{StatusFulfilled, StatusShipped} {
+		if rr := setStatus(srv, order.ID, status); rr.Code != http.StatusOK {
+			t.Fatalf("setting %s: got %v", status, rr.Code)
+		}
+	}
+
+	if rr := cancelOrder(srv, order); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 cancelling a shipped order, got %v: %s", rr.Code, rr.Body)
+	}
+	if rr := cancelOrder(srv, Order{ID: 999}); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown order, got %v", rr.Code)
+	}
+}
+
+// failingRefundGateway approves payments but cannot refund them
+type failingRefundGateway struct {
+	*FakeGateway
+}
+
+func (g failingRefundGateway) Refund(ctx context.Context, authorizationID string, amount Money, idempotencyKey string) (string, error) {
+	return "", ErrGatewayTimeout
+}
+
+func TestCancelKeepsOrderPaidWhenRefundFails(t *testing.T) {
+	t.Parallel()
+	srv := NewServer(NewMemoryStore(testCatalog(t)), WithPaymentGateway(failingRefundGateway{NewFakeGateway()}))
+	order := payTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 1})
+
+	rr := cancelOrder(srv, order)
+	var errResp ErrorResponse
+	json.Unmarshal(rr.Body.Bytes(), &errResp)
+	if rr.Code != http.StatusGatewayTimeout || errResp.Code != PaymentCodeGatewayTimeout {
+		t.Errorf("expected 504 %s, got %v: %s", PaymentCodeGatewayTimeout, rr.Code, rr.Body)
+	}
+
+	fetched, _ := srv.store.GetOrder(context.Background(), order.ID)
+	if fetched.Status != StatusPaid || len(fetched.Refunds) != 0 {
+		t.Errorf("expected the order to stay paid without refunds, got %+v", fetched)
+	}
+}
+
+// flakyOrderStore fails the next order update after fail is set
+type flakyOrderStore struct {
+	Store
+	fail atomic.Bool
+}
+
+func (s *flakyOrderStore) UpdateOrder(ctx context.Context, id int, fn func(*Order) error) (Order, error) {
+	if s.fail.Swap(false) {
+		return Order{}, errors.New("database is locked")
+	}
+	return s.Store.UpdateOrder(ctx, id, fn)
+}
+
+func TestCancelRetryAfterUnsavedRefund(t *testing.T) {
+	t.Parallel()
+	gateway := NewFakeGateway()
+	store := &flakyOrderStore{Store: NewMemoryStore(testCatalog(t))}
+	srv := NewServer(store, WithPaymentGateway(gateway))
+	order := payTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 1})
+
+	// The gateway refunds, but the cancellation cannot be saved
+	store.fail.Store(true)
+	if rr := cancelOrder(srv, order); rr.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500 when the cancellation cannot be saved, got %v: %s", rr.Code, rr.Body)
+	}
+	if fetched, _ := store.GetOrder(context.Background(), order.ID); fetched.Status != StatusPaid {
+		t.Fatalf("expected the order still paid, got %s", fetched.Status)
+	}
+
+	// The retry gets the same refund back and records it once
+	rr := cancelOrder(srv, order)
+	var cancelled Order
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &cancelled) != nil {
+		t.Fatalf("retrying the cancellation failed: %v: %s", rr.Code, rr.Body)
+	}
+	if cancelled.Status != StatusCancelled || len(cancelled.Refunds) != 1 {
+		t.Errorf("expected a cancelled order with one refund, got %+v", cancelled)
+	}
+	payments, _ := store.ListPayments(context.Background(), order.ID)
+	if auth, _ := gateway.authorization(payments[0].Reference); auth.refunded != order.Total {
+		t.Errorf("expected %s refunded once, got %s", order.Total, auth.refunded)
+	}
+}
+
+// requestRefund asks for a refund as the admin
+func requestRefund(srv *Server, orderID int, refundReq RefundRequest) *httptest.ResponseRecorder {
+	return adminRequest(srv, "POST", fmt.Sprintf("/api/orders/%d/refunds", orderID), refundReq)
+}
+
+func TestPartialRefundsByItem(t *testing.T) {
+	t.Parallel()
+	gateway := NewFakeGateway()
+	srv := newAccountTestServer(t, WithPaymentGateway(gateway))
+	order := payTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 2}, OrderItem{ProductID: 3, Quantity: 1})
+
+	// Return one pair of headphones
+	rr := requestRefund(srv, order.ID, RefundRequest{Items: []OrderItem{{ProductID: 1, Quantity: 1}}, Reason: "damaged"})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("refund failed: got %v: %s", rr.Code, rr.Body)
+	}
+	var refunded Order
+	json.Unmarshal(rr.Body.Bytes(), &refunded)
+	if refunded.Status != StatusPartiallyRefunded {
+		t.Errorf("expected status partially_refunded, got %s", refunded.Status)
+	}
+	if len(refunded.Refunds) != 1 || refunded.Refunds[0].Amount != NewMoney(9999, DefaultCurrency) {
+		t.Fatalf("expected a refund of 99.99, got %+v", refunded.Refunds)
+	}
+
+	// Only one pair is left to return
+	rr = requestRefund(srv, order.ID, RefundRequest{Items: []OrderItem{{ProductID: 1, Quantity: 2}}})
+	var verr ValidationError
+	json.Unmarshal(rr.Body.Bytes(), &verr)
+	if rr.Code != http.StatusUnprocessableEntity || len(verr.Items) != 1 || verr.Items[0].Field != "quantity" {
+		t.Errorf("expected 422 for returning too many, got %v: %s", rr.Code, rr.Body)
+	}
+
+	// Returning the rest refunds the order in full
+	rr = requestRefund(srv, order.ID, RefundRequest{Items: []OrderItem{{ProductID: 1, Quantity: 1}, {ProductID: 3, Quantity: 1}}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("refund failed: got %v: %s", rr.Code, rr.Body)
+	}
+	json.Unmarshal(rr.Body.Bytes(), &refunded)
+	if refunded.Status != StatusRefunded {
+		t.Errorf("expected status refunded, got %s", refunded.Status)
+	}
+
+	payments, _ := srv.store.ListPayments(context.Background(), order.ID)
+	auth, _ := gateway.authorization(payments[0].Reference)
+	if auth.refunded != order.Total {
+		t.Errorf("expected the gateway to refund %s, got %s", order.Total, auth.refunded)
+	}
+
+	if rr := requestRefund(srv, order.ID, RefundRequest{Amount: &Money{Amount: 1, Currency: DefaultCurrency}}); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 refunding a refunded order, got %v", rr.Code)
+	}
+}
+
+func TestRefundRetryAfterUnsavedRefund(t *testing.T) {
+	t.Parallel()
+	gateway := NewFakeGateway()
+	store := &flakyOrderStore{Store: NewMemoryStore(testCatalog(t))}
+	srv := NewServer(store, WithPaymentGateway(gateway), WithAdminToken(testAdminToken))
+	order := payTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 2})
+	req := RefundRequest{Items: []OrderItem{{ProductID: 1, Quantity: 1}}}
+
+	store.fail.Store(true)
+	if rr := requestRefund(srv, order.ID, req); rr.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500 when the refund cannot be saved, got %v: %s", rr.Code, rr.Body)
+	}
+
+	// The retry records the refund the gateway already made, once
+	rr := requestRefund(srv, order.ID, req)
+	var refunded Order
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &refunded) != nil {
+		t.Fatalf("retrying the refund failed: %v: %s", rr.Code, rr.Body)
+	}
+	if refunded.Status != StatusPartiallyRefunded || len(refunded.Refunds) != 1 {
+		t.Errorf("expected one refund on a partially refunded order, got %+v", refunded)
+	}
+	payments, _ := store.ListPayments(context.Background(), order.ID)
+	if auth, _ := gateway.authorization(payments[0].Reference); auth.refunded != NewMoney(9999, DefaultCurrency) {
+		t.Errorf("expected 99.99 refunded once, got %s", auth.refunded)
+	}
+
+	// The next refund is a new one
+	if rr := requestRefund(srv, order.ID, req); rr.Code != http.StatusOK {
+		t.Fatalf("second refund failed: %v: %s", rr.Code, rr.Body)
+	}
+	if auth, _ := gateway.authorization(payments[0].Reference); auth.refunded != order.Total {
+		t.Errorf("expected the order refunded in full, got %s", auth.refunded)
+	}
+}
+
+func TestRefundByAmountCannotExceedTotal(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+	order := payTestOrder(t, srv, OrderItem{ProductID: 5, Quantity: 1})
+
+	rr := requestRefund(srv, order.ID, RefundRequest{Amount: &Money{Amount: 2000, Currency: DefaultCurrency}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("refund failed: got %v: %s", rr.Code, rr.Body)
+	}
+
+	// 29.99 is left; 30.00 is too much
+	rr = requestRefund(srv, order.ID, RefundRequest{Amount: &Money{Amount: 3000, Currency: DefaultCurrency}})
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 over-refunding, got %v: %s", rr.Code, rr.Body)
+	}
+
+	fetched, _ := srv.store.GetOrder(context.Background(), order.ID)
+	if fetched.Status != StatusPartiallyRefunded || len(fetched.Refunds) != 1 {
+		t.Errorf("expected one refund on a partially refunded order, got %+v", fetched)
+	}
+}
+
+func TestRefundRejectsBadRequests(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+	paid := payTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 1})
+	pending := createTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 1})
+	ten := &Money{Amount: 1000, Currency: DefaultCurrency}
+
+	testCases := []struct {
+		name    string
+		orderID int
+		req     RefundRequest
+		code    int
+	}{
+		{"nothing to refund", paid.ID, RefundRequest{}, http.StatusUnprocessableEntity},
+		{"items and amount", paid.ID, RefundRequest{Items: []OrderItem{{ProductID: 1, Quantity: 1}}, Amount: ten}, http.StatusUnprocessableEntity},
+		{"negative amount", paid.ID, RefundRequest{Amount: &Money{Amount: -1, Currency: DefaultCurrency}}, http.StatusUnprocessableEntity},
+		{"product not ordered", paid.ID, RefundRequest{Items: []OrderItem{{ProductID: 2, Quantity: 1}}}, http.StatusUnprocessableEntity},
+		{"unpaid order", pending.ID, RefundRequest{Amount: ten}, http.StatusConflict},
+		{"unknown order", 999, RefundRequest{Amount: ten}, http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		if rr := requestRefund(srv, tc.orderID, tc.req); rr.Code != tc.code {
+			t.Errorf("%s: expected %v, got %v: %s", tc.name, tc.code, rr.Code, rr.Body)
+		}
+	}
+}
+
+func TestRefundRequiresAdmin(t *testing.T) {
+	t.Parallel()
+	srv := newAccountTestServer(t)
+	customer := registerAccount(t, srv, "jane@example.com")
+	order := payTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 1})
+
+	url := fmt.Sprintf("/api/orders/%d/refunds", order.ID)
+	for _, token := range []string{"", customer.Token} {
+		rr := customerRequest(srv, "POST", url, RefundRequest{Amount: &Money{Amount: 100, Currency: DefaultCurrency}}, token)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401 without the admin token, got %v: %s", rr.Code, rr.Body)
+		}
+	}
+	if fetched, _ := srv.store.GetOrder(context.Background(), order.ID); fetched.Status != StatusPaid || len(fetched.Refunds) != 0 {
+		t.Errorf("expected the order left paid without refunds, got %+v", fetched)
+	}
+}
+
+func TestRefundKeysTellRequestsApart(t *testing.T) {
+	t.Parallel()
+	order := Order{Total: NewMoney(10000, DefaultCurrency)}
+	amount := NewMoney(2500, DefaultCurrency)
+	hats := []OrderItem{{ProductID: 1, Quantity: 1, UnitPrice: amount}}
+	scarves := []OrderItem{{ProductID: 2, Quantity: 1, UnitPrice: amount}}
+
+	if refundKey(order, amount, hats, "") != refundKey(order, amount, hats, "") {
+		t.Error("expected a retried request to keep its key")
+	}
+	for name, key := range map[string]string{
+		"other items":  refundKey(order, amount, scarves, ""),
+		"other reason": refundKey(order, amount, hats, "damaged"),
+		"later refund": refundKey(Order{Refunds: []Refund{{}}}, amount, hats, ""),
+	} {
+		if key == refundKey(order, amount, hats, "") {
+			t.Errorf("%s: expected a different key for the same amount", name)
+		}
+	}
+}
+
+func TestRefundIdempotencyKey(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+	order := payTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 2})
+	refund := func(reason string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(RefundRequest{Items: []OrderItem{{ProductID: 1, Quantity: 1}}, Reason: reason})
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/api/orders/%d/refunds", order.ID), bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		req.Header.Set("Idempotency-Key", "return-1")
+		rr := httptest.NewRecorder()
+		srv.Routes().ServeHTTP(rr, req)
+		return rr
+	}
+
+	// The same request sent twice is refunded once
+	for i := 0; i < 2; i++ {
+		if rr := refund("damaged"); rr.Code != http.StatusOK {
+			t.Fatalf("attempt %d: expected 200, got %v: %s", i+1, rr.Code, rr.Body)
+		}
+	}
+	// Reusing the key for another request is refused, not reported as done
+	if rr := refund("wrong size"); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a reused key, got %v: %s", rr.Code, rr.Body)
+	}
+	fetched, _ := srv.store.GetOrder(context.Background(), order.ID)
+	if len(fetched.Refunds) != 1 || fetched.Refunds[0].Reason != "damaged" {
+		t.Errorf("expected one refund, got %+v", fetched.Refunds)
+	}
+}
+
+// staleRefundStore returns orders as they were before any refund, the way
+// a read racing a concurrent refund sees them
+type staleRefundStore struct {
+	Store
+}
+
+func (s staleRefundStore) GetOrder(ctx context.Context, id int) (Order, error) {
+	order, err := s.Store.GetOrder(ctx, id)
+	if len(order.Refunds) > 0 {
+		order.Refunds, order.Status = []Refund{}, StatusPaid
+	}
+	return order, err
+}
+
+// lenientRefundGateway refunds whatever it is asked to
+type lenientRefundGateway struct {
+	PaymentGateway
+	refunds atomic.Int64
+}
+
+func (g *lenientRefundGateway) Refund(ctx context.Context, authorizationID string, amount Money, idempotencyKey string) (string, error) {
+	return fmt.Sprintf("lenient_refund_%d", g.refunds.Add(1)), nil
+}
+
+func TestRefundLedgerCheckedWhenRecording(t *testing.T) {
+	t.Parallel()
+	gateway := &lenientRefundGateway{PaymentGateway: NewFakeGateway()}
+	srv := NewServer(staleRefundStore{NewMemoryStore(testCatalog(t))}, WithPaymentGateway(gateway), WithAdminToken(testAdminToken))
+	order := payTestOrder(t, srv, OrderItem{ProductID: 5, Quantity: 1})
+	full := RefundRequest{Amount: &order.Total}
+
+	if rr := requestRefund(srv, order.ID, full); rr.Code != http.StatusOK {
+		t.Fatalf("refund failed: got %v: %s", rr.Code, rr.Body)
+	}
+	// Planned against a stale order and let through by the gateway, the
+	// second full refund is still not recorded
+	if rr := requestRefund(srv, order.ID, full); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a refund past the total, got %v: %s", rr.Code, rr.Body)
+	}
+	fetched, _ := srv.store.(staleRefundStore).Store.GetOrder(context.Background(), order.ID)
+	if fetched.Status != StatusRefunded || len(fetched.Refunds) != 1 {
+		t.Errorf("expected one full refund, got %s with %+v", fetched.Status, fetched.Refunds)
+	}
+}
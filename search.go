@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// DefaultSearchLimit is how many results a search returns unless the
+// request sets limit
+const DefaultSearchLimit = 20
+
+// How much a match in each field counts towards a product's score
+const (
+	searchWeightName        = 3
+	searchWeightCategory    = 2
+	searchWeightDescription = 1
+)
+
+// How much each kind of match counts: an exact word beats a word the query
+// is the start of, which beats a word one or two typos away
+const (
+	matchExact  = 1.0
+	matchPrefix = 0.7
+	matchTypo1  = 0.5
+	matchTypo2  = 0.3
+)
+
+// SearchHit is a product matching a search, with its relevance score
+type SearchHit struct {
+	Product
+	Score float64 `json:"score"`
+}
+
+// SearchResponse lists the best matches of a search, best first. Total
+// counts every product that matched.
+type SearchResponse struct {
+	Data  []SearchHit `json:"data"`
+	Total int         `json:"total"`
+}
+
+// SearchIndex is an inverted index over the name, category and description
+// of the products on sale. It is safe for concurrent use.
+type SearchIndex struct {
+	mu sync.RWMutex
+	// postings maps each word to the products containing it, with the
+	// summed weight of the fields it appears in
+	postings map[string]map[int]float64
+	// words lists the words indexed for each product, to remove them
+	words map[int][]string
+	// terms is every indexed word in order, for prefix and typo matching;
+	// nil when it needs rebuilding
+	terms []string
+}
+
+// NewSearchIndex returns an empty index
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{
+		postings: map[string]map[int]float64{},
+		words:    map[int][]string{},
+	}
+}
+
+// tokenize splits text into lower case words of letters and digits
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Put indexes a product, replacing what was indexed for it before.
+// Deleted products are removed from the index.
+func (idx *SearchIndex) Put(p Product) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.remove(p.ID)
+	if p.DeletedAt != nil {
+		return
+	}
+
+	weights := map[string]float64{}
+	for _, field := range []struct {
+		text   string
+		weight float64
+	}{
+		{p.Name, searchWeightName},
+		{p.Category, searchWeightCategory},
+		{p.Description, searchWeightDescription},
+	} {
+		seen := map[string]bool{}
+		for _, word := range tokenize(field.text) {
+			if !seen[word] {
+				seen[word] = true
+				weights[word] += field.weight
+			}
+		}
+	}
+
+	for word, weight := range weights {
+		if idx.postings[word] == nil {
+			idx.postings[word] = map[int]float64{}
+			idx.terms = nil
+		}
+		idx.postings[word][p.ID] = weight
+		idx.words[p.ID] = append(idx.words[p.ID], word)
+	}
+}
+
+// remove drops a product from the index; callers must hold idx.mu
+func (idx *SearchIndex) remove(id int) {
+	for _, word := range idx.words[id] {
+		delete(idx.postings[word], id)
+		if len(idx.postings[word]) == 0 {
+			delete(idx.postings, word)
+			idx.terms = nil
+		}
+	}
+	delete(idx.words, id)
+}
+
+// sortedTerms returns every indexed word in order, rebuilding the list
+// after words were added or removed
+func (idx *SearchIndex) sortedTerms() []string {
+	idx.mu.RLock()
+	terms := idx.terms
+	idx.mu.RUnlock()
+	if terms != nil {
+		return terms
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.terms == nil {
+		idx.terms = make([]string, 0, len(idx.postings))
+		for word := range idx.postings {
+			idx.terms = append(idx.terms, word)
+		}
+		sort.Strings(idx.terms)
+	}
+	return idx.terms
+}
+
+// matches returns the indexed words a query word matches, with how good a
+// match each is. Any word it is the start of matches; longer query words
+// also match words a typo or two away.
+func matches(terms []string, word string) map[string]float64 {
+	found := map[string]float64{}
+	for i := sort.SearchStrings(terms, word); i < len(terms) && strings.HasPrefix(terms[i], word); i++ {
+		found[terms[i]] = matchPrefix
+	}
+	if _, ok := found[word]; ok {
+		found[word] = matchExact
+	}
+
+	maxEdits := 0
+	switch n := len([]rune(word)); {
+	case n >= 8:
+		maxEdits = 2
+	case n >= 4:
+		maxEdits = 1
+	}
+	if maxEdits == 0 {
+		return found
+	}
+	for _, term := range terms {
+		if _, ok := found[term]; ok {
+			continue
+		}
+		switch d := editDistance(word, term, maxEdits); {
+		case d > maxEdits:
+		case d == 1:
+			found[term] = matchTypo1
+		default:
+			found[term] = matchTypo2
+		}
+	}
+	return found
+}
+
+// editDistance returns the number of single character insertions,
+// deletions, substitutions and swaps of neighbours that turn a into b, or
+// limit+1 once it is certain to exceed limit
+func editDistance(a, b string, limit int) int {
+	ra, rb := []rune(a), []rune(b)
+	if d := len(ra) - len(rb); d > limit || -d > limit {
+		return limit + 1
+	}
+
+	// Three rows of the dynamic programming table suffice for swaps
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		best := cur[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+			best = min(best, cur[j])
+		}
+		if best > limit {
+			return limit + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return min(prev[len(rb)], limit+1)
+}
+
+// Search returns the products matching every word of query, best first, as
+// hits carrying only the product ID. Each query word scores its best match
+// in a product, weighted by the fields it is in and by how rare the word is.
+func (idx *SearchIndex) Search(query string) []SearchHit {
+	words := tokenize(query)
+	if len(words) == 0 {
+		return nil
+	}
+	terms := idx.sortedTerms()
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	n := float64(len(idx.words))
+	var scores map[int]float64
+	for _, word := range words {
+		best := map[int]float64{}
+		for term, quality := range matches(terms, word) {
+			postings := idx.postings[term]
+			idf := math.Log(1 + n/float64(len(postings)))
+			for id, weight := range postings {
+				best[id] = math.Max(best[id], quality*weight*idf)
+			}
+		}
+
+		// Products must match every word
+		if scores == nil {
+			scores = best
+			continue
+		}
+		for id := range scores {
+			if s, ok := best[id]; ok {
+				scores[id] += s
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	hits := make([]SearchHit, 0, len(scores))
+	for id, score := range scores {
+		hits = append(hits, SearchHit{Product: Product{ID: id}, Score: math.Round(score*1000) / 1000})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ID < hits[j].ID
+	})
+	return hits
+}
+
+// searchIndex returns the server's search index, building it from the
+// store on first use. Product changes made through this server keep it up
+// to date after that.
+func (s *Server) searchIndex(ctx context.Context) (*SearchIndex, error) {
+	s.searchMu.Lock()
+	defer s.searchMu.Unlock()
+	if s.search != nil {
+		return s.search, nil
+	}
+
+	idx := NewSearchIndex()
+	page := Page{Limit: MaxPageLimit}
+	for {
+		products, err := s.store.ListProducts(ctx, ProductFilter{}, page)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range products {
+			idx.Put(p)
+		}
+		if len(products) < page.Limit {
+			break
+		}
+		page.AfterID = products[len(products)-1].ID
+	}
+	s.search = idx
+	return idx, nil
+}
+
+// indexProduct brings the search index up to date with a product that was
+// just saved; before the index is built there is nothing to update
+func (s *Server) indexProduct(p Product) {
+	s.searchMu.Lock()
+	defer s.searchMu.Unlock()
+	if s.search != nil {
+		s.search.Put(p)
+	}
+}
+
+// dropSearchIndex discards the search index after a change to many
+// products at once; the next search builds it afresh
+func (s *Server) dropSearchIndex() {
+	s.searchMu.Lock()
+	defer s.searchMu.Unlock()
+	s.search = nil
+}
+
+// searchProducts returns up to limit of the products matching query, best
+// first, and how many matched in all
+func (s *Server) searchProducts(ctx context.Context, query string, limit int) (SearchResponse, error) {
+	idx, err := s.searchIndex(ctx)
+	if err != nil {
+		return SearchResponse{}, err
+	}
+	hits := idx.Search(query)
+
+	resp := SearchResponse{Data: []SearchHit{}, Total: len(hits)}
+	for _, hit := range hits {
+		if len(resp.Data) == limit {
+			break
+		}
+		p, err := s.store.GetProduct(ctx, hit.ID)
+		if errors.Is(err, ErrProductNotFound) {
+			continue
+		}
+		if err != nil {
+			return SearchResponse{}, err
+		}
+		resp.Data = append(resp.Data, SearchHit{Product: p, Score: hit.Score})
+	}
+	return resp, nil
+}
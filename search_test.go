@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func searchProducts(srv *Server, query string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/api/products/search?"+query, nil)
+	rr := httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rr, req)
+	return rr
+}
+
+// searchIDs returns the IDs of the products a search finds, best first
+func searchIDs(t *testing.T, srv *Server, q string) []int {
+	t.Helper()
+	rr := searchProducts(srv, "q="+url.QueryEscape(q))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("search %q failed: got %v: %s", q, rr.Code, rr.Body)
+	}
+	var resp SearchResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	ids := make([]int, len(resp.Data))
+	for i, hit := range resp.Data {
+		ids[i] = hit.ID
+	}
+	return ids
+}
+
+func TestEditDistance(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		a, b string
+		want int
+	}{
+		{"coffee", "coffee", 0},
+		{"cofee", "coffee", 1},
+		{"cofefe", "coffee", 1},
+		{"caffe", "coffee", 2},
+		{"laptop", "backpack", 3},
+	}
+	for _, tc := range testCases {
+		if got := editDistance(tc.a, tc.b, 2); got != tc.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestSearchProducts(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	testCases := []struct {
+		name  string
+		query string
+		want  []int
+	}{
+		{"exact word", "backpack", []int{5}},
+		{"every word must match", "wireless headphones", []int{1}},
+		{"case and punctuation", "COFFEE-maker!", []int{3}},
+		{"prefix", "head", []int{1}},
+		{"typo", "hedphones", []int{1}},
+		{"swapped letters", "runnnig shoes", []int{4}},
+		{"category", "electronics", []int{1, 2}},
+		{"no match", "toaster", []int{}},
+	}
+	for _, tc := range testCases {
+		if got := searchIDs(t, srv, tc.query); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%s: search %q found %v, want %v", tc.name, tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestSearchRanking(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	// "watch" is in the name of the Smart Watch but only part of a word
+	// elsewhere; a name match outranks a description match
+	if got := searchIDs(t, srv, "watch"); len(got) == 0 || got[0] != 2 {
+		t.Errorf("expected the Smart Watch first, got %v", got)
+	}
+	if got := searchIDs(t, srv, "laptop"); len(got) != 1 || got[0] != 5 {
+		t.Errorf("expected only the backpack, got %v", got)
+	}
+
+	rr := searchProducts(srv, "q=with&limit=2")
+	var resp SearchResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if len(resp.Data) != 2 || resp.Total != 5 {
+		t.Errorf("expected 2 of 5 matches, got %d of %d", len(resp.Data), resp.Total)
+	}
+	if resp.Data[0].Score < resp.Data[1].Score || resp.Data[0].Name == "" {
+		t.Errorf("expected full products best first, got %+v", resp.Data)
+	}
+}
+
+func TestSearchFollowsCatalogChanges(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+	searchIDs(t, srv, "lamp")
+
+	rr := adminRequest(srv, "POST", "/api/products", Product{Name: "Desk Lamp", Price: NewMoney(3499, DefaultCurrency), Category: "Home"})
+	var lamp Product
+	json.Unmarshal(rr.Body.Bytes(), &lamp)
+	if got := searchIDs(t, srv, "lamp"); len(got) != 1 || got[0] != lamp.ID {
+		t.Errorf("expected the new lamp found, got %v", got)
+	}
+
+	adminRequest(srv, "PATCH", fmt.Sprintf("/api/products/%d", lamp.ID), map[string]any{"name": "Floor Light"})
+	if got := searchIDs(t, srv, "lamp"); len(got) != 0 {
+		t.Errorf("expected the old name forgotten, got %v", got)
+	}
+	if got := searchIDs(t, srv, "floor"); len(got) != 1 {
+		t.Errorf("expected the new name found, got %v", got)
+	}
+
+	adminRequest(srv, "DELETE", "/api/products/1", nil)
+	if got := searchIDs(t, srv, "headphones"); len(got) != 0 {
+		t.Errorf("expected the deleted product gone, got %v", got)
+	}
+
+	rr = importProducts(srv, "", "text/csv", "sku,name,price,category\nKT-1,Electric Kettle,39.99,Kitchen\n")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("import failed: got %v: %s", rr.Code, rr.Body)
+	}
+	if got := searchIDs(t, srv, "kettle"); len(got) != 1 {
+		t.Errorf("expected the imported product found, got %v", got)
+	}
+}
+
+func TestSearchRequestErrors(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	for _, query := range []string{"", "q=%20", "q=watch&limit=0", "q=watch&limit=x"} {
+		if rr := searchProducts(srv, query); rr.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %v", query, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,1469 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migration is one versioned step of a SQL schema
+type migration struct {
+	version    int
+	name       string
+	statements []string
+}
+
+// sqlDialect captures the differences between the supported databases
+type sqlDialect struct {
+	// dollarParams rewrites ? placeholders to $1, $2, ...
+	dollarParams bool
+	// forUpdate is appended to SELECTs that must lock the rows they read
+	forUpdate string
+	// syncProductIDs moves the product ID generator past products inserted
+	// with explicit IDs
+	syncProductIDs string
+}
+
+var (
+	sqliteDialect   = sqlDialect{}
+	postgresDialect = sqlDialect{
+		dollarParams:   true,
+		forUpdate:      " FOR UPDATE",
+		syncProductIDs: `SELECT setval(pg_get_serial_sequence('products', 'id'), COALESCE((SELECT MAX(id) FROM products), 0) + 1, false)`,
+	}
+)
+
+// productColumns is the column list scanned by scanProduct
+const productColumns = `id, sku, name, description, price_minor, currency, image, category, stock, reserved, deleted_at`
+
+// categoryColumns is the column list scanned by scanCategory
+const categoryColumns = `id, slug, name, description, parent_id`
+
+// variantColumns is the column list scanned by scanVariant
+const variantColumns = `id, product_id, sku, options, price_minor, currency, stock, reserved`
+
+// SQLStore persists the catalog, orders and payments in a SQL database
+type SQLStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+// rebind rewrites a query written with ? placeholders for the store's dialect
+func (s *SQLStore) rebind(query string) string {
+	if !s.dialect.dollarParams {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Close releases the underlying database handle
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+// migrate applies every migration newer than the recorded schema version
+func (s *SQLStore) migrate(ctx context.Context, migrations []migration) error {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	var current int
+	err = s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		err := s.withTx(ctx, func(tx *sql.Tx) error {
+			for _, stmt := range m.statements {
+				if _, err := tx.ExecContext(ctx, stmt); err != nil {
+					return err
+				}
+			}
+			_, err := tx.ExecContext(ctx,
+				s.rebind(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`),
+				m.version, m.name, time.Now().UTC())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+// seedProducts inserts the given catalog if the products table is empty
+func (s *SQLStore) seedProducts(ctx context.Context, products []Product) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		var count int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM products`).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			return nil
+		}
+		for _, p := range products {
+			_, err := tx.ExecContext(ctx,
+				s.rebind(`INSERT INTO products (id, sku, name, description, price_minor, currency, image, category, stock) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+				p.ID, nullString(p.SKU), p.Name, p.Description, p.Price.Amount, p.Price.Currency, p.Image, p.Category, p.Stock)
+			if err != nil {
+				return fmt.Errorf("seed product %d: %w", p.ID, err)
+			}
+		}
+		if s.dialect.syncProductIDs != "" {
+			if _, err := tx.ExecContext(ctx, s.dialect.syncProductIDs); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// seedCategories adds a top-level category for every category of a product
+// on sale that has none, including those saved before categories existed
+func (s *SQLStore) seedCategories(ctx context.Context) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `SELECT DISTINCT category FROM products WHERE deleted_at IS NULL AND category <> '' ORDER BY category`)
+		if err != nil {
+			return err
+		}
+		var names []string
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return err
+			}
+			names = append(names, name)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			if err := s.ensureCategory(ctx, tx, Product{Category: name}); err != nil {
+				return fmt.Errorf("seed category %q: %w", name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// withTx runs fn inside a transaction, rolling back if it returns an error
+func (s *SQLStore) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanProduct reads a row selected with productColumns
+func scanProduct(row rowScanner) (Product, error) {
+	var p Product
+	var sku sql.NullString
+	var deletedAt sql.NullTime
+	err := row.Scan(&p.ID, &sku, &p.Name, &p.Description, &p.Price.Amount, &p.Price.Currency, &p.Image, &p.Category, &p.Stock, &p.Reserved, &deletedAt)
+	p.SKU = sku.String
+	if deletedAt.Valid {
+		p.DeletedAt = &deletedAt.Time
+	}
+	return p, err
+}
+
+// scanCategory reads a row selected with categoryColumns
+func scanCategory(row rowScanner) (Category, error) {
+	var c Category
+	var parentID sql.NullInt64
+	err := row.Scan(&c.ID, &c.Slug, &c.Name, &c.Description, &parentID)
+	c.ParentID = int(parentID.Int64)
+	return c, err
+}
+
+// scanVariant reads a row selected with variantColumns and returns it with
+// the ID of its product
+func scanVariant(row rowScanner) (int, Variant, error) {
+	var productID int
+	var v Variant
+	var sku, currency sql.NullString
+	var options string
+	var price sql.NullInt64
+	if err := row.Scan(&v.ID, &productID, &sku, &options, &price, &currency, &v.Stock, &v.Reserved); err != nil {
+		return 0, Variant{}, err
+	}
+	v.SKU = sku.String
+	if price.Valid {
+		v.Price = &Money{Amount: price.Int64, Currency: currency.String}
+	}
+	return productID, v, json.Unmarshal([]byte(options), &v.Options)
+}
+
+// attachVariants reads the variants selected by where, in order, and adds
+// them to the products they belong to
+func (s *SQLStore) attachVariants(ctx context.Context, q queryer, products []Product, where string, args ...any) error {
+	index := map[int]int{}
+	for i, p := range products {
+		index[p.ID] = i
+	}
+
+	rows, err := q.QueryContext(ctx,
+		s.rebind(`SELECT `+variantColumns+` FROM product_variants`+where+` ORDER BY product_id, position`), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		productID, v, err := scanVariant(rows)
+		if err != nil {
+			return err
+		}
+		if i, ok := index[productID]; ok {
+			products[i].Variants = append(products[i].Variants, v)
+		}
+	}
+	return rows.Err()
+}
+
+// loadVariants reads the variants of a single product
+func (s *SQLStore) loadVariants(ctx context.Context, q queryer, p Product) (Product, error) {
+	products := []Product{p}
+	err := s.attachVariants(ctx, q, products, ` WHERE product_id = ?`, p.ID)
+	return products[0], err
+}
+
+// saveVariants stores the variants of p in place of those of old, the
+// product it replaces: variants p no longer lists are removed and new ones
+// are given IDs. Reservations must already be carried over.
+func (s *SQLStore) saveVariants(ctx context.Context, tx *sql.Tx, p *Product, old Product) error {
+	// Clear SKUs first so variants can trade them without tripping the
+	// unique index
+	if _, err := tx.ExecContext(ctx, s.rebind(`UPDATE product_variants SET sku = NULL WHERE product_id = ?`), p.ID); err != nil {
+		return err
+	}
+
+	kept := map[int]bool{}
+	for i := range p.Variants {
+		v := &p.Variants[i]
+		options, err := json.Marshal(v.Options)
+		if err != nil {
+			return err
+		}
+		var price, currency any
+		if v.Price != nil {
+			price, currency = v.Price.Amount, v.Price.Currency
+		}
+
+		if v.ID != 0 && old.variantIndex(v.ID) >= 0 {
+			kept[v.ID] = true
+			_, err = tx.ExecContext(ctx,
+				s.rebind(`UPDATE product_variants SET position = ?, sku = ?, options = ?, price_minor = ?, currency = ?, stock = ? WHERE id = ?`),
+				i, nullString(v.SKU), string(options), price, currency, v.Stock, v.ID)
+		} else {
+			err = tx.QueryRowContext(ctx,
+				s.rebind(`INSERT INTO product_variants (product_id, position, sku, options, price_minor, currency, stock) VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id`),
+				p.ID, i, nullString(v.SKU), string(options), price, currency, v.Stock).Scan(&v.ID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, v := range old.Variants {
+		if !kept[v.ID] {
+			if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM product_variants WHERE id = ?`), v.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// nullID stores an ID of 0, meaning none, as NULL
+func nullID(id int) any {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// nullString stores an empty string as NULL, so unique indexes ignore it
+func nullString(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func (s *SQLStore) ListProducts(ctx context.Context, filter ProductFilter, page Page) ([]Product, error) {
+	clause, args, err := filter.sql(page)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx,
+		s.rebind(`SELECT `+productColumns+` FROM products`+clause), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	products := []Product{}
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	err = s.attachVariants(ctx, s.db, products, ` WHERE product_id IN (SELECT id FROM products`+clause+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	return products, nil
+}
+
+func (s *SQLStore) CountProductsByCategory(ctx context.Context, filter ProductFilter) ([]CategoryCount, error) {
+	where, args := filter.where()
+	rows, err := s.db.QueryContext(ctx,
+		s.rebind(`SELECT category, COUNT(*) FROM products`+where+` GROUP BY category ORDER BY category`), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := []CategoryCount{}
+	for rows.Next() {
+		var c CategoryCount
+		if err := rows.Scan(&c.Category, &c.Count); err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+func (s *SQLStore) CountProductsByPrice(ctx context.Context, filter ProductFilter) ([]PriceBucket, error) {
+	// The CASE numbers each product's bucket the way priceBucket does
+	where, args := filter.where()
+	bucket := "CASE"
+	for i, bound := range priceBucketBounds {
+		bucket += fmt.Sprintf(" WHEN price_minor < %d THEN %d", bound, i)
+	}
+	bucket += fmt.Sprintf(" ELSE %d END", len(priceBucketBounds))
+	args = append(args, DefaultCurrency)
+
+	rows, err := s.db.QueryContext(ctx,
+		s.rebind(`SELECT bucket, COUNT(*) FROM (SELECT `+bucket+` AS bucket FROM products`+where+
+			` AND currency = ?) buckets GROUP BY bucket`), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[int]int{}
+	for rows.Next() {
+		var bucket, count int
+		if err := rows.Scan(&bucket, &count); err != nil {
+			return nil, err
+		}
+		counts[bucket] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return newPriceBuckets(counts), nil
+}
+
+func (s *SQLStore) GetProduct(ctx context.Context, id int) (Product, error) {
+	return s.getProduct(ctx, s.db, id)
+}
+
+func (s *SQLStore) getProduct(ctx context.Context, q queryer, id int) (Product, error) {
+	p, err := scanProduct(q.QueryRowContext(ctx,
+		s.rebind(`SELECT `+productColumns+` FROM products WHERE id = ?`), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Product{}, ErrProductNotFound
+	}
+	if err != nil {
+		return Product{}, err
+	}
+	return s.loadVariants(ctx, q, p)
+}
+
+func (s *SQLStore) GetProductBySKU(ctx context.Context, sku string) (Product, error) {
+	p, err := scanProduct(s.db.QueryRowContext(ctx,
+		s.rebind(`SELECT `+productColumns+` FROM products WHERE sku = ?`), sku))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Product{}, ErrProductNotFound
+	}
+	if err != nil {
+		return Product{}, err
+	}
+	return s.loadVariants(ctx, s.db, p)
+}
+
+// checkSKUs returns ErrDuplicateSKU if another product, or a variant of
+// one, has the SKU of p or of one of its variants. The unique indexes back
+// this up against concurrent writers within each table.
+func (s *SQLStore) checkSKUs(ctx context.Context, tx *sql.Tx, p Product) error {
+	for _, sku := range productSKUs(p) {
+		var other int
+		err := tx.QueryRowContext(ctx,
+			s.rebind(`SELECT id FROM products WHERE sku = ? AND id <> ? UNION ALL SELECT product_id FROM product_variants WHERE sku = ? AND product_id <> ?`),
+			sku, p.ID, sku, p.ID).Scan(&other)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			continue
+		case err != nil:
+			return err
+		}
+		return ErrDuplicateSKU
+	}
+	return nil
+}
+
+func (s *SQLStore) CreateProduct(ctx context.Context, product Product) (Product, error) {
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		product, err = s.createProduct(ctx, tx, product)
+		return err
+	})
+	if err != nil {
+		return Product{}, err
+	}
+	return product, nil
+}
+
+// createProduct saves a new product within tx
+func (s *SQLStore) createProduct(ctx context.Context, tx *sql.Tx, product Product) (Product, error) {
+	product.ID = 0
+	product.Variants = copyVariants(product.Variants)
+	carryReservations(Product{}, &product)
+	if err := s.checkSKUs(ctx, tx, product); err != nil {
+		return Product{}, err
+	}
+	err := tx.QueryRowContext(ctx,
+		s.rebind(`INSERT INTO products (sku, name, description, price_minor, currency, image, category, stock) VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`),
+		nullString(product.SKU), product.Name, product.Description, product.Price.Amount, product.Price.Currency, product.Image, product.Category, product.Stock).Scan(&product.ID)
+	if err != nil {
+		return Product{}, err
+	}
+	if err := s.saveVariants(ctx, tx, &product, Product{}); err != nil {
+		return Product{}, err
+	}
+	return product, s.ensureCategory(ctx, tx, product)
+}
+
+func (s *SQLStore) UpdateProduct(ctx context.Context, id int, fn func(*Product) error) (Product, error) {
+	var product Product
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		product, err = s.updateProduct(ctx, tx, id, fn)
+		return err
+	})
+	if err != nil {
+		return Product{}, err
+	}
+	return product, nil
+}
+
+func (s *SQLStore) SaveProducts(ctx context.Context, products []Product, fn func(old Product, p *Product) error) ([]Product, error) {
+	var saved []Product
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		saved = make([]Product, 0, len(products))
+		for i, product := range products {
+			var err error
+			if product.ID == 0 {
+				product, err = s.createProduct(ctx, tx, product)
+			} else {
+				product, err = s.updateProduct(ctx, tx, product.ID, func(p *Product) error {
+					old := copyProduct(*p)
+					*p = copyProduct(products[i])
+					return fn(old, p)
+				})
+			}
+			if err != nil {
+				return &BatchError{Index: i, Err: err}
+			}
+			saved = append(saved, product)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+// updateProduct applies fn to a product within tx
+func (s *SQLStore) updateProduct(ctx context.Context, tx *sql.Tx, id int, fn func(*Product) error) (Product, error) {
+	product, err := scanProduct(tx.QueryRowContext(ctx,
+		s.rebind(`SELECT `+productColumns+` FROM products WHERE id = ?`+s.dialect.forUpdate), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Product{}, ErrProductNotFound
+	}
+	if err != nil {
+		return Product{}, err
+	}
+	if product, err = s.loadVariants(ctx, tx, product); err != nil {
+		return Product{}, err
+	}
+	old := copyProduct(product)
+	if err := fn(&product); err != nil {
+		return Product{}, err
+	}
+	product.ID = id
+	carryReservations(old, &product)
+	if err := s.checkSKUs(ctx, tx, product); err != nil {
+		return Product{}, err
+	}
+	if err := s.saveVariants(ctx, tx, &product, old); err != nil {
+		return Product{}, err
+	}
+
+	var deletedAt any
+	if product.DeletedAt != nil {
+		deletedAt = product.DeletedAt.UTC()
+	}
+	_, err = tx.ExecContext(ctx,
+		s.rebind(`UPDATE products SET sku = ?, name = ?, description = ?, price_minor = ?, currency = ?, image = ?, category = ?, stock = ?, deleted_at = ? WHERE id = ?`),
+		nullString(product.SKU), product.Name, product.Description, product.Price.Amount, product.Price.Currency, product.Image, product.Category, product.Stock, deletedAt, id)
+	if err != nil {
+		return Product{}, err
+	}
+	return product, s.ensureCategory(ctx, tx, product)
+}
+
+// listCategories reads every category in ID order, locking them when
+// lock is set
+func (s *SQLStore) listCategories(ctx context.Context, q queryer, lock bool) ([]Category, error) {
+	query := `SELECT ` + categoryColumns + ` FROM categories ORDER BY id`
+	if lock {
+		query += s.dialect.forUpdate
+	}
+	rows, err := q.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := []Category{}
+	for rows.Next() {
+		c, err := scanCategory(rows)
+		if err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+// ensureCategory adds a top-level category for the category of a product
+// on sale if there is none. Products saved before categories were required
+// may have none.
+func (s *SQLStore) ensureCategory(ctx context.Context, tx *sql.Tx, p Product) error {
+	if p.DeletedAt != nil || p.Category == "" {
+		return nil
+	}
+	categories, err := s.listCategories(ctx, tx, true)
+	if err != nil {
+		return err
+	}
+	slugs := map[string]bool{}
+	for _, c := range categories {
+		if c.Name == p.Category {
+			return nil
+		}
+		slugs[c.Slug] = true
+	}
+	slug := uniqueSlug(p.Category, func(slug string) bool { return slugs[slug] })
+	_, err = tx.ExecContext(ctx,
+		s.rebind(`INSERT INTO categories (slug, name) VALUES (?, ?)`), slug, p.Category)
+	return err
+}
+
+func (s *SQLStore) ListCategories(ctx context.Context) ([]Category, error) {
+	return s.listCategories(ctx, s.db, false)
+}
+
+func (s *SQLStore) CreateCategory(ctx context.Context, category Category) (Category, error) {
+	category.ID = 0
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		categories, err := s.listCategories(ctx, tx, true)
+		if err != nil {
+			return err
+		}
+		if categoryTaken(categories, category) {
+			return ErrDuplicateCategory
+		}
+		if err := checkCategory(categories, category); err != nil {
+			return err
+		}
+		return tx.QueryRowContext(ctx,
+			s.rebind(`INSERT INTO categories (slug, name, description, parent_id) VALUES (?, ?, ?, ?) RETURNING id`),
+			category.Slug, category.Name, category.Description, nullID(category.ParentID)).Scan(&category.ID)
+	})
+	if err != nil {
+		return Category{}, err
+	}
+	return category, nil
+}
+
+func (s *SQLStore) UpdateCategory(ctx context.Context, id int, fn func(*Category) error) (Category, error) {
+	var category Category
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		// The whole tree is locked, since moving a category is checked
+		// against every other
+		categories, err := s.listCategories(ctx, tx, true)
+		if err != nil {
+			return err
+		}
+		var old Category
+		if old, err = findCategoryByID(categories, id); err != nil {
+			return err
+		}
+		category = old
+		if err := fn(&category); err != nil {
+			return err
+		}
+		category.ID = id
+		if categoryTaken(categories, category) {
+			return ErrDuplicateCategory
+		}
+		if err := checkCategory(categories, category); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx,
+			s.rebind(`UPDATE categories SET slug = ?, name = ?, description = ?, parent_id = ? WHERE id = ?`),
+			category.Slug, category.Name, category.Description, nullID(category.ParentID), id)
+		if err != nil || category.Name == old.Name {
+			return err
+		}
+		_, err = tx.ExecContext(ctx,
+			s.rebind(`UPDATE products SET category = ? WHERE category = ?`), category.Name, old.Name)
+		return err
+	})
+	if err != nil {
+		return Category{}, err
+	}
+	return category, nil
+}
+
+func (s *SQLStore) DeleteCategory(ctx context.Context, id int) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		categories, err := s.listCategories(ctx, tx, true)
+		if err != nil {
+			return err
+		}
+		category, err := findCategoryByID(categories, id)
+		if err != nil {
+			return err
+		}
+		for _, c := range categories {
+			if c.ParentID == id {
+				return ErrCategoryInUse
+			}
+		}
+
+		var products int
+		err = tx.QueryRowContext(ctx,
+			s.rebind(`SELECT COUNT(*) FROM products WHERE category = ? AND deleted_at IS NULL`), category.Name).Scan(&products)
+		if err != nil {
+			return err
+		}
+		if products > 0 {
+			return ErrCategoryInUse
+		}
+		_, err = tx.ExecContext(ctx, s.rebind(`DELETE FROM categories WHERE id = ?`), id)
+		return err
+	})
+}
+
+func (s *SQLStore) CreateOrder(ctx context.Context, items []OrderItem, contact OrderContact) (Order, error) {
+	var order Order
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		priced, total, err := priceItems(items, func(id int) (Product, error) {
+			return s.getProduct(ctx, tx, id)
+		})
+		if err != nil {
+			return err
+		}
+		if err := s.reserveStock(ctx, tx, mergeItems(priced)); err != nil {
+			return err
+		}
+		order = newOrder(priced, total, contact, time.Now().UTC())
+
+		var name, email any
+		phone := ""
+		if c := order.Customer; c != nil {
+			name, email, phone = c.Name, c.Email, c.Phone
+		}
+		err = tx.QueryRowContext(ctx,
+			s.rebind(`INSERT INTO orders (total_minor, currency, status, created_at, account_id, access_token_hash, customer_name, customer_email, customer_phone) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`),
+			order.Total.Amount, order.Total.Currency, order.Status, order.CreatedAt, nullID(order.AccountID), nullString(order.AccessTokenHash), name, email, phone).Scan(&order.ID)
+		if err != nil {
+			return err
+		}
+		if err := s.insertAddresses(ctx, tx, order); err != nil {
+			return err
+		}
+
+		for i, item := range order.Items {
+			_, err := tx.ExecContext(ctx,
+				s.rebind(`INSERT INTO order_items (order_id, position, product_id, variant_id, quantity, unit_price_minor, currency) VALUES (?, ?, ?, ?, ?, ?, ?)`),
+				order.ID, i, item.ProductID, item.VariantID, item.Quantity, item.UnitPrice.Amount, item.UnitPrice.Currency)
+			if err != nil {
+				return err
+			}
+		}
+		return s.insertHistory(ctx, tx, order.ID, 0, order.History)
+	})
+	if err != nil {
+		return Order{}, err
+	}
+	return order, nil
+}
+
+// reserveStock reserves items, failing with ErrOutOfStock if any product
+// or variant has too few units left. The condition is checked by the
+// UPDATE itself, so concurrent orders cannot both take the last unit.
+// Products with variants reserve the variant's units in their totals too.
+func (s *SQLStore) reserveStock(ctx context.Context, tx *sql.Tx, items []OrderItem) error {
+	for _, item := range items {
+		query := `UPDATE products SET reserved = reserved + ? WHERE id = ? AND stock - reserved >= ?`
+		args := []any{item.Quantity, item.ProductID, item.Quantity}
+		if item.VariantID != 0 {
+			query = `UPDATE product_variants SET reserved = reserved + ? WHERE id = ? AND product_id = ? AND stock - reserved >= ?`
+			args = []any{item.Quantity, item.VariantID, item.ProductID, item.Quantity}
+		}
+		res, err := tx.ExecContext(ctx, s.rebind(query), args...)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return fmt.Errorf("%w: %s", ErrOutOfStock, item.stockName())
+		}
+
+		if item.VariantID != 0 {
+			_, err := tx.ExecContext(ctx,
+				s.rebind(`UPDATE products SET reserved = reserved + ? WHERE id = ?`), item.Quantity, item.ProductID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// adjustStock changes the stock and reservations of each product, and of
+// the variant the line is for, by the given amounts per unit of items.
+// Lines for variants since removed change nothing.
+func (s *SQLStore) adjustStock(ctx context.Context, tx *sql.Tx, items []OrderItem, stock, reserved int) error {
+	if stock == 0 && reserved == 0 {
+		return nil
+	}
+	for _, item := range items {
+		if item.VariantID != 0 {
+			res, err := tx.ExecContext(ctx,
+				s.rebind(`UPDATE product_variants SET stock = stock + ?, reserved = reserved + ? WHERE id = ? AND product_id = ?`),
+				stock*item.Quantity, reserved*item.Quantity, item.VariantID, item.ProductID)
+			if err != nil {
+				return err
+			}
+			if n, err := res.RowsAffected(); err != nil {
+				return err
+			} else if n == 0 {
+				continue
+			}
+		}
+		_, err := tx.ExecContext(ctx,
+			s.rebind(`UPDATE products SET stock = stock + ?, reserved = reserved + ? WHERE id = ?`),
+			stock*item.Quantity, reserved*item.Quantity, item.ProductID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLStore) ListOrders(ctx context.Context, filter OrderFilter, page Page) ([]Order, error) {
+	// Child rows are restricted to the orders the filter and page select
+	where, args := filter.where()
+	clause, args := page.sql(where, args)
+	scope := ""
+	if where != "" || page != (Page{}) {
+		scope = " WHERE order_id IN (SELECT id FROM orders" + clause + ")"
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		s.rebind(`SELECT id, total_minor, currency, status, created_at, account_id, access_token_hash, customer_name, customer_email, customer_phone FROM orders`+clause), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []Order{}
+	index := map[int]int{}
+	for rows.Next() {
+		var o Order
+		var customer customerColumns
+		if err := rows.Scan(&o.ID, &o.Total.Amount, &o.Total.Currency, &o.Status, &o.CreatedAt, &customer.accountID, &customer.accessTokenHash, &customer.name, &customer.email, &customer.phone); err != nil {
+			return nil, err
+		}
+		o.AccountID, o.AccessTokenHash, o.Customer = int(customer.accountID.Int64), customer.accessTokenHash.String, customer.customer()
+		o.Items = []OrderItem{}
+		o.History = []StatusChange{}
+		o.Refunds = []Refund{}
+		index[o.ID] = len(orders)
+		orders = append(orders, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	itemRows, err := s.db.QueryContext(ctx,
+		s.rebind(`SELECT order_id, product_id, variant_id, quantity, unit_price_minor, currency FROM order_items`+scope+` ORDER BY order_id, position`), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer itemRows.Close()
+
+	for itemRows.Next() {
+		var orderID int
+		var item OrderItem
+		if err := itemRows.Scan(&orderID, &item.ProductID, &item.VariantID, &item.Quantity, &item.UnitPrice.Amount, &item.UnitPrice.Currency); err != nil {
+			return nil, err
+		}
+		if i, ok := index[orderID]; ok {
+			orders[i].Items = append(orders[i].Items, item)
+		}
+	}
+	if err := itemRows.Err(); err != nil {
+		return nil, err
+	}
+
+	historyRows, err := s.db.QueryContext(ctx,
+		s.rebind(`SELECT order_id, from_status, to_status, changed_at FROM order_status_history`+scope+` ORDER BY order_id, position`), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer historyRows.Close()
+
+	for historyRows.Next() {
+		var orderID int
+		var change StatusChange
+		if err := historyRows.Scan(&orderID, &change.From, &change.To, &change.At); err != nil {
+			return nil, err
+		}
+		if i, ok := index[orderID]; ok {
+			orders[i].History = append(orders[i].History, change)
+		}
+	}
+	if err := historyRows.Err(); err != nil {
+		return nil, err
+	}
+
+	addressRows, err := s.db.QueryContext(ctx,
+		s.rebind(`SELECT order_id, kind, `+addressColumns+` FROM order_addresses`+scope), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer addressRows.Close()
+
+	for addressRows.Next() {
+		var orderID int
+		var kind string
+		var a Address
+		if err := addressRows.Scan(&orderID, &kind, &a.Name, &a.Line1, &a.Line2, &a.City, &a.Region, &a.PostalCode, &a.Country); err != nil {
+			return nil, err
+		}
+		if i, ok := index[orderID]; ok {
+			orders[i].setAddress(kind, a)
+		}
+	}
+	if err := addressRows.Err(); err != nil {
+		return nil, err
+	}
+
+	refundRows, err := s.db.QueryContext(ctx,
+		s.rebind(`SELECT order_id, amount_minor, currency, reference, reason, created_at FROM order_refunds`+scope+` ORDER BY order_id, position`), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer refundRows.Close()
+
+	for refundRows.Next() {
+		var orderID int
+		var refund Refund
+		if err := refundRows.Scan(&orderID, &refund.Amount.Amount, &refund.Amount.Currency, &refund.Reference, &refund.Reason, &refund.CreatedAt); err != nil {
+			return nil, err
+		}
+		if i, ok := index[orderID]; ok {
+			orders[i].Refunds = append(orders[i].Refunds, refund)
+		}
+	}
+	if err := refundRows.Err(); err != nil {
+		return nil, err
+	}
+
+	refundItemRows, err := s.db.QueryContext(ctx,
+		s.rebind(`SELECT order_id, refund_position, product_id, variant_id, quantity, unit_price_minor, currency FROM order_refund_items`+scope+` ORDER BY order_id, refund_position, position`), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer refundItemRows.Close()
+
+	for refundItemRows.Next() {
+		var orderID, refund int
+		var item OrderItem
+		if err := refundItemRows.Scan(&orderID, &refund, &item.ProductID, &item.VariantID, &item.Quantity, &item.UnitPrice.Amount, &item.UnitPrice.Currency); err != nil {
+			return nil, err
+		}
+		if i, ok := index[orderID]; ok && refund < len(orders[i].Refunds) {
+			orders[i].Refunds[refund].Items = append(orders[i].Refunds[refund].Items, item)
+		}
+	}
+	return orders, refundItemRows.Err()
+}
+
+func (s *SQLStore) GetOrder(ctx context.Context, id int) (Order, error) {
+	return s.getOrder(ctx, s.db, id)
+}
+
+func (s *SQLStore) getOrder(ctx context.Context, q queryer, id int) (Order, error) {
+	var o Order
+	var customer customerColumns
+	err := q.QueryRowContext(ctx,
+		s.rebind(`SELECT id, total_minor, currency, status, created_at, account_id, access_token_hash, customer_name, customer_email, customer_phone FROM orders WHERE id = ?`), id).
+		Scan(&o.ID, &o.Total.Amount, &o.Total.Currency, &o.Status, &o.CreatedAt, &customer.accountID, &customer.accessTokenHash, &customer.name, &customer.email, &customer.phone)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Order{}, ErrOrderNotFound
+	}
+	if err != nil {
+		return Order{}, err
+	}
+	o.AccountID, o.AccessTokenHash, o.Customer = int(customer.accountID.Int64), customer.accessTokenHash.String, customer.customer()
+
+	rows, err := q.QueryContext(ctx,
+		s.rebind(`SELECT product_id, variant_id, quantity, unit_price_minor, currency FROM order_items WHERE order_id = ? ORDER BY position`), id)
+	if err != nil {
+		return Order{}, err
+	}
+	defer rows.Close()
+
+	o.Items = []OrderItem{}
+	for rows.Next() {
+		var item OrderItem
+		if err := rows.Scan(&item.ProductID, &item.VariantID, &item.Quantity, &item.UnitPrice.Amount, &item.UnitPrice.Currency); err != nil {
+			return Order{}, err
+		}
+		o.Items = append(o.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return Order{}, err
+	}
+
+	historyRows, err := q.QueryContext(ctx,
+		s.rebind(`SELECT from_status, to_status, changed_at FROM order_status_history WHERE order_id = ? ORDER BY position`), id)
+	if err != nil {
+		return Order{}, err
+	}
+	defer historyRows.Close()
+
+	o.History = []StatusChange{}
+	for historyRows.Next() {
+		var change StatusChange
+		if err := historyRows.Scan(&change.From, &change.To, &change.At); err != nil {
+			return Order{}, err
+		}
+		o.History = append(o.History, change)
+	}
+	if err := historyRows.Err(); err != nil {
+		return Order{}, err
+	}
+
+	addressRows, err := q.QueryContext(ctx,
+		s.rebind(`SELECT kind, `+addressColumns+` FROM order_addresses WHERE order_id = ?`), id)
+	if err != nil {
+		return Order{}, err
+	}
+	defer addressRows.Close()
+
+	for addressRows.Next() {
+		var kind string
+		var a Address
+		if err := addressRows.Scan(&kind, &a.Name, &a.Line1, &a.Line2, &a.City, &a.Region, &a.PostalCode, &a.Country); err != nil {
+			return Order{}, err
+		}
+		o.setAddress(kind, a)
+	}
+	if err := addressRows.Err(); err != nil {
+		return Order{}, err
+	}
+
+	refundRows, err := q.QueryContext(ctx,
+		s.rebind(`SELECT amount_minor, currency, reference, reason, created_at FROM order_refunds WHERE order_id = ? ORDER BY position`), id)
+	if err != nil {
+		return Order{}, err
+	}
+	defer refundRows.Close()
+
+	o.Refunds = []Refund{}
+	for refundRows.Next() {
+		var refund Refund
+		if err := refundRows.Scan(&refund.Amount.Amount, &refund.Amount.Currency, &refund.Reference, &refund.Reason, &refund.CreatedAt); err != nil {
+			return Order{}, err
+		}
+		o.Refunds = append(o.Refunds, refund)
+	}
+	if err := refundRows.Err(); err != nil {
+		return Order{}, err
+	}
+
+	refundItemRows, err := q.QueryContext(ctx,
+		s.rebind(`SELECT refund_position, product_id, variant_id, quantity, unit_price_minor, currency FROM order_refund_items WHERE order_id = ? ORDER BY refund_position, position`), id)
+	if err != nil {
+		return Order{}, err
+	}
+	defer refundItemRows.Close()
+
+	for refundItemRows.Next() {
+		var refund int
+		var item OrderItem
+		if err := refundItemRows.Scan(&refund, &item.ProductID, &item.VariantID, &item.Quantity, &item.UnitPrice.Amount, &item.UnitPrice.Currency); err != nil {
+			return Order{}, err
+		}
+		if refund < len(o.Refunds) {
+			o.Refunds[refund].Items = append(o.Refunds[refund].Items, item)
+		}
+	}
+	return o, refundItemRows.Err()
+}
+
+// addressColumns are the columns of order_addresses after order_id and
+// kind, in the order of the Address fields
+const addressColumns = "name, line1, line2, city, region, postal_code, country"
+
+// Kinds of order_addresses rows
+const (
+	shippingAddress = "shipping"
+	billingAddress  = "billing"
+)
+
+// customerColumns scans the customer columns of an order row, which are
+// NULL for guest orders and orders placed without contact details
+type customerColumns struct {
+	accountID       sql.NullInt64
+	accessTokenHash sql.NullString
+	name, email     sql.NullString
+	phone           string
+}
+
+func (c customerColumns) customer() *Customer {
+	if !c.email.Valid {
+		return nil
+	}
+	return &Customer{Name: c.name.String, Email: c.email.String, Phone: c.phone}
+}
+
+// setAddress puts an address read from order_addresses on the order
+func (o *Order) setAddress(kind string, a Address) {
+	switch kind {
+	case shippingAddress:
+		o.ShippingAddress = &a
+	case billingAddress:
+		o.BillingAddress = &a
+	}
+}
+
+// insertAddresses stores the shipping and billing addresses of an order
+func (s *SQLStore) insertAddresses(ctx context.Context, tx *sql.Tx, order Order) error {
+	for kind, a := range map[string]*Address{shippingAddress: order.ShippingAddress, billingAddress: order.BillingAddress} {
+		if a == nil {
+			continue
+		}
+		_, err := tx.ExecContext(ctx,
+			s.rebind(`INSERT INTO order_addresses (order_id, kind, `+addressColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+			order.ID, kind, a.Name, a.Line1, a.Line2, a.City, a.Region, a.PostalCode, a.Country)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertHistory stores status changes of an order starting at position
+func (s *SQLStore) insertHistory(ctx context.Context, tx *sql.Tx, orderID, position int, changes []StatusChange) error {
+	for i, change := range changes {
+		_, err := tx.ExecContext(ctx,
+			s.rebind(`INSERT INTO order_status_history (order_id, position, from_status, to_status, changed_at) VALUES (?, ?, ?, ?, ?)`),
+			orderID, position+i, change.From, change.To, change.At.UTC())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertRefunds stores refunds of an order starting at position
+func (s *SQLStore) insertRefunds(ctx context.Context, tx *sql.Tx, orderID, position int, refunds []Refund) error {
+	for i, refund := range refunds {
+		_, err := tx.ExecContext(ctx,
+			s.rebind(`INSERT INTO order_refunds (order_id, position, amount_minor, currency, reference, reason, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`),
+			orderID, position+i, refund.Amount.Amount, refund.Amount.Currency, refund.Reference, refund.Reason, refund.CreatedAt.UTC())
+		if err != nil {
+			return err
+		}
+		for j, item := range refund.Items {
+			_, err := tx.ExecContext(ctx,
+				s.rebind(`INSERT INTO order_refund_items (order_id, refund_position, position, product_id, variant_id, quantity, unit_price_minor, currency) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+				orderID, position+i, j, item.ProductID, item.VariantID, item.Quantity, item.UnitPrice.Amount, item.UnitPrice.Currency)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *SQLStore) UpdateOrder(ctx context.Context, id int, fn func(*Order) error) (Order, error) {
+	var order Order
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		order, err = s.updateOrder(ctx, tx, id, fn)
+		return err
+	})
+	if err != nil {
+		return Order{}, err
+	}
+	return order, nil
+}
+
+// updateOrder locks an order, applies fn and saves the result within tx
+func (s *SQLStore) updateOrder(ctx context.Context, tx *sql.Tx, id int, fn func(*Order) error) (Order, error) {
+	// Lock the order row so concurrent updates to it are serialised
+	var locked int
+	err := tx.QueryRowContext(ctx,
+		s.rebind(`SELECT id FROM orders WHERE id = ?`+s.dialect.forUpdate), id).Scan(&locked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Order{}, ErrOrderNotFound
+	}
+	if err != nil {
+		return Order{}, err
+	}
+
+	order, err := s.getOrder(ctx, tx, id)
+	if err != nil {
+		return Order{}, err
+	}
+	// History and refunds are append-only; store what fn added
+	changes, refunds := len(order.History), len(order.Refunds)
+	from := order.Status
+	if err := fn(&order); err != nil {
+		return Order{}, err
+	}
+	stock, reserved := stockEffect(from, order.Status)
+	if err := s.adjustStock(ctx, tx, mergeItems(order.Items), stock, reserved); err != nil {
+		return Order{}, err
+	}
+
+	_, err = tx.ExecContext(ctx, s.rebind(`UPDATE orders SET status = ? WHERE id = ?`), order.Status, id)
+	if err != nil {
+		return Order{}, err
+	}
+	if err := s.insertHistory(ctx, tx, id, changes, order.History[changes:]); err != nil {
+		return Order{}, err
+	}
+	if err := s.insertRefunds(ctx, tx, id, refunds, order.Refunds[refunds:]); err != nil {
+		return Order{}, err
+	}
+	return order, nil
+}
+
+func (s *SQLStore) CreateCart(ctx context.Context, cart Cart) (Cart, error) {
+	cart.CreatedAt, cart.UpdatedAt = cart.CreatedAt.UTC(), cart.UpdatedAt.UTC()
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx,
+			s.rebind(`INSERT INTO carts (id, order_id, created_at, updated_at) VALUES (?, ?, ?, ?)`),
+			cart.ID, nullID(cart.OrderID), cart.CreatedAt, cart.UpdatedAt)
+		if err != nil {
+			return err
+		}
+		return s.insertCartItems(ctx, tx, cart)
+	})
+	if err != nil {
+		return Cart{}, err
+	}
+	return cart, nil
+}
+
+func (s *SQLStore) GetCart(ctx context.Context, id string) (Cart, error) {
+	return s.getCart(ctx, s.db, id, "")
+}
+
+// getCart reads a cart and its items; lock is appended to the SELECT of
+// the cart row
+func (s *SQLStore) getCart(ctx context.Context, q queryer, id, lock string) (Cart, error) {
+	var c Cart
+	var orderID sql.NullInt64
+	err := q.QueryRowContext(ctx,
+		s.rebind(`SELECT id, order_id, created_at, updated_at FROM carts WHERE id = ?`+lock), id).
+		Scan(&c.ID, &orderID, &c.CreatedAt, &c.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Cart{}, ErrCartNotFound
+	}
+	if err != nil {
+		return Cart{}, err
+	}
+	c.OrderID = int(orderID.Int64)
+
+	rows, err := q.QueryContext(ctx,
+		s.rebind(`SELECT id, product_id, variant_id, quantity FROM cart_items WHERE cart_id = ? ORDER BY position`), id)
+	if err != nil {
+		return Cart{}, err
+	}
+	defer rows.Close()
+
+	c.Items = []CartItem{}
+	for rows.Next() {
+		var item CartItem
+		if err := rows.Scan(&item.ID, &item.ProductID, &item.VariantID, &item.Quantity); err != nil {
+			return Cart{}, err
+		}
+		c.Items = append(c.Items, item)
+	}
+	return c, rows.Err()
+}
+
+// insertCartItems stores the items of a cart in order
+func (s *SQLStore) insertCartItems(ctx context.Context, tx *sql.Tx, cart Cart) error {
+	for i, item := range cart.Items {
+		_, err := tx.ExecContext(ctx,
+			s.rebind(`INSERT INTO cart_items (cart_id, id, position, product_id, variant_id, quantity) VALUES (?, ?, ?, ?, ?, ?)`),
+			cart.ID, item.ID, i, item.ProductID, item.VariantID, item.Quantity)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLStore) UpdateCart(ctx context.Context, id string, fn func(*Cart) error) (Cart, error) {
+	var cart Cart
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		if cart, err = s.getCart(ctx, tx, id, s.dialect.forUpdate); err != nil {
+			return err
+		}
+		if err := fn(&cart); err != nil {
+			return err
+		}
+		cart.ID = id
+		cart.UpdatedAt = cart.UpdatedAt.UTC()
+
+		_, err = tx.ExecContext(ctx,
+			s.rebind(`UPDATE carts SET order_id = ?, updated_at = ? WHERE id = ?`),
+			nullID(cart.OrderID), cart.UpdatedAt, id)
+		if err != nil {
+			return err
+		}
+		// Carts are small; their items are simply written afresh
+		if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM cart_items WHERE cart_id = ?`), id); err != nil {
+			return err
+		}
+		return s.insertCartItems(ctx, tx, cart)
+	})
+	if err != nil {
+		return Cart{}, err
+	}
+	return cart, nil
+}
+
+func (s *SQLStore) DeleteCarts(ctx context.Context, updatedBefore time.Time) (int, error) {
+	var deleted int64
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx,
+			s.rebind(`DELETE FROM cart_items WHERE cart_id IN (SELECT id FROM carts WHERE updated_at < ?)`), updatedBefore.UTC())
+		if err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM carts WHERE updated_at < ?`), updatedBefore.UTC())
+		if err != nil {
+			return err
+		}
+		deleted, err = res.RowsAffected()
+		return err
+	})
+	return int(deleted), err
+}
+
+// accountColumns are the columns scanAccount reads, in order
+const accountColumns = "id, email, name, password_hash, created_at"
+
+// scanAccount reads a row selected with accountColumns
+func scanAccount(row rowScanner) (Account, error) {
+	var a Account
+	err := row.Scan(&a.ID, &a.Email, &a.Name, &a.PasswordHash, &a.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Account{}, ErrAccountNotFound
+	}
+	return a, err
+}
+
+func (s *SQLStore) CreateAccount(ctx context.Context, account Account) (Account, error) {
+	account.CreatedAt = account.CreatedAt.UTC()
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var taken int
+		err := tx.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*) FROM accounts WHERE email = ?`), account.Email).Scan(&taken)
+		if err != nil {
+			return err
+		}
+		if taken > 0 {
+			return ErrDuplicateAccount
+		}
+		return tx.QueryRowContext(ctx,
+			s.rebind(`INSERT INTO accounts (email, name, password_hash, created_at) VALUES (?, ?, ?, ?) RETURNING id`),
+			account.Email, account.Name, account.PasswordHash, account.CreatedAt).Scan(&account.ID)
+	})
+	if err != nil {
+		return Account{}, err
+	}
+	return account, nil
+}
+
+func (s *SQLStore) GetAccount(ctx context.Context, id int) (Account, error) {
+	return scanAccount(s.db.QueryRowContext(ctx, s.rebind(`SELECT `+accountColumns+` FROM accounts WHERE id = ?`), id))
+}
+
+func (s *SQLStore) GetAccountByEmail(ctx context.Context, email string) (Account, error) {
+	return scanAccount(s.db.QueryRowContext(ctx, s.rebind(`SELECT `+accountColumns+` FROM accounts WHERE email = ?`), email))
+}
+
+func (s *SQLStore) CreateSession(ctx context.Context, session Session) error {
+	_, err := s.db.ExecContext(ctx,
+		s.rebind(`INSERT INTO sessions (token_hash, account_id, created_at, expires_at) VALUES (?, ?, ?, ?)`),
+		session.TokenHash, session.AccountID, session.CreatedAt.UTC(), session.ExpiresAt.UTC())
+	return err
+}
+
+func (s *SQLStore) GetSession(ctx context.Context, tokenHash string) (Session, error) {
+	var session Session
+	err := s.db.QueryRowContext(ctx,
+		s.rebind(`SELECT token_hash, account_id, created_at, expires_at FROM sessions WHERE token_hash = ?`), tokenHash).
+		Scan(&session.TokenHash, &session.AccountID, &session.CreatedAt, &session.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, ErrSessionNotFound
+	}
+	return session, err
+}
+
+func (s *SQLStore) DeleteSession(ctx context.Context, tokenHash string) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM sessions WHERE token_hash = ?`), tokenHash)
+	return err
+}
+
+func (s *SQLStore) DeleteSessions(ctx context.Context, expiredBy time.Time) (int, error) {
+	res, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM sessions WHERE expires_at <= ?`), expiredBy.UTC())
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := res.RowsAffected()
+	return int(deleted), err
+}
+
+func (s *SQLStore) RecordPayment(ctx context.Context, payment Payment) (Payment, error) {
+	return s.insertPayment(ctx, s.db, payment)
+}
+
+func (s *SQLStore) PayOrder(ctx context.Context, payment Payment, fn func(*Order) error) (Order, Payment, error) {
+	var order Order
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		if order, err = s.updateOrder(ctx, tx, payment.OrderID, fn); err != nil {
+			return err
+		}
+		payment, err = s.insertPayment(ctx, tx, payment)
+		return err
+	})
+	if err != nil {
+		return Order{}, Payment{}, err
+	}
+	return order, payment, nil
+}
+
+// insertPayment saves a payment through q
+func (s *SQLStore) insertPayment(ctx context.Context, q queryer, payment Payment) (Payment, error) {
+	payment.CreatedAt = time.Now().UTC()
+	err := q.QueryRowContext(ctx,
+		s.rebind(`INSERT INTO payments (order_id, amount_minor, currency, reference, created_at) VALUES (?, ?, ?, ?, ?) RETURNING id`),
+		payment.OrderID, payment.Amount.Amount, payment.Amount.Currency, payment.Reference, payment.CreatedAt).Scan(&payment.ID)
+	if err != nil {
+		return Payment{}, err
+	}
+	return payment, nil
+}
+
+func (s *SQLStore) ListPayments(ctx context.Context, orderID int) ([]Payment, error) {
+	rows, err := s.db.QueryContext(ctx,
+		s.rebind(`SELECT id, order_id, amount_minor, currency, reference, created_at FROM payments WHERE order_id = ? ORDER BY id`), orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payments := []Payment{}
+	for rows.Next() {
+		var p Payment
+		if err := rows.Scan(&p.ID, &p.OrderID, &p.Amount.Amount, &p.Amount.Currency, &p.Reference, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		payments = append(payments, p)
+	}
+	return payments, rows.Err()
+}
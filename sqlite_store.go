@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteMigrations is the schema history of the SQLite backend
+var sqliteMigrations = []migration{
+	{
+		version: 1,
+		name:    "create catalog, orders and payments",
+		statements: []string{
+			`CREATE TABLE products (
+				id INTEGER PRIMARY KEY,
+				name TEXT NOT NULL,
+				description TEXT NOT NULL DEFAULT '',
+				price REAL NOT NULL,
+				image TEXT NOT NULL DEFAULT '',
+				category TEXT NOT NULL DEFAULT ''
+			)`,
+			`CREATE TABLE orders (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				total REAL NOT NULL,
+				status TEXT NOT NULL,
+				created_at TIMESTAMP NOT NULL
+			)`,
+			`CREATE TABLE order_items (
+				order_id INTEGER NOT NULL REFERENCES orders(id),
+				position INTEGER NOT NULL,
+				product_id INTEGER NOT NULL,
+				quantity INTEGER NOT NULL,
+				PRIMARY KEY (order_id, position)
+			)`,
+			`CREATE TABLE payments (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				order_id INTEGER NOT NULL REFERENCES orders(id),
+				amount REAL NOT NULL,
+				created_at TIMESTAMP NOT NULL
+			)`,
+			`CREATE INDEX payments_order_id ON payments (order_id)`,
+		},
+	},
+	{
+		version: 2,
+		name:    "store money as integer minor units with a currency",
+		statements: []string{
+			`ALTER TABLE products ADD COLUMN price_minor INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE products ADD COLUMN currency TEXT NOT NULL DEFAULT 'USD'`,
+			`UPDATE products SET price_minor = CAST(ROUND(price * 100) AS INTEGER)`,
+			`ALTER TABLE products DROP COLUMN price`,
+			`ALTER TABLE orders ADD COLUMN total_minor INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE orders ADD COLUMN currency TEXT NOT NULL DEFAULT 'USD'`,
+			`UPDATE orders SET total_minor = CAST(ROUND(total * 100) AS INTEGER)`,
+			`ALTER TABLE orders DROP COLUMN total`,
+			`ALTER TABLE payments ADD COLUMN amount_minor INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE payments ADD COLUMN currency TEXT NOT NULL DEFAULT 'USD'`,
+			`UPDATE payments SET amount_minor = CAST(ROUND(amount * 100) AS INTEGER)`,
+			`ALTER TABLE payments DROP COLUMN amount`,
+		},
+	},
+	{
+		version: 3,
+		name:    "record the gateway reference of payments",
+		statements: []string{
+			`ALTER TABLE payments ADD COLUMN reference TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version: 4,
+		name:    "record order status history",
+		statements: []string{
+			`CREATE TABLE order_status_history (
+				order_id INTEGER NOT NULL REFERENCES orders(id),
+				position INTEGER NOT NULL,
+				from_status TEXT NOT NULL,
+				to_status TEXT NOT NULL,
+				changed_at TIMESTAMP NOT NULL,
+				PRIMARY KEY (order_id, position)
+			)`,
+			`INSERT INTO order_status_history (order_id, position, from_status, to_status, changed_at)
+				SELECT id, 0, '', status, created_at FROM orders`,
+		},
+	},
+	{
+		version: 5,
+		name:    "record refunds on orders",
+		statements: []string{
+			`CREATE TABLE order_refunds (
+				order_id INTEGER NOT NULL REFERENCES orders(id),
+				position INTEGER NOT NULL,
+				amount_minor INTEGER NOT NULL,
+				currency TEXT NOT NULL,
+				reference TEXT NOT NULL,
+				reason TEXT NOT NULL DEFAULT '',
+				created_at TIMESTAMP NOT NULL,
+				PRIMARY KEY (order_id, position)
+			)`,
+		},
+	},
+	{
+		version: 6,
+		name:    "price order lines and itemise refunds",
+		statements: []string{
+			`ALTER TABLE order_items ADD COLUMN unit_price_minor INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE order_items ADD COLUMN currency TEXT NOT NULL DEFAULT 'USD'`,
+			// Orders placed before this migration are priced at today's catalog
+			`UPDATE order_items SET
+				unit_price_minor = COALESCE((SELECT price_minor FROM products WHERE products.id = order_items.product_id), 0),
+				currency = COALESCE((SELECT currency FROM products WHERE products.id = order_items.product_id), 'USD')`,
+			`CREATE TABLE order_refund_items (
+				order_id INTEGER NOT NULL,
+				refund_position INTEGER NOT NULL,
+				position INTEGER NOT NULL,
+				product_id INTEGER NOT NULL,
+				quantity INTEGER NOT NULL,
+				unit_price_minor INTEGER NOT NULL,
+				currency TEXT NOT NULL,
+				PRIMARY KEY (order_id, refund_position, position),
+				FOREIGN KEY (order_id, refund_position) REFERENCES order_refunds(order_id, position)
+			)`,
+		},
+	},
+	{
+		version: 7,
+		name:    "soft-delete products and allocate product IDs",
+		// products.id is an INTEGER PRIMARY KEY, so SQLite already
+		// allocates IDs for rows inserted without one
+		statements: []string{
+			`ALTER TABLE products ADD COLUMN deleted_at TIMESTAMP`,
+		},
+	},
+	{
+		version: 8,
+		name:    "product SKUs",
+		statements: []string{
+			`ALTER TABLE products ADD COLUMN sku TEXT`,
+			`CREATE UNIQUE INDEX products_sku ON products (sku)`,
+		},
+	},
+	{
+		version: 9,
+		name:    "product inventory",
+		// Unpaid orders placed before inventory existed keep their units
+		// reserved; products start with exactly that much stock
+		statements: []string{
+			`ALTER TABLE products ADD COLUMN stock INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE products ADD COLUMN reserved INTEGER NOT NULL DEFAULT 0`,
+			`UPDATE products SET reserved = COALESCE((
+				SELECT SUM(order_items.quantity) FROM order_items
+				JOIN orders ON orders.id = order_items.order_id
+				WHERE order_items.product_id = products.id AND orders.status IN ('pending', 'failed')
+			), 0)`,
+			`UPDATE products SET stock = reserved`,
+		},
+	},
+	{
+		version: 10,
+		name:    "product variants",
+		statements: []string{
+			`CREATE TABLE product_variants (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				product_id INTEGER NOT NULL REFERENCES products(id),
+				position INTEGER NOT NULL,
+				sku TEXT,
+				options TEXT NOT NULL,
+				price_minor INTEGER,
+				currency TEXT,
+				stock INTEGER NOT NULL DEFAULT 0,
+				reserved INTEGER NOT NULL DEFAULT 0
+			)`,
+			`CREATE UNIQUE INDEX product_variants_sku ON product_variants (sku)`,
+			`CREATE INDEX product_variants_product_id ON product_variants (product_id, position)`,
+			// 0 marks lines for products without variants
+			`ALTER TABLE order_items ADD COLUMN variant_id INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE order_refund_items ADD COLUMN variant_id INTEGER NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		version: 11,
+		name:    "product categories",
+		// Categories for the products already saved are added when the
+		// store opens, by seedCategories
+		statements: []string{
+			`CREATE TABLE categories (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				slug TEXT NOT NULL,
+				name TEXT NOT NULL,
+				description TEXT NOT NULL DEFAULT '',
+				parent_id INTEGER REFERENCES categories(id)
+			)`,
+			`CREATE UNIQUE INDEX categories_slug ON categories (slug)`,
+			`CREATE UNIQUE INDEX categories_name ON categories (name)`,
+			`CREATE INDEX categories_parent_id ON categories (parent_id)`,
+		},
+	},
+	{
+		version: 12,
+		name:    "server-side carts",
+		statements: []string{
+			`CREATE TABLE carts (
+				id TEXT PRIMARY KEY,
+				order_id INTEGER REFERENCES orders(id),
+				created_at TIMESTAMP NOT NULL,
+				updated_at TIMESTAMP NOT NULL
+			)`,
+			`CREATE INDEX carts_updated_at ON carts (updated_at)`,
+			`CREATE TABLE cart_items (
+				cart_id TEXT NOT NULL REFERENCES carts(id),
+				id INTEGER NOT NULL,
+				position INTEGER NOT NULL,
+				product_id INTEGER NOT NULL,
+				variant_id INTEGER NOT NULL DEFAULT 0,
+				quantity INTEGER NOT NULL,
+				PRIMARY KEY (cart_id, id)
+			)`,
+		},
+	},
+	{
+		version: 13,
+		name:    "order customer details",
+		statements: []string{
+			`ALTER TABLE orders ADD COLUMN customer_name TEXT`,
+			`ALTER TABLE orders ADD COLUMN customer_email TEXT`,
+			`ALTER TABLE orders ADD COLUMN customer_phone TEXT NOT NULL DEFAULT ''`,
+			`CREATE TABLE order_addresses (
+				order_id INTEGER NOT NULL REFERENCES orders(id),
+				kind TEXT NOT NULL,
+				name TEXT NOT NULL,
+				line1 TEXT NOT NULL,
+				line2 TEXT NOT NULL DEFAULT '',
+				city TEXT NOT NULL,
+				region TEXT NOT NULL DEFAULT '',
+				postal_code TEXT NOT NULL,
+				country TEXT NOT NULL,
+				PRIMARY KEY (order_id, kind)
+			)`,
+		},
+	},
+	{
+		version: 14,
+		name:    "customer accounts",
+		statements: []string{
+			`CREATE TABLE accounts (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				email TEXT NOT NULL,
+				name TEXT NOT NULL,
+				password_hash TEXT NOT NULL,
+				created_at TIMESTAMP NOT NULL
+			)`,
+			`CREATE UNIQUE INDEX accounts_email ON accounts (email)`,
+			`CREATE TABLE sessions (
+				token_hash TEXT PRIMARY KEY,
+				account_id INTEGER NOT NULL REFERENCES accounts(id),
+				created_at TIMESTAMP NOT NULL,
+				expires_at TIMESTAMP NOT NULL
+			)`,
+			`CREATE INDEX sessions_expires_at ON sessions (expires_at)`,
+			`ALTER TABLE orders ADD COLUMN account_id INTEGER REFERENCES accounts(id)`,
+			`CREATE INDEX orders_account_id ON orders (account_id)`,
+		},
+	},
+	{
+		version: 15,
+		name:    "guest order access tokens",
+		statements: []string{
+			`ALTER TABLE orders ADD COLUMN access_token_hash TEXT`,
+		},
+	},
+}
+
+// OpenSQLiteStore opens (or creates) the SQLite database at path, applies
+// pending migrations and seeds the catalog on first start
+func OpenSQLiteStore(path string, seed []Product) (*SQLStore, error) {
+	// Writers take the database lock up front so concurrent transactions
+	// wait on busy_timeout instead of failing on lock upgrade
+	params := url.Values{}
+	params.Set("_foreign_keys", "on")
+	params.Set("_journal_mode", "WAL")
+	params.Set("_busy_timeout", "5000")
+	params.Set("_txlock", "immediate")
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite %s: %w", path, err)
+	}
+
+	store := &SQLStore{db: db, dialect: sqliteDialect}
+	ctx := context.Background()
+	if err := store.migrate(ctx, sqliteMigrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := store.seedProducts(ctx, seed); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := store.seedCategories(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
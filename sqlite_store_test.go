@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// newSQLiteStore opens a SQLite store in a temporary directory
+func newSQLiteStore(t *testing.T, path string) *SQLStore {
+	t.Helper()
+	store, err := OpenSQLiteStore(path, testCatalog(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestSQLiteStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		return newSQLiteStore(t, filepath.Join(t.TempDir(), "test.db"))
+	})
+}
+
+func TestSQLiteStorePersistsAcrossRestart(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	// Create and pay for an order through the handlers
+	store := newSQLiteStore(t, path)
+	srv := NewServer(store)
+
+	jsonData, _ := json.Marshal(Order{Items: []OrderItem{{ProductID: 4, Quantity: 2}}})
+	req, _ := http.NewRequest("POST", "/api/orders", bytes.NewBuffer(jsonData))
+	rr := httptest.NewRecorder()
+	srv.CreateOrder(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("createOrder failed: got %v want %v", status, http.StatusOK)
+	}
+
+	var order Order
+	json.Unmarshal(rr.Body.Bytes(), &order)
+
+	jsonData, _ = json.Marshal(PaymentRequest{OrderID: order.ID, Amount: order.Total})
+	req, _ = http.NewRequest("POST", "/api/payment", bytes.NewBuffer(jsonData))
+	req.Header.Set(OrderTokenHeader, order.AccessToken)
+	rr = httptest.NewRecorder()
+	srv.ProcessPayment(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("processPayment failed: got %v want %v", status, http.StatusOK)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen the same file and check the order survived
+	reopened := newSQLiteStore(t, path)
+
+	orders, err := reopened.ListOrders(context.Background(), OrderFilter{}, Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 1 {
+		t.Fatalf("expected 1 order, got %d", len(orders))
+	}
+	if orders[0].Status != "paid" {
+		t.Errorf("expected status 'paid', got %s", orders[0].Status)
+	}
+	if len(orders[0].Items) != 1 || orders[0].Items[0].Quantity != 2 {
+		t.Errorf("expected items to survive restart, got %+v", orders[0].Items)
+	}
+
+	payments, err := reopened.ListPayments(context.Background(), order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 1 {
+		t.Errorf("expected 1 payment, got %d", len(payments))
+	}
+
+	// Reopening must neither re-run migrations nor duplicate the catalog
+	products, err := reopened.ListProducts(context.Background(), ProductFilter{}, Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 5 {
+		t.Errorf("expected 5 products, got %d", len(products))
+	}
+
+	var version int
+	reopened.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+	if version != len(sqliteMigrations) {
+		t.Errorf("expected schema version %d, got %d", len(sqliteMigrations), version)
+	}
+}
+
+func TestSQLiteStoreMigratesFloatPrices(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	// Build a database at schema version 1, where money was stored as REAL
+	db, err := sql.Open("sqlite3", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := &SQLStore{db: db, dialect: sqliteDialect}
+	if err := legacy.migrate(context.Background(), sqliteMigrations[:1]); err != nil {
+		t.Fatal(err)
+	}
+	db.Exec(`INSERT INTO products (id, name, price) VALUES (1, 'Sticker', 0.29)`)
+	db.Exec(`INSERT INTO orders (id, total, status, created_at) VALUES (1, 8.7, 'pending', CURRENT_TIMESTAMP)`)
+	db.Close()
+
+	store := newSQLiteStore(t, path)
+
+	product, err := store.GetProduct(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product.Price != NewMoney(29, "USD") {
+		t.Errorf("expected price 0.29 USD, got %+v", product.Price)
+	}
+
+	order, err := store.GetOrder(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Total != NewMoney(870, "USD") {
+		t.Errorf("expected total 8.70 USD, got %+v", order.Total)
+	}
+}
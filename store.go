@@ -0,0 +1,828 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Errors returned by Store implementations
+var (
+	ErrProductNotFound = errors.New("product not found")
+	ErrOrderNotFound   = errors.New("order not found")
+	ErrDuplicateSKU    = errors.New("another product already has this SKU")
+)
+
+// BatchError is returned when one product of a batch cannot be saved
+type BatchError struct {
+	// Index is the position of the product in the batch
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("product %d of the batch: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// Store is the persistence layer behind the HTTP handlers
+type Store interface {
+	// Products
+	// ListProducts leaves out deleted products; GetProduct still finds them
+	ListProducts(ctx context.Context, filter ProductFilter, page Page) ([]Product, error)
+	// CountProductsByCategory counts the products filter matches in each
+	// category, in category order
+	CountProductsByCategory(ctx context.Context, filter ProductFilter) ([]CategoryCount, error)
+	// CountProductsByPrice counts the products filter matches in each
+	// bucket of the price facet, empty buckets included
+	CountProductsByPrice(ctx context.Context, filter ProductFilter) ([]PriceBucket, error)
+	GetProduct(ctx context.Context, id int) (Product, error)
+	// GetProductBySKU finds deleted products too, like GetProduct
+	GetProductBySKU(ctx context.Context, sku string) (Product, error)
+	// CreateProduct allocates the product's ID. It and UpdateProduct
+	// return ErrDuplicateSKU rather than save a SKU another product has.
+	CreateProduct(ctx context.Context, product Product) (Product, error)
+	// UpdateProduct applies fn to a product atomically, like UpdateOrder
+	UpdateProduct(ctx context.Context, id int, fn func(*Product) error) (Product, error)
+	// SaveProducts saves a batch of products in one transaction: all of
+	// them or, on the first error, none. Products without an ID are
+	// created as by CreateProduct; the others replace the product with
+	// their ID once fn has checked the replacement against it. Errors are
+	// a *BatchError naming the product that failed.
+	SaveProducts(ctx context.Context, products []Product, fn func(old Product, p *Product) error) ([]Product, error)
+
+	// Categories
+	// ListCategories returns every category in ID order. CreateProduct and
+	// UpdateProduct add a top-level category for a product whose category
+	// has none, so every product on sale is in one.
+	ListCategories(ctx context.Context) ([]Category, error)
+	// CreateCategory allocates the category's ID. It and UpdateCategory
+	// return ErrDuplicateCategory rather than save a name or slug another
+	// category has, and ErrParentNotFound or ErrCategoryCycle rather than
+	// a parent that would break the tree.
+	CreateCategory(ctx context.Context, category Category) (Category, error)
+	// UpdateCategory applies fn to a category atomically, like
+	// UpdateProduct. Renaming a category renames it on its products too.
+	UpdateCategory(ctx context.Context, id int, fn func(*Category) error) (Category, error)
+	// DeleteCategory returns ErrCategoryInUse while the category has
+	// subcategories or products on sale
+	DeleteCategory(ctx context.Context, id int) error
+
+	// Carts
+	// CreateCart saves a new cart under the ID it carries
+	CreateCart(ctx context.Context, cart Cart) (Cart, error)
+	GetCart(ctx context.Context, id string) (Cart, error)
+	// UpdateCart applies fn to a cart atomically, like UpdateOrder
+	UpdateCart(ctx context.Context, id string, fn func(*Cart) error) (Cart, error)
+	// DeleteCarts removes the carts last changed before the given time and
+	// returns how many it removed
+	DeleteCarts(ctx context.Context, updatedBefore time.Time) (int, error)
+
+	// Accounts
+	// CreateAccount returns ErrDuplicateAccount if the email is taken
+	CreateAccount(ctx context.Context, account Account) (Account, error)
+	GetAccount(ctx context.Context, id int) (Account, error)
+	GetAccountByEmail(ctx context.Context, email string) (Account, error)
+	CreateSession(ctx context.Context, session Session) error
+	GetSession(ctx context.Context, tokenHash string) (Session, error)
+	// DeleteSession signs a session out; it is not an error if it is gone
+	DeleteSession(ctx context.Context, tokenHash string) error
+	// DeleteSessions removes the sessions expired by the given time and
+	// returns how many it removed
+	DeleteSessions(ctx context.Context, expiredBy time.Time) (int, error)
+
+	// Orders
+	// CreateOrder prices and reserves items and saves them in a new order
+	// with the given contact details
+	CreateOrder(ctx context.Context, items []OrderItem, contact OrderContact) (Order, error)
+	ListOrders(ctx context.Context, filter OrderFilter, page Page) ([]Order, error)
+	GetOrder(ctx context.Context, id int) (Order, error)
+	// UpdateOrder loads an order, applies fn and saves the result atomically:
+	// no other update to the same order can interleave. If fn returns an
+	// error nothing is saved and the error is returned unchanged.
+	UpdateOrder(ctx context.Context, id int, fn func(*Order) error) (Order, error)
+
+	// Payments
+	RecordPayment(ctx context.Context, payment Payment) (Payment, error)
+	// PayOrder applies fn to the payment's order like UpdateOrder and
+	// records the payment in the same write, so an order is never saved as
+	// paid without its payment or the other way round
+	PayOrder(ctx context.Context, payment Payment, fn func(*Order) error) (Order, Payment, error)
+	ListPayments(ctx context.Context, orderID int) ([]Payment, error)
+}
+
+// MemoryStore keeps products, orders and payments in memory. It is safe for
+// concurrent use; order IDs are allocated under the write lock so they are
+// unique and increase in creation order.
+type MemoryStore struct {
+	mu             sync.RWMutex
+	products       []Product
+	categories     []Category
+	carts          map[string]Cart
+	accounts       []Account
+	sessions       map[string]Session
+	orders         []Order
+	payments       []Payment
+	nextProductID  int
+	nextVariantID  int
+	nextCategoryID int
+	nextAccountID  int
+	nextOrderID    int
+	nextPaymentID  int
+}
+
+// NewMemoryStore creates an in-memory store seeded with the given catalog
+func NewMemoryStore(products []Product) *MemoryStore {
+	m := &MemoryStore{
+		products:       make([]Product, len(products)),
+		orders:         []Order{},
+		payments:       []Payment{},
+		categories:     []Category{},
+		carts:          map[string]Cart{},
+		accounts:       []Account{},
+		sessions:       map[string]Session{},
+		nextProductID:  1,
+		nextVariantID:  1,
+		nextCategoryID: 1,
+		nextAccountID:  1,
+		nextOrderID:    1,
+		nextPaymentID:  1,
+	}
+	for i, product := range products {
+		product = copyProduct(product)
+		product.sumVariants()
+		m.products[i] = product
+		if product.ID >= m.nextProductID {
+			m.nextProductID = product.ID + 1
+		}
+		for _, v := range product.Variants {
+			if v.ID >= m.nextVariantID {
+				m.nextVariantID = v.ID + 1
+			}
+		}
+		m.ensureCategory(product)
+	}
+	return m
+}
+
+func (m *MemoryStore) ListProducts(ctx context.Context, filter ProductFilter, page Page) ([]Product, error) {
+	last, err := filter.cursorProduct(page)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	matched := []Product{}
+	for _, product := range m.products {
+		if filter.Matches(product) {
+			matched = append(matched, product)
+		}
+	}
+	filter.sortProducts(matched)
+
+	products := []Product{}
+	for _, product := range matched {
+		if page.Limit > 0 && len(products) == page.Limit {
+			break
+		}
+		if page.AfterID == 0 || filter.less(last, product) {
+			products = append(products, copyProduct(product))
+		}
+	}
+	return products, nil
+}
+
+func (m *MemoryStore) CountProductsByCategory(ctx context.Context, filter ProductFilter) ([]CategoryCount, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	counts := map[string]int{}
+	for _, product := range m.products {
+		if filter.Matches(product) {
+			counts[product.Category]++
+		}
+	}
+	categories := make([]CategoryCount, 0, len(counts))
+	for category, count := range counts {
+		categories = append(categories, CategoryCount{Category: category, Count: count})
+	}
+	sort.Slice(categories, func(i, j int) bool { return categories[i].Category < categories[j].Category })
+	return categories, nil
+}
+
+func (m *MemoryStore) CountProductsByPrice(ctx context.Context, filter ProductFilter) ([]PriceBucket, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	counts := map[int]int{}
+	for _, product := range m.products {
+		if filter.Matches(product) && product.Price.Currency == DefaultCurrency {
+			counts[priceBucket(product.Price.Amount)]++
+		}
+	}
+	return newPriceBuckets(counts), nil
+}
+
+func (m *MemoryStore) GetProduct(ctx context.Context, id int) (Product, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.product(id)
+}
+
+func (m *MemoryStore) GetProductBySKU(ctx context.Context, sku string) (Product, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, product := range m.products {
+		if sku != "" && product.SKU == sku {
+			return copyProduct(product), nil
+		}
+	}
+	return Product{}, ErrProductNotFound
+}
+
+func (m *MemoryStore) CreateProduct(ctx context.Context, product Product) (Product, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.createProduct(product)
+}
+
+// createProduct saves a new product; callers must hold m.mu
+func (m *MemoryStore) createProduct(product Product) (Product, error) {
+	product.ID = 0
+	if m.skuTaken(product) {
+		return Product{}, ErrDuplicateSKU
+	}
+	product = copyProduct(product)
+	for i := range product.Variants {
+		product.Variants[i].ID = m.nextVariantID
+		m.nextVariantID++
+	}
+	carryReservations(Product{}, &product)
+	product.ID = m.nextProductID
+	m.nextProductID++
+	m.products = append(m.products, product)
+	m.ensureCategory(product)
+	return copyProduct(product), nil
+}
+
+func (m *MemoryStore) UpdateProduct(ctx context.Context, id int, fn func(*Product) error) (Product, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.updateProduct(id, fn)
+}
+
+func (m *MemoryStore) SaveProducts(ctx context.Context, products []Product, fn func(old Product, p *Product) error) ([]Product, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Products and categories are replaced or appended, never changed in
+	// place, so copies of the slices are enough to undo the batch
+	products0, categories0 := append([]Product(nil), m.products...), append([]Category(nil), m.categories...)
+	nextProductID, nextVariantID, nextCategoryID := m.nextProductID, m.nextVariantID, m.nextCategoryID
+	saved := make([]Product, 0, len(products))
+	for i, product := range products {
+		var err error
+		if product.ID == 0 {
+			product, err = m.createProduct(product)
+		} else {
+			product, err = m.updateProduct(product.ID, func(p *Product) error {
+				old := copyProduct(*p)
+				*p = copyProduct(products[i])
+				return fn(old, p)
+			})
+		}
+		if err != nil {
+			m.products, m.categories = products0, categories0
+			m.nextProductID, m.nextVariantID, m.nextCategoryID = nextProductID, nextVariantID, nextCategoryID
+			return nil, &BatchError{Index: i, Err: err}
+		}
+		saved = append(saved, product)
+	}
+	return saved, nil
+}
+
+// updateProduct applies fn to a product; callers must hold m.mu
+func (m *MemoryStore) updateProduct(id int, fn func(*Product) error) (Product, error) {
+	for i := range m.products {
+		if m.products[i].ID == id {
+			old := m.products[i]
+			product := copyProduct(old)
+			if err := fn(&product); err != nil {
+				return Product{}, err
+			}
+			product.ID = id
+			if m.skuTaken(product) {
+				return Product{}, ErrDuplicateSKU
+			}
+			// Reservations are the store's to keep; variants fn added get
+			// new IDs
+			product = copyProduct(product)
+			carryReservations(old, &product)
+			for j := range product.Variants {
+				if v := &product.Variants[j]; v.ID == 0 || old.variantIndex(v.ID) < 0 {
+					v.ID = m.nextVariantID
+					m.nextVariantID++
+				}
+			}
+			m.products[i] = product
+			m.ensureCategory(product)
+			return copyProduct(product), nil
+		}
+	}
+	return Product{}, ErrProductNotFound
+}
+
+// skuTaken reports whether another product, or one of its variants, has
+// the SKU of p or of one of p's variants; callers must hold m.mu
+func (m *MemoryStore) skuTaken(p Product) bool {
+	skus := map[string]bool{}
+	for _, sku := range productSKUs(p) {
+		skus[sku] = true
+	}
+	for _, product := range m.products {
+		if product.ID == p.ID {
+			continue
+		}
+		for _, sku := range productSKUs(product) {
+			if skus[sku] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ensureCategory adds a top-level category for the category of a product
+// on sale if there is none; callers must hold m.mu for writing. Seeded
+// products may have no category.
+func (m *MemoryStore) ensureCategory(p Product) {
+	if p.DeletedAt != nil || p.Category == "" || m.categoryIndex(func(c Category) bool { return c.Name == p.Category }) >= 0 {
+		return
+	}
+	slug := uniqueSlug(p.Category, func(slug string) bool {
+		return m.categoryIndex(func(c Category) bool { return c.Slug == slug }) >= 0
+	})
+	m.categories = append(m.categories, Category{ID: m.nextCategoryID, Slug: slug, Name: p.Category})
+	m.nextCategoryID++
+}
+
+// categoryIndex returns the position of the first category match accepts
+// in m.categories, or -1; callers must hold m.mu
+func (m *MemoryStore) categoryIndex(match func(Category) bool) int {
+	for i, c := range m.categories {
+		if match(c) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *MemoryStore) ListCategories(ctx context.Context) ([]Category, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append([]Category{}, m.categories...), nil
+}
+
+func (m *MemoryStore) CreateCategory(ctx context.Context, category Category) (Category, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	category.ID = 0
+	if categoryTaken(m.categories, category) {
+		return Category{}, ErrDuplicateCategory
+	}
+	if err := checkCategory(m.categories, category); err != nil {
+		return Category{}, err
+	}
+	category.ID = m.nextCategoryID
+	m.nextCategoryID++
+	m.categories = append(m.categories, category)
+	return category, nil
+}
+
+func (m *MemoryStore) UpdateCategory(ctx context.Context, id int, fn func(*Category) error) (Category, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.categoryIndex(func(c Category) bool { return c.ID == id })
+	if i < 0 {
+		return Category{}, ErrCategoryNotFound
+	}
+	old := m.categories[i]
+	category := old
+	if err := fn(&category); err != nil {
+		return Category{}, err
+	}
+	category.ID = id
+	if categoryTaken(m.categories, category) {
+		return Category{}, ErrDuplicateCategory
+	}
+	if err := checkCategory(m.categories, category); err != nil {
+		return Category{}, err
+	}
+
+	if category.Name != old.Name {
+		for j := range m.products {
+			if m.products[j].Category == old.Name {
+				m.products[j].Category = category.Name
+			}
+		}
+	}
+	m.categories[i] = category
+	return category, nil
+}
+
+func (m *MemoryStore) DeleteCategory(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.categoryIndex(func(c Category) bool { return c.ID == id })
+	if i < 0 {
+		return ErrCategoryNotFound
+	}
+	if m.categoryIndex(func(c Category) bool { return c.ParentID == id }) >= 0 {
+		return ErrCategoryInUse
+	}
+	for _, product := range m.products {
+		if product.DeletedAt == nil && product.Category == m.categories[i].Name {
+			return ErrCategoryInUse
+		}
+	}
+	m.categories = append(m.categories[:i], m.categories[i+1:]...)
+	return nil
+}
+
+// product looks up a catalog entry; callers must hold m.mu
+func (m *MemoryStore) product(id int) (Product, error) {
+	if i := m.productIndex(id); i >= 0 {
+		return copyProduct(m.products[i]), nil
+	}
+	return Product{}, ErrProductNotFound
+}
+
+// productIndex returns the position of a product in m.products, or -1;
+// callers must hold m.mu
+func (m *MemoryStore) productIndex(id int) int {
+	for i, product := range m.products {
+		if product.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// adjustStock changes the stock and reservations of each product, and of
+// the variant the line is for, by the given amounts per unit of items.
+// Lines for variants since removed change nothing. Callers must hold m.mu
+// for writing.
+func (m *MemoryStore) adjustStock(items []OrderItem, stock, reserved int) {
+	if stock == 0 && reserved == 0 {
+		return
+	}
+	for _, item := range items {
+		i := m.productIndex(item.ProductID)
+		if i < 0 {
+			continue
+		}
+		product := &m.products[i]
+		if item.VariantID != 0 {
+			j := product.variantIndex(item.VariantID)
+			if j < 0 {
+				continue
+			}
+			product.Variants[j].Stock += stock * item.Quantity
+			product.Variants[j].Reserved += reserved * item.Quantity
+		}
+		product.Stock += stock * item.Quantity
+		product.Reserved += reserved * item.Quantity
+	}
+}
+
+func (m *MemoryStore) CreateOrder(ctx context.Context, items []OrderItem, contact OrderContact) (Order, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	priced, total, err := priceItems(items, m.product)
+	if err != nil {
+		return Order{}, err
+	}
+
+	// Check every line before reserving any, so a failed order holds nothing
+	merged := mergeItems(priced)
+	for _, item := range merged {
+		product := m.products[m.productIndex(item.ProductID)]
+		if _, available, _ := product.lineFor(item.VariantID); item.Quantity > available {
+			return Order{}, fmt.Errorf("%w: %s has %d left", ErrOutOfStock, item.stockName(), max(available, 0))
+		}
+	}
+	m.adjustStock(merged, 0, 1)
+
+	order := newOrder(priced, total, contact, time.Now())
+	order.ID = m.nextOrderID
+	m.nextOrderID++
+	m.orders = append(m.orders, order)
+
+	return copyOrder(order), nil
+}
+
+func (m *MemoryStore) ListOrders(ctx context.Context, filter OrderFilter, page Page) ([]Order, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	orders := []Order{}
+	for _, order := range m.orders {
+		if page.Limit > 0 && len(orders) == page.Limit {
+			break
+		}
+		if order.ID > page.AfterID && filter.Matches(order) {
+			orders = append(orders, copyOrder(order))
+		}
+	}
+	return orders, nil
+}
+
+func (m *MemoryStore) GetOrder(ctx context.Context, id int) (Order, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, order := range m.orders {
+		if order.ID == id {
+			return copyOrder(order), nil
+		}
+	}
+	return Order{}, ErrOrderNotFound
+}
+
+func (m *MemoryStore) UpdateOrder(ctx context.Context, id int, fn func(*Order) error) (Order, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.updateOrder(id, fn)
+}
+
+// updateOrder applies fn to an order; the caller holds the write lock
+func (m *MemoryStore) updateOrder(id int, fn func(*Order) error) (Order, error) {
+	for i := range m.orders {
+		if m.orders[i].ID == id {
+			order := copyOrder(m.orders[i])
+			if err := fn(&order); err != nil {
+				return Order{}, err
+			}
+			stock, reserved := stockEffect(m.orders[i].Status, order.Status)
+			m.adjustStock(mergeItems(order.Items), stock, reserved)
+			m.orders[i] = copyOrder(order)
+			return order, nil
+		}
+	}
+	return Order{}, ErrOrderNotFound
+}
+
+func (m *MemoryStore) CreateCart(ctx context.Context, cart Cart) (Cart, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.carts[cart.ID]; ok {
+		return Cart{}, fmt.Errorf("cart %s already exists", cart.ID)
+	}
+	m.carts[cart.ID] = copyCart(cart)
+	return copyCart(cart), nil
+}
+
+func (m *MemoryStore) GetCart(ctx context.Context, id string) (Cart, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	cart, ok := m.carts[id]
+	if !ok {
+		return Cart{}, ErrCartNotFound
+	}
+	return copyCart(cart), nil
+}
+
+func (m *MemoryStore) UpdateCart(ctx context.Context, id string, fn func(*Cart) error) (Cart, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.carts[id]
+	if !ok {
+		return Cart{}, ErrCartNotFound
+	}
+	cart := copyCart(stored)
+	if err := fn(&cart); err != nil {
+		return Cart{}, err
+	}
+	cart.ID = id
+	m.carts[id] = copyCart(cart)
+	return cart, nil
+}
+
+func (m *MemoryStore) DeleteCarts(ctx context.Context, updatedBefore time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deleted := 0
+	for id, cart := range m.carts {
+		if cart.UpdatedAt.Before(updatedBefore) {
+			delete(m.carts, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (m *MemoryStore) CreateAccount(ctx context.Context, account Account) (Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, other := range m.accounts {
+		if other.Email == account.Email {
+			return Account{}, ErrDuplicateAccount
+		}
+	}
+	account.ID = m.nextAccountID
+	m.nextAccountID++
+	m.accounts = append(m.accounts, account)
+	return account, nil
+}
+
+func (m *MemoryStore) GetAccount(ctx context.Context, id int) (Account, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, account := range m.accounts {
+		if account.ID == id {
+			return account, nil
+		}
+	}
+	return Account{}, ErrAccountNotFound
+}
+
+func (m *MemoryStore) GetAccountByEmail(ctx context.Context, email string) (Account, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, account := range m.accounts {
+		if account.Email == email {
+			return account, nil
+		}
+	}
+	return Account{}, ErrAccountNotFound
+}
+
+func (m *MemoryStore) CreateSession(ctx context.Context, session Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions[session.TokenHash] = session
+	return nil
+}
+
+func (m *MemoryStore) GetSession(ctx context.Context, tokenHash string) (Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, ok := m.sessions[tokenHash]
+	if !ok {
+		return Session{}, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+func (m *MemoryStore) DeleteSession(ctx context.Context, tokenHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, tokenHash)
+	return nil
+}
+
+func (m *MemoryStore) DeleteSessions(ctx context.Context, expiredBy time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deleted := 0
+	for hash, session := range m.sessions {
+		if !session.ExpiresAt.After(expiredBy) {
+			delete(m.sessions, hash)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (m *MemoryStore) RecordPayment(ctx context.Context, payment Payment) (Payment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.recordPayment(payment), nil
+}
+
+func (m *MemoryStore) PayOrder(ctx context.Context, payment Payment, fn func(*Order) error) (Order, Payment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	order, err := m.updateOrder(payment.OrderID, fn)
+	if err != nil {
+		return Order{}, Payment{}, err
+	}
+	return order, m.recordPayment(payment), nil
+}
+
+// recordPayment saves a payment; the caller holds the write lock
+func (m *MemoryStore) recordPayment(payment Payment) Payment {
+	payment.ID = m.nextPaymentID
+	payment.CreatedAt = time.Now()
+	m.nextPaymentID++
+	m.payments = append(m.payments, payment)
+	return payment
+}
+
+func (m *MemoryStore) ListPayments(ctx context.Context, orderID int) ([]Payment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	payments := []Payment{}
+	for _, payment := range m.payments {
+		if payment.OrderID == orderID {
+			payments = append(payments, payment)
+		}
+	}
+	return payments, nil
+}
+
+// priceItems prices each line with lookup, at its variant's price when
+// that has one, and returns the priced lines together with the order total
+func priceItems(items []OrderItem, lookup func(id int) (Product, error)) ([]OrderItem, Money, error) {
+	priced := make([]OrderItem, len(items))
+	total := Money{Currency: DefaultCurrency}
+	for i, item := range items {
+		product, err := lookup(item.ProductID)
+		if errors.Is(err, ErrProductNotFound) {
+			return nil, Money{}, fmt.Errorf("%w: %d", err, item.ProductID)
+		}
+		if err != nil {
+			return nil, Money{}, err
+		}
+		if product.DeletedAt != nil {
+			return nil, Money{}, fmt.Errorf("%w: %d is no longer sold", ErrProductNotFound, item.ProductID)
+		}
+		price, _, err := product.lineFor(item.VariantID)
+		if err != nil {
+			return nil, Money{}, err
+		}
+		if i == 0 {
+			total.Currency = price.Currency
+		}
+		if total, err = total.Add(price.Mul(item.Quantity)); err != nil {
+			return nil, Money{}, err
+		}
+		item.UnitPrice = price
+		priced[i] = item
+	}
+	return priced, total, nil
+}
+
+// newOrder returns a pending order for items, placed by contact at createdAt
+func newOrder(items []OrderItem, total Money, contact OrderContact, createdAt time.Time) Order {
+	return Order{
+		Items:        append([]OrderItem{}, items...),
+		Total:        total,
+		Status:       StatusPending,
+		CreatedAt:    createdAt,
+		History:      []StatusChange{{To: StatusPending, At: createdAt}},
+		Refunds:      []Refund{},
+		OrderContact: contact.clone(),
+	}
+}
+
+// copyProduct returns a product that shares no variants with p
+func copyProduct(p Product) Product {
+	p.Variants = copyVariants(p.Variants)
+	return p
+}
+
+// copyOrder returns an order that shares no slices or contact details with
+// the stored one
+func copyOrder(order Order) Order {
+	order.Items = append([]OrderItem(nil), order.Items...)
+	order.History = append([]StatusChange(nil), order.History...)
+	order.Refunds = append([]Refund{}, order.Refunds...)
+	for i := range order.Refunds {
+		order.Refunds[i].Items = append([]OrderItem(nil), order.Refunds[i].Items...)
+	}
+	order.OrderContact = order.OrderContact.clone()
+	return order
+}
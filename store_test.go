@@ -0,0 +1,1151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// markPaid is an UpdateOrder callback that sets the order status to paid
+func markPaid(o *Order) error {
+	return o.Transition(StatusPaid, time.Now())
+}
+
+// testStore runs the behaviour every Store implementation must share
+func testStore(t *testing.T, newStore func(t *testing.T) Store) {
+	t.Run("ListProducts", func(t *testing.T) {
+		store := newStore(t)
+
+		products, err := store.ListProducts(context.Background(), ProductFilter{}, Page{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(products) != 5 {
+			t.Errorf("expected 5 products, got %d", len(products))
+		}
+	})
+
+	t.Run("GetProductNotFound", func(t *testing.T) {
+		store := newStore(t)
+
+		_, err := store.GetProduct(context.Background(), 999)
+		if !errors.Is(err, ErrProductNotFound) {
+			t.Errorf("expected ErrProductNotFound, got %v", err)
+		}
+	})
+
+	t.Run("ProductLifecycle", func(t *testing.T) {
+		store := newStore(t)
+		ctx := context.Background()
+
+		created, err := store.CreateProduct(ctx, Product{
+			Name:     "Desk Lamp",
+			Price:    NewMoney(3499, DefaultCurrency),
+			Category: "Home",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created.ID <= 5 {
+			t.Errorf("expected an ID after the seeded products, got %d", created.ID)
+		}
+
+		updated, err := store.UpdateProduct(ctx, created.ID, func(p *Product) error {
+			p.Price = NewMoney(2999, DefaultCurrency)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated.Price != NewMoney(2999, DefaultCurrency) || updated.Name != "Desk Lamp" {
+			t.Errorf("unexpected product after update: %+v", updated)
+		}
+
+		if _, err := store.UpdateProduct(ctx, 999, func(p *Product) error { return nil }); !errors.Is(err, ErrProductNotFound) {
+			t.Errorf("expected ErrProductNotFound, got %v", err)
+		}
+
+		// Soft-deleted products are not listed but can still be fetched
+		_, err = store.UpdateProduct(ctx, created.ID, func(p *Product) error {
+			now := time.Now()
+			p.DeletedAt = &now
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		products, err := store.ListProducts(ctx, ProductFilter{}, Page{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range products {
+			if p.ID == created.ID {
+				t.Errorf("deleted product %d is still listed", p.ID)
+			}
+		}
+		fetched, err := store.GetProduct(ctx, created.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fetched.DeletedAt == nil || fetched.Price != updated.Price {
+			t.Errorf("expected the deleted product with its data, got %+v", fetched)
+		}
+
+		// and can no longer be ordered
+		_, err = store.CreateOrder(ctx, []OrderItem{{ProductID: created.ID, Quantity: 1}}, OrderContact{})
+		if !errors.Is(err, ErrProductNotFound) {
+			t.Errorf("expected ErrProductNotFound ordering a deleted product, got %v", err)
+		}
+	})
+
+	t.Run("Inventory", func(t *testing.T) {
+		store := newStore(t)
+		ctx := context.Background()
+		setStock := func(id, stock int) {
+			t.Helper()
+			if _, err := store.UpdateProduct(ctx, id, func(p *Product) error {
+				p.Stock = stock
+				// Reservations belong to the store
+				p.Reserved = 99
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stockOf := func(id int) (int, int) {
+			t.Helper()
+			p, err := store.GetProduct(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return p.Stock, p.Reserved
+		}
+		setStock(1, 5)
+		setStock(2, 5)
+
+		// Lines for the same product draw on the same stock
+		first, err := store.CreateOrder(ctx, []OrderItem{{ProductID: 1, Quantity: 2}, {ProductID: 1, Quantity: 1}}, OrderContact{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stock, reserved := stockOf(1); stock != 5 || reserved != 3 {
+			t.Errorf("expected 3 of 5 reserved, got %d of %d", reserved, stock)
+		}
+		_, err = store.CreateOrder(ctx, []OrderItem{{ProductID: 2, Quantity: 1}, {ProductID: 1, Quantity: 3}}, OrderContact{})
+		if !errors.Is(err, ErrOutOfStock) {
+			t.Errorf("expected ErrOutOfStock, got %v", err)
+		}
+		if _, reserved := stockOf(2); reserved != 0 {
+			t.Errorf("expected a rejected order to reserve nothing, got %d", reserved)
+		}
+
+		// Paying sells the reserved units
+		if _, err := store.UpdateOrder(ctx, first.ID, markPaid); err != nil {
+			t.Fatal(err)
+		}
+		if stock, reserved := stockOf(1); stock != 2 || reserved != 0 {
+			t.Errorf("expected 2 in stock and none reserved after payment, got %d and %d", stock, reserved)
+		}
+
+		// Cancelling an unpaid order releases its units
+		second, err := store.CreateOrder(ctx, []OrderItem{{ProductID: 1, Quantity: 2}}, OrderContact{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cancel := func(o *Order) error { return o.Transition(StatusCancelled, time.Now()) }
+		if _, err := store.UpdateOrder(ctx, second.ID, cancel); err != nil {
+			t.Fatal(err)
+		}
+		if stock, reserved := stockOf(1); stock != 2 || reserved != 0 {
+			t.Errorf("expected the cancelled order's units released, got %d in stock and %d reserved", stock, reserved)
+		}
+
+		// Cancelling a paid order puts its units back
+		if _, err := store.UpdateOrder(ctx, first.ID, cancel); err != nil {
+			t.Fatal(err)
+		}
+		if stock, _ := stockOf(1); stock != 5 {
+			t.Errorf("expected the cancelled paid order restocked to 5, got %d", stock)
+		}
+	})
+
+	t.Run("ProductSKUs", func(t *testing.T) {
+		store := newStore(t)
+		ctx := context.Background()
+
+		found, err := store.GetProductBySKU(ctx, "CM-3000")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found.ID != 3 || found.SKU != "CM-3000" {
+			t.Errorf("expected product 3, got %+v", found)
+		}
+		if _, err := store.GetProductBySKU(ctx, "NOPE"); !errors.Is(err, ErrProductNotFound) {
+			t.Errorf("expected ErrProductNotFound, got %v", err)
+		}
+
+		// Products without a SKU do not clash with each other
+		lamp := Product{Name: "Desk Lamp", Price: NewMoney(3499, DefaultCurrency), Category: "Home"}
+		for i := 0; i < 2; i++ {
+			if _, err := store.CreateProduct(ctx, lamp); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		lamp.SKU = "WH-1000"
+		if _, err := store.CreateProduct(ctx, lamp); !errors.Is(err, ErrDuplicateSKU) {
+			t.Errorf("expected ErrDuplicateSKU creating, got %v", err)
+		}
+		_, err = store.UpdateProduct(ctx, 2, func(p *Product) error {
+			p.SKU = "WH-1000"
+			return nil
+		})
+		if !errors.Is(err, ErrDuplicateSKU) {
+			t.Errorf("expected ErrDuplicateSKU updating, got %v", err)
+		}
+		if p, _ := store.GetProduct(ctx, 2); p.SKU != "SW-2000" {
+			t.Errorf("expected the failed update to keep SKU SW-2000, got %q", p.SKU)
+		}
+
+		// A product may keep its own SKU
+		if _, err := store.UpdateProduct(ctx, 1, func(p *Product) error { return nil }); err != nil {
+			t.Errorf("updating a product with its own SKU: %v", err)
+		}
+	})
+
+	t.Run("Variants", func(t *testing.T) {
+		store := newStore(t)
+		ctx := context.Background()
+
+		price := NewMoney(14999, DefaultCurrency)
+		shoes, err := store.CreateProduct(ctx, Product{
+			Name:     "Trail Shoes",
+			Price:    NewMoney(12999, DefaultCurrency),
+			Category: "Sports",
+			Variants: []Variant{
+				{SKU: "TS-42", Options: map[string]string{"size": "42"}, Stock: 3, Reserved: 7},
+				{SKU: "TS-44", Options: map[string]string{"size": "44"}, Price: &price, Stock: 2},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fetched, err := store.GetProduct(ctx, shoes.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fetched.Variants) != 2 || fetched.Variants[0].ID == 0 || fetched.Variants[0].ID == fetched.Variants[1].ID {
+			t.Fatalf("expected two variants with their own IDs, got %+v", fetched.Variants)
+		}
+		if fetched.Variants[1].Options["size"] != "44" || fetched.Variants[1].Price == nil || *fetched.Variants[1].Price != price {
+			t.Errorf("expected the second variant's options and price kept, got %+v", fetched.Variants[1])
+		}
+		if fetched.Stock != 5 || fetched.Reserved != 0 {
+			t.Errorf("expected the product to total its variants, got %d in stock and %d reserved", fetched.Stock, fetched.Reserved)
+		}
+		size42, size44 := fetched.Variants[0].ID, fetched.Variants[1].ID
+
+		// Variants are ordered by ID, priced at their own price if they have one
+		order, err := store.CreateOrder(ctx, []OrderItem{{ProductID: shoes.ID, VariantID: size44, Quantity: 2}, {ProductID: shoes.ID, VariantID: size42, Quantity: 1}}, OrderContact{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if order.Items[0].VariantID != size44 || order.Items[0].UnitPrice != price || order.Total.Amount != 2*14999+12999 {
+			t.Errorf("expected variant prices on the order, got %+v totalling %s", order.Items, order.Total)
+		}
+		if _, err := store.CreateOrder(ctx, []OrderItem{{ProductID: shoes.ID, VariantID: size44, Quantity: 1}}, OrderContact{}); !errors.Is(err, ErrOutOfStock) {
+			t.Errorf("expected ErrOutOfStock for a sold out variant, got %v", err)
+		}
+		if _, err := store.CreateOrder(ctx, []OrderItem{{ProductID: shoes.ID, Quantity: 1}}, OrderContact{}); !errors.Is(err, ErrVariantNotFound) {
+			t.Errorf("expected ErrVariantNotFound without a variant, got %v", err)
+		}
+		if _, err := store.CreateOrder(ctx, []OrderItem{{ProductID: 1, VariantID: size42, Quantity: 1}}, OrderContact{}); !errors.Is(err, ErrVariantNotFound) {
+			t.Errorf("expected ErrVariantNotFound for another product's variant, got %v", err)
+		}
+		fetched, _ = store.GetProduct(ctx, shoes.ID)
+		if fetched.Variants[0].Reserved != 1 || fetched.Variants[1].Reserved != 2 || fetched.Reserved != 3 {
+			t.Errorf("expected reservations on the variants and their product, got %+v", fetched)
+		}
+
+		// Replacing the variants keeps the reservations of those kept and
+		// gives new ones IDs
+		updated, err := store.UpdateProduct(ctx, shoes.ID, func(p *Product) error {
+			p.Variants = []Variant{
+				{ID: size44, SKU: "TS-44", Options: map[string]string{"size": "44"}, Stock: 4},
+				{SKU: "TS-46", Options: map[string]string{"size": "46"}, Stock: 1, Reserved: 5},
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fetched, _ = store.GetProduct(ctx, shoes.ID)
+		if len(fetched.Variants) != 2 || fetched.Variants[0].Reserved != 2 || fetched.Variants[1].ID == 0 || fetched.Variants[1].Reserved != 0 {
+			t.Errorf("expected the kept variant's reservation and a new variant, got %+v", fetched.Variants)
+		}
+		if fetched.Stock != 5 || updated.Stock != 5 {
+			t.Errorf("expected the product to total 5 in stock, got %d", fetched.Stock)
+		}
+
+		// Paying sells the variant's units
+		if _, err := store.UpdateOrder(ctx, order.ID, markPaid); err != nil {
+			t.Fatal(err)
+		}
+		fetched, _ = store.GetProduct(ctx, shoes.ID)
+		if fetched.Variants[0].Stock != 2 || fetched.Variants[0].Reserved != 0 || fetched.Stock != 3 {
+			t.Errorf("expected 2 of size 44 left after payment, got %+v", fetched)
+		}
+
+		// Variant SKUs are unique across the catalog
+		_, err = store.UpdateProduct(ctx, 1, func(p *Product) error {
+			p.Variants = []Variant{{SKU: "TS-46", Options: map[string]string{"color": "black"}}}
+			return nil
+		})
+		if !errors.Is(err, ErrDuplicateSKU) {
+			t.Errorf("expected ErrDuplicateSKU reusing a variant SKU, got %v", err)
+		}
+		_, err = store.UpdateProduct(ctx, 1, func(p *Product) error {
+			p.SKU = "TS-44"
+			return nil
+		})
+		if !errors.Is(err, ErrDuplicateSKU) {
+			t.Errorf("expected ErrDuplicateSKU giving a product a variant's SKU, got %v", err)
+		}
+	})
+
+	t.Run("Categories", func(t *testing.T) {
+		store := newStore(t)
+		ctx := context.Background()
+
+		categories, err := store.ListCategories(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slugs := map[string]Category{}
+		for _, c := range categories {
+			slugs[c.Slug] = c
+		}
+		electronics, ok := slugs["electronics"]
+		if len(categories) != 4 || !ok || electronics.Name != "Electronics" || electronics.ParentID != 0 {
+			t.Fatalf("expected a top-level category for each catalog category, got %+v", categories)
+		}
+
+		audio, err := store.CreateCategory(ctx, Category{Slug: "audio", Name: "Audio", ParentID: electronics.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.CreateCategory(ctx, Category{Slug: "sound", Name: "Audio"}); !errors.Is(err, ErrDuplicateCategory) {
+			t.Errorf("expected ErrDuplicateCategory, got %v", err)
+		}
+		if _, err := store.CreateCategory(ctx, Category{Slug: "radio", Name: "Radio", ParentID: 999}); !errors.Is(err, ErrParentNotFound) {
+			t.Errorf("expected ErrParentNotFound, got %v", err)
+		}
+		_, err = store.UpdateCategory(ctx, electronics.ID, func(c *Category) error {
+			c.ParentID = audio.ID
+			return nil
+		})
+		if !errors.Is(err, ErrCategoryCycle) {
+			t.Errorf("expected ErrCategoryCycle, got %v", err)
+		}
+
+		// Products bring their category into being, and follow it when renamed
+		if _, err := store.UpdateProduct(ctx, 1, func(p *Product) error {
+			p.Category = "Home & Garden"
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		categories, _ = store.ListCategories(ctx)
+		garden := categories[len(categories)-1]
+		if garden.Name != "Home & Garden" || garden.Slug != "home-garden" {
+			t.Fatalf("expected a category added for product 1, got %+v", garden)
+		}
+		if _, err := store.UpdateCategory(ctx, garden.ID, func(c *Category) error {
+			c.Name, c.ParentID = "Garden", audio.ID
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if p, _ := store.GetProduct(ctx, 1); p.Category != "Garden" {
+			t.Errorf("expected product 1 moved to the renamed category, got %q", p.Category)
+		}
+
+		for _, id := range []int{audio.ID, garden.ID} {
+			if err := store.DeleteCategory(ctx, id); !errors.Is(err, ErrCategoryInUse) {
+				t.Errorf("expected ErrCategoryInUse deleting category %d, got %v", id, err)
+			}
+		}
+		if _, err := store.UpdateProduct(ctx, 1, func(p *Product) error {
+			p.Category = "Electronics"
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []int{garden.ID, audio.ID} {
+			if err := store.DeleteCategory(ctx, id); err != nil {
+				t.Errorf("deleting category %d: %v", id, err)
+			}
+		}
+		if categories, _ = store.ListCategories(ctx); len(categories) != 4 {
+			t.Errorf("expected the catalog categories left, got %+v", categories)
+		}
+		if err := store.DeleteCategory(ctx, audio.ID); !errors.Is(err, ErrCategoryNotFound) {
+			t.Errorf("expected ErrCategoryNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Carts", func(t *testing.T) {
+		store := newStore(t)
+		ctx := context.Background()
+
+		created := time.Now().Add(-time.Hour)
+		cart, err := store.CreateCart(ctx, Cart{
+			ID:        "abc123",
+			Items:     []CartItem{{ID: 1, ProductID: 1, Quantity: 2}},
+			CreatedAt: created,
+			UpdatedAt: created,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		updated, err := store.UpdateCart(ctx, cart.ID, func(c *Cart) error {
+			c.Items = append(c.Items, CartItem{ID: 2, ProductID: 3, Quantity: 1})
+			c.UpdatedAt = time.Now()
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := store.GetCart(ctx, cart.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got.Items) != "[{1 1 0 2} {2 3 0 1}]" || !got.UpdatedAt.Equal(updated.UpdatedAt) || !got.CreatedAt.Equal(created) {
+			t.Errorf("expected the updated cart, got %+v", got)
+		}
+
+		if _, err := store.GetCart(ctx, "missing"); !errors.Is(err, ErrCartNotFound) {
+			t.Errorf("expected ErrCartNotFound, got %v", err)
+		}
+		if _, err := store.UpdateCart(ctx, "missing", func(*Cart) error { return nil }); !errors.Is(err, ErrCartNotFound) {
+			t.Errorf("expected ErrCartNotFound, got %v", err)
+		}
+
+		// Only carts left unchanged since the cutoff are deleted
+		if _, err := store.CreateCart(ctx, Cart{ID: "old", Items: []CartItem{{ID: 1, ProductID: 2, Quantity: 1}}, CreatedAt: created, UpdatedAt: created}); err != nil {
+			t.Fatal(err)
+		}
+		deleted, err := store.DeleteCarts(ctx, time.Now().Add(-time.Minute))
+		if err != nil || deleted != 1 {
+			t.Fatalf("expected one cart deleted, got %d, %v", deleted, err)
+		}
+		if _, err := store.GetCart(ctx, "old"); !errors.Is(err, ErrCartNotFound) {
+			t.Errorf("expected the old cart gone, got %v", err)
+		}
+		if _, err := store.GetCart(ctx, cart.ID); err != nil {
+			t.Errorf("expected the recent cart kept, got %v", err)
+		}
+	})
+
+	t.Run("Accounts", func(t *testing.T) {
+		store := newStore(t)
+		ctx := context.Background()
+
+		created := time.Now().Add(-time.Hour)
+		account, err := store.CreateAccount(ctx, Account{Email: "ada@example.com", Name: "Ada Lovelace", PasswordHash: "hash", CreatedAt: created})
+		if err != nil || account.ID == 0 {
+			t.Fatalf("expected the account created, got %+v, %v", account, err)
+		}
+		if _, err := store.CreateAccount(ctx, Account{Email: "ada@example.com", Name: "Ada", PasswordHash: "other"}); !errors.Is(err, ErrDuplicateAccount) {
+			t.Errorf("expected ErrDuplicateAccount, got %v", err)
+		}
+		got, err := store.GetAccountByEmail(ctx, "ada@example.com")
+		if err != nil || got.ID != account.ID || got.PasswordHash != "hash" || !got.CreatedAt.Equal(created) {
+			t.Errorf("expected the account by email, got %+v, %v", got, err)
+		}
+		if _, err := store.GetAccount(ctx, account.ID+1); !errors.Is(err, ErrAccountNotFound) {
+			t.Errorf("expected ErrAccountNotFound, got %v", err)
+		}
+		if _, err := store.GetAccountByEmail(ctx, "bob@example.com"); !errors.Is(err, ErrAccountNotFound) {
+			t.Errorf("expected ErrAccountNotFound, got %v", err)
+		}
+
+		for _, s := range []Session{
+			{TokenHash: "old", AccountID: account.ID, CreatedAt: created, ExpiresAt: created.Add(time.Minute)},
+			{TokenHash: "live", AccountID: account.ID, CreatedAt: created, ExpiresAt: created.Add(2 * time.Hour)},
+			{TokenHash: "ended", AccountID: account.ID, CreatedAt: created, ExpiresAt: created.Add(2 * time.Hour)},
+		} {
+			if err := store.CreateSession(ctx, s); err != nil {
+				t.Fatal(err)
+			}
+		}
+		session, err := store.GetSession(ctx, "live")
+		if err != nil || session.AccountID != account.ID || !session.ExpiresAt.Equal(created.Add(2*time.Hour)) {
+			t.Errorf("expected the live session, got %+v, %v", session, err)
+		}
+		if err := store.DeleteSession(ctx, "ended"); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.DeleteSession(ctx, "ended"); err != nil {
+			t.Errorf("expected deleting a missing session to succeed, got %v", err)
+		}
+		if _, err := store.GetSession(ctx, "ended"); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("expected ErrSessionNotFound, got %v", err)
+		}
+		deleted, err := store.DeleteSessions(ctx, time.Now())
+		if err != nil || deleted != 1 {
+			t.Fatalf("expected one session deleted, got %d, %v", deleted, err)
+		}
+		if _, err := store.GetSession(ctx, "live"); err != nil {
+			t.Errorf("expected the live session kept, got %v", err)
+		}
+
+		// Orders keep the account they were placed from
+		order, err := store.CreateOrder(ctx, []OrderItem{{ProductID: 1, Quantity: 1}}, OrderContact{AccountID: account.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.CreateOrder(ctx, []OrderItem{{ProductID: 2, Quantity: 1}}, OrderContact{}); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := store.GetOrder(ctx, order.ID); err != nil || got.AccountID != account.ID {
+			t.Errorf("expected the order linked to account %d, got %+v, %v", account.ID, got.OrderContact, err)
+		}
+		orders, err := store.ListOrders(ctx, OrderFilter{AccountID: account.ID}, Page{})
+		if err != nil || len(orders) != 1 || orders[0].ID != order.ID {
+			t.Errorf("expected only the account's order, got %+v, %v", orders, err)
+		}
+	})
+
+	t.Run("CreateAndGetOrder", func(t *testing.T) {
+		store := newStore(t)
+		ctx := context.Background()
+
+		shipping := Address{Name: "Ada Lovelace", Line1: "12 St James's Square", City: "London", PostalCode: "SW1Y 4JH", Country: "GB"}
+		billing := Address{Name: "Ada Lovelace", Line1: "1 Main St", Line2: "Apt 2", City: "Springfield", Region: "IL", PostalCode: "62701", Country: "US"}
+		created, err := store.CreateOrder(ctx, []OrderItem{
+			{ProductID: 1, Quantity: 2},
+			{ProductID: 3, Quantity: 1},
+		}, OrderContact{
+			Customer:        &Customer{Name: "Ada Lovelace", Email: "ada@example.com"},
+			ShippingAddress: &shipping,
+			BillingAddress:  &billing,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created.ID == 0 {
+			t.Error("order ID should not be zero")
+		}
+		if created.Status != "pending" {
+			t.Errorf("expected status 'pending', got %s", created.Status)
+		}
+
+		if expected := NewMoney(9999*2+7999, DefaultCurrency); created.Total != expected {
+			t.Errorf("expected total %v, got %v", expected, created.Total)
+		}
+
+		fetched, err := store.GetOrder(ctx, created.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fetched.Items) != 2 {
+			t.Fatalf("expected 2 items, got %d", len(fetched.Items))
+		}
+		// Lines keep the price they were bought at
+		if fetched.Items[0].UnitPrice != NewMoney(9999, DefaultCurrency) || fetched.Items[1].UnitPrice != NewMoney(7999, DefaultCurrency) {
+			t.Errorf("expected unit prices 99.99 and 79.99, got %+v", fetched.Items)
+		}
+		if fetched.Total != created.Total {
+			t.Errorf("expected total %v, got %v", created.Total, fetched.Total)
+		}
+
+		listed, err := store.ListOrders(ctx, OrderFilter{}, Page{})
+		if err != nil || len(listed) != 1 {
+			t.Fatalf("expected the order listed, got %v, %v", listed, err)
+		}
+		for _, o := range []Order{fetched, listed[0]} {
+			if o.Customer == nil || o.Customer.Email != "ada@example.com" || o.ShippingAddress == nil || *o.ShippingAddress != shipping || o.BillingAddress == nil || *o.BillingAddress != billing {
+				t.Errorf("expected the contact details kept, got %+v", o.OrderContact)
+			}
+		}
+		if order, _ := store.CreateOrder(ctx, []OrderItem{{ProductID: 1, Quantity: 1}}, OrderContact{}); !order.empty() {
+			t.Errorf("expected no contact details, got %+v", order.OrderContact)
+		}
+	})
+
+	t.Run("CreateOrderUnknownProduct", func(t *testing.T) {
+		store := newStore(t)
+		ctx := context.Background()
+
+		_, err := store.CreateOrder(ctx, []OrderItem{
+			{ProductID: 1, Quantity: 1},
+			{ProductID: 999, Quantity: 1},
+		}, OrderContact{})
+		if !errors.Is(err, ErrProductNotFound) {
+			t.Errorf("expected ErrProductNotFound, got %v", err)
+		}
+
+		orders, err := store.ListOrders(ctx, OrderFilter{}, Page{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(orders) != 0 {
+			t.Errorf("expected no orders, got %d", len(orders))
+		}
+	})
+
+	t.Run("UpdateOrder", func(t *testing.T) {
+		store := newStore(t)
+		ctx := context.Background()
+
+		order, err := store.CreateOrder(ctx, []OrderItem{{ProductID: 2, Quantity: 1}}, OrderContact{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := store.UpdateOrder(ctx, order.ID, markPaid); err != nil {
+			t.Fatal(err)
+		}
+
+		orders, err := store.ListOrders(ctx, OrderFilter{}, Page{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(orders) != 1 || orders[0].Status != "paid" {
+			t.Errorf("expected one paid order, got %+v", orders)
+		}
+
+		_, err = store.UpdateOrder(ctx, 999, markPaid)
+		if !errors.Is(err, ErrOrderNotFound) {
+			t.Errorf("expected ErrOrderNotFound, got %v", err)
+		}
+
+		// A failing callback leaves the order untouched
+		errRejected := errors.New("rejected")
+		_, err = store.UpdateOrder(ctx, order.ID, func(o *Order) error {
+			o.Status = "cancelled"
+			return errRejected
+		})
+		if !errors.Is(err, errRejected) {
+			t.Errorf("expected the callback error, got %v", err)
+		}
+		fetched, err := store.GetOrder(ctx, order.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fetched.Status != "paid" {
+			t.Errorf("expected status 'paid' after rejected update, got %s", fetched.Status)
+		}
+	})
+
+	t.Run("StatusHistory", func(t *testing.T) {
+		store := newStore(t)
+		ctx := context.Background()
+
+		order, err := store.CreateOrder(ctx, []OrderItem{{ProductID: 1, Quantity: 1}}, OrderContact{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(order.History) != 1 || order.History[0].To != StatusPending {
+			t.Fatalf("expected a new order to start pending, got %+v", order.History)
+		}
+
+		for _, next := range []OrderStatus{StatusPaid, StatusFulfilled} {
+			_, err := store.UpdateOrder(ctx, order.ID, func(o *Order) error {
+				return o.Transition(next, time.Now())
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		fetched, err := store.GetOrder(ctx, order.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		orders, err := store.ListOrders(ctx, OrderFilter{}, Page{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, got := range []Order{fetched, orders[0]} {
+			expected := []StatusChange{
+				{To: StatusPending},
+				{From: StatusPending, To: StatusPaid},
+				{From: StatusPaid, To: StatusFulfilled},
+			}
+			if len(got.History) != len(expected) {
+				t.Fatalf("expected %d status changes, got %+v", len(expected), got.History)
+			}
+			for i, change := range got.History {
+				if change.From != expected[i].From || change.To != expected[i].To {
+					t.Errorf("change %d: expected %s -> %s, got %s -> %s", i, expected[i].From, expected[i].To, change.From, change.To)
+				}
+				if change.At.IsZero() || (i > 0 && change.At.Before(got.History[i-1].At)) {
+					t.Errorf("change %d: timestamp %v out of order", i, change.At)
+				}
+			}
+		}
+	})
+
+	t.Run("Refunds", func(t *testing.T) {
+		store := newStore(t)
+		ctx := context.Background()
+
+		order, err := store.CreateOrder(ctx, []OrderItem{{ProductID: 1, Quantity: 2}}, OrderContact{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.UpdateOrder(ctx, order.ID, markPaid); err != nil {
+			t.Fatal(err)
+		}
+
+		refund := Refund{Amount: NewMoney(500, DefaultCurrency), Reference: "re_1", Reason: "damaged", CreatedAt: time.Now()}
+		returned := Refund{
+			Amount:    NewMoney(9999, DefaultCurrency),
+			Items:     []OrderItem{{ProductID: 1, Quantity: 1, UnitPrice: NewMoney(9999, DefaultCurrency)}},
+			Reference: "re_2",
+			CreatedAt: time.Now(),
+		}
+		_, err = store.UpdateOrder(ctx, order.ID, func(o *Order) error {
+			o.Refunds = append(o.Refunds, refund)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.UpdateOrder(ctx, order.ID, func(o *Order) error {
+			o.Refunds = append(o.Refunds, returned)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fetched, err := store.GetOrder(ctx, order.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		orders, err := store.ListOrders(ctx, OrderFilter{}, Page{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, got := range []Order{fetched, orders[0]} {
+			if len(got.Refunds) != 2 {
+				t.Fatalf("expected two refunds, got %+v", got.Refunds)
+			}
+			r := got.Refunds[0]
+			if r.Amount != refund.Amount || r.Reference != refund.Reference || r.Reason != refund.Reason || r.CreatedAt.IsZero() || len(r.Items) != 0 {
+				t.Errorf("expected %+v, got %+v", refund, r)
+			}
+			r = got.Refunds[1]
+			if r.Reference != returned.Reference || len(r.Items) != 1 || r.Items[0] != returned.Items[0] {
+				t.Errorf("expected %+v, got %+v", returned, r)
+			}
+		}
+	})
+
+	t.Run("ListOrdersFilter", func(t *testing.T) {
+		store := newStore(t)
+		ctx := context.Background()
+
+		var ids []int
+		for _, items := range [][]OrderItem{
+			{{ProductID: 1, Quantity: 1}},                              // 99.99
+			{{ProductID: 2, Quantity: 1}},                              // 199.99
+			{{ProductID: 1, Quantity: 1}, {ProductID: 5, Quantity: 2}}, // 199.97
+		} {
+			order, err := store.CreateOrder(ctx, items, OrderContact{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, order.ID)
+		}
+		if _, err := store.UpdateOrder(ctx, ids[1], markPaid); err != nil {
+			t.Fatal(err)
+		}
+
+		money := func(minor int64) *Money {
+			m := NewMoney(minor, DefaultCurrency)
+			return &m
+		}
+		now := time.Now()
+		testCases := []struct {
+			name     string
+			filter   OrderFilter
+			expected []int
+		}{
+			{"no filter", OrderFilter{}, ids},
+			{"status", OrderFilter{Status: StatusPaid}, ids[1:2]},
+			{"product", OrderFilter{ProductID: 1}, []int{ids[0], ids[2]}},
+			{"min total", OrderFilter{MinTotal: money(15000)}, ids[1:]},
+			{"max total", OrderFilter{MaxTotal: money(15000)}, ids[:1]},
+			{"exact total", OrderFilter{MinTotal: money(19997), MaxTotal: money(19997)}, ids[2:]},
+			{"created range", OrderFilter{CreatedAfter: now.Add(-time.Hour), CreatedBefore: now.Add(time.Hour)}, ids},
+			{"created later", OrderFilter{CreatedAfter: now.Add(time.Hour)}, nil},
+			{"created earlier", OrderFilter{CreatedBefore: now.Add(-time.Hour)}, nil},
+			{"combined", OrderFilter{Status: StatusPending, ProductID: 1, MinTotal: money(10000)}, ids[2:]},
+		}
+
+		for _, tc := range testCases {
+			orders, err := store.ListOrders(ctx, tc.filter, Page{})
+			if err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			var got []int
+			for _, order := range orders {
+				got = append(got, order.ID)
+				if len(order.Items) == 0 || len(order.History) == 0 {
+					t.Errorf("%s: order %d is missing its items or history", tc.name, order.ID)
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.expected) {
+				t.Errorf("%s: expected orders %v, got %v", tc.name, tc.expected, got)
+			}
+		}
+	})
+
+	t.Run("Pagination", func(t *testing.T) {
+		store := newStore(t)
+		ctx := context.Background()
+
+		products, err := store.ListProducts(ctx, ProductFilter{}, Page{AfterID: 2, Limit: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(products) != 2 || products[0].ID != 3 || products[1].ID != 4 {
+			t.Errorf("expected products 3 and 4, got %+v", products)
+		}
+
+		var ids []int
+		for i := 0; i < 4; i++ {
+			order, err := store.CreateOrder(ctx, []OrderItem{{ProductID: 1 + i%2, Quantity: 1}}, OrderContact{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, order.ID)
+		}
+
+		// Pages combine with filters: orders for product 1 after the first
+		orders, err := store.ListOrders(ctx, OrderFilter{ProductID: 1}, Page{AfterID: ids[0], Limit: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(orders) != 1 || orders[0].ID != ids[2] || len(orders[0].Items) != 1 {
+			t.Errorf("expected order %d with its items, got %+v", ids[2], orders)
+		}
+
+		orders, err = store.ListOrders(ctx, OrderFilter{}, Page{AfterID: ids[1], Limit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(orders) != 1 || orders[0].ID != ids[2] || len(orders[0].History) != 1 {
+			t.Errorf("expected order %d with its history, got %+v", ids[2], orders)
+		}
+	})
+
+	t.Run("ProductFilter", func(t *testing.T) {
+		store := newStore(t)
+		ctx := context.Background()
+		if _, err := store.UpdateProduct(ctx, 4, func(p *Product) error {
+			p.Price = NewMoney(9999, DefaultCurrency)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		low, high := NewMoney(5000, DefaultCurrency), NewMoney(15000, DefaultCurrency)
+
+		testCases := []struct {
+			name     string
+			filter   ProductFilter
+			page     Page
+			expected []int
+		}{
+			{"category", ProductFilter{Categories: []string{"Electronics", "Kitchen"}}, Page{}, []int{1, 2, 3}},
+			{"price range", ProductFilter{MinPrice: &low, MaxPrice: &high}, Page{}, []int{1, 3, 4}},
+			{"price ascending", ProductFilter{Sort: SortByPriceAsc}, Page{}, []int{5, 3, 1, 4, 2}},
+			{"price descending", ProductFilter{Sort: SortByPriceDesc}, Page{}, []int{2, 1, 4, 3, 5}},
+			{"name", ProductFilter{Sort: SortByName}, Page{}, []int{3, 5, 4, 2, 1}},
+			// Products 1 and 4 share a price; the tie follows ID order
+			{"page past a tie", ProductFilter{Sort: SortByPriceAsc}, Page{AfterID: 1, AfterKey: "9999", Limit: 2}, []int{4, 2}},
+			{"page descending", ProductFilter{Sort: SortByPriceDesc}, Page{AfterID: 1, AfterKey: "9999", Limit: 2}, []int{4, 3}},
+		}
+		for _, tc := range testCases {
+			products, err := store.ListProducts(ctx, tc.filter, tc.page)
+			if err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			var got []int
+			for _, p := range products {
+				got = append(got, p.ID)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.expected) {
+				t.Errorf("%s: expected products %v, got %v", tc.name, tc.expected, got)
+			}
+		}
+
+		categories, err := store.CountProductsByCategory(ctx, ProductFilter{MinPrice: &low})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(categories) != "[{Electronics 2} {Kitchen 1} {Sports 1}]" {
+			t.Errorf("unexpected category counts %v", categories)
+		}
+
+		buckets, err := store.CountProductsByPrice(ctx, ProductFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var counts []int
+		for _, b := range buckets {
+			counts = append(counts, b.Count)
+		}
+		if fmt.Sprint(counts) != "[0 1 3 1 0 0]" {
+			t.Errorf("expected counts [0 1 3 1 0 0] by price, got %v", counts)
+		}
+	})
+
+	t.Run("UpdateOrderIsAtomic", func(t *testing.T) {
+		store := newStore(t)
+		ctx := context.Background()
+
+		order, err := store.CreateOrder(ctx, []OrderItem{{ProductID: 1, Quantity: 1}}, OrderContact{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Every writer checks the status and flips it; only one may see pending
+		const writers = 8
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		succeeded := 0
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := store.UpdateOrder(ctx, order.ID, func(o *Order) error {
+					if err := checkPayable(*o, o.Total); err != nil {
+						return err
+					}
+					o.Status = "paid"
+					return nil
+				})
+				if err == nil {
+					mu.Lock()
+					succeeded++
+					mu.Unlock()
+				} else if !errors.Is(err, ErrOrderNotPayable) {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if succeeded != 1 {
+			t.Errorf("expected exactly one update to succeed, got %d", succeeded)
+		}
+	})
+
+	t.Run("RecordPayment", func(t *testing.T) {
+		store := newStore(t)
+		ctx := context.Background()
+
+		order, err := store.CreateOrder(ctx, []OrderItem{{ProductID: 5, Quantity: 1}}, OrderContact{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		payment, err := store.RecordPayment(ctx, Payment{OrderID: order.ID, Amount: order.Total, Reference: "auth_1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if payment.ID == 0 {
+			t.Error("payment ID should not be zero")
+		}
+
+		payments, err := store.ListPayments(ctx, order.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(payments) != 1 || payments[0].Amount != order.Total || payments[0].Reference != "auth_1" {
+			t.Errorf("expected one payment of %v with reference auth_1, got %+v", order.Total, payments)
+		}
+	})
+
+	t.Run("PayOrder", func(t *testing.T) {
+		store := newStore(t)
+		ctx := context.Background()
+
+		order, err := store.CreateOrder(ctx, []OrderItem{{ProductID: 5, Quantity: 1}}, OrderContact{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		payment := Payment{OrderID: order.ID, Amount: order.Total, Reference: "auth_1"}
+
+		// A failed check saves neither the order nor the payment
+		_, _, err = store.PayOrder(ctx, payment, func(o *Order) error {
+			if err := o.Transition(StatusPaid, time.Now()); err != nil {
+				return err
+			}
+			return ErrOrderNotPayable
+		})
+		if !errors.Is(err, ErrOrderNotPayable) {
+			t.Fatalf("expected the error from fn, got %v", err)
+		}
+		fetched, _ := store.GetOrder(ctx, order.ID)
+		payments, _ := store.ListPayments(ctx, order.ID)
+		if fetched.Status != StatusPending || len(payments) != 0 {
+			t.Fatalf("expected nothing saved, got %s with %d payments", fetched.Status, len(payments))
+		}
+
+		paid, recorded, err := store.PayOrder(ctx, payment, func(o *Order) error {
+			return o.Transition(StatusPaid, time.Now())
+		})
+		if err != nil || paid.Status != StatusPaid || recorded.ID == 0 {
+			t.Fatalf("expected the order paid, got %+v, %+v, %v", paid, recorded, err)
+		}
+		fetched, _ = store.GetOrder(ctx, order.ID)
+		payments, _ = store.ListPayments(ctx, order.ID)
+		if fetched.Status != StatusPaid || len(payments) != 1 || payments[0].Reference != "auth_1" {
+			t.Errorf("expected the order paid with its payment, got %s with %+v", fetched.Status, payments)
+		}
+
+		if _, _, err := store.PayOrder(ctx, Payment{OrderID: 999}, func(*Order) error { return nil }); !errors.Is(err, ErrOrderNotFound) {
+			t.Errorf("expected ErrOrderNotFound, got %v", err)
+		}
+	})
+
+	t.Run("SaveProducts", func(t *testing.T) {
+		store := newStore(t)
+		ctx := context.Background()
+
+		lamp := Product{SKU: "DL-6000", Name: "Desk Lamp", Price: NewMoney(3499, DefaultCurrency), Category: "Home"}
+		headphones, _ := store.GetProduct(ctx, 1)
+		headphones.Price = NewMoney(8999, DefaultCurrency)
+
+		// A failing check saves nothing, not even the products before it
+		_, err := store.SaveProducts(ctx, []Product{lamp, headphones}, func(old Product, p *Product) error {
+			return ErrDuplicateSKU
+		})
+		var berr *BatchError
+		if !errors.As(err, &berr) || berr.Index != 1 || !errors.Is(err, ErrDuplicateSKU) {
+			t.Fatalf("expected a BatchError for product 1, got %v", err)
+		}
+		if _, err := store.GetProductBySKU(ctx, "DL-6000"); !errors.Is(err, ErrProductNotFound) {
+			t.Errorf("expected the lamp not to be created, got %v", err)
+		}
+		if p, _ := store.GetProduct(ctx, 1); p.Price != NewMoney(9999, DefaultCurrency) {
+			t.Errorf("expected product 1 unchanged, got %v", p.Price)
+		}
+
+		// fn sees the product as saved
+		saved, err := store.SaveProducts(ctx, []Product{lamp, headphones}, func(old Product, p *Product) error {
+			if old.Price != NewMoney(9999, DefaultCurrency) {
+				t.Errorf("expected the saved price, got %v", old.Price)
+			}
+			return nil
+		})
+		if err != nil || len(saved) != 2 || saved[0].ID == 0 || saved[1].Price != headphones.Price {
+			t.Fatalf("expected both products saved, got %+v, %v", saved, err)
+		}
+		if p, _ := store.GetProductBySKU(ctx, "DL-6000"); p.ID != saved[0].ID {
+			t.Errorf("expected the lamp as product %d, got %+v", saved[0].ID, p)
+		}
+
+		// SKUs are checked against the rest of the batch
+		_, err = store.SaveProducts(ctx, []Product{{SKU: "X-1", Name: "One"}, {SKU: "X-1", Name: "Two"}}, nil)
+		if !errors.As(err, &berr) || berr.Index != 1 || !errors.Is(err, ErrDuplicateSKU) {
+			t.Errorf("expected the second X-1 to be refused, got %v", err)
+		}
+	})
+
+	t.Run("ConcurrentWriters", func(t *testing.T) {
+		store := newStore(t)
+		ctx := context.Background()
+
+		const workers, perWorker = 8, 10
+		ids := make([][]int, workers)
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < perWorker; i++ {
+					order, err := store.CreateOrder(ctx, []OrderItem{{ProductID: 1, Quantity: 1}}, OrderContact{})
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					ids[w] = append(ids[w], order.ID)
+
+					if _, err := store.UpdateOrder(ctx, order.ID, markPaid); err != nil {
+						t.Error(err)
+						return
+					}
+					if _, err := store.RecordPayment(ctx, Payment{OrderID: order.ID, Amount: order.Total}); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		// IDs must be unique overall and increasing as seen by each writer
+		seen := map[int]bool{}
+		for _, workerIDs := range ids {
+			for i, id := range workerIDs {
+				if seen[id] {
+					t.Errorf("order ID %d allocated twice", id)
+				}
+				seen[id] = true
+				if i > 0 && id <= workerIDs[i-1] {
+					t.Errorf("order IDs not increasing: %d after %d", id, workerIDs[i-1])
+				}
+			}
+		}
+
+		orders, err := store.ListOrders(ctx, OrderFilter{}, Page{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(orders) != workers*perWorker {
+			t.Fatalf("expected %d orders, got %d", workers*perWorker, len(orders))
+		}
+		for _, order := range orders {
+			if order.Status != "paid" {
+				t.Errorf("order %d: expected status 'paid', got %s", order.ID, order.Status)
+			}
+		}
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		return NewMemoryStore(testCatalog(t))
+	})
+}
+
+func TestServersAreIsolated(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	first := newTestServer(t)
+	second := newTestServer(t)
+
+	if _, err := first.store.CreateOrder(ctx, []OrderItem{{ProductID: 1, Quantity: 1}}, OrderContact{}); err != nil {
+		t.Fatal(err)
+	}
+
+	orders, err := second.store.ListOrders(ctx, OrderFilter{}, Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 0 {
+		t.Errorf("expected second server to have no orders, got %d", len(orders))
+	}
+}
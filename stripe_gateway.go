@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultStripeBaseURL is the production Stripe API endpoint
+const DefaultStripeBaseURL = "https://api.stripe.com"
+
+// ErrRequiresAction is returned when the card issuer asks for customer
+// authentication (3D Secure) before the payment can be authorized
+var ErrRequiresAction = errors.New("payment requires customer action")
+
+// ActionRequiredError carries what the client needs to complete 3D Secure
+type ActionRequiredError struct {
+	AuthorizationID string
+	RedirectURL     string
+}
+
+func (e *ActionRequiredError) Error() string {
+	return fmt.Sprintf("%v: payment intent %s", ErrRequiresAction, e.AuthorizationID)
+}
+
+func (e *ActionRequiredError) Unwrap() error {
+	return ErrRequiresAction
+}
+
+// StripeGateway is a PaymentGateway backed by the Stripe PaymentIntents API.
+// Authorize creates and confirms a manually captured intent, Resume fetches
+// it again after 3D Secure, Capture and Void capture or cancel it, and
+// Refund creates a refund against it. Every POST carries an idempotency key
+// scoped to its payment intent, so keys never meet those of another store
+// or environment sharing the Stripe account.
+type StripeGateway struct {
+	baseURL string
+	apiKey  string
+	// returnURL is where Stripe sends the customer back after 3D Secure
+	returnURL string
+	client    *http.Client
+}
+
+// NewStripeGateway creates a gateway talking to baseURL with the given
+// secret key. An empty baseURL uses DefaultStripeBaseURL. Customers asked
+// for 3D Secure come back to returnURL.
+func NewStripeGateway(baseURL, apiKey, returnURL string) *StripeGateway {
+	if baseURL == "" {
+		baseURL = DefaultStripeBaseURL
+	}
+	return &StripeGateway{
+		baseURL:   strings.TrimRight(baseURL, "/"),
+		apiKey:    apiKey,
+		returnURL: returnURL,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// stripePaymentIntent is the subset of a Stripe PaymentIntent we use
+type stripePaymentIntent struct {
+	ID         string            `json:"id"`
+	Status     string            `json:"status"`
+	Amount     int64             `json:"amount"`
+	Currency   string            `json:"currency"`
+	Metadata   map[string]string `json:"metadata"`
+	NextAction *struct {
+		Type          string `json:"type"`
+		RedirectToURL *struct {
+			URL string `json:"url"`
+		} `json:"redirect_to_url"`
+	} `json:"next_action"`
+	LastPaymentError *stripeError `json:"last_payment_error"`
+}
+
+// stripeRefund is the subset of a Stripe Refund we use
+type stripeRefund struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// stripeError is the error object Stripe returns with non-2xx responses
+type stripeError struct {
+	Type        string `json:"type"`
+	Code        string `json:"code"`
+	DeclineCode string `json:"decline_code"`
+	Message     string `json:"message"`
+}
+
+// err maps a Stripe error object onto the gateway errors
+func (e *stripeError) err() error {
+	switch {
+	case e.DeclineCode == "insufficient_funds":
+		return fmt.Errorf("%w: %s", ErrInsufficientFunds, e.Message)
+	case e.Type == "card_error":
+		return fmt.Errorf("%w: %s", ErrCardDeclined, e.Message)
+	default:
+		return fmt.Errorf("%w: %s: %s", ErrGatewayFailure, e.Type, e.Message)
+	}
+}
+
+func (g *StripeGateway) Authorize(ctx context.Context, req ChargeRequest) (Authorization, error) {
+	form := url.Values{}
+	form.Set("amount", strconv.FormatInt(req.Amount.Amount, 10))
+	form.Set("currency", strings.ToLower(req.Amount.Currency))
+	form.Set("capture_method", "manual")
+	form.Set("payment_method", req.PaymentMethod)
+	form.Set("metadata[order_id]", strconv.Itoa(req.OrderID))
+
+	key, err := newIdempotencyKey()
+	if err != nil {
+		return Authorization{}, err
+	}
+	var intent stripePaymentIntent
+	if err := g.post(ctx, "/v1/payment_intents", form, key, &intent); err != nil {
+		return Authorization{}, err
+	}
+
+	confirm := url.Values{}
+	if g.returnURL != "" {
+		confirm.Set("return_url", g.returnURL)
+	}
+	if err := g.post(ctx, "/v1/payment_intents/"+intent.ID+"/confirm", confirm, intent.ID+":confirm", &intent); err != nil {
+		return Authorization{}, err
+	}
+	return intent.authorization(req.Amount)
+}
+
+func (g *StripeGateway) Resume(ctx context.Context, authorizationID string, req ChargeRequest) (Authorization, error) {
+	var intent stripePaymentIntent
+	err := g.do(ctx, "GET", "/v1/payment_intents/"+url.PathEscape(authorizationID), nil, "", &intent)
+	if err == nil && (intent.Metadata["order_id"] != strconv.Itoa(req.OrderID) || intent.Amount != req.Amount.Amount ||
+		intent.Currency != strings.ToLower(req.Amount.Currency)) {
+		err = fmt.Errorf("%w: payment intent %s", ErrForeignAuthorization, authorizationID)
+	}
+	if err != nil {
+		return Authorization{}, err
+	}
+	return intent.authorization(req.Amount)
+}
+
+// authorization maps the status of a confirmed intent onto an
+// Authorization for amount or a gateway error
+func (intent stripePaymentIntent) authorization(amount Money) (Authorization, error) {
+	switch intent.Status {
+	case "requires_capture":
+		return Authorization{ID: intent.ID, Amount: amount}, nil
+	case "requires_action":
+		aerr := &ActionRequiredError{AuthorizationID: intent.ID}
+		if intent.NextAction != nil && intent.NextAction.RedirectToURL != nil {
+			aerr.RedirectURL = intent.NextAction.RedirectToURL.URL
+		}
+		if aerr.RedirectURL == "" {
+			// Without a return_url Stripe leaves the action to its SDK,
+			// which this server cannot hand to the client
+			return Authorization{}, fmt.Errorf("%w: payment intent %s needs customer action but has no redirect URL", ErrGatewayFailure, intent.ID)
+		}
+		return Authorization{}, aerr
+	case "requires_payment_method":
+		if intent.LastPaymentError != nil {
+			return Authorization{}, intent.LastPaymentError.err()
+		}
+		return Authorization{}, ErrCardDeclined
+	default:
+		return Authorization{}, fmt.Errorf("%w: unexpected payment intent status %q", ErrGatewayFailure, intent.Status)
+	}
+}
+
+func (g *StripeGateway) Capture(ctx context.Context, authorizationID string, amount Money) error {
+	form := url.Values{}
+	form.Set("amount_to_capture", strconv.FormatInt(amount.Amount, 10))
+
+	var intent stripePaymentIntent
+	if err := g.post(ctx, "/v1/payment_intents/"+authorizationID+"/capture", form, authorizationID+":capture", &intent); err != nil {
+		return err
+	}
+	if intent.Status != "succeeded" {
+		return fmt.Errorf("%w: capture left payment intent %s", ErrGatewayFailure, intent.Status)
+	}
+	return nil
+}
+
+func (g *StripeGateway) Void(ctx context.Context, authorizationID string) error {
+	var intent stripePaymentIntent
+	return g.post(ctx, "/v1/payment_intents/"+authorizationID+"/cancel", url.Values{}, authorizationID+":cancel", &intent)
+}
+
+func (g *StripeGateway) Refund(ctx context.Context, authorizationID string, amount Money, idempotencyKey string) (string, error) {
+	form := url.Values{}
+	form.Set("payment_intent", authorizationID)
+	form.Set("amount", strconv.FormatInt(amount.Amount, 10))
+
+	var refund stripeRefund
+	if err := g.post(ctx, "/v1/refunds", form, authorizationID+":"+idempotencyKey, &refund); err != nil {
+		return "", err
+	}
+	if refund.Status == "failed" || refund.Status == "canceled" {
+		return "", fmt.Errorf("%w: refund %s", ErrGatewayFailure, refund.Status)
+	}
+	return refund.ID, nil
+}
+
+// newIdempotencyKey returns a random key for a request that is not tied to
+// anything with an ID of its own yet
+func newIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// post sends a form-encoded request to the Stripe API and decodes the
+// response into out. Stripe answers a request repeated with the same
+// idempotencyKey with the first response.
+func (g *StripeGateway) post(ctx context.Context, path string, form url.Values, idempotencyKey string, out any) error {
+	return g.do(ctx, "POST", path, form, idempotencyKey, out)
+}
+
+// do sends a request to the Stripe API and decodes the response into out,
+// translating Stripe errors and timeouts
+func (g *StripeGateway) do(ctx context.Context, method, path string, form url.Values, idempotencyKey string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, g.baseURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+g.apiKey)
+	if method == "POST" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		var netErr net.Error
+		if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+			return fmt.Errorf("%w: %v", ErrGatewayTimeout, err)
+		}
+		return fmt.Errorf("%w: %v", ErrGatewayFailure, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var body struct {
+			Error stripeError `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			return fmt.Errorf("%w: HTTP %d", ErrGatewayFailure, resp.StatusCode)
+		}
+		return body.Error.err()
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%w: decode response: %v", ErrGatewayFailure, err)
+	}
+	return nil
+}
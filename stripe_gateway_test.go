@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	stripeTestKey       = "sk_test_123"
+	stripeTestReturnURL = "https://shop.example.com/checkout/complete"
+)
+
+// stripeStandIn replays Stripe-shaped PaymentIntents responses. The
+// payment_method of an intent picks the outcome of confirming it, using
+// the names of Stripe's own test payment methods.
+type stripeStandIn struct {
+	mu       sync.Mutex
+	intents  map[string]map[string]any
+	methods  map[string]string
+	requests []string
+	// keys holds the Idempotency-Key of every POST, in order
+	keys   []string
+	nextID int
+}
+
+func newStripeStandIn(t *testing.T) (*stripeStandIn, *httptest.Server) {
+	t.Helper()
+	s := &stripeStandIn{intents: map[string]map[string]any{}, methods: map[string]string{}}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	return s, server
+}
+
+func (s *stripeStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer "+stripeTestKey {
+		stripeReply(w, http.StatusUnauthorized, map[string]any{"error": map[string]any{
+			"type": "invalid_request_error", "message": "Invalid API Key provided",
+		}})
+		return
+	}
+	r.ParseForm()
+	s.requests = append(s.requests, r.URL.Path)
+	if r.Method == "POST" {
+		s.keys = append(s.keys, r.Header.Get("Idempotency-Key"))
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "payment_intents":
+		s.nextID++
+		id := fmt.Sprintf("pi_%d", s.nextID)
+		intent := map[string]any{
+			"id":       id,
+			"object":   "payment_intent",
+			"status":   "requires_confirmation",
+			"amount":   formInt(r, "amount"),
+			"currency": r.Form.Get("currency"),
+			"metadata": map[string]any{"order_id": r.Form.Get("metadata[order_id]")},
+		}
+		s.intents[id] = intent
+		s.methods[id] = r.Form.Get("payment_method")
+		stripeReply(w, http.StatusOK, intent)
+
+	case (len(parts) == 2 || len(parts) == 3) && parts[0] == "payment_intents":
+		intent, ok := s.intents[parts[1]]
+		if !ok {
+			stripeReply(w, http.StatusNotFound, map[string]any{"error": map[string]any{
+				"type": "invalid_request_error", "code": "resource_missing", "message": "No such payment_intent",
+			}})
+			return
+		}
+		if len(parts) == 2 {
+			stripeReply(w, http.StatusOK, intent)
+			return
+		}
+		switch parts[2] {
+		case "confirm":
+			s.confirm(w, r, intent, s.methods[parts[1]])
+		case "capture":
+			intent["status"] = "succeeded"
+			stripeReply(w, http.StatusOK, intent)
+		case "cancel":
+			intent["status"] = "canceled"
+			stripeReply(w, http.StatusOK, intent)
+		}
+
+	case len(parts) == 1 && parts[0] == "refunds":
+		s.nextID++
+		stripeReply(w, http.StatusOK, map[string]any{
+			"id":             fmt.Sprintf("re_%d", s.nextID),
+			"object":         "refund",
+			"status":         "succeeded",
+			"payment_intent": r.Form.Get("payment_intent"),
+			"amount":         formInt(r, "amount"),
+		})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *stripeStandIn) confirm(w http.ResponseWriter, r *http.Request, intent map[string]any, method string) {
+	switch method {
+	case "pm_card_chargeDeclined":
+		stripeReply(w, http.StatusPaymentRequired, map[string]any{"error": map[string]any{
+			"type": "card_error", "code": "card_declined", "decline_code": "generic_decline",
+			"message": "Your card was declined.", "payment_intent": intent,
+		}})
+	case "pm_card_chargeDeclinedInsufficientFunds":
+		stripeReply(w, http.StatusPaymentRequired, map[string]any{"error": map[string]any{
+			"type": "card_error", "code": "card_declined", "decline_code": "insufficient_funds",
+			"message": "Your card has insufficient funds.", "payment_intent": intent,
+		}})
+	case "pm_card_threeDSecure2Required":
+		// Like Stripe, only hand out a redirect when told where to return
+		intent["status"] = "requires_action"
+		intent["next_action"] = map[string]any{"type": "use_stripe_sdk"}
+		if r.Form.Get("return_url") != "" {
+			intent["next_action"] = map[string]any{
+				"type":            "redirect_to_url",
+				"redirect_to_url": map[string]any{"url": "https://hooks.stripe.com/3d_secure_2/authenticate/" + intent["id"].(string)},
+			}
+		}
+		stripeReply(w, http.StatusOK, intent)
+	case "pm_card_serverError":
+		stripeReply(w, http.StatusInternalServerError, map[string]any{"error": map[string]any{
+			"type": "api_error", "message": "An unknown error occurred",
+		}})
+	default:
+		intent["status"] = "requires_capture"
+		stripeReply(w, http.StatusOK, intent)
+	}
+}
+
+func formInt(r *http.Request, key string) int64 {
+	n, _ := strconv.ParseInt(r.Form.Get(key), 10, 64)
+	return n
+}
+
+func stripeReply(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func TestStripeGatewayAuthorizeCaptureRefund(t *testing.T) {
+	t.Parallel()
+	standIn, server := newStripeStandIn(t)
+	gateway := NewStripeGateway(server.URL, stripeTestKey, stripeTestReturnURL)
+	ctx := context.Background()
+	amount := NewMoney(9999, DefaultCurrency)
+
+	auth, err := gateway.Authorize(ctx, ChargeRequest{OrderID: 7, Amount: amount, PaymentMethod: "pm_card_visa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gateway.Capture(ctx, auth.ID, amount); err != nil {
+		t.Fatal(err)
+	}
+	refundID, err := gateway.Refund(ctx, auth.ID, NewMoney(1000, DefaultCurrency), "order-7-refund")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(refundID, "re_") {
+		t.Errorf("expected a Stripe refund ID, got %q", refundID)
+	}
+
+	expected := []string{
+		"/v1/payment_intents",
+		"/v1/payment_intents/" + auth.ID + "/confirm",
+		"/v1/payment_intents/" + auth.ID + "/capture",
+		"/v1/refunds",
+	}
+	if strings.Join(standIn.requests, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected requests %v, got %v", expected, standIn.requests)
+	}
+
+	// Every POST carries its own idempotency key, so a repeated request
+	// cannot create, capture or refund twice, and the keys of an intent
+	// start with its ID so no other store's keys can match them
+	seen := map[string]bool{}
+	for i, key := range standIn.keys {
+		if key == "" || seen[key] {
+			t.Errorf("request %s: expected a fresh idempotency key, got %q", expected[i], key)
+		}
+		seen[key] = true
+	}
+	for i, key := range standIn.keys[1:] {
+		if !strings.HasPrefix(key, auth.ID+":") {
+			t.Errorf("request %s: expected a key scoped to %s, got %q", expected[i+1], auth.ID, key)
+		}
+	}
+	if standIn.keys[3] != auth.ID+":order-7-refund" {
+		t.Errorf("expected the refund to use the caller's key, got %q", standIn.keys[3])
+	}
+
+	intent := standIn.intents[auth.ID]
+	if intent["amount"] != int64(9999) || intent["currency"] != "usd" {
+		t.Errorf("expected intent for 9999 usd, got %v %v", intent["amount"], intent["currency"])
+	}
+}
+
+func TestStripeGatewayFailures(t *testing.T) {
+	t.Parallel()
+	_, server := newStripeStandIn(t)
+	gateway := NewStripeGateway(server.URL, stripeTestKey, stripeTestReturnURL)
+	ctx := context.Background()
+
+	testCases := []struct {
+		method   string
+		expected error
+	}{
+		{"pm_card_chargeDeclined", ErrCardDeclined},
+		{"pm_card_chargeDeclinedInsufficientFunds", ErrInsufficientFunds},
+		{"pm_card_threeDSecure2Required", ErrRequiresAction},
+		{"pm_card_serverError", ErrGatewayFailure},
+	}
+
+	for _, tc := range testCases {
+		_, err := gateway.Authorize(ctx, ChargeRequest{OrderID: 1, Amount: NewMoney(500, DefaultCurrency), PaymentMethod: tc.method})
+		if !errors.Is(err, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.method, tc.expected, err)
+		}
+	}
+
+	// 3D Secure hands back where the customer must go next
+	_, err := gateway.Authorize(ctx, ChargeRequest{OrderID: 1, Amount: NewMoney(500, DefaultCurrency), PaymentMethod: "pm_card_threeDSecure2Required"})
+	var aerr *ActionRequiredError
+	if !errors.As(err, &aerr) || !strings.Contains(aerr.RedirectURL, "3d_secure") {
+		t.Errorf("expected a 3D Secure redirect, got %v", err)
+	}
+
+	// Without a return URL there is nowhere to send the customer, which
+	// is a failure rather than a redirect to nowhere
+	noReturn := NewStripeGateway(server.URL, stripeTestKey, "")
+	_, err = noReturn.Authorize(ctx, ChargeRequest{OrderID: 1, Amount: NewMoney(500, DefaultCurrency), PaymentMethod: "pm_card_threeDSecure2Required"})
+	if !errors.Is(err, ErrGatewayFailure) || errors.As(err, &aerr) {
+		t.Errorf("expected ErrGatewayFailure without a redirect URL, got %v", err)
+	}
+
+	// Wrong credentials surface as a gateway error
+	bad := NewStripeGateway(server.URL, "sk_test_wrong", stripeTestReturnURL)
+	if _, err := bad.Authorize(ctx, ChargeRequest{OrderID: 1, Amount: NewMoney(500, DefaultCurrency)}); !errors.Is(err, ErrGatewayFailure) {
+		t.Errorf("expected ErrGatewayFailure for a bad key, got %v", err)
+	}
+}
+
+func TestStripeGatewayTimeout(t *testing.T) {
+	t.Parallel()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	gateway := NewStripeGateway(slow.URL, stripeTestKey, stripeTestReturnURL)
+	gateway.client.Timeout = 50 * time.Millisecond
+
+	_, err := gateway.Authorize(context.Background(), ChargeRequest{OrderID: 1, Amount: NewMoney(500, DefaultCurrency)})
+	if !errors.Is(err, ErrGatewayTimeout) {
+		t.Errorf("expected ErrGatewayTimeout, got %v", err)
+	}
+}
+
+func TestProcessPaymentWithStripe(t *testing.T) {
+	t.Parallel()
+	standIn, server := newStripeStandIn(t)
+	srv := NewServer(NewMemoryStore(testCatalog(t)), WithPaymentGateway(NewStripeGateway(server.URL, stripeTestKey, stripeTestReturnURL)))
+
+	// 3D Secure leaves the order pending and tells the client where to go
+	order := createTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 1})
+	rr := pay(srv, order.AccessToken, PaymentRequest{OrderID: order.ID, Amount: order.Total, PaymentMethod: "pm_card_threeDSecure2Required"})
+
+	var payment PaymentResponse
+	json.Unmarshal(rr.Body.Bytes(), &payment)
+	if rr.Code != http.StatusPaymentRequired || payment.Code != PaymentCodeRequiresAction || payment.NextActionURL == "" {
+		t.Errorf("expected 402 requires_action with a next action URL, got %v %+v", rr.Code, payment)
+	}
+
+	// A good card pays the order and records the intent as the reference
+	rr = pay(srv, order.AccessToken, PaymentRequest{OrderID: order.ID, Amount: order.Total, PaymentMethod: "pm_card_visa"})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("payment failed: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+
+	payments, _ := srv.store.ListPayments(context.Background(), order.ID)
+	if len(payments) != 1 {
+		t.Fatalf("expected 1 payment, got %d", len(payments))
+	}
+	standIn.mu.Lock()
+	status := standIn.intents[payments[0].Reference]["status"]
+	standIn.mu.Unlock()
+	if status != "succeeded" {
+		t.Errorf("expected intent %s to be captured, got %v", payments[0].Reference, status)
+	}
+}
+
+func TestProcessPaymentResumesAfter3DSecure(t *testing.T) {
+	t.Parallel()
+	standIn, server := newStripeStandIn(t)
+	srv := NewServer(NewMemoryStore(testCatalog(t)), WithPaymentGateway(NewStripeGateway(server.URL, stripeTestKey, stripeTestReturnURL)))
+	order := createTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 1})
+	other := createTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 1})
+
+	rr := pay(srv, order.AccessToken, PaymentRequest{OrderID: order.ID, Amount: order.Total, PaymentMethod: "pm_card_threeDSecure2Required"})
+	var payment PaymentResponse
+	json.Unmarshal(rr.Body.Bytes(), &payment)
+	if rr.Code != http.StatusPaymentRequired || payment.AuthorizationID == "" {
+		t.Fatalf("expected 402 with the intent to resume, got %v %+v", rr.Code, payment)
+	}
+	resume := PaymentRequest{OrderID: order.ID, Amount: order.Total, AuthorizationID: payment.AuthorizationID}
+
+	// Until the customer has authenticated, the payment still needs action
+	if rr := pay(srv, order.AccessToken, resume); rr.Code != http.StatusPaymentRequired {
+		t.Errorf("expected 402 before 3D Secure is done, got %v: %s", rr.Code, rr.Body)
+	}
+
+	// The customer completes 3D Secure with their bank
+	standIn.mu.Lock()
+	standIn.intents[payment.AuthorizationID]["status"] = "requires_capture"
+	standIn.mu.Unlock()
+
+	// The intent cannot pay for another order
+	if rr := pay(srv, other.AccessToken, PaymentRequest{OrderID: other.ID, Amount: other.Total, AuthorizationID: payment.AuthorizationID}); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected another order's intent to be refused, got %v: %s", rr.Code, rr.Body)
+	}
+
+	if rr := pay(srv, order.AccessToken, resume); rr.Code != http.StatusOK {
+		t.Fatalf("resumed payment failed: got %v: %s", rr.Code, rr.Body)
+	}
+	payments, _ := srv.store.ListPayments(context.Background(), order.ID)
+	if len(payments) != 1 || payments[0].Reference != payment.AuthorizationID {
+		t.Fatalf("expected the resumed intent to be recorded, got %+v", payments)
+	}
+	standIn.mu.Lock()
+	status := standIn.intents[payment.AuthorizationID]["status"]
+	standIn.mu.Unlock()
+	if status != "succeeded" {
+		t.Errorf("expected the intent to be captured, got %v", status)
+	}
+}
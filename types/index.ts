@@ -1,32 +1,200 @@
 export interface Product {
   id: number
+  sku?: string
   name: string
   description: string
   price: number
   image: string
   category: string
+  stock: number
+  reserved: number
+  variants?: Variant[]
+  deleted_at?: string
+}
+
+export interface Variant {
+  id: number
+  sku?: string
+  options: Record<string, string>
+  price?: number
+  stock: number
+  reserved: number
+}
+
+export interface Category {
+  id: number
+  slug: string
+  name: string
+  description: string
+  parent_id?: number
+}
+
+export interface CategoryNode extends Category {
+  children: CategoryNode[]
+}
+
+export interface SearchHit extends Product {
+  score: number
+}
+
+export interface SearchResponse {
+  data: SearchHit[]
+  total: number
 }
 
 export interface OrderItem {
   product_id: number
+  variant_id?: number
   quantity: number
+  unit_price?: number
 }
 
-export interface Order {
+export type OrderStatus =
+  | 'pending'
+  | 'paid'
+  | 'fulfilled'
+  | 'shipped'
+  | 'delivered'
+  | 'cancelled'
+  | 'partially_refunded'
+  | 'refunded'
+  | 'failed'
+
+export interface StatusChange {
+  from?: OrderStatus
+  to: OrderStatus
+  at: string
+}
+
+export interface Refund {
+  amount: number
+  items?: OrderItem[]
+  reference: string
+  reason?: string
+  created_at: string
+}
+
+export interface RefundRequest {
+  items?: OrderItem[]
+  amount?: number
+  reason?: string
+}
+
+export interface Customer {
+  name: string
+  email: string
+  phone?: string
+}
+
+export interface Address {
+  name: string
+  line1: string
+  line2?: string
+  city: string
+  region?: string
+  postal_code: string
+  country: string
+}
+
+export interface OrderContact {
+  account_id?: number
+  customer?: Customer
+  shipping_address?: Address
+  billing_address?: Address
+}
+
+export interface Order extends OrderContact {
   id: number
   items: OrderItem[]
   total: number
-  status: string
+  status: OrderStatus
   created_at: string
+  history: StatusChange[]
+  refunds: Refund[]
+  access_token?: string
+}
+
+export interface CartItem {
+  id: number
+  product_id: number
+  variant_id?: number
+  quantity: number
+}
+
+export interface CartLine extends CartItem {
+  name: string
+  unit_price?: number
+  line_total?: number
+  problem?: string
+}
+
+export interface Account {
+  id: number
+  email: string
+  name: string
+  created_at: string
+}
+
+export interface RegisterRequest {
+  email: string
+  name: string
+  password: string
+}
+
+export interface LoginResponse {
+  token: string
+  expires_at: string
+  account: Account
+}
+
+export interface Cart {
+  id: string
+  items: CartLine[]
+  total: number
+  order_id?: number
+  created_at: string
+  updated_at: string
+  expires_at?: string
 }
 
 export interface PaymentRequest {
   order_id: number
   amount: number
+  card_number?: string
+  payment_method?: string
+  authorization_id?: string
 }
 
 export interface PaymentResponse {
   success: boolean
   message: string
   order_id: number
+  code?: string
+  next_action_url?: string
+  authorization_id?: string
+}
+
+export interface ListResponse<T> {
+  data: T[]
+  next_cursor?: string
+}
+
+export interface CategoryCount {
+  category: string
+  count: number
+}
+
+export interface PriceBucket {
+  min: number
+  max?: number
+  count: number
+}
+
+export interface ProductFacets {
+  categories: CategoryCount[]
+  prices: PriceBucket[]
+}
+
+export interface ProductListResponse extends ListResponse<Product> {
+  facets?: ProductFacets
 }
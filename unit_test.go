@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -10,7 +11,27 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// testCatalog loads a fresh copy of the catalog fixture, so every test
+// starts from the same products
+func testCatalog(tb testing.TB) []Product {
+	tb.Helper()
+	products, err := LoadCatalog("testdata/catalog.json")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return products
+}
+
+// newTestServer returns a server backed by a fresh in-memory store
+func newTestServer(tb testing.TB) *Server {
+	tb.Helper()
+	return NewServer(NewMemoryStore(testCatalog(tb)))
+}
+
 func TestGetProducts(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
 	// Create a request to the /api/products endpoint
 	req, err := http.NewRequest("GET", "/api/products", nil)
 	if err != nil {
@@ -19,7 +40,7 @@ func TestGetProducts(t *testing.T) {
 
 	// Create a ResponseRecorder to record the response
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(GetProducts)
+	handler := http.HandlerFunc(srv.GetProducts)
 
 	// Call the handler
 	handler.ServeHTTP(rr, req)
@@ -54,13 +75,16 @@ func TestGetProducts(t *testing.T) {
 		if product.Name == "" {
 			t.Errorf("product %d has no name", i)
 		}
-		if product.Price <= 0 {
+		if product.Price.Amount <= 0 {
 			t.Errorf("product %d has invalid price: %v", i, product.Price)
 		}
 	}
 }
 
 func TestGetProduct(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
 	// Test getting a specific product
 	req, err := http.NewRequest("GET", "/api/products/1", nil)
 	if err != nil {
@@ -69,7 +93,7 @@ func TestGetProduct(t *testing.T) {
 
 	rr := httptest.NewRecorder()
 	router := mux.NewRouter()
-	router.HandleFunc("/api/products/{id}", GetProduct).Methods("GET")
+	router.HandleFunc("/api/products/{id}", srv.GetProduct).Methods("GET")
 	router.ServeHTTP(rr, req)
 
 	if status := rr.Code; status != http.StatusOK {
@@ -87,6 +111,9 @@ func TestGetProduct(t *testing.T) {
 }
 
 func TestGetProductNotFound(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
 	// Test getting a non-existent product
 	req, err := http.NewRequest("GET", "/api/products/999", nil)
 	if err != nil {
@@ -95,7 +122,7 @@ func TestGetProductNotFound(t *testing.T) {
 
 	rr := httptest.NewRecorder()
 	router := mux.NewRouter()
-	router.HandleFunc("/api/products/{id}", GetProduct).Methods("GET")
+	router.HandleFunc("/api/products/{id}", srv.GetProduct).Methods("GET")
 	router.ServeHTTP(rr, req)
 
 	if status := rr.Code; status != http.StatusNotFound {
@@ -104,8 +131,8 @@ func TestGetProductNotFound(t *testing.T) {
 }
 
 func TestCreateOrder(t *testing.T) {
-	// Reset state before test
-	ResetGlobalState()
+	t.Parallel()
+	srv := newTestServer(t)
 
 	// Create a test order
 	orderData := Order{
@@ -127,7 +154,7 @@ func TestCreateOrder(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(CreateOrder)
+	handler := http.HandlerFunc(srv.CreateOrder)
 	handler.ServeHTTP(rr, req)
 
 	if status := rr.Code; status != http.StatusOK {
@@ -146,7 +173,7 @@ func TestCreateOrder(t *testing.T) {
 	if order.Status != "pending" {
 		t.Errorf("expected status 'pending', got %s", order.Status)
 	}
-	if order.Total <= 0 {
+	if order.Total.Amount <= 0 {
 		t.Errorf("order total should be positive, got %v", order.Total)
 	}
 	if len(order.Items) != 2 {
@@ -155,6 +182,9 @@ func TestCreateOrder(t *testing.T) {
 }
 
 func TestCreateOrderInvalidJSON(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
 	// Test with invalid JSON
 	req, err := http.NewRequest("POST", "/api/orders", bytes.NewBufferString("invalid json"))
 	if err != nil {
@@ -163,7 +193,7 @@ func TestCreateOrderInvalidJSON(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(CreateOrder)
+	handler := http.HandlerFunc(srv.CreateOrder)
 	handler.ServeHTTP(rr, req)
 
 	if status := rr.Code; status != http.StatusBadRequest {
@@ -172,8 +202,8 @@ func TestCreateOrderInvalidJSON(t *testing.T) {
 }
 
 func TestGetOrders(t *testing.T) {
-	// Reset state before test
-	ResetGlobalState()
+	t.Parallel()
+	srv := newAdminTestServer(t)
 
 	// First create an order
 	orderData := Order{
@@ -187,16 +217,17 @@ func TestGetOrders(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
-	CreateOrder(rr, req)
+	srv.CreateOrder(rr, req)
 
 	// Now test getting orders
 	req, err := http.NewRequest("GET", "/api/orders", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
 
 	rr = httptest.NewRecorder()
-	handler := http.HandlerFunc(GetOrders)
+	handler := http.HandlerFunc(srv.GetOrders)
 	handler.ServeHTTP(rr, req)
 
 	if status := rr.Code; status != http.StatusOK {
@@ -214,8 +245,8 @@ func TestGetOrders(t *testing.T) {
 }
 
 func TestProcessPayment(t *testing.T) {
-	// Reset state before test
-	ResetGlobalState()
+	t.Parallel()
+	srv := newTestServer(t)
 
 	// First create an order
 	orderData := Order{
@@ -229,7 +260,7 @@ func TestProcessPayment(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
-	CreateOrder(rr, req)
+	srv.CreateOrder(rr, req)
 
 	var order Order
 	json.Unmarshal(rr.Body.Bytes(), &order)
@@ -250,9 +281,10 @@ func TestProcessPayment(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(OrderTokenHeader, order.AccessToken)
 
 	rr = httptest.NewRecorder()
-	handler := http.HandlerFunc(ProcessPayment)
+	handler := http.HandlerFunc(srv.ProcessPayment)
 	handler.ServeHTTP(rr, req)
 
 	if status := rr.Code; status != http.StatusOK {
@@ -273,13 +305,13 @@ func TestProcessPayment(t *testing.T) {
 }
 
 func TestProcessPaymentOrderNotFound(t *testing.T) {
-	// Reset state before test
-	ResetGlobalState()
+	t.Parallel()
+	srv := newTestServer(t)
 
 	// Test payment for non-existent order
 	paymentData := PaymentRequest{
 		OrderID: 999,
-		Amount:  100.0,
+		Amount:  NewMoney(10000, DefaultCurrency),
 	}
 
 	jsonData, err := json.Marshal(paymentData)
@@ -294,7 +326,7 @@ func TestProcessPaymentOrderNotFound(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(ProcessPayment)
+	handler := http.HandlerFunc(srv.ProcessPayment)
 	handler.ServeHTTP(rr, req)
 
 	if status := rr.Code; status != http.StatusNotFound {
@@ -303,6 +335,9 @@ func TestProcessPaymentOrderNotFound(t *testing.T) {
 }
 
 func TestProcessPaymentInvalidJSON(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
 	// Test with invalid JSON
 	req, err := http.NewRequest("POST", "/api/payment", bytes.NewBufferString("invalid json"))
 	if err != nil {
@@ -311,10 +346,98 @@ func TestProcessPaymentInvalidJSON(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(ProcessPayment)
+	handler := http.HandlerFunc(srv.ProcessPayment)
 	handler.ServeHTTP(rr, req)
 
 	if status := rr.Code; status != http.StatusBadRequest {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
 	}
 }
+
+func TestGetOrder(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+	order := createTestOrder(t, srv, OrderItem{ProductID: 2, Quantity: 3})
+
+	testCases := []struct {
+		path   string
+		status int
+	}{
+		{fmt.Sprintf("/api/orders/%d", order.ID), http.StatusOK},
+		{"/api/orders/999", http.StatusNotFound},
+		{"/api/orders/abc", http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		req.Header.Set(OrderTokenHeader, order.AccessToken)
+		rr := httptest.NewRecorder()
+		srv.Routes().ServeHTTP(rr, req)
+		if rr.Code != tc.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tc.path, rr.Code, tc.status)
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+
+		var fetched Order
+		json.Unmarshal(rr.Body.Bytes(), &fetched)
+		if fetched.ID != order.ID || fetched.Total != order.Total || len(fetched.Items) != 1 {
+			t.Errorf("expected order %+v, got %+v", order, fetched)
+		}
+	}
+}
+
+func TestGetOrdersFilters(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+	cheap := createTestOrder(t, srv, OrderItem{ProductID: 5, Quantity: 1})
+	dear := createTestOrder(t, srv, OrderItem{ProductID: 2, Quantity: 1})
+	paid := createTestOrder(t, srv, OrderItem{ProductID: 5, Quantity: 2})
+	if rr := pay(srv, paid.AccessToken, PaymentRequest{OrderID: paid.ID, Amount: paid.Total}); rr.Code != http.StatusOK {
+		t.Fatalf("payment failed: %v", rr.Code)
+	}
+
+	testCases := []struct {
+		query    string
+		status   int
+		expected []int
+	}{
+		{"", http.StatusOK, []int{cheap.ID, dear.ID, paid.ID}},
+		{"?status=paid", http.StatusOK, []int{paid.ID}},
+		{"?product_id=5&status=pending", http.StatusOK, []int{cheap.ID}},
+		{"?min_total=60&max_total=150", http.StatusOK, []int{paid.ID}},
+		{"?created_before=2000-01-01T00:00:00Z", http.StatusOK, nil},
+		{"?created_after=2000-01-01T00:00:00Z&max_total=49.99", http.StatusOK, []int{cheap.ID}},
+		{"?status=lost", http.StatusBadRequest, nil},
+		{"?created_after=yesterday", http.StatusBadRequest, nil},
+		{"?min_total=lots", http.StatusBadRequest, nil},
+		{"?product_id=-1", http.StatusBadRequest, nil},
+	}
+
+	for _, tc := range testCases {
+		req, _ := http.NewRequest("GET", "/api/orders"+tc.query, nil)
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		rr := httptest.NewRecorder()
+		srv.GetOrders(rr, req)
+		if rr.Code != tc.status {
+			t.Errorf("%q: handler returned wrong status code: got %v want %v", tc.query, rr.Code, tc.status)
+			continue
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+
+		var orders []Order
+		if err := json.Unmarshal(rr.Body.Bytes(), &orders); err != nil {
+			t.Fatalf("%q: failed to unmarshal response: %v", tc.query, err)
+		}
+		var got []int
+		for _, order := range orders {
+			got = append(got, order.ID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.expected) {
+			t.Errorf("%q: expected orders %v, got %v", tc.query, tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// DefaultMaxQuantityPerLine caps the quantity of a single order line
+const DefaultMaxQuantityPerLine = 100
+
+// ItemError describes a problem with one line of a request
+type ItemError struct {
+	Index     int    `json:"index"`
+	ProductID int    `json:"product_id"`
+	VariantID int    `json:"variant_id,omitempty"`
+	Field     string `json:"field"`
+	Message   string `json:"message"`
+}
+
+// FieldError describes a problem with one field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned with a 422 when a request is well-formed JSON
+// but cannot be accepted
+type ValidationError struct {
+	Message string       `json:"error"`
+	Items   []ItemError  `json:"items,omitempty"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+func (e *ValidationError) Error() string {
+	switch {
+	case len(e.Items) > 0:
+		return fmt.Sprintf("%s: %s", e.Message, e.Items[0].Message)
+	case len(e.Fields) > 0:
+		return fmt.Sprintf("%s: %s %s", e.Message, e.Fields[0].Field, e.Fields[0].Message)
+	}
+	return e.Message
+}
+
+// Limits on product fields
+const (
+	maxProductNameLength     = 200
+	maxProductCategoryLength = 100
+	maxProductSKULength      = 64
+)
+
+// skuPattern allows letters, digits, dots, dashes and underscores, so SKUs
+// survive spreadsheets and URLs unquoted
+var skuPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// validateProduct checks the fields an admin may set on a product and
+// returns a *ValidationError listing all problems found
+func validateProduct(p Product) error {
+	verr := &ValidationError{Message: "invalid product"}
+	add := func(field, message string) {
+		verr.Fields = append(verr.Fields, FieldError{Field: field, Message: message})
+	}
+
+	if problem := skuProblem(p.SKU); problem != "" {
+		add("sku", problem)
+	}
+
+	switch name := strings.TrimSpace(p.Name); {
+	case name == "":
+		add("name", "is required")
+	case len(name) > maxProductNameLength:
+		add("name", fmt.Sprintf("must be at most %d characters", maxProductNameLength))
+	}
+
+	if p.Price.Amount <= 0 {
+		add("price", "must be greater than zero")
+	}
+
+	switch category := strings.TrimSpace(p.Category); {
+	case category == "":
+		add("category", "is required")
+	case len(category) > maxProductCategoryLength:
+		add("category", fmt.Sprintf("must be at most %d characters", maxProductCategoryLength))
+	}
+
+	if p.Stock < 0 {
+		add("stock", "must not be negative")
+	}
+
+	if p.Image != "" {
+		u, err := url.Parse(p.Image)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("image", "must be an absolute http or https URL")
+		}
+	}
+
+	validateVariants(p, add)
+
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// slugPattern allows lower case words of letters and digits joined by
+// dashes
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// validateCategory checks the fields an admin may set on a category and
+// returns a *ValidationError listing all problems found
+func validateCategory(c Category) error {
+	verr := &ValidationError{Message: "invalid category"}
+	add := func(field, message string) {
+		verr.Fields = append(verr.Fields, FieldError{Field: field, Message: message})
+	}
+
+	switch name := strings.TrimSpace(c.Name); {
+	case name == "":
+		add("name", "is required")
+	case name != c.Name:
+		add("name", "must not start or end with spaces")
+	case len(name) > maxProductCategoryLength:
+		add("name", fmt.Sprintf("must be at most %d characters", maxProductCategoryLength))
+	}
+
+	switch {
+	case len(c.Slug) > maxProductCategoryLength:
+		add("slug", fmt.Sprintf("must be at most %d characters", maxProductCategoryLength))
+	case !slugPattern.MatchString(c.Slug):
+		add("slug", "may only contain lower case letters and digits, in words joined by dashes")
+	}
+
+	if c.ParentID < 0 {
+		add("parent_id", "must not be negative")
+	}
+
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// skuProblem describes what is wrong with a SKU, if anything; SKUs are
+// optional
+func skuProblem(sku string) string {
+	switch {
+	case sku == "":
+	case len(sku) > maxProductSKULength:
+		return fmt.Sprintf("must be at most %d characters", maxProductSKULength)
+	case !skuPattern.MatchString(sku):
+		return "may only contain letters, digits, dots, dashes and underscores"
+	}
+	return ""
+}
+
+// validateVariants checks the variants of a product, reporting problems
+// through add. Each needs options that no other variant of the product
+// has, and a SKU that the product and its other variants do not use.
+func validateVariants(p Product, add func(field, message string)) {
+	ids := map[int]bool{}
+	skus := map[string]bool{p.SKU: p.SKU != ""}
+	labels := map[string]int{}
+	for i, v := range p.Variants {
+		field := func(name string) string { return fmt.Sprintf("variants[%d].%s", i, name) }
+
+		if v.ID != 0 {
+			if ids[v.ID] {
+				add(field("id"), fmt.Sprintf("variant %d is listed twice", v.ID))
+			}
+			ids[v.ID] = true
+		}
+
+		if problem := skuProblem(v.SKU); problem != "" {
+			add(field("sku"), problem)
+		} else if skus[v.SKU] {
+			add(field("sku"), fmt.Sprintf("%s is already used by this product", v.SKU))
+		}
+		skus[v.SKU] = v.SKU != ""
+
+		if len(v.Options) == 0 {
+			add(field("options"), "are required")
+		}
+		for name, value := range v.Options {
+			if strings.TrimSpace(name) == "" || strings.TrimSpace(value) == "" {
+				add(field("options"), "must have non-empty names and values")
+				break
+			}
+		}
+		label := optionsLabel(v.Options)
+		if first, ok := labels[label]; ok && len(v.Options) > 0 {
+			add(field("options"), fmt.Sprintf("are the same as variant %d's", first))
+		} else {
+			labels[label] = i
+		}
+
+		if v.Price != nil {
+			switch {
+			case v.Price.Amount <= 0:
+				add(field("price"), "must be greater than zero")
+			case v.Price.Currency != p.Price.Currency:
+				add(field("price"), fmt.Sprintf("must be in %s, like the product", p.Price.Currency))
+			}
+		}
+		if v.Stock < 0 {
+			add(field("stock"), "must not be negative")
+		}
+	}
+}
+
+// validateOrderItems checks every line of an order against the catalog and
+// returns a *ValidationError listing all problems found
+func (s *Server) validateOrderItems(ctx context.Context, items []OrderItem) error {
+	if len(items) == 0 {
+		return &ValidationError{Message: "order must contain at least one item"}
+	}
+
+	verr := &ValidationError{Message: "invalid order items"}
+	ordered := map[lineKey]int{}
+	currency := ""
+	for i, item := range items {
+		switch {
+		case item.Quantity <= 0:
+			verr.Items = append(verr.Items, ItemError{
+				Index:     i,
+				ProductID: item.ProductID,
+				VariantID: item.VariantID,
+				Field:     "quantity",
+				Message:   "quantity must be at least 1",
+			})
+		case item.Quantity > s.maxQuantityPerLine:
+			verr.Items = append(verr.Items, ItemError{
+				Index:     i,
+				ProductID: item.ProductID,
+				VariantID: item.VariantID,
+				Field:     "quantity",
+				Message:   fmt.Sprintf("quantity must not exceed %d", s.maxQuantityPerLine),
+			})
+		}
+
+		product, err := s.store.GetProduct(ctx, item.ProductID)
+		switch {
+		case errors.Is(err, ErrProductNotFound):
+			verr.Items = append(verr.Items, ItemError{
+				Index:     i,
+				ProductID: item.ProductID,
+				Field:     "product_id",
+				Message:   fmt.Sprintf("product %d does not exist", item.ProductID),
+			})
+		case err != nil:
+			return err
+		case product.DeletedAt != nil:
+			verr.Items = append(verr.Items, ItemError{
+				Index:     i,
+				ProductID: item.ProductID,
+				Field:     "product_id",
+				Message:   fmt.Sprintf("product %d is no longer sold", item.ProductID),
+			})
+		default:
+			price, available, err := product.lineFor(item.VariantID)
+			if err != nil {
+				message := fmt.Sprintf("product %d has no variant %d", item.ProductID, item.VariantID)
+				if item.VariantID == 0 {
+					message = fmt.Sprintf("product %d is sold by variant; choose one", item.ProductID)
+				}
+				verr.Items = append(verr.Items, ItemError{
+					Index:     i,
+					ProductID: item.ProductID,
+					VariantID: item.VariantID,
+					Field:     "variant_id",
+					Message:   message,
+				})
+				break
+			}
+			if currency == "" {
+				currency = price.Currency
+			} else if price.Currency != currency {
+				verr.Items = append(verr.Items, ItemError{
+					Index:     i,
+					ProductID: item.ProductID,
+					VariantID: item.VariantID,
+					Field:     "product_id",
+					Message:   fmt.Sprintf("product %d is priced in %s, unlike the rest of the order", item.ProductID, price.Currency),
+				})
+				break
+			}
+
+			// Lines for the same product or variant draw on the same stock
+			ordered[item.key()] += item.Quantity
+			if item.Quantity > 0 && ordered[item.key()] > available {
+				message := fmt.Sprintf("only %d of product %d in stock", max(available, 0), item.ProductID)
+				if item.VariantID != 0 {
+					message = fmt.Sprintf("only %d of variant %d in stock", max(available, 0), item.VariantID)
+				}
+				verr.Items = append(verr.Items, ItemError{
+					Index:     i,
+					ProductID: item.ProductID,
+					VariantID: item.VariantID,
+					Field:     "quantity",
+					Message:   message,
+				})
+			}
+		}
+	}
+
+	if len(verr.Items) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// ErrorResponse is the body of JSON error responses that carry no details
+type ErrorResponse struct {
+	Message string `json:"error"`
+	// Code is set when a payment gateway call failed, as in PaymentResponse
+	Code string `json:"code,omitempty"`
+}
+
+// writeJSON encodes v as the response body with the given status code
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
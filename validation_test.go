@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCreateOrderValidation(t *testing.T) {
+	testCases := []struct {
+		name    string
+		items   []OrderItem
+		message string
+		errors  []ItemError
+	}{
+		{
+			name:    "No items",
+			items:   []OrderItem{},
+			message: "order must contain at least one item",
+		},
+		{
+			name:    "Zero quantity",
+			items:   []OrderItem{{ProductID: 1, Quantity: 0}},
+			message: "invalid order items",
+			errors:  []ItemError{{Index: 0, ProductID: 1, Field: "quantity"}},
+		},
+		{
+			name:    "Negative quantity",
+			items:   []OrderItem{{ProductID: 2, Quantity: -3}},
+			message: "invalid order items",
+			errors:  []ItemError{{Index: 0, ProductID: 2, Field: "quantity"}},
+		},
+		{
+			name:    "Quantity above limit",
+			items:   []OrderItem{{ProductID: 1, Quantity: 1}, {ProductID: 3, Quantity: 11}},
+			message: "invalid order items",
+			errors:  []ItemError{{Index: 1, ProductID: 3, Field: "quantity"}},
+		},
+		{
+			name: "Every bad line is reported",
+			items: []OrderItem{
+				{ProductID: 999, Quantity: 1},
+				{ProductID: 1, Quantity: 2},
+				{ProductID: 998, Quantity: 0},
+			},
+			message: "invalid order items",
+			errors: []ItemError{
+				{Index: 0, ProductID: 999, Field: "product_id"},
+				{Index: 2, ProductID: 998, Field: "quantity"},
+				{Index: 2, ProductID: 998, Field: "product_id"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			srv := NewServer(NewMemoryStore(testCatalog(t)), WithMaxQuantityPerLine(10))
+
+			jsonData, _ := json.Marshal(Order{Items: tc.items})
+			req, _ := http.NewRequest("POST", "/api/orders", bytes.NewBuffer(jsonData))
+			req.Header.Set("Content-Type", "application/json")
+
+			rr := httptest.NewRecorder()
+			srv.CreateOrder(rr, req)
+
+			if status := rr.Code; status != http.StatusUnprocessableEntity {
+				t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusUnprocessableEntity)
+			}
+
+			var verr ValidationError
+			if err := json.Unmarshal(rr.Body.Bytes(), &verr); err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+
+			if verr.Message != tc.message {
+				t.Errorf("expected message %q, got %q", tc.message, verr.Message)
+			}
+			if len(verr.Items) != len(tc.errors) {
+				t.Fatalf("expected %d item errors, got %+v", len(tc.errors), verr.Items)
+			}
+			for i, want := range tc.errors {
+				got := verr.Items[i]
+				if got.Index != want.Index || got.ProductID != want.ProductID || got.Field != want.Field {
+					t.Errorf("item error %d: expected %+v, got %+v", i, want, got)
+				}
+				if got.Message == "" {
+					t.Errorf("item error %d has no message", i)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateOrderAtQuantityLimit(t *testing.T) {
+	t.Parallel()
+	srv := NewServer(NewMemoryStore(testCatalog(t)), WithMaxQuantityPerLine(10))
+
+	jsonData, _ := json.Marshal(Order{Items: []OrderItem{{ProductID: 1, Quantity: 10}}})
+	req, _ := http.NewRequest("POST", "/api/orders", bytes.NewBuffer(jsonData))
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	srv.CreateOrder(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+}
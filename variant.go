@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrVariantNotFound is returned when an order line names a variant its
+// product does not have, or no variant of a product that has them
+var ErrVariantNotFound = errors.New("variant not found")
+
+// Variant is a version of a product a customer chooses between, such as a
+// size or colour. A product with variants is ordered by variant, and each
+// variant keeps its own stock.
+type Variant struct {
+	ID  int    `json:"id"`
+	SKU string `json:"sku,omitempty"`
+	// Options name what sets the variant apart, e.g. {"size": "42"}
+	Options map[string]string `json:"options"`
+	// Price replaces the product's price when set
+	Price    *Money `json:"price,omitempty"`
+	Stock    int    `json:"stock"`
+	Reserved int    `json:"reserved"`
+}
+
+// lineKey identifies what an order line draws stock from: a product, or
+// one of its variants
+type lineKey struct {
+	productID, variantID int
+}
+
+func (item OrderItem) key() lineKey {
+	return lineKey{item.ProductID, item.VariantID}
+}
+
+// stockName names what an order line draws stock from, for errors
+func (item OrderItem) stockName() string {
+	if item.VariantID != 0 {
+		return fmt.Sprintf("variant %d of product %d", item.VariantID, item.ProductID)
+	}
+	return fmt.Sprintf("product %d", item.ProductID)
+}
+
+// productSKUs returns the SKUs set on a product and its variants
+func productSKUs(p Product) []string {
+	var skus []string
+	if p.SKU != "" {
+		skus = append(skus, p.SKU)
+	}
+	for _, v := range p.Variants {
+		if v.SKU != "" {
+			skus = append(skus, v.SKU)
+		}
+	}
+	return skus
+}
+
+// variantIndex returns the position of a variant in p.Variants, or -1
+func (p Product) variantIndex(id int) int {
+	for i, v := range p.Variants {
+		if v.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// lineFor checks that an order line names a variant exactly when the
+// product has them, and returns the price and units left for the line
+func (p Product) lineFor(variantID int) (Money, int, error) {
+	switch {
+	case variantID == 0 && len(p.Variants) > 0:
+		return Money{}, 0, fmt.Errorf("%w: product %d is sold by variant", ErrVariantNotFound, p.ID)
+	case variantID == 0:
+		return p.Price, p.Stock - p.Reserved, nil
+	}
+	i := p.variantIndex(variantID)
+	if i < 0 {
+		return Money{}, 0, fmt.Errorf("%w: product %d has no variant %d", ErrVariantNotFound, p.ID, variantID)
+	}
+	v := p.Variants[i]
+	price := p.Price
+	if v.Price != nil {
+		price = *v.Price
+	}
+	return price, v.Stock - v.Reserved, nil
+}
+
+// sumVariants sets the stock and reservations of a product with variants
+// to the totals of its variants
+func (p *Product) sumVariants() {
+	if len(p.Variants) == 0 {
+		return
+	}
+	p.Stock, p.Reserved = 0, 0
+	for _, v := range p.Variants {
+		p.Stock += v.Stock
+		p.Reserved += v.Reserved
+	}
+}
+
+// carryReservations sets the reservations of p and its variants to those
+// of old, the product p replaces, and the stock totals to match. Variants
+// old does not have start with nothing reserved.
+func carryReservations(old Product, p *Product) {
+	p.Reserved = old.Reserved
+	for i := range p.Variants {
+		v := &p.Variants[i]
+		v.Reserved = 0
+		if j := old.variantIndex(v.ID); v.ID != 0 && j >= 0 {
+			v.Reserved = old.Variants[j].Reserved
+		}
+	}
+	p.sumVariants()
+}
+
+// optionsLabel writes options in a fixed order, e.g. "color=red, size=42",
+// so variants of a product can be compared and named in errors
+func optionsLabel(options map[string]string) string {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + options[name]
+	}
+	return strings.Join(pairs, ", ")
+}
+
+// copyVariants returns variants that share no maps or pointers with vs
+func copyVariants(vs []Variant) []Variant {
+	if vs == nil {
+		return nil
+	}
+	copied := make([]Variant, len(vs))
+	for i, v := range vs {
+		options := make(map[string]string, len(v.Options))
+		for name, value := range v.Options {
+			options[name] = value
+		}
+		v.Options = options
+		if v.Price != nil {
+			price := *v.Price
+			v.Price = &price
+		}
+		copied[i] = v
+	}
+	return copied
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// createShoes adds a product sold in sizes 42 and 44, the larger size at
+// its own price, and returns it as the API does
+func createShoes(t *testing.T, srv *Server) Product {
+	t.Helper()
+	price := NewMoney(14999, DefaultCurrency)
+	rr := adminRequest(srv, "POST", "/api/products", Product{
+		SKU:      "TS",
+		Name:     "Trail Shoes",
+		Price:    NewMoney(12999, DefaultCurrency),
+		Category: "Sports",
+		Variants: []Variant{
+			{SKU: "TS-42", Options: map[string]string{"size": "42"}, Stock: 2},
+			{SKU: "TS-44", Options: map[string]string{"size": "44"}, Price: &price, Stock: 5},
+		},
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create failed: got %v: %s", rr.Code, rr.Body)
+	}
+
+	var created Product
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/api/products/%d", created.ID), nil)
+	rr = httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rr, req)
+	var shoes Product
+	json.Unmarshal(rr.Body.Bytes(), &shoes)
+	if rr.Code != http.StatusOK || len(shoes.Variants) != 2 {
+		t.Fatalf("expected the product with its variants, got %v: %s", rr.Code, rr.Body)
+	}
+	return shoes
+}
+
+func TestGetProductNestsVariants(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+	shoes := createShoes(t, srv)
+
+	size42, size44 := shoes.Variants[0], shoes.Variants[1]
+	if size42.ID == 0 || size42.SKU != "TS-42" || size42.Options["size"] != "42" || size42.Price != nil {
+		t.Errorf("unexpected first variant %+v", size42)
+	}
+	if size44.Price == nil || *size44.Price != NewMoney(14999, DefaultCurrency) {
+		t.Errorf("expected the second variant's own price, got %+v", size44)
+	}
+	if shoes.Stock != 7 || shoes.Reserved != 0 {
+		t.Errorf("expected the product to total its variants' stock, got %d and %d reserved", shoes.Stock, shoes.Reserved)
+	}
+}
+
+func TestOrderVariants(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+	shoes := createShoes(t, srv)
+	size42, size44 := shoes.Variants[0].ID, shoes.Variants[1].ID
+
+	order := createTestOrder(t, srv, OrderItem{ProductID: shoes.ID, VariantID: size44, Quantity: 1}, OrderItem{ProductID: shoes.ID, VariantID: size42, Quantity: 2})
+	if order.Items[0].UnitPrice != NewMoney(14999, DefaultCurrency) || order.Items[1].UnitPrice != NewMoney(12999, DefaultCurrency) {
+		t.Errorf("expected each line at its variant's price, got %+v", order.Items)
+	}
+	if order.Total != NewMoney(14999+2*12999, DefaultCurrency) {
+		t.Errorf("unexpected total %s", order.Total)
+	}
+
+	testCases := []struct {
+		name    string
+		item    OrderItem
+		field   string
+		message string
+	}{
+		{"no variant", OrderItem{ProductID: shoes.ID, Quantity: 1}, "variant_id", fmt.Sprintf("product %d is sold by variant; choose one", shoes.ID)},
+		{"unknown variant", OrderItem{ProductID: shoes.ID, VariantID: 999, Quantity: 1}, "variant_id", fmt.Sprintf("product %d has no variant 999", shoes.ID)},
+		{"another product's variant", OrderItem{ProductID: 1, VariantID: size42, Quantity: 1}, "variant_id", fmt.Sprintf("product 1 has no variant %d", size42)},
+		{"sold out", OrderItem{ProductID: shoes.ID, VariantID: size42, Quantity: 1}, "quantity", fmt.Sprintf("only 0 of variant %d in stock", size42)},
+	}
+	for _, tc := range testCases {
+		rr := placeOrder(srv, tc.item)
+		var verr ValidationError
+		json.Unmarshal(rr.Body.Bytes(), &verr)
+		if rr.Code != http.StatusUnprocessableEntity || len(verr.Items) != 1 {
+			t.Errorf("%s: expected 422 with one item error, got %v: %s", tc.name, rr.Code, rr.Body)
+			continue
+		}
+		if verr.Items[0].Field != tc.field || verr.Items[0].Message != tc.message {
+			t.Errorf("%s: expected %s %q, got %+v", tc.name, tc.field, tc.message, verr.Items[0])
+		}
+	}
+
+	// Refunds name the variant returned
+	paid := payTestOrder(t, srv, OrderItem{ProductID: shoes.ID, VariantID: size44, Quantity: 2})
+	rr := requestRefund(srv, paid.ID, RefundRequest{Items: []OrderItem{{ProductID: shoes.ID, VariantID: size42, Quantity: 1}}})
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 refunding a variant not ordered, got %v: %s", rr.Code, rr.Body)
+	}
+	rr = requestRefund(srv, paid.ID, RefundRequest{Items: []OrderItem{{ProductID: shoes.ID, VariantID: size44, Quantity: 1}}})
+	var refunded Order
+	json.Unmarshal(rr.Body.Bytes(), &refunded)
+	if rr.Code != http.StatusOK || refunded.Refunds[0].Amount != NewMoney(14999, DefaultCurrency) {
+		t.Errorf("expected a refund of 149.99, got %v: %s", rr.Code, rr.Body)
+	}
+}
+
+func TestVariantValidation(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+	zero := NewMoney(0, DefaultCurrency)
+
+	rr := adminRequest(srv, "POST", "/api/products", Product{
+		SKU:      "TS",
+		Name:     "Trail Shoes",
+		Price:    NewMoney(12999, DefaultCurrency),
+		Category: "Sports",
+		Variants: []Variant{
+			{SKU: "TS", Options: map[string]string{"size": "42"}},
+			{SKU: "TS 44", Options: map[string]string{"size": "42"}, Price: &zero, Stock: -1},
+			{Options: map[string]string{}},
+		},
+	})
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %v: %s", rr.Code, rr.Body)
+	}
+	var verr ValidationError
+	json.Unmarshal(rr.Body.Bytes(), &verr)
+	fields := map[string]bool{}
+	for _, f := range verr.Fields {
+		fields[f.Field] = true
+	}
+	for _, field := range []string{"variants[0].sku", "variants[1].sku", "variants[1].options", "variants[1].price", "variants[1].stock", "variants[2].options"} {
+		if !fields[field] {
+			t.Errorf("expected an error for %s, got %+v", field, verr.Fields)
+		}
+	}
+	if fields["variants[0].options"] {
+		t.Errorf("expected only the repeated options reported, got %+v", verr.Fields)
+	}
+}
+
+func TestVariantReservations(t *testing.T) {
+	t.Parallel()
+	srv := newAdminTestServer(t)
+	shoes := createShoes(t, srv)
+	size42, size44 := shoes.Variants[0], shoes.Variants[1]
+	createTestOrder(t, srv, OrderItem{ProductID: shoes.ID, VariantID: size42.ID, Quantity: 2})
+	path := fmt.Sprintf("/api/products/%d", shoes.ID)
+
+	lowered := size42
+	lowered.Stock = 1
+	added := Variant{SKU: "TS-46", Options: map[string]string{"size": "46"}, Stock: 3}
+	testCases := []struct {
+		name     string
+		variants []Variant
+		code     int
+	}{
+		{"stock below reserved", []Variant{lowered, size44}, http.StatusUnprocessableEntity},
+		{"reserved variant removed", []Variant{size44}, http.StatusUnprocessableEntity},
+		{"unknown variant", []Variant{size42, {ID: 999, Options: map[string]string{"size": "48"}}}, http.StatusUnprocessableEntity},
+		{"variant added", []Variant{size42, size44, added}, http.StatusOK},
+	}
+	for _, tc := range testCases {
+		rr := adminRequest(srv, "PATCH", path, map[string]any{"variants": tc.variants})
+		if rr.Code != tc.code {
+			t.Errorf("%s: expected %v, got %v: %s", tc.name, tc.code, rr.Code, rr.Body)
+		}
+	}
+
+	p, _ := srv.store.GetProduct(context.Background(), shoes.ID)
+	if len(p.Variants) != 3 || p.Variants[0].Reserved != 2 || p.Stock != 10 || p.Reserved != 2 {
+		t.Errorf("expected three variants with the reservation kept, got %+v", p)
+	}
+
+	// Variants cannot be added to a product unpaid orders reserve
+	createTestOrder(t, srv, OrderItem{ProductID: 1, Quantity: 1})
+	rr := adminRequest(srv, "PATCH", "/api/products/1", map[string]any{"variants": []Variant{added}})
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 adding variants to a reserved product, got %v: %s", rr.Code, rr.Body)
+	}
+}